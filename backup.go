@@ -21,7 +21,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"io"
+	"math"
 
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/y"
@@ -51,95 +53,227 @@ func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
 }
 
 // Backup dumps a protobuf-encoded list of all entries in the database into the
-// given writer, that are newer than or equal to the specified version. It returns a
-// timestamp(version) indicating the version of last entry that was dumped, which
-// after incrementing by 1 can be passed into a later invocation to generate an
-// incremental dump of entries that have been added/modified since the last
-// invocation of Stream.Backup().
+// given writer, that are newer than or equal to the specified version. The entries
+// are written in blocks, compressed with the compression of the DB and encrypted if
+// the DB is encrypted. It returns a timestamp(version) indicating the version of
+// last entry that was dumped, which after incrementing by 1 can be passed into a
+// later invocation to generate an incremental dump of entries that have been
+// added/modified since the last invocation of Stream.Backup().
 //
 // This can be used to backup the data in a database at a given point in time.
 func (stream *Stream) Backup(w io.Writer, since uint64) (uint64, error) {
 	stream.KeyToList = func(key []byte, itr *Iterator) (*pb.KVList, error) {
-		list := &pb.KVList{}
-		for ; itr.Valid(); itr.Next() {
-			item := itr.Item()
-			if !bytes.Equal(item.Key(), key) {
-				return list, nil
-			}
-			if item.Version() < since {
-				// Ignore versions less than given timestamp, or skip older
-				// versions of the given key.
-				return list, nil
-			}
+		return stream.db.backupList(key, itr, since)
+	}
+
+	enc, err := stream.db.newBackupEncoder(w, since)
+	if err != nil {
+		return 0, err
+	}
+	stream.Send = enc.writeList
+
+	if err := stream.Orchestrate(context.Background()); err != nil {
+		return 0, err
+	}
+	if err := enc.finish(); err != nil {
+		return 0, err
+	}
+	return enc.trailer.MaxVersion, nil
+}
 
-			var valCopy []byte
-			if !item.IsDeletedOrExpired() {
-				// No need to copy value, if item is deleted or expired.
-				var err error
+// backupList returns the versions of the key to write to a backup with the given since. It has
+// the signature of Stream.KeyToList, apart from the since.
+func (db *DB) backupList(key []byte, itr *Iterator, since uint64) (*pb.KVList, error) {
+	list := &pb.KVList{}
+	for ; itr.Valid(); itr.Next() {
+		item := itr.Item()
+		if !bytes.Equal(item.Key(), key) {
+			return list, nil
+		}
+		if item.Version() < since {
+			// Ignore versions less than given timestamp, or skip older
+			// versions of the given key.
+			return list, nil
+		}
+
+		var valCopy []byte
+		if !item.IsDeletedOrExpired() {
+			// No need to copy value, if item is deleted or expired.
+			var err error
+			if isBlob(item.meta) {
+				valCopy, err = item.backupBlob(list)
+			} else {
 				valCopy, err = item.ValueCopy(nil)
-				if err != nil {
-					stream.db.opt.Errorf("Key [%x, %d]. Error while fetching value [%v]\n",
-						item.Key(), item.Version(), err)
-					return nil, err
-				}
 			}
-
-			// clear txn bits
-			meta := item.meta &^ (bitTxn | bitFinTxn)
-			kv := &pb.KV{
-				Key:       item.KeyCopy(nil),
-				Value:     valCopy,
-				UserMeta:  []byte{item.UserMeta()},
-				Version:   item.Version(),
-				ExpiresAt: item.ExpiresAt(),
-				Meta:      []byte{meta},
+			if err != nil {
+				db.opt.Errorf("Key [%x, %d]. Error while fetching value [%v]\n",
+					item.Key(), item.Version(), err)
+				return nil, err
 			}
-			list.Kv = append(list.Kv, kv)
+		}
 
-			switch {
-			case item.DiscardEarlierVersions():
-				// If we need to discard earlier versions of this item, add a delete
-				// marker just below the current version.
-				list.Kv = append(list.Kv, &pb.KV{
-					Key:     item.KeyCopy(nil),
-					Version: item.Version() - 1,
-					Meta:    []byte{bitDelete},
-				})
-				return list, nil
-
-			case item.IsDeletedOrExpired():
-				return list, nil
-			}
+		// clear txn bits
+		meta := item.meta &^ (bitTxn | bitFinTxn)
+		kv := &pb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     valCopy,
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+			Meta:      []byte{meta},
 		}
-		return list, nil
-	}
+		list.Kv = append(list.Kv, kv)
 
-	var maxVersion uint64
-	stream.Send = func(list *pb.KVList) error {
-		for _, kv := range list.Kv {
-			if maxVersion < kv.Version {
-				maxVersion = kv.Version
-			}
+		switch {
+		case item.DiscardEarlierVersions():
+			// If we need to discard earlier versions of this item, add a delete
+			// marker just below the current version.
+			list.Kv = append(list.Kv, &pb.KV{
+				Key:     item.KeyCopy(nil),
+				Version: item.Version() - 1,
+				Meta:    []byte{bitDelete},
+			})
+			return list, nil
+
+		case item.IsDeletedOrExpired():
+			return list, nil
 		}
-		return writeTo(list, w)
 	}
+	return list, nil
+}
 
-	if err := stream.Orchestrate(context.Background()); err != nil {
+// backupState is the state of DB.BackupTo recorded in the resume points of its uploads.
+type backupState struct {
+	ReadTs  uint64
+	Header  backupHeader
+	Trailer backupTrailer
+	// LastKey is the last key held by the uploaded chunks, along with all its versions.
+	LastKey []byte
+}
+
+// BackupTo takes a backup of the DB like Backup, and uploads it as the named backup of the sink
+// in chunks of about chunkSize bytes. The chunks hold whole blocks of the backup, and every chunk
+// is uploaded along with a resume point recording the last key it holds. If the upload is
+// interrupted, calling BackupTo again with the same name and since continues the backup after
+// that key, instead of starting over.
+//
+// Unlike Backup, BackupTo reads the keys in order, with a single goroutine. A resumed backup reads
+// the DB at the same timestamp as the interrupted one, which doesn't keep the compactions from
+// discarding the versions visible at that timestamp. If they may have been discarded since the
+// interruption, which Options.HistoryRetention can prevent, the backup starts over. If they may
+// have been discarded while the backup was resumed, ErrHistoryUnavailable is returned, and the
+// backup starts over on the next call.
+func (db *DB) BackupTo(sink BackupSink, name string, since uint64, chunkSize int) (uint64, error) {
+	w, err := ResumeBackupWriter(sink, name, chunkSize)
+	if err != nil {
 		return 0, err
 	}
-	return maxVersion, nil
-}
+	var st backupState
+	if len(w.rp.State) > 0 {
+		if err := json.Unmarshal(w.rp.State, &st); err != nil {
+			return 0, y.Wrapf(err, "Error while unmarshalling resume point of backup: %q", name)
+		}
+	}
 
-func writeTo(list *pb.KVList, w io.Writer) error {
-	if err := binary.Write(w, binary.LittleEndian, uint64(proto.Size(list))); err != nil {
-		return err
+	var txn *Txn
+	var enc *backupEncoder
+	resume := len(w.rp.State) > 0 && st.Header.Since == since
+	if resume && st.ReadTs < db.orc.discardAtOrBelow() {
+		db.opt.Infof("Restarting backup %q, its versions may have been discarded\n", name)
+		resume = false
 	}
-	buf, err := proto.Marshal(list)
-	if err != nil {
-		return err
+	if resume {
+		db.opt.Infof("Resuming backup %q after %d bytes\n", name, w.Offset())
+		w.aligned = true
+		if enc, err = db.resumeBackupEncoder(w, st.Header, st.Trailer); err != nil {
+			return 0, err
+		}
+		txn = db.newTransaction(false, true)
+		txn.readTs = st.ReadTs
+		// Same as in NewTransactionAsOf, the read timestamp is behind the read watermark.
+		txn.doneRead = true
+	} else {
+		// There is nothing to resume from, or it can't be read anymore.
+		if w, err = NewBackupWriter(sink, name, chunkSize); err != nil {
+			return 0, err
+		}
+		w.aligned = true
+		if enc, err = db.newBackupEncoder(w, since); err != nil {
+			return 0, err
+		}
+		txn = db.newTransaction(false, db.opt.managedTxns)
+		if db.opt.managedTxns {
+			txn.readTs = math.MaxUint64
+		}
+		st = backupState{ReadTs: txn.readTs, Header: enc.header}
 	}
-	_, err = w.Write(buf)
-	return err
+	defer txn.Discard()
+
+	opt := DefaultIteratorOptions
+	opt.AllVersions = true
+	opt.PrefetchValues = false
+	opt.InternalAccess = true
+	itr := txn.NewIterator(opt)
+	defer itr.Close()
+
+	list := &pb.KVList{}
+	var size int
+	prevKey := y.SafeCopy(nil, st.LastKey)
+	for itr.Seek(st.LastKey); itr.Valid(); {
+		item := itr.Item()
+		if bytes.Equal(item.Key(), prevKey) {
+			itr.Next()
+			continue
+		}
+		prevKey = item.KeyCopy(prevKey)
+		if isInternalKey(prevKey) || db.cfs.isDropped(prevKey) {
+			continue
+		}
+		kvs, err := db.backupList(item.KeyCopy(nil), itr, since)
+		if err != nil {
+			return 0, err
+		}
+		for _, kv := range kvs.Kv {
+			size += proto.Size(kv)
+			list.Kv = append(list.Kv, kv)
+		}
+		if size < batchSize && size < chunkSize {
+			continue
+		}
+		if err := enc.writeList(list); err != nil {
+			return 0, err
+		}
+		list = &pb.KVList{}
+		size = 0
+		if len(w.buf) < chunkSize {
+			continue
+		}
+		st.Trailer = enc.trailer
+		st.LastKey = y.SafeCopy(st.LastKey, prevKey)
+		state, err := json.Marshal(st)
+		if err != nil {
+			return 0, err
+		}
+		if err := w.flush(state); err != nil {
+			return 0, err
+		}
+	}
+	if len(list.Kv) > 0 {
+		if err := enc.writeList(list); err != nil {
+			return 0, err
+		}
+	}
+	if resume && st.ReadTs < db.orc.discardAtOrBelow() {
+		// The backup isn't completed, so that the next call starts it over.
+		return 0, ErrHistoryUnavailable
+	}
+	if err := enc.finish(); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	return enc.trailer.MaxVersion, nil
 }
 
 // KVLoader is used to write KVList objects in to badger. It can be used to restore a backup.
@@ -222,36 +356,41 @@ func (l *KVLoader) Finish() error {
 // made by calling DB.Backup(). If more complex logic is needed to restore a badger
 // backup, the KVLoader interface should be used instead.
 //
+// The checksums, the header and the trailer of the backup are validated while loading, so a
+// corrupted or truncated backup results in an error. Backups which are encrypted need the DB to be
+// opened with the encryption key of the DB they were taken from.
+//
 // DB.Load() should be called on a database that is not running any other
 // concurrent transactions while it is running.
 func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
+	return db.load(r, maxPendingWrites, math.MaxUint64)
+}
+
+// load is like Load, but skips the entries with a version greater than untilVersion.
+func (db *DB) load(r io.Reader, maxPendingWrites int, untilVersion uint64) error {
 	br := bufio.NewReaderSize(r, 16<<10)
-	unmarshalBuf := make([]byte, 1<<10)
+	next := legacyBackupReader(br)
+	if isBackupFormat(br) {
+		dec, err := db.newBackupDecoder(br)
+		if err != nil {
+			return err
+		}
+		next = dec.next
+	}
 
 	ldr := db.NewKVLoader(maxPendingWrites)
 	for {
-		var sz uint64
-		err := binary.Read(br, binary.LittleEndian, &sz)
+		list, err := next()
 		if err == io.EOF {
 			break
 		} else if err != nil {
 			return err
 		}
 
-		if cap(unmarshalBuf) < int(sz) {
-			unmarshalBuf = make([]byte, sz)
-		}
-
-		if _, err = io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
-			return err
-		}
-
-		list := &pb.KVList{}
-		if err := proto.Unmarshal(unmarshalBuf[:sz], list); err != nil {
-			return err
-		}
-
 		for _, kv := range list.Kv {
+			if kv.Version > untilVersion {
+				continue
+			}
 			if err := ldr.Set(kv); err != nil {
 				return err
 			}
@@ -270,3 +409,29 @@ func (db *DB) Load(r io.Reader, maxPendingWrites int) error {
 	db.orc.txnMark.Done(db.orc.nextTxnTs - 1)
 	return nil
 }
+
+// legacyBackupReader returns a function which reads the next list from a backup written before
+// the backup format was introduced. It returns io.EOF at the end of the backup.
+func legacyBackupReader(br *bufio.Reader) func() (*pb.KVList, error) {
+	unmarshalBuf := make([]byte, 1<<10)
+	return func() (*pb.KVList, error) {
+		var sz uint64
+		if err := binary.Read(br, binary.LittleEndian, &sz); err != nil {
+			return nil, err
+		}
+
+		if cap(unmarshalBuf) < int(sz) {
+			unmarshalBuf = make([]byte, sz)
+		}
+
+		if _, err := io.ReadFull(br, unmarshalBuf[:sz]); err != nil {
+			return nil, err
+		}
+
+		list := &pb.KVList{}
+		if err := proto.Unmarshal(unmarshalBuf[:sz], list); err != nil {
+			return nil, err
+		}
+		return list, nil
+	}
+}
@@ -0,0 +1,270 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackupCatalogFilename is the name of the file which describes the backups in a backup
+	// directory.
+	BackupCatalogFilename        = "CATALOG"
+	backupCatalogRewriteFilename = "CATALOG-REWRITE"
+)
+
+// BackupInfo describes a single backup file of a backup catalog.
+type BackupInfo struct {
+	// File is the name of the backup file, relative to the backup directory.
+	File string
+	// Since is the version passed to DB.Backup. It is zero for full backups.
+	Since uint64
+	// MaxVersion is the version of the latest entry in the backup. An incremental backup without
+	// any entries has a MaxVersion of Since-1.
+	MaxVersion uint64
+	// Time is the time at which the backup finished.
+	Time time.Time
+	// Size is the size of the backup file in bytes.
+	Size int64
+}
+
+// Full returns true if this is a full backup.
+func (b BackupInfo) Full() bool {
+	return b.Since == 0
+}
+
+// BackupCatalog is a chain of full and incremental backups stored in a single directory. The
+// catalog is stored along with the backups and is used to restore a DB to any version covered by
+// the chain.
+type BackupCatalog struct {
+	// Backups are ordered by the time they were taken.
+	Backups []BackupInfo
+
+	dir string
+}
+
+// OpenBackupCatalog opens the backup catalog in the given directory, creating the directory if it
+// doesn't exist.
+func OpenBackupCatalog(dir string) (*BackupCatalog, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, y.Wrapf(err, "Error while creating backup directory: %q", dir)
+	}
+	c := &BackupCatalog{dir: dir}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, BackupCatalogFilename))
+	switch {
+	case os.IsNotExist(err):
+		return c, nil
+	case err != nil:
+		return nil, y.Wrapf(err, "Error while reading backup catalog")
+	}
+	if err := json.Unmarshal(buf, &c.Backups); err != nil {
+		return nil, y.Wrapf(err, "Error while unmarshalling backup catalog")
+	}
+	return c, nil
+}
+
+// Dir returns the directory of the catalog.
+func (c *BackupCatalog) Dir() string {
+	return c.dir
+}
+
+// Backup takes a backup of the DB, adds it to the catalog and returns its description. A full
+// backup is taken if full is true or if the catalog is empty, otherwise the backup only contains
+// the entries written since the last backup in the catalog.
+func (c *BackupCatalog) Backup(db *DB, full bool) (*BackupInfo, error) {
+	var since uint64
+	if n := len(c.Backups); n > 0 && !full {
+		since = c.Backups[n-1].MaxVersion + 1
+	}
+	b := BackupInfo{
+		File:  fmt.Sprintf("%06d.bak", len(c.Backups)+1),
+		Since: since,
+	}
+
+	path := filepath.Join(c.dir, b.File)
+	f, err := y.OpenTruncFile(path, false)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while creating backup file: %q", path)
+	}
+	bw := bufio.NewWriterSize(f, 64<<20)
+	if b.MaxVersion, err = db.Backup(bw, since); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if b.MaxVersion < since {
+		// Nothing has been written since the last backup.
+		b.MaxVersion = since - 1
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	b.Size = fi.Size()
+	b.Time = time.Now()
+
+	c.Backups = append(c.Backups, b)
+	if err := c.save(); err != nil {
+		c.Backups = c.Backups[:len(c.Backups)-1]
+		return nil, err
+	}
+	return &b, nil
+}
+
+// save atomically rewrites the catalog file.
+func (c *BackupCatalog) save() error {
+	buf, err := json.MarshalIndent(c.Backups, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(c.dir, backupCatalogRewriteFilename)
+	fp, err := y.OpenTruncFile(tmpPath, true)
+	if err != nil {
+		return y.Wrapf(err, "Error while opening tmp file in BackupCatalog.save")
+	}
+	if _, err = fp.Write(buf); err != nil {
+		fp.Close()
+		return y.Wrapf(err, "Error while writing tmp file in BackupCatalog.save")
+	}
+	// In Windows the files should be closed before doing a Rename.
+	if err = fp.Close(); err != nil {
+		return y.Wrapf(err, "Error while closing tmp file in BackupCatalog.save")
+	}
+	if err = os.Rename(tmpPath, filepath.Join(c.dir, BackupCatalogFilename)); err != nil {
+		return y.Wrapf(err, "Error while renaming file in BackupCatalog.save")
+	}
+	return syncDir(c.dir)
+}
+
+// VersionAt returns the MaxVersion of the latest backup which finished at or before t.
+func (c *BackupCatalog) VersionAt(t time.Time) (uint64, error) {
+	var version uint64
+	var found bool
+	for _, b := range c.Backups {
+		if b.Time.After(t) {
+			break
+		}
+		version, found = b.MaxVersion, true
+	}
+	if !found {
+		return 0, errors.Errorf("No backup finished at or before %s", t)
+	}
+	return version, nil
+}
+
+// Chain returns the backups which need to be loaded, in order, to restore the DB to the given
+// version. The chain starts at the latest full backup which doesn't go past the version. An error
+// is returned if the catalog doesn't cover the version, if there is a gap between two consecutive
+// backups of the chain, or if a backup file is missing or has been modified.
+func (c *BackupCatalog) Chain(untilVersion uint64) ([]BackupInfo, error) {
+	start := -1
+	for i, b := range c.Backups {
+		if !b.Full() {
+			continue
+		}
+		if start == -1 || b.MaxVersion <= untilVersion {
+			start = i
+		}
+	}
+	if start == -1 {
+		return nil, errors.New("Backup catalog doesn't contain a full backup")
+	}
+
+	chain := []BackupInfo{c.Backups[start]}
+	for _, b := range c.Backups[start+1:] {
+		last := chain[len(chain)-1]
+		if last.MaxVersion >= untilVersion {
+			break
+		}
+		if b.Full() {
+			// A later full backup past the version. The incrementals after it belong to it.
+			break
+		}
+		if b.Since > last.MaxVersion+1 {
+			return nil, errors.Errorf("Gap in backup chain: %s ends at version %d, "+
+				"but %s starts at version %d", last.File, last.MaxVersion, b.File, b.Since)
+		}
+		if b.Since < last.Since {
+			return nil, errors.Errorf("Backup chain out of order: %s starts at version %d, "+
+				"but %s starts at version %d", last.File, last.Since, b.File, b.Since)
+		}
+		chain = append(chain, b)
+	}
+	last := chain[len(chain)-1]
+	if last.MaxVersion < untilVersion && untilVersion != math.MaxUint64 {
+		return nil, errors.Errorf("Backup chain ends at version %d, before version %d",
+			last.MaxVersion, untilVersion)
+	}
+
+	for _, b := range chain {
+		fi, err := os.Stat(filepath.Join(c.dir, b.File))
+		if err != nil {
+			return nil, y.Wrapf(err, "Error while checking backup file: %q", b.File)
+		}
+		if fi.Size() != b.Size {
+			return nil, errors.Errorf("Backup file %q has size %d, expected %d",
+				b.File, fi.Size(), b.Size)
+		}
+	}
+	return chain, nil
+}
+
+// Restore loads the backup chain in the catalog into the DB, skipping all the entries with a
+// version greater than untilVersion. Pass math.MaxUint64 to restore the latest version covered
+// by the catalog. The chain is validated before anything is loaded, see BackupCatalog.Chain.
+//
+// Like DB.Load, Restore should be called on a new database which isn't running any other
+// concurrent transactions.
+func (c *BackupCatalog) Restore(db *DB, untilVersion uint64, maxPendingWrites int) error {
+	chain, err := c.Chain(untilVersion)
+	if err != nil {
+		return err
+	}
+	for _, b := range chain {
+		f, err := os.Open(filepath.Join(c.dir, b.File))
+		if err != nil {
+			return err
+		}
+		err = db.load(f, maxPendingWrites, untilVersion)
+		f.Close()
+		if err != nil {
+			return y.Wrapf(err, "Error while restoring backup file: %q", b.File)
+		}
+	}
+	return nil
+}
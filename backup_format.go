@@ -0,0 +1,491 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// A backup file has the following layout. All the integers are little endian.
+//
+//	magic (8 bytes) | format version (2 bytes) | header record | block records | trailer record
+//
+// Every record is laid out as
+//
+//	type (1 byte) | payload length (4 bytes) | CRC32C of the payload (8 bytes) | payload
+//
+// The header payload is a JSON encoded backupHeader. The payload of a block is the length of the
+// uncompressed block (4 bytes), followed by the IV (16 bytes) if the backup is encrypted, and the
+// compressed and then encrypted protobuf-encoded pb.KVList. The trailer payload is a
+// backupTrailer, which lets Load detect truncated backups.
+//
+// Backups written before the format was introduced are a plain sequence of length-prefixed
+// pb.KVLists, and can still be loaded. The magic can't be mistaken for the length of a KVList,
+// as its last byte is not zero.
+var backupMagic = []byte("BADGERBK")
+
+const backupFormatVersion uint16 = 1
+
+const (
+	backupRecordHeader  byte = 1
+	backupRecordBlock   byte = 2
+	backupRecordTrailer byte = 3
+
+	backupRecordHeaderSize = 1 + 4 + 8
+)
+
+// backupHeader describes how the blocks of a backup are encoded, along with a summary of the
+// options of the DB the backup was taken from.
+type backupHeader struct {
+	Since       uint64
+	Compression options.CompressionType
+	// DataKey is the key the blocks are encrypted with, itself encrypted with the encryption key
+	// of the DB. It's nil if the backup isn't encrypted.
+	DataKey *pb.DataKey `json:",omitempty"`
+	// Sanity is sanityText encrypted with the data key, to detect a wrong encryption key.
+	Sanity []byte `json:",omitempty"`
+	Source backupSourceOptions
+	// ColumnFamilies holds the definitions of the column families whose keys are in the backup.
+	ColumnFamilies []cfDef `json:",omitempty"`
+}
+
+type backupSourceOptions struct {
+	NumVersionsToKeep int
+	ValueThreshold    int
+	MaxTableSize      int64
+	BlockSize         int
+	Compression       options.CompressionType
+	Encrypted         bool
+	InMemory          bool
+}
+
+type backupTrailer struct {
+	NumKVs     uint64
+	MaxVersion uint64
+	NumBlocks  uint64
+}
+
+const backupTrailerSize = 24
+
+func (t *backupTrailer) encode() []byte {
+	buf := make([]byte, backupTrailerSize)
+	binary.LittleEndian.PutUint64(buf[0:8], t.NumKVs)
+	binary.LittleEndian.PutUint64(buf[8:16], t.MaxVersion)
+	binary.LittleEndian.PutUint64(buf[16:24], t.NumBlocks)
+	return buf
+}
+
+func (t *backupTrailer) decode(buf []byte) error {
+	if len(buf) != backupTrailerSize {
+		return errors.Errorf("Invalid backup trailer size: %d", len(buf))
+	}
+	t.NumKVs = binary.LittleEndian.Uint64(buf[0:8])
+	t.MaxVersion = binary.LittleEndian.Uint64(buf[8:16])
+	t.NumBlocks = binary.LittleEndian.Uint64(buf[16:24])
+	return nil
+}
+
+// backupEncoder writes a backup in the format described above.
+type backupEncoder struct {
+	w           io.Writer
+	header      backupHeader
+	compression options.CompressionType
+	zstdLevel   int
+	dataKey     []byte // Nil if the backup isn't encrypted.
+	trailer     backupTrailer
+}
+
+// newBackupEncoder writes the magic, the format version and the header of a backup to w. The
+// blocks are compressed like the tables of the DB, and encrypted if the DB is encrypted.
+func (db *DB) newBackupEncoder(w io.Writer, since uint64) (*backupEncoder, error) {
+	hdr, err := db.newBackupHeader(since)
+	if err != nil {
+		return nil, err
+	}
+	e, err := db.resumeBackupEncoder(w, hdr, backupTrailer{})
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, err
+	}
+	var prefix [10]byte
+	copy(prefix[:], backupMagic)
+	binary.LittleEndian.PutUint16(prefix[8:], backupFormatVersion)
+	if _, err := w.Write(prefix[:]); err != nil {
+		return nil, err
+	}
+	if err := e.writeRecord(backupRecordHeader, buf); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// resumeBackupEncoder returns an encoder which writes the blocks of a backup with the given
+// header to w, after the ones accounted for by the trailer.
+func (db *DB) resumeBackupEncoder(w io.Writer, hdr backupHeader,
+	trailer backupTrailer) (*backupEncoder, error) {
+	dataKey, err := db.backupDataKey(&hdr)
+	if err != nil {
+		return nil, err
+	}
+	return &backupEncoder{
+		w:           w,
+		header:      hdr,
+		compression: hdr.Compression,
+		zstdLevel:   db.opt.ZSTDCompressionLevel,
+		dataKey:     dataKey,
+		trailer:     trailer,
+	}, nil
+}
+
+func (db *DB) newBackupHeader(since uint64) (backupHeader, error) {
+	hdr := backupHeader{
+		Since:       since,
+		Compression: db.opt.Compression,
+		Source: backupSourceOptions{
+			NumVersionsToKeep: db.opt.NumVersionsToKeep,
+			ValueThreshold:    db.opt.ValueThreshold,
+			MaxTableSize:      db.opt.MaxTableSize,
+			BlockSize:         db.opt.BlockSize,
+			Compression:       db.opt.Compression,
+			Encrypted:         len(db.opt.EncryptionKey) > 0,
+			InMemory:          db.opt.InMemory,
+		},
+		ColumnFamilies: db.cfs.defs().Families,
+	}
+	if len(db.opt.EncryptionKey) == 0 {
+		return hdr, nil
+	}
+	dk, err := db.registry.latestDataKey()
+	if err != nil {
+		return hdr, y.Wrapf(err, "Error while getting data key for backup")
+	}
+	encKey, err := y.XORBlockAllocate(dk.Data, db.opt.EncryptionKey, dk.Iv)
+	if err != nil {
+		return hdr, y.Wrapf(err, "Error while encrypting data key for backup")
+	}
+	if hdr.Sanity, err = y.XORBlockAllocate(sanityText, dk.Data, dk.Iv); err != nil {
+		return hdr, y.Wrapf(err, "Error while encrypting sanity text for backup")
+	}
+	hdr.DataKey = &pb.DataKey{
+		KeyId:     dk.KeyId,
+		Data:      encKey,
+		Iv:        dk.Iv,
+		CreatedAt: dk.CreatedAt,
+	}
+	return hdr, nil
+}
+
+// backupDataKey returns the key the blocks of a backup with the given header are encrypted with,
+// or nil if the backup isn't encrypted.
+func (db *DB) backupDataKey(hdr *backupHeader) ([]byte, error) {
+	dk := hdr.DataKey
+	if dk == nil {
+		return nil, nil
+	}
+	if len(db.opt.EncryptionKey) == 0 {
+		return nil, errors.New("Backup is encrypted, but the DB has no encryption key")
+	}
+	dataKey, err := y.XORBlockAllocate(dk.Data, db.opt.EncryptionKey, dk.Iv)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while decrypting backup data key")
+	}
+	sanity, err := y.XORBlockAllocate(hdr.Sanity, dataKey, dk.Iv)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while decrypting backup sanity text")
+	}
+	if !bytes.Equal(sanity, sanityText) {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	return dataKey, nil
+}
+
+func (e *backupEncoder) writeRecord(typ byte, payload []byte) error {
+	var hdr [backupRecordHeaderSize]byte
+	hdr[0] = typ
+	binary.LittleEndian.PutUint32(hdr[1:5], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(hdr[5:13], y.CalculateChecksum(payload, pb.Checksum_CRC32C))
+	if _, err := e.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := e.w.Write(payload)
+	return err
+}
+
+// writeList writes the list as a single block.
+func (e *backupEncoder) writeList(list *pb.KVList) error {
+	data, err := proto.Marshal(list)
+	if err != nil {
+		return err
+	}
+	var compressed []byte
+	switch e.compression {
+	case options.None:
+		compressed = data
+	case options.Snappy:
+		compressed = snappy.Encode(nil, data)
+	case options.ZSTD:
+		dst := make([]byte, y.ZSTDCompressBound(len(data)))
+		if compressed, err = y.ZSTDCompress(dst, data, e.zstdLevel); err != nil {
+			return y.Wrapf(err, "Error while compressing backup block")
+		}
+	default:
+		return errors.Errorf("Unsupported compression type: %d", e.compression)
+	}
+
+	payload := make([]byte, 4, 4+16+len(compressed))
+	binary.LittleEndian.PutUint32(payload, uint32(len(data)))
+	if e.dataKey != nil {
+		iv, err := y.GenerateIV()
+		if err != nil {
+			return err
+		}
+		if compressed, err = y.XORBlockAllocate(compressed, e.dataKey, iv); err != nil {
+			return y.Wrapf(err, "Error while encrypting backup block")
+		}
+		payload = append(payload, iv...)
+	}
+	payload = append(payload, compressed...)
+	if err := e.writeRecord(backupRecordBlock, payload); err != nil {
+		return err
+	}
+
+	e.trailer.NumBlocks++
+	for _, kv := range list.Kv {
+		e.trailer.NumKVs++
+		if kv.Version > e.trailer.MaxVersion {
+			e.trailer.MaxVersion = kv.Version
+		}
+	}
+	return nil
+}
+
+// finish writes the trailer. It must be called after all the lists have been written.
+func (e *backupEncoder) finish() error {
+	return e.writeRecord(backupRecordTrailer, e.trailer.encode())
+}
+
+// backupDecoder reads a backup written by backupEncoder, validating the checksums of all the
+// records and the trailer.
+//
+// Like the legacy format, several backups can be concatenated and read as one, which is how
+// incremental backups are commonly restored.
+type backupDecoder struct {
+	db      *DB
+	r       *bufio.Reader
+	header  backupHeader
+	dataKey []byte
+	cfIDs   map[uint32]uint32 // IDs of the column families of the backup in the DB.
+	trailer backupTrailer     // Computed from the blocks read so far.
+	done    bool
+}
+
+// isBackupFormat returns true if the backup read by br has been written by backupEncoder, as
+// opposed to being in the legacy format.
+func isBackupFormat(br *bufio.Reader) bool {
+	magic, err := br.Peek(len(backupMagic))
+	return err == nil && bytes.Equal(magic, backupMagic)
+}
+
+func (db *DB) newBackupDecoder(br *bufio.Reader) (*backupDecoder, error) {
+	d := &backupDecoder{db: db, r: br}
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readHeader reads the magic, the format version and the header of a backup.
+func (d *backupDecoder) readHeader() error {
+	var prefix [10]byte
+	if _, err := io.ReadFull(d.r, prefix[:]); err != nil {
+		return y.Wrapf(err, "Error while reading backup magic")
+	}
+	if !bytes.Equal(prefix[:8], backupMagic) {
+		return errors.New("Invalid backup magic")
+	}
+	if v := binary.LittleEndian.Uint16(prefix[8:]); v != backupFormatVersion {
+		return errors.Errorf("Unsupported backup format version: %d", v)
+	}
+
+	typ, payload, err := d.readRecord()
+	if err != nil {
+		return err
+	}
+	if typ != backupRecordHeader {
+		return errors.Errorf("Expected backup header, found record of type %d", typ)
+	}
+	d.header = backupHeader{}
+	if err := json.Unmarshal(payload, &d.header); err != nil {
+		return y.Wrapf(err, "Error while unmarshalling backup header")
+	}
+	switch d.header.Compression {
+	case options.None, options.Snappy:
+	case options.ZSTD:
+		if !y.CgoEnabled {
+			return y.ErrZstdCgo
+		}
+	default:
+		return errors.Errorf("Unsupported compression type: %d", d.header.Compression)
+	}
+
+	d.trailer = backupTrailer{}
+	if d.dataKey, err = d.db.backupDataKey(&d.header); err != nil {
+		return err
+	}
+	// The keys of the column families are loaded into the ones with the same names in the DB.
+	d.cfIDs, err = d.db.importColumnFamilies(d.header.ColumnFamilies)
+	return err
+}
+
+func (d *backupDecoder) readRecord() (byte, []byte, error) {
+	var hdr [backupRecordHeaderSize]byte
+	if _, err := io.ReadFull(d.r, hdr[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil, ErrBackupTruncated
+		}
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(hdr[1:5]))
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, nil, ErrBackupTruncated
+		}
+		return 0, nil, err
+	}
+	if err := y.VerifyChecksum(payload, &pb.Checksum{
+		Algo: pb.Checksum_CRC32C,
+		Sum:  binary.LittleEndian.Uint64(hdr[5:13]),
+	}); err != nil {
+		return 0, nil, y.Wrapf(err, "Backup record of type %d", hdr[0])
+	}
+	return hdr[0], payload, nil
+}
+
+// next returns the next list in the backup. It returns io.EOF once the trailer of the last
+// backup has been read and validated.
+func (d *backupDecoder) next() (*pb.KVList, error) {
+	for !d.done {
+		typ, payload, err := d.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case backupRecordBlock:
+			list, err := d.decodeBlock(payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, kv := range list.Kv {
+				if err := remapCFKey(d.cfIDs, kv.Key); err != nil {
+					return nil, err
+				}
+			}
+			return list, nil
+		case backupRecordTrailer:
+			if err := d.checkTrailer(payload); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("Unexpected backup record of type %d", typ)
+		}
+	}
+	return nil, io.EOF
+}
+
+func (d *backupDecoder) decodeBlock(payload []byte) (*pb.KVList, error) {
+	if len(payload) < 4 {
+		return nil, errors.New("Invalid backup block")
+	}
+	size := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+	if d.dataKey != nil {
+		if len(payload) < 16 {
+			return nil, errors.New("Invalid backup block")
+		}
+		var err error
+		iv := payload[:16]
+		if payload, err = y.XORBlockAllocate(payload[16:], d.dataKey, iv); err != nil {
+			return nil, y.Wrapf(err, "Error while decrypting backup block")
+		}
+	}
+
+	var data []byte
+	var err error
+	switch d.header.Compression {
+	case options.None:
+		data = payload
+	case options.Snappy:
+		data, err = snappy.Decode(make([]byte, size), payload)
+	case options.ZSTD:
+		data, err = y.ZSTDDecompress(make([]byte, size), payload)
+	}
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while decompressing backup block")
+	}
+	if uint32(len(data)) != size {
+		return nil, errors.Errorf("Backup block has size %d, expected %d", len(data), size)
+	}
+
+	list := &pb.KVList{}
+	if err := proto.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+	d.trailer.NumBlocks++
+	for _, kv := range list.Kv {
+		d.trailer.NumKVs++
+		if kv.Version > d.trailer.MaxVersion {
+			d.trailer.MaxVersion = kv.Version
+		}
+	}
+	return list, nil
+}
+
+func (d *backupDecoder) checkTrailer(payload []byte) error {
+	var t backupTrailer
+	if err := t.decode(payload); err != nil {
+		return err
+	}
+	if t != d.trailer {
+		return errors.Errorf("Backup trailer mismatch: expected %+v, read %+v", d.trailer, t)
+	}
+	switch _, err := d.r.Peek(1); {
+	case err == io.EOF:
+		d.done = true
+		return nil
+	case err != nil:
+		return err
+	case isBackupFormat(d.r):
+		// Another backup follows.
+		return d.readHeader()
+	default:
+		return errors.New("Unexpected data after backup trailer")
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// S3BackupStore is a BackupSink and BackupSource backed by an S3 compatible object storage. Every
+// chunk of a backup is stored as an object under Prefix + name + "/", along with an index object
+// which is written once the backup is complete. Requests are signed with AWS Signature Version 4
+// and use path style URLs, which are supported by S3 as well as by most compatible servers.
+type S3BackupStore struct {
+	// Endpoint is the URL of the server, like https://s3.us-east-1.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+	Prefix   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client is the HTTP client used for the requests. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+var _ BackupSink = (*S3BackupStore)(nil)
+var _ BackupSource = (*S3BackupStore)(nil)
+
+func (s *S3BackupStore) objectKey(name, file string) string {
+	return s.Prefix + name + "/" + file
+}
+
+// ResumePoint implements BackupSink.
+func (s *S3BackupStore) ResumePoint(name string) (*BackupResumePoint, error) {
+	key := s.objectKey(name, backupResumeFilename)
+	keys, err := s.listObjects(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 || keys[0] != key {
+		return nil, nil
+	}
+	buf, err := s.getObject(key)
+	if err != nil {
+		return nil, err
+	}
+	rp := &BackupResumePoint{}
+	if err := json.Unmarshal(buf, rp); err != nil {
+		return nil, y.Wrapf(err, "Error while unmarshalling resume point of backup: %q", name)
+	}
+	return rp, nil
+}
+
+// PutChunk implements BackupSink.
+func (s *S3BackupStore) PutChunk(name string, c BackupChunk, data []byte) error {
+	resp, err := s.do("PUT", s.objectKey(name, backupChunkName(c.Index)), nil, nil, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// PutResumePoint implements BackupSink.
+func (s *S3BackupStore) PutResumePoint(name string, rp *BackupResumePoint) error {
+	buf, err := json.Marshal(rp)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", s.objectKey(name, backupResumeFilename), nil, nil, buf)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Complete implements BackupSink.
+func (s *S3BackupStore) Complete(name string, chunks []BackupChunk) error {
+	buf, err := json.Marshal(chunks)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", s.objectKey(name, backupIndexFilename), nil, nil, buf)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Remove the chunks left over by an earlier upload with more chunks.
+	keys, err := s.listObjects(s.objectKey(name, ""))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		var index int
+		file := key[len(s.objectKey(name, "")):]
+		if _, err := fmt.Sscanf(file, "%06d.chunk", &index); err != nil || index < len(chunks) {
+			continue
+		}
+		resp, err := s.do("DELETE", key, nil, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	resp, err = s.do("DELETE", s.objectKey(name, backupResumeFilename), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Chunks implements BackupSource.
+func (s *S3BackupStore) Chunks(name string) ([]BackupChunk, error) {
+	buf, err := s.getObject(s.objectKey(name, backupIndexFilename))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []BackupChunk
+	if err := json.Unmarshal(buf, &chunks); err != nil {
+		return nil, y.Wrapf(err, "Error while unmarshalling index of backup: %q", name)
+	}
+	return chunks, nil
+}
+
+// GetChunk implements BackupSource.
+func (s *S3BackupStore) GetChunk(name string, c BackupChunk) ([]byte, error) {
+	return s.getObject(s.objectKey(name, backupChunkName(c.Index)))
+}
+
+func (s *S3BackupStore) getObject(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listObjects returns the keys of all the objects with the given prefix.
+func (s *S3BackupStore) listObjects(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, y.Wrapf(err, "Error while decoding list of objects")
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !res.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// do sends a signed request for the object with the given key, or for the bucket if the key is
+// empty. Responses with a status other than 2xx are turned into errors.
+func (s *S3BackupStore) do(method, key string, query url.Values, header http.Header,
+	body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	sum := sha256.Sum256(body)
+	signV4(req, hex.EncodeToString(sum[:]), s.AccessKeyID, s.SecretAccessKey, s.Region,
+		time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		resp.Body.Close()
+		return nil, errors.Errorf("%s %s: %s: %s", method, u.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// signV4 signs the request with AWS Signature Version 4, as documented at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html.
+func signV4(req *http.Request, payloadHash, accessKeyID, secretAccessKey, region string,
+	now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vals := query[k]
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, awsURIEscape(k, true)+"="+awsURIEscape(v, true))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEscape(req.URL.Path, false),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// awsURIEscape escapes everything but the unreserved characters, and the slashes if escapeSlash
+// is false.
+func awsURIEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
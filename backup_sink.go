@@ -0,0 +1,389 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// DefaultBackupChunkSize is the default size of the chunks a backup is split into by BackupWriter.
+const DefaultBackupChunkSize = 64 << 20
+
+// backupChunkChecksum is the checksum algorithm used for the chunks of a backup.
+const backupChunkChecksum = pb.Checksum_CRC32C
+
+// BackupChunk describes a single chunk of a backup stored in a BackupSink.
+type BackupChunk struct {
+	Index    int
+	Size     int64
+	Checksum uint64 // CRC32C of the chunk, see y.CalculateChecksum.
+}
+
+// BackupResumePoint records how far an upload of a backup has got, so that an interrupted upload
+// can be resumed instead of starting over.
+type BackupResumePoint struct {
+	// Chunks are the chunks uploaded so far.
+	Chunks []BackupChunk
+	// Offset is the size of the backup held by Chunks.
+	Offset int64
+	// State is set by DB.BackupTo to continue the backup after the last key held by Chunks.
+	State []byte `json:",omitempty"`
+}
+
+// BackupSink is a destination for backups. A backup is uploaded as a sequence of chunks, which
+// allows large backups to be streamed without knowing their size upfront, and interrupted uploads
+// to be resumed.
+type BackupSink interface {
+	// ResumePoint returns the resume point of an upload of the named backup which hasn't been
+	// completed, or nil if there is none.
+	ResumePoint(name string) (*BackupResumePoint, error)
+	// PutChunk uploads a chunk of the named backup, replacing any chunk with the same index.
+	PutChunk(name string, c BackupChunk, data []byte) error
+	// PutResumePoint replaces the resume point of the named backup. It is called once the chunks
+	// of the resume point have been uploaded.
+	PutResumePoint(name string, rp *BackupResumePoint) error
+	// Complete makes the named backup, made up of the given chunks in order, available to
+	// BackupSource, and removes its resume point.
+	Complete(name string, chunks []BackupChunk) error
+}
+
+// BackupSource is a source of the backups written to a BackupSink.
+type BackupSource interface {
+	// Chunks returns the chunks of the named backup.
+	Chunks(name string) ([]BackupChunk, error)
+	// GetChunk returns the data of a chunk of the named backup.
+	GetChunk(name string, c BackupChunk) ([]byte, error)
+}
+
+// BackupWriter is an io.WriteCloser which uploads a backup to a BackupSink in chunks. A resume
+// point is recorded along with every chunk, see ResumeBackupWriter. The backup is only made
+// available once Close returns successfully.
+type BackupWriter struct {
+	sink      BackupSink
+	name      string
+	chunkSize int
+	rp        BackupResumePoint
+	buf       []byte
+	closed    bool
+	// aligned is set by DB.BackupTo, which uploads the chunks itself in between the blocks of the
+	// backup, so that they can be resumed from.
+	aligned bool
+}
+
+// NewBackupWriter returns a BackupWriter which uploads the named backup to the sink, in chunks of
+// chunkSize bytes. Any earlier upload of the backup is started over.
+func NewBackupWriter(sink BackupSink, name string, chunkSize int) (*BackupWriter, error) {
+	if chunkSize <= 0 {
+		return nil, errors.Errorf("Invalid backup chunk size: %d", chunkSize)
+	}
+	w := &BackupWriter{
+		sink:      sink,
+		name:      name,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+	}
+	// Otherwise, the upload could be resumed from the chunks this one is about to replace.
+	if err := sink.PutResumePoint(name, &w.rp); err != nil {
+		return nil, y.Wrapf(err, "Error while resetting resume point of backup: %q", name)
+	}
+	return w, nil
+}
+
+// ResumeBackupWriter is like NewBackupWriter, but resumes an interrupted upload of the backup if
+// there is one. The data written to the BackupWriter must continue from Offset, for example by
+// seeking the file being uploaded to it.
+func ResumeBackupWriter(sink BackupSink, name string, chunkSize int) (*BackupWriter, error) {
+	if chunkSize <= 0 {
+		return nil, errors.Errorf("Invalid backup chunk size: %d", chunkSize)
+	}
+	rp, err := sink.ResumePoint(name)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while reading resume point of backup: %q", name)
+	}
+	if rp == nil {
+		return NewBackupWriter(sink, name, chunkSize)
+	}
+	return &BackupWriter{
+		sink:      sink,
+		name:      name,
+		chunkSize: chunkSize,
+		rp:        *rp,
+		buf:       make([]byte, 0, chunkSize),
+	}, nil
+}
+
+// Offset returns the size of the backup uploaded so far.
+func (w *BackupWriter) Offset() int64 {
+	return w.rp.Offset
+}
+
+// Write implements io.Writer.
+func (w *BackupWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("Write on closed BackupWriter")
+	}
+	if w.aligned {
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	}
+	n := len(p)
+	for len(p) > 0 {
+		m := w.chunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(nil); err != nil {
+				// The chunk stays buffered, and is retried by the next Write or Close.
+				return n - len(p), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush uploads the buffered data as a chunk, along with a resume point holding the given state.
+func (w *BackupWriter) flush(state []byte) error {
+	c := BackupChunk{
+		Index:    len(w.rp.Chunks),
+		Size:     int64(len(w.buf)),
+		Checksum: y.CalculateChecksum(w.buf, backupChunkChecksum),
+	}
+	if err := w.sink.PutChunk(w.name, c, w.buf); err != nil {
+		return y.Wrapf(err, "Error while uploading chunk %d of backup: %q", c.Index, w.name)
+	}
+	rp := BackupResumePoint{
+		Chunks: append(w.rp.Chunks[:len(w.rp.Chunks):len(w.rp.Chunks)], c),
+		Offset: w.rp.Offset + c.Size,
+		State:  state,
+	}
+	if err := w.sink.PutResumePoint(w.name, &rp); err != nil {
+		return y.Wrapf(err, "Error while saving resume point of backup: %q", w.name)
+	}
+	w.rp = rp
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close uploads the last chunk and completes the upload.
+func (w *BackupWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(nil); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	return w.sink.Complete(w.name, w.rp.Chunks)
+}
+
+// backupReader reads a backup from a BackupSource, verifying the checksum of every chunk.
+type backupReader struct {
+	src    BackupSource
+	name   string
+	chunks []BackupChunk
+	buf    []byte
+}
+
+// NewBackupReader returns an io.Reader over the named backup in src. The reader returns
+// y.ErrChecksumMismatch if a chunk has been corrupted.
+func NewBackupReader(src BackupSource, name string) (io.Reader, error) {
+	chunks, err := src.Chunks(name)
+	if err != nil {
+		return nil, y.Wrapf(err, "Error while listing chunks of backup: %q", name)
+	}
+	return &backupReader{src: src, name: name, chunks: chunks}, nil
+}
+
+func (r *backupReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		c := r.chunks[0]
+		data, err := r.src.GetChunk(r.name, c)
+		if err != nil {
+			return 0, y.Wrapf(err, "Error while reading chunk %d of backup: %q", c.Index, r.name)
+		}
+		if int64(len(data)) != c.Size {
+			return 0, errors.Errorf("Chunk %d of backup %q has size %d, expected %d",
+				c.Index, r.name, len(data), c.Size)
+		}
+		if err := y.VerifyChecksum(data, &pb.Checksum{
+			Algo: backupChunkChecksum,
+			Sum:  c.Checksum,
+		}); err != nil {
+			return 0, y.Wrapf(err, "Chunk %d of backup: %q", c.Index, r.name)
+		}
+		r.buf = data
+		r.chunks = r.chunks[1:]
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+const (
+	backupIndexFilename  = "INDEX"
+	backupResumeFilename = "RESUME"
+)
+
+func backupChunkName(index int) string {
+	return fmt.Sprintf("%06d.chunk", index)
+}
+
+// LocalBackupStore is a BackupSink and BackupSource which stores every backup in a directory of
+// its own, under Dir. The directory holds one file per chunk, and an index of the chunks which
+// is written once the backup is complete.
+type LocalBackupStore struct {
+	Dir string
+}
+
+var _ BackupSink = (*LocalBackupStore)(nil)
+var _ BackupSource = (*LocalBackupStore)(nil)
+
+// ResumePoint implements BackupSink.
+func (s *LocalBackupStore) ResumePoint(name string) (*BackupResumePoint, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.Dir, name, backupResumeFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rp := &BackupResumePoint{}
+	if err := json.Unmarshal(buf, rp); err != nil {
+		return nil, y.Wrapf(err, "Error while unmarshalling resume point of backup: %q", name)
+	}
+	return rp, nil
+}
+
+// PutResumePoint implements BackupSink.
+func (s *LocalBackupStore) PutResumePoint(name string, rp *BackupResumePoint) error {
+	dir := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(rp)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, backupResumeFilename)
+	if err := writeFileSync(path+".tmp", buf); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// PutChunk implements BackupSink.
+func (s *LocalBackupStore) PutChunk(name string, c BackupChunk, data []byte) error {
+	dir := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a partially written chunk is never mistaken for
+	// an uploaded one.
+	path := filepath.Join(dir, backupChunkName(c.Index))
+	if err := writeFileSync(path+".tmp", data); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Complete implements BackupSink.
+func (s *LocalBackupStore) Complete(name string, chunks []BackupChunk) error {
+	dir := filepath.Join(s.Dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(chunks)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, backupIndexFilename)
+	if err := writeFileSync(path+".tmp", buf); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	// Remove the chunks left over by an earlier upload with more chunks.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		var index int
+		if _, err := fmt.Sscanf(fi.Name(), "%06d.chunk", &index); err == nil &&
+			index >= len(chunks) {
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	err = os.Remove(filepath.Join(dir, backupResumeFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Chunks implements BackupSource.
+func (s *LocalBackupStore) Chunks(name string) ([]BackupChunk, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.Dir, name, backupIndexFilename))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []BackupChunk
+	if err := json.Unmarshal(buf, &chunks); err != nil {
+		return nil, y.Wrapf(err, "Error while unmarshalling index of backup: %q", name)
+	}
+	return chunks, nil
+}
+
+// GetChunk implements BackupSource.
+func (s *LocalBackupStore) GetChunk(name string, c BackupChunk) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.Dir, name, backupChunkName(c.Index)))
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := y.OpenTruncFile(path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
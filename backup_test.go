@@ -18,8 +18,10 @@ package badger
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -28,7 +30,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/require"
 )
 
@@ -562,3 +567,170 @@ func TestBackupBitClear(t *testing.T) {
 		return nil
 	}))
 }
+
+func TestBackupCatalogRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(filepath.Join(dir, "db")))
+	require.NoError(t, err)
+	defer db.Close()
+	catalog, err := OpenBackupCatalog(filepath.Join(dir, "backup"))
+	require.NoError(t, err)
+
+	set := func(key, val string) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(key), []byte(val))
+		}))
+	}
+	set("a", "a1")
+	set("b", "b1")
+	full, err := catalog.Backup(db, false)
+	require.NoError(t, err)
+	require.True(t, full.Full())
+
+	set("a", "a2")
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Delete([]byte("b"))
+	}))
+	incr1, err := catalog.Backup(db, false)
+	require.NoError(t, err)
+	require.Equal(t, full.MaxVersion+1, incr1.Since)
+
+	// An incremental backup without any entries doesn't break the chain.
+	empty, err := catalog.Backup(db, false)
+	require.NoError(t, err)
+	require.Equal(t, incr1.MaxVersion, empty.MaxVersion)
+
+	set("c", "c1")
+	_, err = catalog.Backup(db, false)
+	require.NoError(t, err)
+
+	// The catalog is persisted.
+	catalog, err = OpenBackupCatalog(catalog.Dir())
+	require.NoError(t, err)
+	require.Len(t, catalog.Backups, 4)
+	version, err := catalog.VersionAt(catalog.Backups[2].Time)
+	require.NoError(t, err)
+	require.Equal(t, incr1.MaxVersion, version)
+	_, err = catalog.VersionAt(full.Time.Add(-time.Second))
+	require.Error(t, err)
+
+	restore := func(until uint64) map[string]string {
+		rdir, err := ioutil.TempDir(dir, "restore")
+		require.NoError(t, err)
+		rdb, err := Open(getTestOptions(rdir))
+		require.NoError(t, err)
+		defer rdb.Close()
+		require.NoError(t, catalog.Restore(rdb, until, 16))
+
+		kvs := make(map[string]string)
+		require.NoError(t, rdb.View(func(txn *Txn) error {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			for it.Rewind(); it.Valid(); it.Next() {
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				kvs[string(it.Item().Key())] = string(val)
+			}
+			return nil
+		}))
+		return kvs
+	}
+	require.Equal(t, map[string]string{"a": "a1", "b": "b1"}, restore(full.MaxVersion))
+	require.Equal(t, map[string]string{"a": "a1"}, restore(full.MaxVersion-1))
+	require.Equal(t, map[string]string{"a": "a2"}, restore(incr1.MaxVersion))
+	require.Equal(t, map[string]string{"a": "a2", "c": "c1"}, restore(math.MaxUint64))
+
+	_, err = catalog.Chain(catalog.Backups[3].MaxVersion + 1)
+	require.Error(t, err)
+
+	// A gap in the chain is detected.
+	catalog.Backups[3].Since = catalog.Backups[2].MaxVersion + 2
+	_, err = catalog.Chain(math.MaxUint64)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Gap in backup chain")
+	// The chain up to an earlier version doesn't need the last backup.
+	_, err = catalog.Chain(incr1.MaxVersion)
+	require.NoError(t, err)
+	catalog.Backups[3].Since = catalog.Backups[2].MaxVersion + 1
+
+	// So is a modified backup file.
+	require.NoError(t, os.Truncate(filepath.Join(catalog.Dir(), incr1.File), incr1.Size-1))
+	_, err = catalog.Chain(math.MaxUint64)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "has size")
+}
+
+func TestBackupFormat(t *testing.T) {
+	key := []byte("thisisaverysecretkeyof32bytes...")
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := DefaultOptions(filepath.Join(dir, "db")).
+		WithEncryptionKey(key).
+		WithCompression(options.Snappy).
+		WithBlockCacheSize(10 << 20)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	entries := createEntries(1000)
+	for i := 0; i < len(entries); i += 100 {
+		require.NoError(t, populateEntries(db, entries[i:i+100]))
+	}
+	var bb bytes.Buffer
+	_, err = db.Backup(&bb, 0)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	backup := bb.Bytes()
+	require.True(t, bytes.HasPrefix(backup, backupMagic))
+	require.False(t, bytes.Contains(backup, entries[0].Key), "Backup should be encrypted")
+
+	load := func(opt Options, data []byte) error {
+		rdir, err := ioutil.TempDir(dir, "restore")
+		require.NoError(t, err)
+		opt.Dir, opt.ValueDir = rdir, rdir
+		db, err := Open(opt)
+		require.NoError(t, err)
+		defer db.Close()
+		if err := db.Load(bytes.NewReader(data), 16); err != nil {
+			return err
+		}
+		return db.View(func(txn *Txn) error {
+			for _, e := range entries {
+				item, err := txn.Get(e.Key)
+				require.NoError(t, err)
+				require.Equal(t, e.Value, getItemValue(t, item))
+			}
+			return nil
+		})
+	}
+	require.NoError(t, load(opt, backup))
+
+	err = load(opt.WithEncryptionKey(nil), backup)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Backup is encrypted")
+	require.Equal(t, ErrEncryptionKeyMismatch,
+		load(opt.WithEncryptionKey([]byte("thisisanothersecretkeyof32bytes.")), backup))
+
+	// Truncated backups are detected, including when the cut falls between two records.
+	for _, n := range []int{1, 24 + 13, len(backup) / 2} {
+		require.Equal(t, ErrBackupTruncated, load(opt, backup[:len(backup)-n]))
+	}
+
+	corrupted := append([]byte{}, backup...)
+	corrupted[len(corrupted)/2]++
+	err = load(opt, corrupted)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), y.ErrChecksumMismatch.Error())
+
+	// Backups in the legacy format can still be loaded.
+	var legacy bytes.Buffer
+	list := &pb.KVList{Kv: entries}
+	require.NoError(t, binary.Write(&legacy, binary.LittleEndian, uint64(proto.Size(list))))
+	buf, err := proto.Marshal(list)
+	require.NoError(t, err)
+	legacy.Write(buf)
+	require.NoError(t, load(opt, legacy.Bytes()))
+}
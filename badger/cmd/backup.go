@@ -18,14 +18,27 @@ package cmd
 
 import (
 	"bufio"
+	"fmt"
+	"io"
 	"math"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var backupFile string
+var backupDir string
+var fullBackup bool
+var backupDest string
+var uploadFile bool
+var chunkSize int
+var s3Endpoint string
 var truncate bool
 
 // backupCmd represents the backup command
@@ -37,7 +50,21 @@ var backupCmd = &cobra.Command{
 Iterates over each key-value pair, encodes it along with its metadata and
 version in protocol buffers and writes them to a file. This file can later be
 used by the restore command to create an identical copy of the
-database.`,
+database.
+
+If --backup-dir is set, the backup is added to the backup catalog in that
+directory instead. The first backup in a catalog is a full backup, and the
+following ones are incremental unless --full is set. The restore command can
+replay the catalog up to any version it covers.
+
+If --destination is set, the backup is uploaded in chunks to a local directory
+(file:///path/to/dir/name) or to an S3 compatible object storage
+(s3://bucket/prefix/name). The credentials for S3 are read from the
+AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION environment variables.
+An interrupted upload is resumed by running the command again, which continues
+the backup after the last key that has been uploaded. Use --upload to upload the
+backup file written earlier by this command instead of taking a new backup, an
+interrupted upload of the file is resumed as well.`,
 	RunE: doBackup,
 }
 
@@ -45,6 +72,18 @@ func init() {
 	RootCmd.AddCommand(backupCmd)
 	backupCmd.Flags().StringVarP(&backupFile, "backup-file", "f",
 		"badger.bak", "File to backup to")
+	backupCmd.Flags().StringVar(&backupDir, "backup-dir", "",
+		"Directory of the backup catalog to add the backup to.")
+	backupCmd.Flags().BoolVar(&fullBackup, "full", false,
+		"Take a full backup, even if the backup catalog isn't empty.")
+	backupCmd.Flags().StringVar(&backupDest, "destination", "",
+		"URL of the backup to upload to, file:///dir/name or s3://bucket/prefix/name.")
+	backupCmd.Flags().BoolVar(&uploadFile, "upload", false,
+		"Upload the existing backup file to --destination instead of taking a new backup.")
+	backupCmd.Flags().IntVar(&chunkSize, "chunk-size", badger.DefaultBackupChunkSize,
+		"Size of the chunks the backup is uploaded in, in bytes.")
+	backupCmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com",
+		"Endpoint of the S3 compatible object storage.")
 	backupCmd.Flags().BoolVarP(&truncate, "truncate", "t",
 		false, "Allow value log truncation if required.")
 	backupCmd.Flags().IntVarP(&numVersions, "num-versions", "n",
@@ -52,6 +91,10 @@ func init() {
 }
 
 func doBackup(cmd *cobra.Command, args []string) error {
+	if uploadFile {
+		return doUpload()
+	}
+
 	opt := badger.DefaultOptions(sstDir).
 		WithValueDir(vlogDir).
 		WithTruncate(truncate).
@@ -68,6 +111,28 @@ func doBackup(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	if backupDir != "" {
+		catalog, err := badger.OpenBackupCatalog(backupDir)
+		if err != nil {
+			return err
+		}
+		b, err := catalog.Backup(db, fullBackup)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote backup %s with versions [%d, %d]\n", b.File, b.Since, b.MaxVersion)
+		return nil
+	}
+
+	if backupDest != "" {
+		store, name, err := openBackupStore(backupDest)
+		if err != nil {
+			return err
+		}
+		_, err = db.BackupTo(store, name, 0, chunkSize)
+		return err
+	}
+
 	// Create File
 	f, err := os.Create(backupFile)
 	if err != nil {
@@ -89,3 +154,73 @@ func doBackup(cmd *cobra.Command, args []string) error {
 
 	return f.Close()
 }
+
+// doUpload uploads an existing backup file to the destination.
+func doUpload() error {
+	if backupDest == "" {
+		return errors.New("--upload requires --destination")
+	}
+	f, err := os.Open(backupFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	store, name, err := openBackupStore(backupDest)
+	if err != nil {
+		return err
+	}
+	w, err := badger.ResumeBackupWriter(store, name, chunkSize)
+	if err != nil {
+		return err
+	}
+	offset := w.Offset()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, bufio.NewReaderSize(f, 64<<20)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Uploaded %s, resumed after %d bytes uploaded earlier\n", backupFile, offset)
+	return nil
+}
+
+type backupStore interface {
+	badger.BackupSink
+	badger.BackupSource
+}
+
+// openBackupStore returns the store and the name of the backup at the given URL.
+func openBackupStore(rawurl string) (backupStore, string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "", "file":
+		dir, name := filepath.Split(filepath.Clean(u.Path))
+		return &badger.LocalBackupStore{Dir: dir}, name, nil
+	case "s3":
+		prefix, name := path.Split(strings.TrimPrefix(u.Path, "/"))
+		if u.Host == "" || name == "" {
+			return nil, "", errors.Errorf("Invalid S3 backup URL: %q", rawurl)
+		}
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &badger.S3BackupStore{
+			Endpoint:        s3Endpoint,
+			Region:          region,
+			Bucket:          u.Host,
+			Prefix:          prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}, name, nil
+	default:
+		return nil, "", errors.Errorf("Unsupported backup URL scheme: %q", u.Scheme)
+	}
+}
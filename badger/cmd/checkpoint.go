@@ -0,0 +1,73 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/spf13/cobra"
+)
+
+var checkpointDir string
+
+var checkpointCmd = &cobra.Command{
+	Use:   "checkpoint",
+	Short: "Create a checkpoint of Badger database.",
+	Long: `
+Creates a consistent copy of the database in the directory given by --out, which
+can be opened like any other Badger directory. The SST files and the value log
+files are hard linked when possible, so the directory must be on the same
+filesystem as the database. It must either not exist or be empty.
+`,
+	RunE: doCheckpoint,
+}
+
+func init() {
+	RootCmd.AddCommand(checkpointCmd)
+	checkpointCmd.Flags().StringVarP(&checkpointDir, "out", "o", "",
+		"Directory to create the checkpoint in.")
+	checkpointCmd.Flags().BoolVarP(&truncate, "truncate", "t", false,
+		"Allow value log truncation if required.")
+	checkpointCmd.Flags().StringVarP(&encryptionKey, "encryption-key", "e", "",
+		"Encryption key of the database.")
+}
+
+func doCheckpoint(cmd *cobra.Command, args []string) error {
+	if checkpointDir == "" {
+		return errors.New("--out is required")
+	}
+	opt := badger.DefaultOptions(sstDir).
+		WithValueDir(vlogDir).
+		WithTruncate(truncate)
+	if encryptionKey != "" {
+		opt = opt.WithEncryptionKey([]byte(encryptionKey)).
+			WithBlockCacheSize(10 << 20)
+	}
+	db, err := badger.Open(opt)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Checkpoint(checkpointDir); err != nil {
+		return err
+	}
+	fmt.Printf("Created checkpoint in %s\n", checkpointDir)
+	return nil
+}
@@ -44,6 +44,8 @@ type flagOptions struct {
 	showKeys      bool
 	withPrefix    string
 	keyLookup     string
+	asOf          string
+	retention     time.Duration
 	itemMeta      bool
 	keyHistory    bool
 	showInternal  bool
@@ -66,6 +68,10 @@ func init() {
 	infoCmd.Flags().StringVar(&opt.withPrefix, "with-prefix", "",
 		"Consider only the keys with specified prefix")
 	infoCmd.Flags().StringVarP(&opt.keyLookup, "lookup", "l", "", "Hex of the key to lookup")
+	infoCmd.Flags().StringVar(&opt.asOf, "as-of", "", "Lookup the key as it was at this time, "+
+		"in RFC3339 format. The history retention of the DB must be set to cover it.")
+	infoCmd.Flags().DurationVar(&opt.retention, "history-retention", 0,
+		"The history retention the DB is used with. See Options.HistoryRetention.")
 	infoCmd.Flags().BoolVar(&opt.itemMeta, "show-meta", true, "Output item meta data as well")
 	infoCmd.Flags().BoolVar(&opt.keyHistory, "history", false, "Show all versions of a key")
 	infoCmd.Flags().BoolVar(
@@ -102,6 +108,7 @@ func handleInfo(cmd *cobra.Command, args []string) error {
 		WithReadOnly(opt.readOnly).
 		WithTruncate(opt.truncate).
 		WithTableLoadingMode(options.MemoryMap).
+		WithHistoryRetention(opt.retention).
 		WithEncryptionKey([]byte(opt.encryptionKey)))
 	if err != nil {
 		return errors.Wrap(err, "failed to open database")
@@ -165,7 +172,18 @@ func showKeys(db *badger.DB, prefix []byte) error {
 }
 
 func lookup(db *badger.DB) error {
-	txn := db.NewTransaction(false)
+	var txn *badger.Txn
+	if len(opt.asOf) > 0 {
+		asOf, err := time.Parse(time.RFC3339, opt.asOf)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse time: %q", opt.asOf)
+		}
+		if txn, err = db.NewTransactionAsOf(asOf); err != nil {
+			return errors.Wrapf(err, "failed to read the DB as of: %s", opt.asOf)
+		}
+	} else {
+		txn = db.NewTransaction(false)
+	}
 	defer txn.Discard()
 
 	key, err := hex.DecodeString(opt.keyLookup)
@@ -335,6 +353,11 @@ func printInfo(dir, valueDir string) error {
 	} else {
 		fmt.Printf("%s [MISSING]\n", manifestInfo.Name())
 	}
+	if timeLogInfo, ok := fileinfoByName[badger.TimeLogFilename]; ok {
+		fileinfoMarked[badger.TimeLogFilename] = true
+		fmt.Printf("[%25s] %-12s %6s TL\n", dur(baseTime, timeLogInfo.ModTime()),
+			timeLogInfo.Name(), hbytes(timeLogInfo.Size()))
+	}
 
 	numMissing := 0
 	numEmpty := 0
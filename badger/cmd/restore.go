@@ -21,6 +21,7 @@ import (
 	"math"
 	"os"
 	"path"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/spf13/cobra"
@@ -28,6 +29,10 @@ import (
 
 var restoreFile string
 var maxPendingWrites int
+var restoreDir string
+var untilVersion uint64
+var untilTime string
+var restoreSource string
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
@@ -39,6 +44,16 @@ It reads a file generated using the backup command (or by calling the
 DB.Backup() API method) and writes each key-value pair found in the file to
 the Badger database.
 
+If --backup-dir is set, the backup chain in the catalog of that directory is
+restored instead. --until-version or --until-time restore the database as of
+an earlier version, or as of the latest backup taken at or before the given
+time. The chain is checked for gaps and missing or modified files before
+anything is written.
+
+If --source is set, the backup is downloaded from a local directory or an S3
+compatible object storage, see the backup command. The checksum of every chunk
+is verified while downloading.
+
 Restore creates a new database, and currently does not work on an already
 existing database.`,
 	RunE: doRestore,
@@ -52,9 +67,49 @@ func init() {
 	// and overall finish time.
 	restoreCmd.Flags().IntVarP(&maxPendingWrites, "max-pending-writes", "w",
 		256, "Max number of pending writes at any time while restore")
+	restoreCmd.Flags().StringVar(&restoreSource, "source", "",
+		"URL of the backup to restore from, file:///dir/name or s3://bucket/prefix/name.")
+	restoreCmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com",
+		"Endpoint of the S3 compatible object storage.")
+	restoreCmd.Flags().StringVar(&restoreDir, "backup-dir", "",
+		"Directory of the backup catalog to restore from.")
+	restoreCmd.Flags().Uint64Var(&untilVersion, "until-version", 0,
+		"Restore the backup catalog up to this version. 0 restores all the versions.")
+	restoreCmd.Flags().StringVar(&untilTime, "until-time", "",
+		"Restore the backup catalog up to the latest backup taken at or before this time, "+
+			"in RFC3339 format.")
 }
 
 func doRestore(cmd *cobra.Command, args []string) error {
+	var catalog *badger.BackupCatalog
+	until := uint64(math.MaxUint64)
+	if restoreDir != "" {
+		var err error
+		if catalog, err = badger.OpenBackupCatalog(restoreDir); err != nil {
+			return err
+		}
+		switch {
+		case untilVersion > 0 && untilTime != "":
+			return errors.New("Only one of --until-version and --until-time can be set")
+		case untilVersion > 0:
+			until = untilVersion
+		case untilTime != "":
+			t, err := time.Parse(time.RFC3339, untilTime)
+			if err != nil {
+				return err
+			}
+			if until, err = catalog.VersionAt(t); err != nil {
+				return err
+			}
+		}
+		// Refuse to restore an inconsistent chain before creating the DB.
+		if _, err := catalog.Chain(until); err != nil {
+			return err
+		}
+	} else if untilVersion > 0 || untilTime != "" {
+		return errors.New("--until-version and --until-time require --backup-dir")
+	}
+
 	// Check if the DB already exists
 	manifestFile := path.Join(sstDir, badger.ManifestFilename)
 	if _, err := os.Stat(manifestFile); err == nil { // No error. File already exists.
@@ -74,6 +129,21 @@ func doRestore(cmd *cobra.Command, args []string) error {
 	}
 	defer db.Close()
 
+	if catalog != nil {
+		return catalog.Restore(db, until, maxPendingWrites)
+	}
+	if restoreSource != "" {
+		store, name, err := openBackupStore(restoreSource)
+		if err != nil {
+			return err
+		}
+		r, err := badger.NewBackupReader(store, name)
+		if err != nil {
+			return err
+		}
+		return db.Load(r, maxPendingWrites)
+	}
+
 	// Open File
 	f, err := os.Open(restoreFile)
 	if err != nil {
@@ -0,0 +1,358 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// blobChunkSize is the size of the chunks of the values set by Txn.SetStream.
+const blobChunkSize = 1 << 20
+
+// ReadSeekCloser is the interface that groups the Read, Seek and Close methods, like
+// io.ReadSeekCloser in the versions of Go which have it.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// blobManifest is the value of a key set by Txn.SetStream. The chunks of the blob are stored under
+// blobChunkKey, with the same version as the manifest.
+type blobManifest struct {
+	size      uint64
+	chunkSize uint32
+}
+
+const blobManifestSize = 12
+
+func (m blobManifest) encode() []byte {
+	buf := make([]byte, blobManifestSize)
+	binary.BigEndian.PutUint64(buf, m.size)
+	binary.BigEndian.PutUint32(buf[8:], m.chunkSize)
+	return buf
+}
+
+func (m *blobManifest) decode(buf []byte) error {
+	if len(buf) != blobManifestSize {
+		return errors.Errorf("Invalid blob manifest of size %d", len(buf))
+	}
+	m.size = binary.BigEndian.Uint64(buf)
+	m.chunkSize = binary.BigEndian.Uint32(buf[8:])
+	if m.chunkSize == 0 && m.size > 0 {
+		return errors.New("Invalid blob manifest with empty chunks")
+	}
+	return nil
+}
+
+func (m blobManifest) numChunks() uint32 {
+	if m.size == 0 {
+		return 0
+	}
+	return uint32((m.size-1)/uint64(m.chunkSize) + 1)
+}
+
+// blobChunkKey returns the key of the i-th chunk of the blob of key.
+func blobChunkKey(key []byte, i uint32) []byte {
+	buf := make([]byte, len(blobPrefix)+len(key)+4)
+	n := copy(buf, blobPrefix)
+	n += copy(buf[n:], key)
+	binary.BigEndian.PutUint32(buf[n:], i)
+	return buf
+}
+
+// SetStream sets the value of the key to the data read from r until io.EOF. The data is stored
+// in chunks, so that its size isn't limited by Options.ValueLogFileSize, and Item.ValueReader
+// streams it chunk by chunk rather than reading it whole. Data fitting in a single chunk is
+// stored as a regular value.
+//
+// The chunks are held in memory until the transaction is committed. If reading r fails, the
+// chunks set so far are removed from the transaction. Backups hold the chunks as they are stored,
+// while Stream and the subscribers get the data as a whole value.
+func (txn *Txn) SetStream(key []byte, r io.Reader) error {
+	switch {
+	case len(key) == 0:
+		return ErrEmptyKey
+	case bytes.HasPrefix(key, badgerPrefix):
+		return ErrInvalidKey
+	}
+	sp := txn.Savepoint()
+	defer txn.releaseSavepoint(sp)
+	if err := txn.setStream(key, r); err != nil {
+		// It only fails if the txn is discarded.
+		_ = txn.RollbackTo(sp)
+		return err
+	}
+	return nil
+}
+
+func (txn *Txn) setStream(key []byte, r io.Reader) error {
+	chunkSize := blobChunkSize
+	if txn.db.opt.InMemory && txn.db.opt.ValueThreshold < chunkSize {
+		// The values of an in-memory DB can't exceed ValueThreshold.
+		chunkSize = txn.db.opt.ValueThreshold
+	}
+
+	var size uint64
+	for i := uint32(0); ; i++ {
+		chunk := make([]byte, chunkSize)
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if last && i == 0 {
+			return txn.Set(key, append([]byte{}, chunk[:n]...))
+		}
+		if n > 0 {
+			e := &Entry{Key: blobChunkKey(key, i), Value: chunk[:n]}
+			if err := txn.modifyEntry(e, true); err != nil {
+				return err
+			}
+			size += uint64(n)
+		}
+		if last {
+			break
+		}
+	}
+	m := blobManifest{size: size, chunkSize: uint32(chunkSize)}
+	return txn.modify(&Entry{Key: key, Value: m.encode(), meta: bitBlob})
+}
+
+// blobReader reads a blob chunk by chunk.
+type blobReader struct {
+	db       *DB
+	txn      *Txn // Set if the blob is a pending write of txn.
+	key      []byte
+	version  uint64
+	manifest blobManifest
+
+	off      int64
+	chunk    []byte // The chunk at chunkIdx, if read.
+	chunkIdx uint32
+}
+
+func newBlobReader(db *DB, txn *Txn, key []byte, version uint64, manifest []byte) (
+	*blobReader, error) {
+	r := &blobReader{db: db, txn: txn, key: key, version: version}
+	if err := r.manifest.decode(manifest); err != nil {
+		return nil, y.Wrapf(err, "while reading the blob of key: %q", key)
+	}
+	return r, nil
+}
+
+// readChunk returns the i-th chunk of the blob.
+func (r *blobReader) readChunk(i uint32) ([]byte, error) {
+	key := blobChunkKey(r.key, i)
+	var chunk []byte
+	if r.txn != nil {
+		if e, ok := r.txn.pendingWrites[string(key)]; ok {
+			chunk = e.Value
+		}
+	} else {
+		vs, err := r.db.get(y.KeyWithTs(key, r.version))
+		if err != nil {
+			return nil, err
+		}
+		if vs.Version == r.version && !isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			if chunk, err = r.db.readValue(vs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	want := uint64(r.manifest.chunkSize)
+	if end := uint64(i+1) * want; end > r.manifest.size {
+		want -= end - r.manifest.size
+	}
+	if uint64(len(chunk)) != want {
+		return nil, errors.Errorf("Chunk %d of the blob of key %q has size %d, expected %d",
+			i, r.key, len(chunk), want)
+	}
+	return chunk, nil
+}
+
+// Read implements io.Reader.
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.off >= int64(r.manifest.size) {
+		return 0, io.EOF
+	}
+	i := uint32(r.off / int64(r.manifest.chunkSize))
+	if r.chunk == nil || r.chunkIdx != i {
+		chunk, err := r.readChunk(i)
+		if err != nil {
+			return 0, err
+		}
+		r.chunk, r.chunkIdx = chunk, i
+	}
+	n := copy(p, r.chunk[r.off-int64(i)*int64(r.manifest.chunkSize):])
+	r.off += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (r *blobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += int64(r.manifest.size)
+	default:
+		return 0, errors.Errorf("Invalid whence: %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *blobReader) Close() error {
+	r.chunk = nil
+	return nil
+}
+
+// readAll returns the whole blob.
+func (r *blobReader) readAll() ([]byte, error) {
+	val := make([]byte, r.manifest.size)
+	if _, err := io.ReadFull(r, val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// valueReader is the ReadSeekCloser over a value read whole.
+type valueReader struct {
+	*bytes.Reader
+}
+
+func (valueReader) Close() error {
+	return nil
+}
+
+// ValueReader returns a reader over the value of the item. The values set by Txn.SetStream are
+// read chunk by chunk as the reader is read, while the other ones are read whole, as by
+// ValueCopy. Like Value, the reader is only valid within the transaction.
+func (item *Item) ValueReader() (ReadSeekCloser, error) {
+	if !isBlob(item.meta) {
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		return valueReader{bytes.NewReader(val)}, nil
+	}
+	return item.blobReader()
+}
+
+func (item *Item) blobReader() (*blobReader, error) {
+	db := item.txn.db
+	manifest, err := db.readValue(y.ValueStruct{Meta: item.meta, Value: item.vptr})
+	if err != nil {
+		return nil, err
+	}
+	var txn *Txn
+	if item.pending {
+		txn = item.txn
+	}
+	return newBlobReader(db, txn, item.key, item.version, manifest)
+}
+
+// backupBlob appends the chunks of the blob of the item to list, and returns its manifest, as
+// blobs are backed up the way they are stored.
+func (item *Item) backupBlob(list *pb.KVList) ([]byte, error) {
+	r, err := item.blobReader()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < r.manifest.numChunks(); i++ {
+		chunk, err := r.readChunk(i)
+		if err != nil {
+			return nil, err
+		}
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:     blobChunkKey(item.key, i),
+			Value:   chunk,
+			Version: item.version,
+		})
+	}
+	return r.manifest.encode(), nil
+}
+
+// blobValue returns the data of the blob with the given manifest, reading the chunks from chunks,
+// which holds them by key with version, or from the DB if they aren't there.
+func (db *DB) blobValue(key []byte, version uint64, manifest []byte,
+	chunks map[string][]byte) ([]byte, error) {
+	r, err := newBlobReader(db, nil, key, version, manifest)
+	if err != nil {
+		return nil, err
+	}
+	val := make([]byte, 0, r.manifest.size)
+	for i := uint32(0); i < r.manifest.numChunks(); i++ {
+		chunk, ok := chunks[string(y.KeyWithTs(blobChunkKey(key, i), version))]
+		if !ok {
+			if chunk, err = r.readChunk(i); err != nil {
+				return nil, err
+			}
+		}
+		val = append(val, chunk...)
+	}
+	if uint64(len(val)) != r.manifest.size {
+		return nil, errors.Errorf("Blob of key %q has size %d, expected %d",
+			key, len(val), r.manifest.size)
+	}
+	return val, nil
+}
+
+// blobLiveness holds the liveness of the versions of the latest blob whose chunks were checked by
+// a compaction, so that its manifest is looked up once per version rather than for every chunk.
+type blobLiveness struct {
+	key  []byte
+	live map[uint64]bool
+}
+
+// blobChunkLive returns true if the chunk of a blob, given by its key with version, is still part
+// of the value of a key. The chunks are discarded by the compactions which follow the one
+// discarding their manifest.
+func (db *DB) blobChunkLive(chunkKey []byte, cache *blobLiveness) bool {
+	key := y.ParseKey(chunkKey)
+	if len(key) < len(blobPrefix)+4 {
+		return true
+	}
+	key = key[len(blobPrefix) : len(key)-4]
+	version := y.ParseTs(chunkKey)
+	if !bytes.Equal(key, cache.key) {
+		cache.key = append(cache.key[:0], key...)
+		cache.live = make(map[uint64]bool)
+	}
+	if live, ok := cache.live[version]; ok {
+		return live
+	}
+	vs, err := db.get(y.KeyWithTs(key, version))
+	if err != nil {
+		return true
+	}
+	live := vs.Version == version && isBlob(vs.Meta) && !isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+	cache.live[version] = live
+	return live
+}
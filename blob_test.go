@@ -0,0 +1,228 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/trace"
+)
+
+func TestSetStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// The chunks don't fit in a single value log file.
+	opt := getTestOptions(dir).WithNumCompactors(0).WithValueLogFileSize(1 << 20)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	key := []byte("blob")
+	data := make([]byte, 5*blobChunkSize/2)
+	rand.Read(data)
+	checkReader := func(item *Item) {
+		r, err := item.ValueReader()
+		require.NoError(t, err)
+		defer func() { require.NoError(t, r.Close()) }()
+		// Read across the boundary of the chunks.
+		_, err = r.Seek(blobChunkSize-10, io.SeekStart)
+		require.NoError(t, err)
+		buf := make([]byte, 20)
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		require.Equal(t, data[blobChunkSize-10:blobChunkSize+10], buf)
+		_, err = r.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		val, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, data, val)
+	}
+	check := func(db *DB) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(data)), item.ValueSize())
+			checkReader(item)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, data, val)
+
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			it.Rewind()
+			require.True(t, it.Valid())
+			val, err = it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, data, val)
+			return nil
+		}))
+	}
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetStream(key, bytes.NewReader(data)))
+		// The pending blob can be read too.
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		checkReader(item)
+		// Small values are stored as they are.
+		require.NoError(t, txn.SetStream([]byte("small"), strings.NewReader("abc")))
+		return nil
+	}))
+	check(db)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("small"))
+		require.NoError(t, err)
+		require.False(t, isBlob(item.meta))
+		r, err := item.ValueReader()
+		require.NoError(t, err)
+		val, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "abc", string(val))
+		return r.Close()
+	}))
+
+	// The value log GC moves the chunks.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	db.vlog.filesLock.RLock()
+	lf := db.vlog.filesMap[db.vlog.sortedFids()[0]]
+	db.vlog.filesLock.RUnlock()
+	tr := trace.New("Test", "Test")
+	defer tr.Finish()
+	require.NoError(t, db.vlog.rewrite(lf, tr))
+	check(db)
+
+	// Backups hold the chunks.
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf, 0)
+	require.NoError(t, err)
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Load(&buf, 16))
+		check(db)
+	})
+
+	// The chunks are discarded along with the blob.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set(key, []byte("value"))
+	}))
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.orc.readMark.WaitForMark(context.Background(), db.orc.nextTs()-1))
+	// The first compaction discards the manifest, and the next one the chunks.
+	for level := 0; level < 2; level++ {
+		cdef := compactDef{
+			thisLevel: db.lc.levels[level],
+			nextLevel: db.lc.levels[level+1],
+			top:       db.lc.levels[level].tables,
+			bot:       db.lc.levels[level+1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(level, cdef))
+	}
+	require.NoError(t, db.View(func(txn *Txn) error {
+		iopt := DefaultIteratorOptions
+		iopt.AllVersions = true
+		iopt.InternalAccess = true
+		iopt.Prefix = blobPrefix
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+		it.Rewind()
+		require.False(t, it.Valid())
+		return nil
+	}))
+}
+
+// errReader returns the data of r, followed by err.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		err = r.err
+	}
+	return n, err
+}
+
+func TestSetStreamReadError(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("blob")
+		errTest := errors.New("test")
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("other"), nil))
+		sp := txn.Savepoint()
+		r := &errReader{r: bytes.NewReader(make([]byte, 5*blobChunkSize/2)), err: errTest}
+		require.Equal(t, errTest, txn.SetStream(key, r))
+
+		// The chunks set before the error are removed, and the txn can still be committed.
+		require.Equal(t, 1, len(txn.pendingWrites))
+		require.Len(t, txn.savepoints, 1)
+		require.NoError(t, txn.RollbackTo(sp))
+		require.NoError(t, txn.Commit())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get(key)
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn.Get([]byte("other"))
+			return err
+		}))
+	})
+}
+
+func TestSubscribeBlob(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		data := make([]byte, 5*blobChunkSize/2)
+		rand.Read(data)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var got []*pb.KV
+		done := make(chan error, 1)
+		go func() {
+			done <- db.Subscribe(ctx, func(kvs *KVList) error {
+				got = append(got, kvs.GetKv()...)
+				cancel()
+				return nil
+			}, nil)
+		}()
+		for db.pub.noOfSubscribers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.SetStream([]byte("blob"), bytes.NewReader(data))
+		}))
+		require.Equal(t, context.Canceled, <-done)
+
+		// The subscribers get the data rather than the manifest, and not the chunks.
+		require.Len(t, got, 1)
+		require.Equal(t, "blob", string(got[0].Key))
+		require.Equal(t, data, got[0].Value)
+	})
+}
@@ -0,0 +1,194 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/skl"
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint creates a consistent copy of the DB in dir, which can be opened with Open like any
+// other DB directory. Writes aren't stopped while the checkpoint is taken. The checkpoint contains
+// all the transactions committed before Checkpoint was called, and may contain some of the
+// transactions committed while it runs.
+//
+// The SST files and the value log files which are no longer written to are hard linked into dir,
+// so it must be on the same filesystem as the DB, and it must either not exist or be empty. Both
+// the SST and the value log files end up in dir, even if Options.ValueDir differs from
+// Options.Dir. The checkpoint is encrypted with the same key as the DB.
+//
+// Value log GC and compactions are paused while the files are being linked.
+func (db *DB) Checkpoint(dir string) error {
+	if db.opt.KeepL0InMemory {
+		return ErrCheckpointL0InMemory
+	}
+	if err := createCheckpointDir(dir); err != nil {
+		return err
+	}
+
+	// Flush the memtable, so that the value log doesn't need to be replayed from far behind when
+	// the checkpoint is opened.
+	if !db.opt.ReadOnly {
+		if err := db.forceFlushMemtable(); err != nil {
+			return y.Wrapf(err, "Error while flushing memtable for checkpoint")
+		}
+	}
+
+	// Block value log GC, which could rewrite and delete the value log files, and pause the
+	// compactions, which could delete the SST files before they are linked.
+	db.vlog.garbageCh <- struct{}{}
+	defer func() { <-db.vlog.garbageCh }()
+	db.stopCompactions()
+	defer db.startCompactions()
+
+	// Pin the state of the LSM tree. Every SST file in the manifest holds a value log head which is
+	// at or before db.vhead, so everything written after the head stored in the SSTs is found in
+	// the value log up to db.vhead.
+	db.manifest.appendLock.Lock()
+	manifest := db.manifest.manifest.clone()
+	db.manifest.appendLock.Unlock()
+	db.RLock()
+	vhead := db.vhead
+	db.RUnlock()
+
+	for id := range manifest.Tables {
+		src := table.NewFilename(id, db.opt.Dir)
+		if err := os.Link(src, table.NewFilename(id, dir)); err != nil {
+			return y.Wrapf(err, "Error while linking table: %q", src)
+		}
+	}
+
+	db.vlog.filesLock.RLock()
+	fids := db.vlog.sortedFids()
+	db.vlog.filesLock.RUnlock()
+	for _, fid := range fids {
+		src := db.vlog.fpath(fid)
+		switch {
+		case fid < vhead.Fid:
+			if err := os.Link(src, vlogFilePath(dir, fid)); err != nil {
+				return y.Wrapf(err, "Error while linking value log file: %q", src)
+			}
+		case fid == vhead.Fid:
+			// The head file is still being written to. Copy it up to the end of the head entry.
+			end := int64(vhead.Offset + vhead.Len)
+			if end < vlogHeaderSize {
+				end = vlogHeaderSize
+			}
+			if err := copyFilePrefix(src, vlogFilePath(dir, fid), end); err != nil {
+				return y.Wrapf(err, "Error while copying value log file: %q", src)
+			}
+		}
+	}
+
+	fp, _, err := helpRewrite(dir, &manifest)
+	if err != nil {
+		return y.Wrapf(err, "Error while writing manifest for checkpoint")
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	db.registry.RLock()
+	err = WriteKeyRegistry(db.registry, KeyRegistryOptions{
+		Dir:           dir,
+		EncryptionKey: db.opt.EncryptionKey,
+	})
+	db.registry.RUnlock()
+	if err != nil {
+		return y.Wrapf(err, "Error while writing key registry for checkpoint")
+	}
+	return syncDir(dir)
+}
+
+// createCheckpointDir creates the directory for a checkpoint, or checks that it is empty if it
+// already exists.
+func createCheckpointDir(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return os.MkdirAll(dir, 0700)
+	case err != nil:
+		return y.Wrapf(err, "Error while reading checkpoint directory: %q", dir)
+	case len(files) > 0:
+		return errors.Errorf("Checkpoint directory %q is not empty", dir)
+	}
+	return nil
+}
+
+// forceFlushMemtable makes the write goroutine flush the current memtable, and waits until the
+// memtable has been written to L0.
+func (db *DB) forceFlushMemtable() error {
+	atomic.StoreInt32(&db.logRotates, db.opt.LogRotatesToFlush)
+	req, err := db.sendToWriteCh(nil)
+	if err != nil {
+		return err
+	}
+	if err := req.Wait(); err != nil {
+		return err
+	}
+
+	db.RLock()
+	pending := make(map[*skl.Skiplist]struct{}, len(db.imm))
+	for _, mt := range db.imm {
+		pending[mt] = struct{}{}
+	}
+	db.RUnlock()
+	for {
+		db.RLock()
+		var flushing bool
+		for _, mt := range db.imm {
+			if _, ok := pending[mt]; ok {
+				flushing = true
+				break
+			}
+		}
+		db.RUnlock()
+		if !flushing {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// copyFilePrefix copies the first n bytes of the file at src to a new file at dst.
+func copyFilePrefix(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := y.OpenTruncFile(dst, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(out, in, n); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	opt := DefaultOptions(filepath.Join(dir, "db")).
+		WithValueThreshold(32).
+		WithValueLogFileSize(1 << 20).
+		WithMaxTableSize(1 << 20)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Values alternate between the LSM tree and the value log.
+	val := func(i int) []byte { return []byte(fmt.Sprintf("%0*d", 16+(i%2)*100, i)) }
+	write := func(i int) error {
+		return db.Update(func(txn *Txn) error {
+			return txn.Set(key(i), val(i))
+		})
+	}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		require.NoError(t, write(i))
+	}
+
+	// Keep writing while the checkpoint is being taken.
+	var written int32 = n
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			i := int(atomic.LoadInt32(&written))
+			require.NoError(t, write(i))
+			atomic.StoreInt32(&written, int32(i+1))
+		}
+	}()
+	cpDir := filepath.Join(dir, "checkpoint")
+	require.NoError(t, db.Checkpoint(cpDir))
+	close(stop)
+	wg.Wait()
+	require.Error(t, db.Checkpoint(cpDir), "Checkpoint directory isn't empty")
+
+	cp, err := Open(DefaultOptions(cpDir))
+	require.NoError(t, err)
+	defer cp.Close()
+	var count int
+	require.NoError(t, cp.View(func(txn *Txn) error {
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			require.Equal(t, key(count), it.Item().Key())
+			v, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, val(count), v)
+			count++
+		}
+		return nil
+	}))
+	// The checkpoint holds a prefix of the writes, which contains every write done before it.
+	require.True(t, count >= n, "count: %d", count)
+	require.True(t, count <= int(atomic.LoadInt32(&written)), "count: %d", count)
+
+	// The checkpoint is independent of the DB.
+	require.NoError(t, cp.Update(func(txn *Txn) error {
+		return txn.Delete(key(0))
+	}))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get(key(0))
+		return err
+	}))
+}
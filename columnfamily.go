@@ -0,0 +1,553 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+var (
+	cfPrefix = []byte("!badger!cf!") // Prefix for the keys of all the column families.
+	cfsKey   = []byte("!badger!cfs") // For storing the definitions of column families.
+)
+
+// cfPrefixLen is the length of the prefix of the keys of a single column family. The prefix is
+// cfPrefix followed by the big endian ID of the column family.
+var cfPrefixLen = len(cfPrefix) + 4
+
+// CFOptions are the options of a column family. They override the corresponding DB options for
+// the keys of the column family.
+type CFOptions struct {
+	// Compression is the compression used for the tables holding the keys of the column family.
+	// Tables in level zero are shared by all the column families and use the DB compression.
+	Compression options.CompressionType
+	// NumVersionsToKeep is the number of versions of a key kept by compactions.
+	NumVersionsToKeep int
+	// ValueThreshold is the size of the smallest value which is stored in the value log.
+	ValueThreshold int
+}
+
+// DefaultCFOptions returns the options of a column family which behaves like the rest of a DB
+// opened with opt.
+func DefaultCFOptions(opt Options) CFOptions {
+	return CFOptions{
+		Compression:       opt.Compression,
+		NumVersionsToKeep: opt.NumVersionsToKeep,
+		ValueThreshold:    opt.ValueThreshold,
+	}
+}
+
+// WithCompression returns a new CFOptions value with Compression set to the given value.
+func (opt CFOptions) WithCompression(cType options.CompressionType) CFOptions {
+	opt.Compression = cType
+	return opt
+}
+
+// WithNumVersionsToKeep returns a new CFOptions value with NumVersionsToKeep set to the given
+// value.
+func (opt CFOptions) WithNumVersionsToKeep(val int) CFOptions {
+	opt.NumVersionsToKeep = val
+	return opt
+}
+
+// WithValueThreshold returns a new CFOptions value with ValueThreshold set to the given value.
+func (opt CFOptions) WithValueThreshold(val int) CFOptions {
+	opt.ValueThreshold = val
+	return opt
+}
+
+// ColumnFamily is a named keyspace within a DB, with its own options. Keys of a column family
+// are only visible through the Txn methods which take the column family, and a single
+// transaction can write to any number of column families atomically.
+type ColumnFamily struct {
+	name    string
+	id      uint32
+	prefix  []byte
+	opt     CFOptions
+	dropped int32 // Accessed atomically.
+}
+
+// Name returns the name of the column family.
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// Options returns the options of the column family.
+func (cf *ColumnFamily) Options() CFOptions {
+	return cf.opt
+}
+
+func (cf *ColumnFamily) isDropped() bool {
+	return atomic.LoadInt32(&cf.dropped) == 1
+}
+
+// key returns the internal key for the given key of the column family.
+func (cf *ColumnFamily) key(key []byte) []byte {
+	out := make([]byte, 0, len(cf.prefix)+len(key))
+	return append(append(out, cf.prefix...), key...)
+}
+
+// upperBound returns a key bigger than all the keys of the column family.
+func (cf *ColumnFamily) upperBound() []byte {
+	return cfKeyPrefix(cf.id + 1)
+}
+
+func cfKeyPrefix(id uint32) []byte {
+	out := make([]byte, cfPrefixLen)
+	copy(out, cfPrefix)
+	binary.BigEndian.PutUint32(out[len(cfPrefix):], id)
+	return out
+}
+
+// cfID returns the ID of the column family the key belongs to. The key may or may not contain
+// the version.
+func cfID(key []byte) (uint32, bool) {
+	if len(key) < cfPrefixLen || !bytes.HasPrefix(key, cfPrefix) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(key[len(cfPrefix):cfPrefixLen]), true
+}
+
+// isCFKey returns true if the key belongs to a column family. The key may or may not contain the
+// version.
+func isCFKey(key []byte) bool {
+	return bytes.HasPrefix(key, cfPrefix)
+}
+
+// isInternalKey returns true if the key is used by badger for its own purposes. The keys of the
+// column families are under badgerPrefix as well, but they hold user data.
+func isInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, badgerPrefix) && !isCFKey(key)
+}
+
+// cfDef is the persisted definition of a column family.
+type cfDef struct {
+	Name              string
+	ID                uint32
+	Compression       options.CompressionType
+	NumVersionsToKeep int
+	ValueThreshold    int
+}
+
+func (def cfDef) options() CFOptions {
+	return CFOptions{
+		Compression:       def.Compression,
+		NumVersionsToKeep: def.NumVersionsToKeep,
+		ValueThreshold:    def.ValueThreshold,
+	}
+}
+
+type cfDefs struct {
+	NextID   uint32
+	Families []cfDef
+}
+
+// columnFamilies is the registry of the column families of a DB.
+type columnFamilies struct {
+	sync.RWMutex
+	byName  map[string]*ColumnFamily
+	byID    map[uint32]*ColumnFamily
+	dropped map[uint32]struct{}
+	nextID  uint32
+
+	// updateLock serializes creating and dropping column families. It is separate from the
+	// RWMutex because writes look up the column families while the definitions are persisted.
+	updateLock sync.Mutex
+}
+
+func (c *columnFamilies) get(key []byte) *ColumnFamily {
+	id, ok := cfID(key)
+	if !ok {
+		return nil
+	}
+	c.RLock()
+	defer c.RUnlock()
+	return c.byID[id]
+}
+
+// isDropped returns true if the key belongs to a column family which has been dropped.
+func (c *columnFamilies) isDropped(key []byte) bool {
+	id, ok := cfID(key)
+	if !ok {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	_, ok = c.dropped[id]
+	return ok
+}
+
+// defs returns the definitions of the live column families, sorted by ID.
+func (c *columnFamilies) defs() cfDefs {
+	c.RLock()
+	defer c.RUnlock()
+	defs := cfDefs{NextID: c.nextID}
+	for _, cf := range c.byID {
+		defs.Families = append(defs.Families, cfDef{
+			Name:              cf.name,
+			ID:                cf.id,
+			Compression:       cf.opt.Compression,
+			NumVersionsToKeep: cf.opt.NumVersionsToKeep,
+			ValueThreshold:    cf.opt.ValueThreshold,
+		})
+	}
+	sort.Slice(defs.Families, func(i, j int) bool {
+		return defs.Families[i].ID < defs.Families[j].ID
+	})
+	return defs
+}
+
+// numVersionsToKeep returns the number of versions of the key compactions should keep.
+func (db *DB) numVersionsToKeep(key []byte) int {
+	if cf := db.cfs.get(key); cf != nil {
+		return cf.opt.NumVersionsToKeep
+	}
+	return db.opt.NumVersionsToKeep
+}
+
+// valueThreshold returns the size of the smallest value for the key stored in the value log.
+func (db *DB) valueThreshold(key []byte) int {
+	if db.opt.InMemory {
+		return db.opt.ValueThreshold
+	}
+	if cf := db.cfs.get(key); cf != nil {
+		return cf.opt.ValueThreshold
+	}
+	return db.opt.ValueThreshold
+}
+
+// loadColumnFamilies reads the column family definitions stored in the LSM tree, skipping the ones
+// dropped as per the manifest. It must be called after the value log has been replayed.
+func (db *DB) loadColumnFamilies(dropped map[uint32]struct{}) error {
+	c := &db.cfs
+	c.Lock()
+	defer c.Unlock()
+	c.byName = make(map[string]*ColumnFamily)
+	c.byID = make(map[uint32]*ColumnFamily)
+	c.dropped = make(map[uint32]struct{})
+	c.nextID = 1
+	for id := range dropped {
+		c.dropped[id] = struct{}{}
+		if id >= c.nextID {
+			c.nextID = id + 1
+		}
+	}
+
+	vs, err := db.get(y.KeyWithTs(cfsKey, math.MaxUint64))
+	if err != nil {
+		return err
+	}
+	if vs.Meta == 0 && len(vs.Value) == 0 {
+		return nil
+	}
+	val := vs.Value
+	if vs.Meta&bitValuePointer > 0 {
+		var vp valuePointer
+		vp.Decode(val)
+		result, cb, err := db.vlog.Read(vp, new(y.Slice))
+		val = y.SafeCopy(nil, result)
+		runCallback(cb)
+		if err != nil {
+			return err
+		}
+	}
+
+	var defs cfDefs
+	if err := json.Unmarshal(val, &defs); err != nil {
+		return errors.Wrapf(err, "failed to unmarshal column families")
+	}
+	if defs.NextID > c.nextID {
+		c.nextID = defs.NextID
+	}
+	for _, def := range defs.Families {
+		if _, ok := c.dropped[def.ID]; ok {
+			continue
+		}
+		cf := &ColumnFamily{
+			name:   def.Name,
+			id:     def.ID,
+			prefix: cfKeyPrefix(def.ID),
+			opt:    def.options(),
+		}
+		c.byName[cf.name] = cf
+		c.byID[cf.id] = cf
+	}
+	return nil
+}
+
+// persistColumnFamilies writes the definitions of the live column families to the LSM tree. It
+// must be called with updateLock held.
+func (db *DB) persistColumnFamilies() error {
+	buf, err := json.Marshal(db.cfs.defs())
+	if err != nil {
+		return err
+	}
+	// Like the discard stats, the definitions are always written at version 1, so that they are
+	// visible irrespective of the read timestamp, and the latest write shadows the older ones.
+	req, err := db.sendToWriteCh([]*Entry{{Key: y.KeyWithTs(cfsKey, 1), Value: buf}})
+	if err != nil {
+		return errors.Wrapf(err, "failed to push column families to write channel")
+	}
+	return req.Wait()
+}
+
+func (db *DB) checkCFOptions(opt CFOptions) error {
+	switch {
+	case opt.NumVersionsToKeep < 1:
+		return errors.New("NumVersionsToKeep of a column family must be at least 1")
+	case opt.ValueThreshold > maxValueThreshold:
+		return errors.Errorf("Invalid ValueThreshold, must be less or equal to %d",
+			maxValueThreshold)
+	case int64(opt.ValueThreshold) > db.opt.maxBatchSize:
+		return errors.Errorf("Valuethreshold greater than max batch size of %d.",
+			db.opt.maxBatchSize)
+	case opt.Compression == options.ZSTD && !y.CgoEnabled:
+		return y.ErrZstdCgo
+	case opt.Compression != options.None && db.opt.BlockCacheSize == 0:
+		return errors.New("BlockCacheSize should be set since compression is enabled")
+	}
+	return nil
+}
+
+// CreateColumnFamily creates a new column family with the given name and options. The column
+// family is persisted and can be looked up via GetColumnFamily after the DB is reopened.
+func (db *DB) CreateColumnFamily(name string, opt CFOptions) (*ColumnFamily, error) {
+	if db.opt.ReadOnly {
+		return nil, ErrReadOnlyTxn
+	}
+	if len(name) == 0 {
+		return nil, errors.New("Column family name cannot be empty")
+	}
+	if err := db.checkCFOptions(opt); err != nil {
+		return nil, err
+	}
+
+	c := &db.cfs
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	c.Lock()
+	if _, ok := c.byName[name]; ok {
+		c.Unlock()
+		return nil, ErrColumnFamilyExists
+	}
+	cf := &ColumnFamily{
+		name:   name,
+		id:     c.nextID,
+		prefix: cfKeyPrefix(c.nextID),
+		opt:    opt,
+	}
+	c.nextID++
+	c.byName[name] = cf
+	c.byID[cf.id] = cf
+	c.Unlock()
+
+	if err := db.persistColumnFamilies(); err != nil {
+		c.Lock()
+		delete(c.byName, name)
+		delete(c.byID, cf.id)
+		c.Unlock()
+		return nil, err
+	}
+	return cf, nil
+}
+
+// importColumnFamilies creates the column families of another DB which this DB doesn't have,
+// matching them by name. It returns the IDs of the column families in this DB, keyed by their IDs
+// in the other DB.
+func (db *DB) importColumnFamilies(defs []cfDef) (map[uint32]uint32, error) {
+	ids := make(map[uint32]uint32, len(defs))
+	for _, def := range defs {
+		cf, err := db.GetColumnFamily(def.Name)
+		if err == ErrColumnFamilyNotFound {
+			cf, err = db.CreateColumnFamily(def.Name, def.options())
+		}
+		if err == ErrColumnFamilyExists {
+			cf, err = db.GetColumnFamily(def.Name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "while importing column family %q", def.Name)
+		}
+		ids[def.ID] = cf.id
+	}
+	return ids, nil
+}
+
+// remapCFKey rewrites in place the column family of the key, which comes from another DB, as per
+// the IDs returned by importColumnFamilies. Keys which don't belong to a column family are left
+// as they are.
+func remapCFKey(ids map[uint32]uint32, key []byte) error {
+	id, ok := cfID(key)
+	if !ok {
+		return nil
+	}
+	newID, ok := ids[id]
+	if !ok {
+		return errors.Errorf("Key %q belongs to an unknown column family", key)
+	}
+	binary.BigEndian.PutUint32(key[len(cfPrefix):cfPrefixLen], newID)
+	return nil
+}
+
+// GetColumnFamily returns the column family with the given name.
+func (db *DB) GetColumnFamily(name string) (*ColumnFamily, error) {
+	db.cfs.RLock()
+	defer db.cfs.RUnlock()
+	cf, ok := db.cfs.byName[name]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return cf, nil
+}
+
+// DropColumnFamily drops the column family with the given name, along with all its keys. The drop
+// is recorded in the MANIFEST and takes effect immediately, without blocking writes. The keys of
+// the column family are removed from disk lazily, by the compactions which come across them.
+func (db *DB) DropColumnFamily(name string) error {
+	if db.opt.ReadOnly {
+		return ErrReadOnlyTxn
+	}
+	c := &db.cfs
+	c.updateLock.Lock()
+	defer c.updateLock.Unlock()
+
+	cf, err := db.GetColumnFamily(name)
+	if err != nil {
+		return err
+	}
+	if err := db.manifest.addChanges([]*pb.ManifestChange{
+		newDropColumnFamilyChange(cf.id),
+	}); err != nil {
+		return err
+	}
+
+	c.Lock()
+	atomic.StoreInt32(&cf.dropped, 1)
+	delete(c.byName, cf.name)
+	delete(c.byID, cf.id)
+	c.dropped[cf.id] = struct{}{}
+	c.Unlock()
+
+	// Even if this fails, the column family stays dropped because of the MANIFEST entry.
+	return db.persistColumnFamilies()
+}
+
+// SetCF adds a key-value pair to the column family. See Txn.Set.
+func (txn *Txn) SetCF(cf *ColumnFamily, key, val []byte) error {
+	return txn.SetEntryCF(cf, NewEntry(key, val))
+}
+
+// SetEntryCF adds the entry to the column family. See Txn.SetEntry.
+func (txn *Txn) SetEntryCF(cf *ColumnFamily, e *Entry) error {
+	if cf.isDropped() {
+		return ErrColumnFamilyDropped
+	}
+	if len(e.Key) == 0 {
+		return ErrEmptyKey
+	}
+	ne := *e
+	ne.Key = cf.key(e.Key)
+	return txn.modifyEntry(&ne, true)
+}
+
+// DeleteCF deletes a key from the column family. See Txn.Delete.
+func (txn *Txn) DeleteCF(cf *ColumnFamily, key []byte) error {
+	if cf.isDropped() {
+		return ErrColumnFamilyDropped
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	e := &Entry{
+		Key:  cf.key(key),
+		meta: bitDelete,
+	}
+	return txn.modifyEntry(e, true)
+}
+
+// GetCF looks for the key in the column family. See Txn.Get.
+func (txn *Txn) GetCF(cf *ColumnFamily, key []byte) (*Item, error) {
+	if cf.isDropped() {
+		return nil, ErrColumnFamilyDropped
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	item, err := txn.Get(cf.key(key))
+	if err != nil {
+		return nil, err
+	}
+	item.key = key
+	return item, nil
+}
+
+// NewIteratorCF returns a new iterator over the keys of the column family. The keys returned by
+// the iterator, and the keys passed to Seek and IteratorOptions.Prefix, don't include any prefix
+// used internally for the column family. See Txn.NewIterator.
+func (txn *Txn) NewIteratorCF(cf *ColumnFamily, opt IteratorOptions) *Iterator {
+	if cf.isDropped() {
+		panic(ErrColumnFamilyDropped.Error())
+	}
+	prefix := opt.Prefix
+	opt.Prefix = cf.key(opt.Prefix)
+	opt.InternalAccess = true
+	it := txn.NewIterator(opt)
+	it.iitr = &prefixIterator{Iterator: it.iitr, prefix: cf.prefix}
+	it.opt.Prefix = prefix
+	it.cf = cf
+	return it
+}
+
+// prefixIterator is a y.Iterator which is only valid over the keys with the given prefix.
+type prefixIterator struct {
+	y.Iterator
+	prefix []byte
+}
+
+func (pi *prefixIterator) Valid() bool {
+	return pi.Iterator.Valid() && bytes.HasPrefix(pi.Key(), pi.prefix)
+}
+
+// userKey strips the column family prefix from the key, if the iterator is over a column family.
+func (it *Iterator) userKey(key []byte) []byte {
+	if it.cf == nil {
+		return key
+	}
+	return key[len(it.cf.prefix):]
+}
+
+// cfSeekKey returns the internal key to seek to for the given key of the column family.
+func (it *Iterator) cfSeekKey(key []byte) []byte {
+	if len(key) == 0 {
+		key = it.opt.Prefix
+	}
+	if len(key) == 0 && it.opt.Reverse {
+		return it.cf.upperBound()
+	}
+	return it.cf.key(key)
+}
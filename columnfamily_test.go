@@ -0,0 +1,267 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/stretchr/testify/require"
+)
+
+func iterateCF(t *testing.T, txn *Txn, cf *ColumnFamily, reverse bool) []string {
+	opt := DefaultIteratorOptions
+	opt.Reverse = reverse
+	it := txn.NewIteratorCF(cf, opt)
+	defer it.Close()
+
+	var out []string
+	for it.Rewind(); it.Valid(); it.Next() {
+		val, err := it.Item().ValueCopy(nil)
+		require.NoError(t, err)
+		out = append(out, fmt.Sprintf("%s=%s", it.Item().Key(), val))
+	}
+	return out
+}
+
+func TestColumnFamily(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		users, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		orders, err := db.CreateColumnFamily("orders", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		_, err = db.CreateColumnFamily("users", DefaultCFOptions(db.opt))
+		require.Equal(t, ErrColumnFamilyExists, err)
+		_, err = db.GetColumnFamily("missing")
+		require.Equal(t, ErrColumnFamilyNotFound, err)
+
+		// A single transaction writes to all the keyspaces atomically.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("a"), []byte("default")))
+			require.NoError(t, txn.SetCF(users, []byte("a"), []byte("alice")))
+			require.NoError(t, txn.SetCF(users, []byte("b"), []byte("bob")))
+			require.NoError(t, txn.SetCF(users, []byte("c"), []byte("carol")))
+			return txn.SetCF(orders, []byte("a"), []byte("1"))
+		}))
+
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			item, err := txn.GetCF(users, []byte("a"))
+			require.NoError(t, err)
+			require.Equal(t, []byte("a"), item.Key())
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, []byte("alice"), val)
+
+			require.NoError(t, txn.DeleteCF(users, []byte("c")))
+			_, err = txn.GetCF(users, []byte("c"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn.GetCF(orders, []byte("b"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			require.Equal(t, []string{"a=alice", "b=bob"}, iterateCF(t, txn, users, false))
+			require.Equal(t, []string{"b=bob", "a=alice"}, iterateCF(t, txn, users, true))
+			require.Equal(t, []string{"a=1"}, iterateCF(t, txn, orders, false))
+			require.Equal(t, []string{"a=1"}, iterateCF(t, txn, orders, true))
+
+			// The keys of the column families aren't visible in the default keyspace.
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			var keys []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Item().Key()))
+			}
+			require.Equal(t, []string{"a"}, keys)
+			return nil
+		}))
+
+		require.NoError(t, db.DropColumnFamily("users"))
+		require.Equal(t, ErrColumnFamilyNotFound, db.DropColumnFamily("users"))
+		_, err = db.GetColumnFamily("users")
+		require.Equal(t, ErrColumnFamilyNotFound, err)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.GetCF(users, []byte("a"))
+			require.Equal(t, ErrColumnFamilyDropped, err)
+			return nil
+		}))
+		require.Equal(t, ErrColumnFamilyDropped, db.Update(func(txn *Txn) error {
+			return txn.SetCF(users, []byte("d"), []byte("dave"))
+		}))
+	})
+}
+
+func TestColumnFamilyReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	users, err := db.CreateColumnFamily("users",
+		DefaultCFOptions(opt).WithNumVersionsToKeep(3).WithValueThreshold(16))
+	require.NoError(t, err)
+	orders, err := db.CreateColumnFamily("orders", DefaultCFOptions(opt))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetCF(users, []byte("a"), []byte("alice")))
+		return txn.SetCF(orders, []byte("a"), []byte("1"))
+	}))
+	require.NoError(t, db.DropColumnFamily("orders"))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+
+	users, err = db.GetColumnFamily("users")
+	require.NoError(t, err)
+	require.Equal(t, 3, users.Options().NumVersionsToKeep)
+	require.Equal(t, 16, users.Options().ValueThreshold)
+	_, err = db.GetColumnFamily("orders")
+	require.Equal(t, ErrColumnFamilyNotFound, err)
+
+	// The ID of the dropped column family isn't reused.
+	events, err := db.CreateColumnFamily("events", DefaultCFOptions(opt))
+	require.NoError(t, err)
+	require.True(t, events.id > orders.id)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		require.Equal(t, []string{"a=alice"}, iterateCF(t, txn, users, false))
+		require.Empty(t, iterateCF(t, txn, events, false))
+		return nil
+	}))
+}
+
+func TestCompactionColumnFamily(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		users, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt).WithNumVersionsToKeep(2))
+		require.NoError(t, err)
+		orders, err := db.CreateColumnFamily("orders", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		userKey, orderKey := string(users.key([]byte("a"))), string(orders.key([]byte("a")))
+
+		// Keys of column families sort before the rest of the keys.
+		l0 := []keyValVersion{
+			{userKey, "alice3", 3, 0}, {orderKey, "3", 3, 0}, {"foo", "bar", 3, 0},
+		}
+		l1 := []keyValVersion{
+			{userKey, "alice2", 2, 0}, {userKey, "alice1", 1, 0},
+			{orderKey, "2", 2, 0}, {orderKey, "1", 1, 0},
+			{"foo", "bar", 2, 0}, {"foo", "bar", 1, 0},
+		}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l1, 1)
+		require.NoError(t, db.DropColumnFamily("orders"))
+
+		db.SetDiscardTs(10)
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		// The dropped column family is gone, and the other one keeps two versions.
+		var keys []string
+		for _, tbl := range db.lc.levels[1].tables {
+			it := tbl.NewIterator(0)
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, fmt.Sprintf("%s@%d", y.ParseKey(it.Key()), y.ParseTs(it.Key())))
+			}
+			require.NoError(t, it.Close())
+		}
+		require.Equal(t, []string{userKey + "@3", userKey + "@2", "foo@3"}, keys)
+		// Every column family gets tables of its own.
+		require.Len(t, db.lc.levels[1].tables, 2)
+	})
+}
+
+func TestColumnFamilyBackup(t *testing.T) {
+	var buf bytes.Buffer
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		users, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt).WithNumVersionsToKeep(3))
+		require.NoError(t, err)
+		orders, err := db.CreateColumnFamily("orders", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("a"), []byte("default")))
+			require.NoError(t, txn.SetCF(users, []byte("a"), []byte("alice")))
+			return txn.SetCF(orders, []byte("a"), []byte("1"))
+		}))
+		require.NoError(t, db.DropColumnFamily("orders"))
+		_, err = db.Backup(&buf, 0)
+		require.NoError(t, err)
+	})
+
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		// The column family gets another ID in this DB.
+		events, err := db.CreateColumnFamily("events", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		require.NoError(t, db.Load(&buf, 16))
+
+		users, err := db.GetColumnFamily("users")
+		require.NoError(t, err)
+		require.Equal(t, 3, users.Options().NumVersionsToKeep)
+		_, err = db.GetColumnFamily("orders")
+		require.Equal(t, ErrColumnFamilyNotFound, err)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			require.Equal(t, []string{"a=alice"}, iterateCF(t, txn, users, false))
+			require.Empty(t, iterateCF(t, txn, events, false))
+			item, err := txn.Get([]byte("a"))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, []byte("default"), val)
+			return nil
+		}))
+	})
+}
+
+func TestDeleteRangeColumnFamily(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		users, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt))
+		require.NoError(t, err)
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			for _, k := range []string{"a", "b", "c"} {
+				require.NoError(t, txn.Set([]byte(k), []byte(k)))
+				require.NoError(t, txn.SetCF(users, []byte(k), []byte(k)))
+			}
+			return nil
+		}))
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.Equal(t, ErrInvalidRange, txn.DeleteRangeCF(users, []byte("c"), []byte("a")))
+			return txn.DeleteRangeCF(users, []byte("a"), []byte("c"))
+		}))
+		require.NoError(t, db.View(func(txn *Txn) error {
+			require.Equal(t, []string{"c=c"}, iterateCF(t, txn, users, false))
+			_, err := txn.GetCF(users, []byte("a"))
+			require.Equal(t, ErrKeyNotFound, err)
+			for _, k := range []string{"a", "b", "c"} {
+				_, err := txn.Get([]byte(k))
+				require.NoError(t, err)
+			}
+			return nil
+		}))
+	})
+}
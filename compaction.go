@@ -152,7 +152,7 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 
 	y.AssertTruef(level < len(cs.levels)-1, "Got level %d. Max levels: %d", level, len(cs.levels))
 	thisLevel := cs.levels[level]
-	nextLevel := cs.levels[level+1]
+	nextLevel := cs.levels[cd.nextLevel.level]
 
 	if thisLevel.overlapsWith(cd.thisRange) {
 		return false
@@ -160,6 +160,13 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 	if nextLevel.overlapsWith(cd.nextRange) {
 		return false
 	}
+	// The levels in between are merged whole, and no other compaction may write to them meanwhile,
+	// even if they're empty.
+	for l := level + 1; l < cd.nextLevel.level; l++ {
+		if cs.levels[l].overlapsWith(infRange) {
+			return false
+		}
+	}
 	// Check whether this level really needs compaction or not. Otherwise, we'll end up
 	// running parallel compactions for the same level.
 	// Update: We should not be checking size here. Compaction priority already did the size checks.
@@ -167,6 +174,9 @@ func (cs *compactStatus) compareAndAdd(_ thisAndNextLevelRLocked, cd compactDef)
 
 	thisLevel.ranges = append(thisLevel.ranges, cd.thisRange)
 	nextLevel.ranges = append(nextLevel.ranges, cd.nextRange)
+	for l := level + 1; l < cd.nextLevel.level; l++ {
+		cs.levels[l].ranges = append(cs.levels[l].ranges, infRange)
+	}
 	thisLevel.delSize += cd.thisSize
 	return true
 }
@@ -179,11 +189,14 @@ func (cs *compactStatus) delete(cd compactDef) {
 	y.AssertTruef(level < len(cs.levels)-1, "Got level %d. Max levels: %d", level, len(cs.levels))
 
 	thisLevel := cs.levels[level]
-	nextLevel := cs.levels[level+1]
+	nextLevel := cs.levels[cd.nextLevel.level]
 
 	thisLevel.delSize -= cd.thisSize
 	found := thisLevel.remove(cd.thisRange)
 	found = nextLevel.remove(cd.nextRange) && found
+	for l := level + 1; l < cd.nextLevel.level; l++ {
+		found = cs.levels[l].remove(infRange) && found
+	}
 
 	if !found {
 		this := cd.thisRange
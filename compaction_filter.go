@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"github.com/dgraph-io/badger/v2/y"
+)
+
+// CompactionDecision is the decision of a CompactionFilter about a version of a key.
+type CompactionDecision int
+
+const (
+	// CompactionKeep keeps the version as it is.
+	CompactionKeep CompactionDecision = iota
+	// CompactionDrop drops the version, along with the older versions of the key.
+	CompactionDrop
+	// CompactionRewrite replaces the value of the version with the one returned by the filter. The
+	// new value is stored in the LSM tree, whatever its size.
+	CompactionRewrite
+)
+
+// CompactionFilter decides which versions of the keys are kept by the compactions, see
+// Options.CompactionFilter.
+//
+// The filter is only called with the versions at or below the discard timestamp which the
+// compactions would otherwise keep, and never with the deleted or expired ones, the internal keys
+// or the keys of the column families. The transactions reading above the discard timestamp keep
+// seeing the versions above it as they were, but they see the decisions about the latest version
+// at or below it once the compaction is done. So the filter should only drop or rewrite the
+// versions which the application already treats as dead, and its decisions should not change
+// over time.
+type CompactionFilter interface {
+	// Filter returns the decision about the version of the key, along with the new value if it is
+	// CompactionRewrite. vs holds the user meta and the expiry of the version, and its value if it
+	// is stored in the LSM tree. vs.Value is nil if the value is stored in the value log, or in
+	// chunks by Txn.SetStream. Filter must not modify key or vs, and may be called concurrently by
+	// several compactions.
+	Filter(key []byte, version uint64, vs y.ValueStruct) (CompactionDecision, []byte)
+}
+
+// CompactionFilterFunc is an adapter to use a function as a CompactionFilter.
+type CompactionFilterFunc func(key []byte, version uint64, vs y.ValueStruct) (
+	CompactionDecision, []byte)
+
+// Filter calls f(key, version, vs).
+func (f CompactionFilterFunc) Filter(key []byte, version uint64, vs y.ValueStruct) (
+	CompactionDecision, []byte) {
+	return f(key, version, vs)
+}
+
+// filterVersion applies the CompactionFilter to the version of the key with timestamp. It returns
+// the decision of the filter, and the value struct to store instead of vs if the version is
+// rewritten, or dropped. A dropped version is replaced by a deletion marker, which is needed if
+// the lower levels hold older versions of the key.
+func (db *DB) filterVersion(key []byte, version uint64, vs y.ValueStruct) (
+	CompactionDecision, y.ValueStruct) {
+	filter := db.opt.CompactionFilter
+	// The keys of the column families are left alone too, as the filter can't tell them apart
+	// from the keys of the DB.
+	if filter == nil || isInternalKey(key) || isCFKey(key) {
+		return CompactionKeep, vs
+	}
+	arg := vs
+	if vs.Meta&bitValuePointer > 0 || isBlob(vs.Meta) {
+		arg.Value = nil
+	}
+	decision, value := filter.Filter(y.ParseKey(key), version, arg)
+	switch decision {
+	case CompactionDrop:
+		return decision, y.ValueStruct{Meta: bitDelete, UserMeta: vs.UserMeta}
+	case CompactionRewrite:
+		vs.Meta &^= bitValuePointer | bitBlob
+		vs.Value = value
+		return decision, vs
+	default:
+		return CompactionKeep, vs
+	}
+}
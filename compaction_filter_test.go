@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactionFilter(t *testing.T) {
+	var mu sync.Mutex
+	var filtered []string
+	filter := func(key []byte, version uint64, vs y.ValueStruct) (CompactionDecision, []byte) {
+		mu.Lock()
+		filtered = append(filtered, fmt.Sprintf("%s@%d", key, version))
+		mu.Unlock()
+		switch {
+		case strings.HasPrefix(string(vs.Value), "dead"):
+			return CompactionDrop, nil
+		case string(vs.Value) == "old":
+			return CompactionRewrite, []byte("new")
+		}
+		return CompactionKeep, nil
+	}
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1).
+		WithCompactionFilter(CompactionFilterFunc(filter))
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l0 := []keyValVersion{
+			{"a", "dead", 3, 0}, {"b", "old", 3, 0}, {"c", "dead", 11, 0}, {"d", "x", 3, 0},
+		}
+		l1 := []keyValVersion{
+			{"a", "a2", 2, 0}, {"b", "b2", 2, 0}, {"c", "c2", 2, 0}, {"d", "dead", 2, 0},
+			{"e", "dead", 1, bitDelete},
+		}
+		// The lower levels hold an older version of a, which must not come back.
+		l2 := []keyValVersion{{"a", "a1", 1, 0}}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l1, 1)
+		createAndOpen(db, l2, 2)
+
+		db.SetDiscardTs(10)
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		var keys []string
+		for _, tbl := range db.lc.levels[1].tables {
+			it := tbl.NewIterator(0)
+			for it.Rewind(); it.Valid(); it.Next() {
+				vs := it.Value()
+				key := fmt.Sprintf("%s@%d=%s", y.ParseKey(it.Key()), y.ParseTs(it.Key()), vs.Value)
+				if vs.Meta&bitDelete > 0 {
+					key += " (deleted)"
+				}
+				keys = append(keys, key)
+			}
+			require.NoError(t, it.Close())
+		}
+		// The versions above the discard timestamp, the versions not kept and the deleted ones
+		// are not filtered.
+		require.Equal(t, []string{"a@3", "b@3", "c@2", "d@3"}, filtered)
+		require.Equal(t, []string{
+			"a@3= (deleted)", "b@3=new", "c@11=dead", "c@2=c2", "d@3=x", "e@1=dead (deleted)",
+		}, keys)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("a"))
+			require.Equal(t, ErrKeyNotFound, err)
+			return nil
+		}))
+	})
+}
@@ -0,0 +1,424 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// compactionStrategy decides which compactions are run, see Options.CompactionStyle.
+type compactionStrategy interface {
+	// pick returns the compactions which the compactor with the given id should try, the most
+	// urgent first.
+	pick(id int) []compactionPriority
+	// fill picks the tables of the compaction p into cd, and adds them to the compaction status.
+	// It returns false if the compaction can't run now.
+	fill(p compactionPriority, cd *compactDef) bool
+	// flatten returns the next compaction run by DB.Flatten, given the levels holding tables, or
+	// false once the tables are in a single level.
+	flatten(levels []int) (compactionPriority, bool)
+}
+
+func newCompactionStrategy(s *levelsController) compactionStrategy {
+	leveled := leveledCompaction{s: s}
+	switch s.kv.opt.CompactionStyle {
+	case options.UniversalCompaction:
+		return universalCompaction{leveled}
+	case options.FIFOCompaction:
+		return fifoCompaction{leveled}
+	default:
+		return leveled
+	}
+}
+
+// leveledCompaction is the compactionStrategy of options.LeveledCompaction.
+type leveledCompaction struct {
+	s *levelsController
+}
+
+func (c leveledCompaction) pick(id int) []compactionPriority {
+	var prios []compactionPriority
+	for _, p := range c.s.pickCompactLevels() {
+		if id == 0 && p.level > 1 {
+			// If I'm ID zero, I only compact L0 and L1.
+			continue
+		}
+		if id != 0 && p.level <= 1 {
+			// If I'm ID non-zero, I do NOT compact L0 and L1.
+			continue
+		}
+		prios = append(prios, p)
+	}
+	return prios
+}
+
+func (c leveledCompaction) fill(p compactionPriority, cd *compactDef) bool {
+	if p.level == 0 {
+		return c.s.fillTablesL0(cd)
+	}
+	return c.s.fillTables(cd)
+}
+
+func (c leveledCompaction) flatten(levels []int) (compactionPriority, bool) {
+	if len(levels) <= 1 {
+		prios := c.s.pickCompactLevels()
+		if len(prios) == 0 || prios[0].score <= 1.0 {
+			return compactionPriority{}, false
+		}
+		return prios[0], true
+	}
+	// Create an artificial compaction priority, to ensure that we compact the level.
+	return compactionPriority{level: levels[0], score: 1.71}, true
+}
+
+const (
+	// A universal compaction merges the newest sorted runs as long as the size of the next one is
+	// within universalSizeRatio percent of their total size.
+	universalSizeRatio = 1
+	// A universal compaction merges all the sorted runs once the newer ones take more than
+	// universalMaxSizeAmplification percent of the size of the oldest one.
+	universalMaxSizeAmplification = 200
+)
+
+// universalCompaction is the compactionStrategy of options.UniversalCompaction.
+//
+// Every level below L0 holds a single sorted run, the newest runs in the upper levels, and every
+// table of L0 is a sorted run of its own. The level layout is the representation of the sorted
+// runs: nothing else is recorded in the manifest, which holds the levels of the tables as with
+// the other styles. A universal compaction merges the tables of some consecutive runs, the whole
+// levels holding them, into the deepest level above the next older run, so that the levels stay
+// in the order of the runs. The levels in between are part of the compaction, even if empty, so
+// that no other compaction writes to them meanwhile. Once the number of runs reaches
+// NumLevelZeroTables, the newest runs of similar sizes are merged together, or all of them if the
+// newer runs take too much space compared to the oldest one. The tables of L0 are always merged together.
+//
+// The compactions asked for by DB.DropPrefix and on close, which don't go through pick, merge the
+// tables of L0 into the overlapping tables of L1 as the leveled compaction does, which keeps every
+// level a single sorted run.
+type universalCompaction struct {
+	leveledCompaction
+}
+
+// sortedRun is a sorted run of the LSM tree, as seen by the universal compaction. The tables of L0
+// are seen as a single run, as they're always merged together.
+type sortedRun struct {
+	level int
+	size  int64
+}
+
+// sortedRuns returns the sorted runs of the LSM tree, the newest first, along with the number of
+// runs counting every table of L0 as a run.
+func (c universalCompaction) sortedRuns() ([]sortedRun, int) {
+	var runs []sortedRun
+	var numRuns int
+	for _, l := range c.s.levels {
+		l.RLock()
+		if len(l.tables) > 0 {
+			runs = append(runs, sortedRun{level: l.level, size: l.totalSize})
+			if l.level == 0 {
+				numRuns += len(l.tables)
+			} else {
+				numRuns++
+			}
+		}
+		l.RUnlock()
+	}
+	return runs, numRuns
+}
+
+func (c universalCompaction) pick(id int) []compactionPriority {
+	// The universal compactions merge whole levels, so they run one at a time.
+	if id != 0 {
+		return nil
+	}
+	for level := range c.s.levels {
+		if c.s.cstatus.overlapsWith(level, infRange) {
+			return nil
+		}
+	}
+	runs, numRuns := c.sortedRuns()
+	if numRuns < c.s.kv.opt.NumLevelZeroTables {
+		return nil
+	}
+	score := float64(numRuns) / float64(c.s.kv.opt.NumLevelZeroTables)
+
+	var newer int64
+	for _, r := range runs[:len(runs)-1] {
+		newer += r.size
+	}
+	if len(runs) > 1 && newer*100 >= runs[len(runs)-1].size*universalMaxSizeAmplification {
+		return []compactionPriority{c.merge(runs, len(runs), score)}
+	}
+
+	n, size := 1, runs[0].size
+	for n < len(runs) && runs[n].size*100 <= size*(100+universalSizeRatio) {
+		size += runs[n].size
+		n++
+	}
+	if n == 1 {
+		switch {
+		case runs[0].level == 0 && (len(runs) == 1 || runs[1].level > 1):
+			// Merge the tables of L0 into an empty level.
+		case len(runs) > 1:
+			n = 2
+		default:
+			return nil
+		}
+	}
+	return []compactionPriority{c.merge(runs, n, score)}
+}
+
+// merge returns the compaction merging the n newest runs.
+func (c universalCompaction) merge(runs []sortedRun, n int, score float64) compactionPriority {
+	next := len(c.s.levels) - 1
+	if n < len(runs) {
+		next = runs[n].level - 1
+	}
+	return compactionPriority{level: runs[0].level, nextLevel: next, score: score}
+}
+
+func (c universalCompaction) fill(p compactionPriority, cd *compactDef) bool {
+	if p.nextLevel == 0 {
+		return c.leveledCompaction.fill(p, cd)
+	}
+	levels := c.s.levels[p.level : p.nextLevel+1]
+	// Lock the levels in increasing order, like the reads.
+	for _, l := range levels {
+		l.RLock()
+	}
+	defer func() {
+		for _, l := range levels {
+			l.RUnlock()
+		}
+	}()
+
+	cd.nextLevel = c.s.levels[p.nextLevel]
+	cd.top = append([]*table.Table{}, cd.thisLevel.tables...)
+	if len(cd.top) == 0 {
+		return false
+	}
+	for _, l := range levels[1 : len(levels)-1] {
+		if len(l.tables) > 0 {
+			cd.mid = append(cd.mid, levelTables{l, append([]*table.Table{}, l.tables...)})
+		}
+	}
+	cd.bot = append([]*table.Table{}, cd.nextLevel.tables...)
+	cd.thisRange, cd.nextRange = infRange, infRange
+	cd.thisSize = cd.thisLevel.totalSize
+	return c.s.cstatus.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
+}
+
+func (c universalCompaction) flatten(levels []int) (compactionPriority, bool) {
+	if len(levels) == 0 || len(levels) == 1 && levels[0] > 0 {
+		return compactionPriority{}, false
+	}
+	// Merge all the sorted runs into the last level.
+	return compactionPriority{level: levels[0], nextLevel: len(c.s.levels) - 1, score: 1.71}, true
+}
+
+// fifoCompaction is the compactionStrategy of options.FIFOCompaction.
+//
+// The tables are deleted oldest first, those of the lowest level first and those of L0 last, so
+// that the older versions of a key never outlive the newer ones. The tables of a level below L0
+// hold a single version of a key, so they are deleted in any order. A table is deleted once the
+// max expiry recorded in its index has passed, or while the tables take more than
+// FIFOCompactionMaxSize. The newest table is always kept, as it holds the latest head of the
+// value log. The definitions of the column families and the range tombstones of a deleted table
+// are kept in a new table in its place, see dropTables.
+//
+// The compactions asked for by DB.DropPrefix, which don't go through pick, still merge the tables
+// of L0 into L1 as the leveled compaction does.
+type fifoCompaction struct {
+	leveledCompaction
+}
+
+func (c fifoCompaction) pick(id int) []compactionPriority {
+	if id != 0 {
+		return nil
+	}
+	var size int64
+	var numTables int
+	for _, l := range c.s.levels {
+		l.RLock()
+		size += l.totalSize
+		numTables += len(l.tables)
+		l.RUnlock()
+	}
+	maxSize := c.s.kv.opt.FIFOCompactionMaxSize
+	now := uint64(time.Now().Unix())
+
+	for i := len(c.s.levels) - 1; i >= 0; i-- {
+		l := c.s.levels[i]
+		l.RLock()
+		tables := append([]*table.Table{}, l.tables...)
+		l.RUnlock()
+
+		var drop []*table.Table
+		for _, t := range tables {
+			if numTables == 1 {
+				break
+			}
+			// The tables holding only the keys kept by fifoKeeps would be built again as they
+			// are. The keys between cfsKey and rangeDelPrefix are disposable.
+			if fifoKeeps(t.Smallest()) && fifoKeeps(t.Biggest()) {
+				numTables--
+				continue
+			}
+			// A max expiry of zero is unknown, as the table was built before it was recorded.
+			expiry := t.MaxExpiry()
+			if (expiry == 0 || expiry > now) && (maxSize == 0 || size <= maxSize) {
+				if i == 0 {
+					break
+				}
+				continue
+			}
+			drop = append(drop, t)
+			size -= t.Size()
+			numTables--
+		}
+		if len(drop) > 0 {
+			return []compactionPriority{{level: i, score: 1, drop: drop}}
+		}
+		if len(tables) > 0 {
+			// The tables of the upper levels are newer.
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c fifoCompaction) flatten(levels []int) (compactionPriority, bool) {
+	// The FIFO compactions never merge tables.
+	return compactionPriority{}, false
+}
+
+// fifoKeeps returns true if the FIFO compaction keeps the key when it drops the table holding it.
+// The definitions of the column families and the range tombstones aren't disposable, unlike the
+// other internal keys, and they may only be written once.
+func fifoKeeps(key []byte) bool {
+	key = y.ParseKey(key)
+	return bytes.Equal(key, cfsKey) || bytes.HasPrefix(key, rangeDelPrefix)
+}
+
+// dropTables deletes the tables of the FIFO compaction p without merging them, and adds the
+// values they point to to the discard stats of the value log, so that the value log GC reclaims
+// their files. The keys kept by fifoKeeps are moved, with their versions, to a new table which
+// takes the place of the dropped one in its level.
+func (s *levelsController) dropTables(id int, p compactionPriority) error {
+	timeStart := time.Now()
+	dk, err := s.kv.registry.latestDataKey()
+	if err != nil {
+		return y.Wrapf(err, "Error while retrieving datakey in levelsController.dropTables")
+	}
+	bopts := buildTableOptions(s.kv.opt)
+	bopts.DataKey = dk
+	bopts.BlockCache = s.kv.blockCache
+	bopts.IndexCache = s.kv.indexCache
+
+	discardStats := make(map[uint32]int64)
+	changes := make([]*pb.ManifestChange, 0, len(p.drop))
+	kept := make(map[uint64]*table.Table)
+	var newTables []*table.Table
+	for _, t := range p.drop {
+		var builder *table.Builder
+		it := t.NewIterator(table.NOCACHE)
+		for it.Rewind(); it.Valid(); it.Next() {
+			key, vs := it.Key(), it.Value()
+			if fifoKeeps(key) && (vs.Meta&bitRangeDelete == 0 || !s.dropRangeTombstone(key)) {
+				if builder == nil {
+					builder = table.NewTableBuilder(bopts)
+				}
+				var vp valuePointer
+				if vs.Meta&bitValuePointer > 0 {
+					vp.Decode(vs.Value)
+				}
+				builder.Add(key, vs, vp.Len)
+				continue
+			}
+			// We don't need to update the discard stats when badger is running in Disk-less
+			// mode.
+			if vs.Meta&bitValuePointer > 0 && !s.kv.opt.InMemory {
+				var vp valuePointer
+				vp.Decode(vs.Value)
+				discardStats[vp.Fid] += int64(vp.Len)
+			}
+		}
+		if err := it.Close(); err != nil {
+			return err
+		}
+		changes = append(changes, newDeleteChange(t.ID()))
+		if builder == nil {
+			continue
+		}
+		tbl, err := s.buildFIFOTable(builder, bopts)
+		if err != nil {
+			_ = decrRefs(newTables)
+			return err
+		}
+		newTables = append(newTables, tbl)
+		kept[t.ID()] = tbl
+		changes = append(changes, newCreateChange(tbl.ID(), p.level, tbl.KeyID(),
+			tbl.CompressionType()))
+	}
+	if len(newTables) > 0 && !s.kv.opt.InMemory {
+		if err := s.kv.syncDir(s.kv.opt.Dir); err != nil {
+			_ = decrRefs(newTables)
+			return err
+		}
+	}
+	// We write to the manifest _before_ we delete the files.
+	if err := s.kv.manifest.addChanges(changes); err != nil {
+		_ = decrRefs(newTables)
+		return err
+	}
+	if err := s.levels[p.level].swapTables(p.drop, kept); err != nil {
+		return err
+	}
+	if err := decrRefs(newTables); err != nil {
+		return err
+	}
+	s.kv.vlog.updateDiscardStats(discardStats)
+	s.kv.opt.Infof("[Compactor: %d] LOG FIFO drop at level %d, del %d tables, kept %d, took %v\n",
+		id, p.level, len(p.drop), len(newTables), time.Since(timeStart))
+	return nil
+}
+
+// buildFIFOTable finishes the builder of the keys kept by dropTables into a new table.
+func (s *levelsController) buildFIFOTable(
+	builder *table.Builder, bopts table.Options) (*table.Table, error) {
+	defer builder.Close()
+	fileID := s.reserveFileID()
+	if s.kv.opt.InMemory {
+		return table.OpenInMemoryTable(builder.Finish(true), fileID, &bopts)
+	}
+	fd, err := y.CreateSyncedFile(table.NewFilename(fileID, s.kv.opt.Dir), true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "While opening new table: %d", fileID)
+	}
+	if err := s.kv.ioLimiter.write(fd, builder.Finish(false), false); err != nil {
+		return nil, errors.Wrapf(err, "Unable to write to file: %d", fileID)
+	}
+	tbl, err := table.OpenTable(fd, bopts)
+	return tbl, errors.Wrapf(err, "Unable to open table: %q", fd.Name())
+}
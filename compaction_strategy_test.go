@@ -0,0 +1,408 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/options"
+	"github.com/stretchr/testify/require"
+)
+
+// levelsWithTables returns the levels of db holding tables.
+func levelsWithTables(db *DB) []int {
+	var levels []int
+	for _, l := range db.lc.levels {
+		if l.numTables() > 0 {
+			levels = append(levels, l.level)
+		}
+	}
+	return levels
+}
+
+// createRun is createAndOpen, keeping the size of the level up to date as the universal
+// compaction picks the runs by size.
+func createRun(db *DB, td []keyValVersion, level int) {
+	createAndOpen(db, td, level)
+	l := db.lc.levels[level]
+	l.Lock()
+	l.totalSize += l.tables[len(l.tables)-1].Size()
+	l.Unlock()
+}
+
+// bigRun returns n keys with large values, sorting after the keys used by the tests.
+func bigRun(n, version int) []keyValVersion {
+	var kvs []keyValVersion
+	for i := 0; i < n; i++ {
+		kvs = append(kvs, keyValVersion{fmt.Sprintf("z%03d", i), strings.Repeat("v", 1<<10),
+			version, 0})
+	}
+	return kvs
+}
+
+func TestUniversalCompaction(t *testing.T) {
+	// Disable the background compactions and keep a single version of each key.
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1).
+		WithNumLevelZeroTables(2).WithCompactionStyle(options.UniversalCompaction)
+	opt.managedTxns = true
+
+	t.Run("level 0 into an empty level", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createRun(db, []keyValVersion{{"a", "a2", 2, 0}}, 0)
+			createRun(db, []keyValVersion{{"b", "b3", 3, 0}}, 0)
+			big := bigRun(100, 1)
+			createRun(db, big, 6)
+			db.SetDiscardTs(10)
+
+			uc := db.lc.strategy.(universalCompaction)
+			require.Empty(t, uc.pick(1))
+			prios := uc.pick(0)
+			require.Equal(t, []compactionPriority{{level: 0, nextLevel: 5, score: 1.5}}, prios)
+
+			// The empty levels in between are taken by the compaction too.
+			cd := compactDef{thisLevel: db.lc.levels[0]}
+			require.True(t, uc.fill(prios[0], &cd))
+			for l := 1; l < 5; l++ {
+				require.True(t, db.lc.cstatus.overlapsWith(l, infRange), "level %d", l)
+			}
+			db.lc.cstatus.delete(cd)
+			for l := 1; l < 5; l++ {
+				require.False(t, db.lc.cstatus.overlapsWith(l, infRange), "level %d", l)
+			}
+			require.NoError(t, db.lc.doCompact(0, prios[0]))
+
+			require.Equal(t, []int{5, 6}, levelsWithTables(db))
+			getAllAndCheck(t, db, append([]keyValVersion{{"a", "a2", 2, 0}, {"b", "b3", 3, 0}},
+				big...))
+			// The two runs left still reach NumLevelZeroTables, so they are merged together.
+			require.Equal(t, []compactionPriority{{level: 5, nextLevel: 6, score: 1}}, uc.pick(0))
+		})
+	})
+	t.Run("runs of similar sizes", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createRun(db, []keyValVersion{{"a", "a4", 4, 0}}, 0)
+			createRun(db, []keyValVersion{{"a", "a3", 3, 0}}, 2)
+			createRun(db, []keyValVersion{{"a", "a2", 2, 0}}, 4)
+			big := bigRun(100, 1)
+			createRun(db, append([]keyValVersion{{"a", "a1", 1, 0}}, big...), 6)
+			db.SetDiscardTs(10)
+
+			prios := db.lc.strategy.pick(0)
+			require.Len(t, prios, 1)
+			require.Equal(t, 0, prios[0].level)
+			require.Equal(t, 5, prios[0].nextLevel)
+			require.NoError(t, db.lc.doCompact(0, prios[0]))
+
+			// The runs of L0, L2 and L4 are merged into L5, above the run of L6.
+			require.Equal(t, []int{5, 6}, levelsWithTables(db))
+			getAllAndCheck(t, db, append([]keyValVersion{{"a", "a4", 4, 0}, {"a", "a1", 1, 0}},
+				big...))
+		})
+	})
+	t.Run("space amplification", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			big := bigRun(100, 3)
+			createRun(db, big, 0)
+			createRun(db, []keyValVersion{{"a", "a2", 2, 0}, {"z000", "z1", 1, 0}}, 3)
+			createRun(db, []keyValVersion{{"a", "a1", 1, 0}}, 6)
+			db.SetDiscardTs(10)
+
+			prios := db.lc.strategy.pick(0)
+			require.Len(t, prios, 1)
+			require.Equal(t, 0, prios[0].level)
+			require.Equal(t, 6, prios[0].nextLevel)
+			require.NoError(t, db.lc.doCompact(0, prios[0]))
+
+			// All the runs are merged into the last level.
+			require.Equal(t, []int{6}, levelsWithTables(db))
+			getAllAndCheck(t, db, append([]keyValVersion{{"a", "a2", 2, 0}}, big...))
+		})
+	})
+	t.Run("too few runs", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createRun(db, []keyValVersion{{"a", "a1", 1, 0}}, 0)
+			require.Empty(t, db.lc.strategy.pick(0))
+		})
+	})
+	t.Run("flatten", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createRun(db, []keyValVersion{{"a", "a3", 3, 0}}, 0)
+			createRun(db, []keyValVersion{{"a", "a2", 2, 0}, {"b", "b2", 2, 0}}, 2)
+			createRun(db, []keyValVersion{{"b", "b1", 1, 0}, {"c", "c1", 1, 0}}, 4)
+			db.SetDiscardTs(10)
+
+			require.NoError(t, db.Flatten(2))
+			require.Equal(t, []int{6}, levelsWithTables(db))
+			getAllAndCheck(t, db, []keyValVersion{
+				{"a", "a3", 3, 0}, {"b", "b2", 2, 0}, {"c", "c1", 1, 0},
+			})
+		})
+	})
+	t.Run("drop prefix", func(t *testing.T) {
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			createRun(db, []keyValVersion{{"a", "a3", 3, 0}, {"b", "b3", 3, 0}}, 0)
+			createRun(db, []keyValVersion{{"a", "a2", 2, 0}, {"c", "c2", 2, 0}}, 3)
+			db.SetDiscardTs(10)
+
+			require.NoError(t, db.DropPrefix([]byte("a")))
+			getAllAndCheck(t, db, []keyValVersion{{"b", "b3", 3, 0}, {"c", "c2", 2, 0}})
+		})
+	})
+}
+
+func TestUniversalCompactionStreamWriter(t *testing.T) {
+	opt := getTestOptions("").WithCompactionStyle(options.UniversalCompaction)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		sw := db.NewStreamWriter()
+		require.NoError(t, sw.Prepare())
+		require.NoError(t, sw.Write(getSortedKVList(128, 1000)))
+		require.NoError(t, sw.Flush())
+
+		// The tables of the stream writer are a single run in the last level, apart from the one
+		// holding the head in L0.
+		require.Equal(t, []int{0, len(db.lc.levels) - 1}, levelsWithTables(db))
+		require.Equal(t, 1000, numKeys(db))
+	})
+}
+
+func TestUniversalCompactionReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithCompactionStyle(options.UniversalCompaction).
+		WithNumLevelZeroTables(2).WithNumLevelZeroTablesStall(4)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	const n = 20000
+	for i := 0; i < n; i += 1000 {
+		wb := db.NewWriteBatch()
+		for j := i; j < i+1000; j++ {
+			require.NoError(t, wb.Set([]byte(key("key", j)), []byte(fmt.Sprintf("%d", j))))
+		}
+		require.NoError(t, wb.Flush())
+	}
+	require.NoError(t, db.Close())
+
+	// Reopen the DB with the leveled compactions, which pick up the levels as they were left.
+	db, err = Open(opt.WithCompactionStyle(options.LeveledCompaction))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for i := 0; i < n; i++ {
+			item, err := txn.Get([]byte(key("key", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("%d", i)), getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestFIFOCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	// Disable the background compactions, so that the tables are only deleted by the test.
+	opt := getTestOptions(dir).WithCompactionStyle(options.FIFOCompaction).WithNumCompactors(0).
+		WithValueThreshold(32)
+	// Every session writes its keys to a table of L0 on close.
+	session := func(prefix string, expiresAt uint64) {
+		db, err := Open(opt)
+		require.NoError(t, err)
+		wb := db.NewWriteBatch()
+		for i := 0; i < 100; i++ {
+			e := NewEntry([]byte(key(prefix, i)), []byte(strings.Repeat("v", 64)))
+			e.ExpiresAt = expiresAt
+			require.NoError(t, wb.SetEntry(e))
+		}
+		require.NoError(t, wb.Flush())
+		require.NoError(t, db.Close())
+	}
+	now := uint64(time.Now().Unix())
+	session("expired", now-10)
+	session("live", now+3600)
+	session("forever", 0)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.Equal(t, []int{0}, levelsWithTables(db))
+	require.Equal(t, 3, db.lc.levels[0].numTables())
+
+	// Only the oldest table has expired.
+	prios := db.lc.strategy.pick(0)
+	require.Len(t, prios, 1)
+	require.Equal(t, 0, prios[0].level)
+	require.Len(t, prios[0].drop, 1)
+	require.Equal(t, uint64(now-10), prios[0].drop[0].MaxExpiry())
+	require.NoError(t, db.lc.doCompact(0, prios[0]))
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	require.Empty(t, db.lc.strategy.pick(0))
+
+	// The values of the deleted table are discardable, once the discard stats are merged in the
+	// background.
+	require.Eventually(t, func() bool {
+		db.vlog.lfDiscardStats.RLock()
+		defer db.vlog.lfDiscardStats.RUnlock()
+		var discard int64
+		for _, d := range db.vlog.lfDiscardStats.m {
+			discard += d
+		}
+		return discard > 100*64
+	}, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, 200, numKeys(db))
+	require.NoError(t, db.Close())
+
+	// Above the size limit, the oldest tables are deleted whatever their expiry, apart from the
+	// newest one.
+	opt = opt.WithFIFOCompactionMaxSize(1)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	prios = db.lc.strategy.pick(0)
+	require.Len(t, prios, 1)
+	require.Len(t, prios[0].drop, 1)
+	require.NoError(t, db.lc.doCompact(0, prios[0]))
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+	require.Empty(t, db.lc.strategy.pick(0))
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte(key("live", 0)))
+		require.Equal(t, ErrKeyNotFound, err)
+		item, err := txn.Get([]byte(key("forever", 0)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(strings.Repeat("v", 64)), getItemValue(t, item))
+		return nil
+	}))
+	require.NoError(t, db.Flatten(1))
+	require.Equal(t, 1, db.lc.levels[0].numTables())
+}
+
+func TestFIFOCompactionColumnFamily(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithCompactionStyle(options.FIFOCompaction).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	cf, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.SetCF(cf, []byte("a"), []byte("forever"))
+	}))
+	require.NoError(t, db.Close())
+	// The newest table is never dropped, so write another one on top.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("b"), []byte("forever"))
+	}))
+	require.NoError(t, db.Close())
+
+	// The oldest table only holds the keys of the column family, which never expire.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Equal(t, 2, db.lc.levels[0].numTables())
+	require.Empty(t, db.lc.strategy.pick(0))
+	cf, err = db.GetColumnFamily("users")
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.GetCF(cf, []byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("forever"), getItemValue(t, item))
+		return nil
+	}))
+}
+
+func TestFIFOCompactionMaxSizeInternalKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	opt := getTestOptions(dir).WithCompactionStyle(options.FIFOCompaction).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	cf, err := db.CreateColumnFamily("users", DefaultCFOptions(db.opt))
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.SetCF(cf, []byte("a"), []byte("a")))
+		return txn.Set([]byte("k1"), []byte("k1"))
+	}))
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.DeleteRange([]byte("k"), []byte("l")))
+		return txn.Set([]byte("b"), []byte("b"))
+	}))
+	require.NoError(t, db.Close())
+	// The newest table is never dropped, so write another one on top.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("c"), []byte("c"))
+	}))
+	require.NoError(t, db.Close())
+
+	// The tables are dropped, apart from the newest one, but the definitions of the column
+	// families and the range tombstone they hold are kept in tables of their own.
+	opt = opt.WithFIFOCompactionMaxSize(1)
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.Equal(t, 3, db.lc.levels[0].numTables())
+	prios := db.lc.strategy.pick(0)
+	require.Len(t, prios, 1)
+	require.Len(t, prios[0].drop, 2)
+	require.NoError(t, db.lc.doCompact(0, prios[0]))
+	require.Equal(t, 3, db.lc.levels[0].numTables())
+	// The tables holding only the kept keys aren't dropped again.
+	require.Empty(t, db.lc.strategy.pick(0))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.Len(t, db.rangeDels.list, 1)
+	cf, err = db.GetColumnFamily("users")
+	require.NoError(t, err)
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.GetCF(cf, []byte("a"))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = txn.Get([]byte("b"))
+		require.Equal(t, ErrKeyNotFound, err)
+		item, err := txn.Get([]byte("c"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("c"), getItemValue(t, item))
+		return nil
+	}))
+}
+
+func TestFIFOCompactionOptions(t *testing.T) {
+	opt := DefaultOptions("").WithCompactionStyle(options.FIFOCompaction)
+	require.NoError(t, checkAndSetOptions(&opt))
+	require.False(t, opt.CompactL0OnClose)
+
+	opt = DefaultOptions("dir").WithCompactionStyle(options.FIFOCompaction).
+		WithKeepL0InMemory(true)
+	require.Error(t, checkAndSetOptions(&opt))
+}
@@ -43,10 +43,13 @@ import (
 )
 
 var (
-	badgerPrefix      = []byte("!badger!")        // Prefix for internal keys used by badger.
-	head              = []byte("!badger!head")    // For storing value offset for replay.
-	txnKey            = []byte("!badger!txn")     // For indicating end of entries in txn.
-	lfDiscardStatsKey = []byte("!badger!discard") // For storing lfDiscardStats
+	badgerPrefix      = []byte("!badger!")          // Prefix for internal keys used by badger.
+	badgerPrefixEnd   = []byte("!badger\"")         // Right after all the keys with badgerPrefix.
+	head              = []byte("!badger!head")      // For storing value offset for replay.
+	txnKey            = []byte("!badger!txn")       // For indicating end of entries in txn.
+	lfDiscardStatsKey = []byte("!badger!discard")   // For storing lfDiscardStats
+	rangeDelPrefix    = []byte("!badger!rangedel!") // For storing range tombstones.
+	blobPrefix        = []byte("!badger!blob!")     // For storing the chunks of blobs.
 )
 
 const (
@@ -59,6 +62,7 @@ type closers struct {
 	memtable    *z.Closer
 	writes      *z.Closer
 	valueGC     *z.Closer
+	valueGCRuns *z.Closer
 	pub         *z.Closer
 	cacheHealth *z.Closer
 }
@@ -92,12 +96,20 @@ type DB struct {
 	blockWrites int32
 	isClosed    uint32
 
-	orc *oracle
+	orc   *oracle
+	locks *lockManager // Row locks taken by Txn.GetForUpdate.
+
+	retention retentionRules // See Options.RetentionRules.
 
 	pub        *publisher
 	registry   *KeyRegistry
 	blockCache *ristretto.Cache
 	indexCache *ristretto.Cache
+
+	rangeDels rangeTombstones // Index over the range tombstones in the LSM tree.
+	metrics   *metrics        // Metrics of this DB, see DB.Metrics.
+	ioLimiter *ioLimiter      // Limits the background I/O, see Options.BackgroundIORate.
+	cfs       columnFamilies
 }
 
 const (
@@ -225,6 +237,11 @@ func checkAndSetOptions(opt *Options) error {
 	if !(opt.ValueLogFileSize <= 2<<30 && opt.ValueLogFileSize >= 1<<20) {
 		return ErrValueLogSize
 	}
+	if gc := opt.ValueLogGCPolicy; gc.Interval > 0 &&
+		(gc.DiscardRatio <= 0.0 || gc.DiscardRatio >= 1.0) {
+		return errors.Errorf("Invalid ValueLogGCPolicy.DiscardRatio: %v, must be in the range "+
+			"(0.0, 1.0)", gc.DiscardRatio)
+	}
 	if !(opt.ValueLogLoadingMode == options.FileIO ||
 		opt.ValueLogLoadingMode == options.MemoryMap) {
 		return ErrInvalidLoadingMode
@@ -241,6 +258,15 @@ func checkAndSetOptions(opt *Options) error {
 	// keepL0InMemory is set we need to compact L0 on close otherwise we might lose data.
 	opt.CompactL0OnClose = opt.CompactL0OnClose || opt.KeepL0InMemory
 
+	if opt.CompactionStyle == options.FIFOCompaction {
+		// L0 would only be persisted by compacting it on close, while the FIFO compactions never
+		// merge tables.
+		if opt.KeepL0InMemory && !opt.InMemory {
+			return errors.New("Cannot use KeepL0InMemory with FIFOCompaction")
+		}
+		opt.CompactL0OnClose = false
+	}
+
 	if opt.ReadOnly {
 		// Can't truncate if the DB is read only.
 		opt.Truncate = false
@@ -311,6 +337,16 @@ func Open(opt Options) (db *DB, err error) {
 		}
 	}()
 
+	timeLog, err := openTimeLog(opt)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if timeLog != nil {
+			_ = timeLog.close()
+		}
+	}()
+
 	db = &DB{
 		imm:           make([]*skl.Skiplist, 0, opt.NumMemtables),
 		flushChan:     make(chan flushTask, opt.NumMemtables),
@@ -320,8 +356,12 @@ func Open(opt Options) (db *DB, err error) {
 		dirLockGuard:  dirLockGuard,
 		valueDirGuard: valueDirLockGuard,
 		orc:           newOracle(opt),
-		pub:           newPublisher(),
+		locks:         newLockManager(),
+		metrics:       newMetrics(opt),
+		ioLimiter:     newIOLimiter(opt.BackgroundIORate),
 	}
+	db.orc.timeLog = timeLog
+	db.pub = newPublisher(db)
 	// Cleanup all the goroutines started by badger in case of an error.
 	defer func() {
 		if err != nil {
@@ -330,6 +370,10 @@ func Open(opt Options) (db *DB, err error) {
 		}
 	}()
 
+	if err = db.retention.store(opt.RetentionRules); err != nil {
+		return db, err
+	}
+
 	if opt.BlockCacheSize > 0 {
 		numInCache := opt.BlockCacheSize / int64(opt.BlockSize)
 
@@ -415,6 +459,21 @@ func Open(opt Options) (db *DB, err error) {
 		return db, y.Wrapf(err, "During db.vlog.open")
 	}
 	replayCloser.SignalAndWait() // Wait for replay to be applied first.
+	db.orc.hlc.observe(db.orc.nextTxnTs)
+	if !opt.ReadOnly {
+		// The latest version is known to be committed by now, even if the time log doesn't have it.
+		db.orc.timeLog.record(db.orc.nextTxnTs, time.Now())
+		if err = db.orc.timeLog.persist(); err != nil {
+			return db, err
+		}
+	}
+
+	if err = db.loadRangeTombstones(); err != nil {
+		return db, y.Wrapf(err, "While loading range tombstones")
+	}
+	if err = db.loadColumnFamilies(manifest.DroppedColumnFamilies); err != nil {
+		return db, y.Wrapf(err, "While loading column families")
+	}
 
 	// Let's advance nextTxnTs to one more than whatever we observed via
 	// replaying the logs.
@@ -430,6 +489,10 @@ func Open(opt Options) (db *DB, err error) {
 	if !db.opt.InMemory {
 		db.closers.valueGC = z.NewCloser(1)
 		go db.vlog.waitOnGC(db.closers.valueGC)
+		if !db.opt.ReadOnly && db.opt.ValueLogGCPolicy.Interval > 0 {
+			db.closers.valueGCRuns = z.NewCloser(1)
+			go db.runValueLogGCScheduler(db.closers.valueGCRuns)
+		}
 	}
 
 	db.closers.pub = z.NewCloser(1)
@@ -438,6 +501,7 @@ func Open(opt Options) (db *DB, err error) {
 	valueDirLockGuard = nil
 	dirLockGuard = nil
 	manifestFile = nil
+	timeLog = nil
 	return db, nil
 }
 
@@ -536,6 +600,9 @@ func (db *DB) cleanup() {
 	if db.closers.updateSize != nil {
 		db.closers.updateSize.Signal()
 	}
+	if db.closers.valueGCRuns != nil {
+		db.closers.valueGCRuns.Signal()
+	}
 	if db.closers.valueGC != nil {
 		db.closers.valueGC.Signal()
 	}
@@ -592,6 +659,9 @@ func (db *DB) close() (err error) {
 
 	if !db.opt.InMemory {
 		// Stop value GC first.
+		if db.closers.valueGCRuns != nil {
+			db.closers.valueGCRuns.SignalAndWait()
+		}
 		db.closers.valueGC.SignalAndWait()
 	}
 
@@ -640,6 +710,8 @@ func (db *DB) close() (err error) {
 			time.Sleep(10 * time.Millisecond)
 		}
 	}
+	// Don't hold up the close on the compactions waiting for the background I/O rate.
+	db.ioLimiter.setRate(0)
 	db.stopMemoryFlush()
 	db.stopCompactions()
 
@@ -686,6 +758,9 @@ func (db *DB) close() (err error) {
 	if manifestErr := db.manifest.close(); err == nil {
 		err = errors.Wrap(manifestErr, "DB.Close")
 	}
+	if timeLogErr := db.orc.timeLog.close(); err == nil {
+		err = errors.Wrap(timeLogErr, "DB.Close")
+	}
 	if registryErr := db.registry.Close(); err == nil {
 		err = errors.Wrap(registryErr, "DB.Close")
 	}
@@ -724,17 +799,20 @@ func (db *DB) getMemTables() ([]*skl.Skiplist, func()) {
 	db.RLock()
 	defer db.RUnlock()
 
-	tables := make([]*skl.Skiplist, len(db.imm)+1)
+	tables := make([]*skl.Skiplist, 0, len(db.imm)+1)
 
-	// Get mutable memtable.
-	tables[0] = db.mt
-	tables[0].IncrRef()
+	// Get mutable memtable. It is nil once DB.Close has pushed it out for flushing, while the
+	// compaction on close can still be looking at the memtables.
+	if db.mt != nil {
+		tables = append(tables, db.mt)
+		db.mt.IncrRef()
+	}
 
 	// Get immutable memtables.
 	last := len(db.imm) - 1
 	for i := range db.imm {
-		tables[i+1] = db.imm[last-i]
-		tables[i+1].IncrRef()
+		tables = append(tables, db.imm[last-i])
+		db.imm[last-i].IncrRef()
 	}
 	return tables, func() {
 		for _, tbl := range tables {
@@ -811,7 +889,7 @@ var requestPool = sync.Pool{
 }
 
 func (db *DB) shouldWriteValueToLSM(e Entry) bool {
-	return len(e.Value) < db.opt.ValueThreshold
+	return len(e.Value) < db.valueThreshold(e.Key)
 }
 
 func (db *DB) writeToLSM(b *request) error {
@@ -826,6 +904,9 @@ func (db *DB) writeToLSM(b *request) error {
 		if entry.meta&bitFinTxn != 0 {
 			continue
 		}
+		if entry.meta&bitRangeDelete != 0 {
+			db.addRangeTombstone(entry)
+		}
 		if db.shouldWriteValueToLSM(*entry) { // Will include deletion / tombstone case.
 			db.mt.Put(entry.Key,
 				y.ValueStruct{
@@ -875,12 +956,18 @@ func (db *DB) writeRequests(reqs []*request) error {
 	db.opt.Debugf("Writing to memtable")
 	var count int
 	for _, b := range reqs {
-		if len(b.Entries) == 0 {
+		// An empty request still gets to flush the memtable if a flush has been forced, see
+		// forceFlushMemtable.
+		if len(b.Entries) == 0 && atomic.LoadInt32(&db.logRotates) < db.opt.LogRotatesToFlush {
 			continue
 		}
 		count += len(b.Entries)
 		var i uint64
+		var stallStart time.Time
 		for err = db.ensureRoomForWrite(); err == errNoRoom; err = db.ensureRoomForWrite() {
+			if i == 0 {
+				stallStart = time.Now()
+			}
 			i++
 			if i%100 == 0 {
 				db.opt.Debugf("Making room for writes")
@@ -890,6 +977,9 @@ func (db *DB) writeRequests(reqs []*request) error {
 			// you will get a deadlock.
 			time.Sleep(10 * time.Millisecond)
 		}
+		if i > 0 {
+			db.metrics.addWriteStall(time.Since(stallStart))
+		}
 		if err != nil {
 			done(err)
 			return errors.Wrap(err, "writeRequests")
@@ -1172,7 +1262,7 @@ func (db *DB) handleFlushTask(ft flushTask) error {
 	dirSyncCh := make(chan error, 1)
 	go func() { dirSyncCh <- db.syncDir(db.opt.Dir) }()
 
-	if _, err = fd.Write(tableData); err != nil {
+	if err = db.ioLimiter.write(fd, tableData, true); err != nil {
 		db.opt.Errorf("ERROR while writing to level 0: %v", err)
 		return err
 	}
@@ -1324,6 +1414,9 @@ func (db *DB) updateSize(lc *z.Closer) {
 // Only one GC is allowed at a time. If another value log GC is running, or DB
 // has been closed, this would return an ErrRejected.
 //
+// The DB can also run the value log GC in the background, see
+// Options.ValueLogGCPolicy.
+//
 // Note: Every time GC is run, it would produce a spike of activity on the LSM
 // tree.
 func (db *DB) RunValueLogGC(discardRatio float64) error {
@@ -1333,7 +1426,20 @@ func (db *DB) RunValueLogGC(discardRatio float64) error {
 	if discardRatio >= 1.0 || discardRatio <= 0.0 {
 		return ErrInvalidRequest
 	}
+	head, err := db.valueLogGCHead()
+	if err != nil {
+		return err
+	}
+
+	// Pick a log file and run GC
+	err = db.vlog.runGC(discardRatio, head)
+	db.metrics.addValueLogGC(err)
+	return err
+}
 
+// valueLogGCHead returns the head of the value log persisted in the LSM tree. The value log GC
+// only rewrites the files before it, as the files after it are still needed for replay.
+func (db *DB) valueLogGCHead() (valuePointer, error) {
 	// startLevel is the level from which we should search for the head key. When badger is running
 	// with KeepL0InMemory flag, all tables on L0 are kept in memory. This means we should pick head
 	// key from Level 1 onwards because if we pick the headkey from Level 0 we might end up losing
@@ -1347,16 +1453,14 @@ func (db *DB) RunValueLogGC(discardRatio float64) error {
 	// Need to pass with timestamp, lsm get removes the last 8 bytes and compares key
 	val, err := db.lc.get(headKey, y.ValueStruct{}, startLevel)
 	if err != nil {
-		return errors.Wrap(err, "Retrieving head from on-disk LSM")
+		return valuePointer{}, errors.Wrap(err, "Retrieving head from on-disk LSM")
 	}
 
 	var head valuePointer
 	if len(val.Value) > 0 {
 		head.Decode(val.Value)
 	}
-
-	// Pick a log file and run GC
-	return db.vlog.runGC(discardRatio, head)
+	return head, nil
 }
 
 // Size returns the size of lsm and value log files in bytes. It can be used to decide how often to
@@ -1625,7 +1729,9 @@ func (db *DB) startMemoryFlush() {
 // level. This ensures that all the versions of keys are colocated and not split across multiple
 // levels, which is necessary after a restore from backup. During Flatten, live compactions are
 // stopped. Ideally, no writes are going on during Flatten. Otherwise, it would create competition
-// between flattening the tree and new tables being created at level zero.
+// between flattening the tree and new tables being created at level zero. With
+// options.UniversalCompaction, all the tables are merged into the lowest level, while with
+// options.FIFOCompaction, which never merges tables, Flatten does nothing.
 func (db *DB) Flatten(workers int) error {
 	db.stopCompactions()
 	defer db.startCompactions()
@@ -1673,19 +1779,11 @@ func (db *DB) Flatten(workers int) error {
 				levels = append(levels, i)
 			}
 		}
-		if len(levels) <= 1 {
-			prios := db.lc.pickCompactLevels()
-			if len(prios) == 0 || prios[0].score <= 1.0 {
-				db.opt.Infof("All tables consolidated into one level. Flattening done.\n")
-				return nil
-			}
-			if err := compactAway(prios[0]); err != nil {
-				return err
-			}
-			continue
+		cp, ok := db.lc.strategy.flatten(levels)
+		if !ok {
+			db.opt.Infof("All tables consolidated into one level. Flattening done.\n")
+			return nil
 		}
-		// Create an artificial compaction priority, to ensure that we compact the level.
-		cp := compactionPriority{level: levels[0], score: 1.71}
 		if err := compactAway(cp); err != nil {
 			return err
 		}
@@ -1757,7 +1855,13 @@ func (db *DB) DropAll() error {
 	if f != nil {
 		f()
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	// The column families themselves survive DropAll, only their keys are dropped.
+	db.cfs.updateLock.Lock()
+	defer db.cfs.updateLock.Unlock()
+	return db.persistColumnFamilies()
 }
 
 func (db *DB) dropAll() (func(), error) {
@@ -1798,6 +1902,7 @@ func (db *DB) dropAll() (func(), error) {
 	}
 	db.vhead = valuePointer{} // Zero it out.
 	db.lc.nextFileID = 1
+	db.rangeDels.clear()
 	db.opt.Infof("Deleted %d value log files. DropAll done.\n", num)
 	db.blockCache.Clear()
 	db.indexCache.Clear()
@@ -1825,8 +1930,6 @@ func (db *DB) DropPrefix(prefixes ...[]byte) error {
 	defer f()
 	// Block all foreign interactions with memory tables.
 	db.Lock()
-	defer db.Unlock()
-
 	db.imm = append(db.imm, db.mt)
 	for _, memtable := range db.imm {
 		if memtable.Empty() {
@@ -1842,6 +1945,7 @@ func (db *DB) DropPrefix(prefixes ...[]byte) error {
 		db.opt.Debugf("Flushing memtable")
 		if err := db.handleFlushTask(task); err != nil {
 			db.opt.Errorf("While trying to flush memtable: %v", err)
+			db.Unlock()
 			return err
 		}
 		memtable.DecrRef()
@@ -1850,6 +1954,9 @@ func (db *DB) DropPrefix(prefixes ...[]byte) error {
 	defer db.startCompactions()
 	db.imm = db.imm[:0]
 	db.mt = skl.NewSkiplist(arenaSize(db.opt))
+	// Writes and flushes are blocked, so the memtables stay empty. The compactions below need to
+	// read them to figure out which range tombstones can be dropped.
+	db.Unlock()
 
 	// Drop prefixes from the levels.
 	if err := db.lc.dropPrefixes(prefixes); err != nil {
@@ -1867,28 +1974,197 @@ type KVList = pb.KVList
 // You can use an empty prefix to monitor all changes to the DB.
 // This function blocks until the given context is done or an error occurs.
 // The given function will be called with a new KVList containing the modified keys and the
-// corresponding values.
+// corresponding values. The Cursor of the KVList is one more than the highest version in it, and
+// can be passed to SubscribeFrom to resume watching after a restart. The merge operands written by
+// Txn.Merge are passed as they are, with KVMergeOperand set in their Meta, and the values set by
+// Txn.SetStream are passed whole.
+//
+// Options.SubscriberPolicy decides what happens when the callback can't keep up with the updates.
+// With options.SubscriberDropOldest, the number of updates dropped since the previous call is
+// passed in KVList.Dropped, and the Cursor stays at the version of the first dropped update, so
+// that SubscribeFrom can fill the gap. With options.SubscriberDisconnect, Subscribe returns
+// ErrSlowSubscriber.
 func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, prefixes ...[]byte) error {
+	return db.SubscribeMatch(ctx, cb, prefixMatches(prefixes)...)
+}
+
+// SubscribeMatch is like Subscribe, but the updates are selected by the given matches instead of
+// key prefixes. An update is passed to cb once, even if it is selected by several matches. The
+// matches are indexed, so that the cost of publishing an update grows with the number of matches
+// selecting it rather than with the number of subscriptions.
+func (db *DB) SubscribeMatch(ctx context.Context, cb func(kv *KVList) error,
+	matches ...Match) error {
 	if cb == nil {
 		return ErrNilCallback
 	}
+	for i := range matches {
+		if err := matches[i].validate(); err != nil {
+			return err
+		}
+	}
+
+	c := z.NewCloser(1)
+	s := db.pub.newSubscriber(c, matches)
+	return db.deliverUpdates(ctx, s, nil, 0, cb)
+}
+
+func prefixMatches(prefixes [][]byte) []Match {
+	matches := make([]Match, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		matches = append(matches, Match{Prefix: prefix})
+	}
+	return matches
+}
 
+// SubscribeFrom is like Subscribe, but it first replays the committed changes to the keys with the
+// given prefixes which have a version greater than or equal to sinceVersion, and then switches to
+// the live updates. Every change is delivered at least once, so a subscriber which persists the
+// Cursor of the last KVList it has processed can pass it as sinceVersion to resume without missing
+// any change.
+//
+// The replayed changes are read from the LSM tree, so only the versions which haven't been
+// discarded by compactions are replayed, see Options.NumVersionsToKeep. They are delivered in key
+// order rather than in version order, hence the Cursor of the replayed lists stays at sinceVersion
+// until the replay is over. Deleted and expired keys are delivered with an empty value.
+//
+// At least one prefix should be passed, or ErrNoPrefixes is returned. The live updates received
+// while the replay is running are buffered up to a limit, after which they are handled as per
+// Options.SubscriberPolicy, like the updates a slow callback can't keep up with.
+//
+// In managed mode, resuming from a Cursor only works if the transactions are committed in
+// increasing order of their commit timestamps.
+func (db *DB) SubscribeFrom(ctx context.Context, sinceVersion uint64, cb func(kv *KVList) error,
+	prefixes ...[]byte) error {
+	if cb == nil {
+		return ErrNilCallback
+	}
+	if len(prefixes) == 0 {
+		return ErrNoPrefixes
+	}
+
+	// Subscribe before picking the read timestamp of the replay, so that all the changes which
+	// aren't visible to the replay are received as live updates.
 	c := z.NewCloser(1)
-	recvCh, id := db.pub.newSubscriber(c, prefixes...)
+	s := db.pub.newSubscriber(c, prefixMatches(prefixes))
+	var txn *Txn
+	if db.opt.managedTxns {
+		txn = db.NewTransactionAt(math.MaxUint64, false)
+	} else {
+		txn = db.NewTransaction(false)
+	}
+
+	// Replay in a separate goroutine, so that the live updates received meanwhile are buffered
+	// instead of blocking the publisher.
+	replayCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		defer txn.Discard()
+		errCh <- db.replayUpdates(replayCtx, txn, sinceVersion, cb, prefixes)
+	}()
+	var pending []*pb.KV
+	var pendingSize int
+	for replaying := true; replaying; {
+		// Once the buffer is full, the updates are left in the queue of the subscriber, where the
+		// publisher applies the subscriber policy to them.
+		sendCh := s.sendCh
+		if pendingSize >= maxReplayPendingSize {
+			sendCh = nil
+		}
+		select {
+		case kvs := <-sendCh:
+			s.received(kvs)
+			pending = append(pending, kvs.Kv...)
+			for _, kv := range kvs.Kv {
+				pendingSize += kv.Size()
+			}
+		case <-c.HasBeenClosed():
+			cancel()
+			<-errCh
+			c.Done()
+			return nil
+		case <-s.disconnected:
+			cancel()
+			<-errCh
+			c.Done()
+			return ErrSlowSubscriber
+		case err := <-errCh:
+			if err != nil {
+				c.Done()
+				db.pub.deleteSubscriber(s.id)
+				return err
+			}
+			replaying = false
+		}
+	}
+
+	// The changes committed at or before the read timestamp have been replayed already.
+	minVersion := txn.readTs + 1
+	if db.opt.managedTxns {
+		minVersion = sinceVersion
+	}
+	return db.deliverUpdates(ctx, s, pending, minVersion, cb)
+}
+
+// maxReplayPendingSize is the size of the live updates SubscribeFrom buffers while replaying.
+var maxReplayPendingSize = 64 << 20
+
+// deliverUpdates passes the updates received by the subscriber to cb, until the context is done,
+// the DB is closed or the subscriber is disconnected. The pending updates are delivered first, and
+// the updates with a version lower than minVersion are dropped.
+func (db *DB) deliverUpdates(ctx context.Context, s *subscriber, pending []*pb.KV,
+	minVersion uint64, cb func(kv *KVList) error) error {
+	c := s.subCloser
 	slurp := func(batch *pb.KVList) error {
 		for {
 			select {
-			case kvs := <-recvCh:
+			case kvs := <-s.sendCh:
+				s.received(kvs)
 				batch.Kv = append(batch.Kv, kvs.Kv...)
 			default:
-				if len(batch.GetKv()) > 0 {
-					return cb(batch)
+				kvs := batch.Kv[:0]
+				for _, kv := range batch.Kv {
+					if kv.Version >= minVersion {
+						kvs = append(kvs, kv)
+					}
+					if kv.Version >= batch.Cursor {
+						batch.Cursor = kv.Version + 1
+					}
+				}
+				batch.Kv = kvs
+				batch.Dropped = atomic.SwapUint64(&s.gap, 0)
+				// Resuming past a dropped update would skip it.
+				if first := atomic.LoadUint64(&s.firstDropped); first > 0 && first < batch.Cursor {
+					batch.Cursor = first
+				}
+				if len(batch.GetKv()) == 0 && batch.Dropped == 0 {
+					return nil
 				}
+				if err := cb(batch); err != nil {
+					return err
+				}
+				s.markDelivered(batch)
 				return nil
 			}
 		}
 	}
+	if len(pending) > 0 {
+		if err := slurp(&pb.KVList{Kv: pending}); err != nil {
+			c.Done()
+			db.pub.deleteSubscriber(s.id)
+			return err
+		}
+	}
 	for {
+		// Don't deliver the updates queued before the disconnection.
+		select {
+		case <-s.disconnected:
+			// The publisher has already deleted the subscriber.
+			c.Done()
+			return ErrSlowSubscriber
+		default:
+		}
+
 		select {
 		case <-c.HasBeenClosed():
 			// No need to delete here. Closer will be called only while
@@ -1897,21 +2173,108 @@ func (db *DB) Subscribe(ctx context.Context, cb func(kv *KVList) error, prefixes
 			// Drain if any pending updates.
 			c.Done()
 			return err
+		case <-s.disconnected:
+			c.Done()
+			return ErrSlowSubscriber
 		case <-ctx.Done():
 			c.Done()
-			db.pub.deleteSubscriber(id)
+			db.pub.deleteSubscriber(s.id)
 			// Delete the subscriber to avoid further updates.
 			return ctx.Err()
-		case batch := <-recvCh:
+		case batch := <-s.sendCh:
+			s.received(batch)
 			err := slurp(batch)
 			if err != nil {
 				c.Done()
 				// Delete the subscriber if there is an error by the callback.
-				db.pub.deleteSubscriber(id)
+				db.pub.deleteSubscriber(s.id)
+				return err
+			}
+		}
+	}
+}
+
+// replayUpdates passes the versions of the keys with the given prefixes which are visible to txn
+// and have a version greater than or equal to sinceVersion to cb. The Cursor of the lists stays at
+// sinceVersion, except for the last one, which covers everything visible to txn.
+func (db *DB) replayUpdates(ctx context.Context, txn *Txn, sinceVersion uint64,
+	cb func(kv *KVList) error, prefixes [][]byte) error {
+	const maxBatchSize = 4 << 20
+	batch := &pb.KVList{Cursor: sinceVersion}
+	var size int
+	maxVersion := sinceVersion
+
+	matchesEarlier := func(key []byte, i int) bool {
+		for _, prefix := range prefixes[:i] {
+			if bytes.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	for i, prefix := range prefixes {
+		opt := DefaultIteratorOptions
+		opt.AllVersions = true
+		opt.Prefix = prefix
+		// The updates of the column families are published, so they are replayed too.
+		opt.InternalAccess = true
+		it := txn.NewIterator(opt)
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if isInternalKey(item.Key()) || db.cfs.isDropped(item.Key()) {
+				continue
+			}
+			// Keys matching several prefixes are replayed once.
+			if item.Version() < sinceVersion || matchesEarlier(item.Key(), i) {
+				continue
+			}
+			kv := &pb.KV{
+				Key:       item.KeyCopy(nil),
+				Meta:      updateMeta(item.UserMeta(), item.meta),
+				ExpiresAt: item.ExpiresAt(),
+				Version:   item.Version(),
+			}
+			if !item.IsDeletedOrExpired() {
+				var err error
+				if kv.Value, err = item.ValueCopy(nil); err != nil {
+					it.Close()
+					return err
+				}
+			}
+			if kv.Version > maxVersion {
+				maxVersion = kv.Version
+			}
+			batch.Kv = append(batch.Kv, kv)
+			size += kv.Size()
+			if size < maxBatchSize {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				it.Close()
 				return err
 			}
+			if err := cb(batch); err != nil {
+				it.Close()
+				return err
+			}
+			batch = &pb.KVList{Cursor: sinceVersion}
+			size = 0
 		}
+		it.Close()
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(batch.Kv) == 0 {
+		return nil
 	}
+	if db.opt.managedTxns {
+		batch.Cursor = maxVersion + 1
+	} else {
+		batch.Cursor = txn.readTs + 1
+	}
+	return cb(batch)
 }
 
 // shouldEncrypt returns bool, which tells whether to encrypt or not.
@@ -1969,6 +2332,10 @@ func (db *DB) StreamDB(outOptions Options) error {
 		return errors.Wrapf(err, "cannot open out DB at %s", outDir)
 	}
 	defer outDB.Close()
+	cfIDs, err := outDB.importColumnFamilies(db.cfs.defs().Families)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create column families in out DB at %s", outDir)
+	}
 	writer := outDB.NewStreamWriter()
 	if err := writer.Prepare(); err != nil {
 		errors.Wrapf(err, "cannot create stream writer in out DB at %s", outDir)
@@ -1978,6 +2345,11 @@ func (db *DB) StreamDB(outOptions Options) error {
 	stream := db.NewStreamAt(math.MaxUint64)
 	stream.LogPrefix = fmt.Sprintf("Streaming DB to new DB at %s", outDir)
 	stream.Send = func(kvs *pb.KVList) error {
+		for _, kv := range kvs.Kv {
+			if err := remapCFKey(cfIDs, kv.Key); err != nil {
+				return err
+			}
+		}
 		return writer.Write(kvs)
 	}
 	if err := stream.Orchestrate(context.Background()); err != nil {
@@ -1986,7 +2358,11 @@ func (db *DB) StreamDB(outOptions Options) error {
 	if err := writer.Flush(); err != nil {
 		return errors.Wrapf(err, "cannot flush writer")
 	}
-	return nil
+	// The stream writer dropped the definitions of the column families along with the rest of
+	// the out DB.
+	outDB.cfs.updateLock.Lock()
+	defer outDB.cfs.updateLock.Unlock()
+	return outDB.persistColumnFamilies()
 }
 
 // Opts returns a copy of the DB options.
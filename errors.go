@@ -42,6 +42,34 @@ var (
 	// happen if the read rows had been updated concurrently by another transaction.
 	ErrConflict = errors.New("Transaction Conflict. Please retry")
 
+	// ErrPreconditionFailed is the cause of the *PreconditionError returned by Txn.Commit if the
+	// version of a key doesn't match the one expected by Txn.SetIfVersion, Txn.SetIfAbsent or
+	// Txn.DeleteIfVersion.
+	ErrPreconditionFailed = errors.New("Precondition failed")
+
+	// ErrInvalidSavepoint is returned by Txn.RollbackTo if the savepoint doesn't exist, or has been
+	// released by rolling back to an earlier one.
+	ErrInvalidSavepoint = errors.New("Invalid savepoint")
+
+	// ErrNoMergeFunc is returned when merge operands are written or read, but Options.MergeFunc
+	// isn't set.
+	ErrNoMergeFunc = errors.New("Options.MergeFunc is not set")
+
+	// ErrHistoryUnavailable is returned by DB.NewTransactionAsOf if the versions needed to read
+	// the DB at the given time may have been discarded, or if the time is before the earliest
+	// commit recorded by the DB. See Options.HistoryRetention. DB.BackupTo returns it if the
+	// versions read by a resumed backup may have been discarded while it ran.
+	ErrHistoryUnavailable = errors.New("History is unavailable at the given time")
+
+	// ErrDeadlock is returned by Txn.GetForUpdate if waiting for the lock on the key would
+	// deadlock, because the transaction holding it is waiting for a lock held by this one, directly
+	// or through other transactions.
+	ErrDeadlock = errors.New("Transaction deadlock. Please retry")
+
+	// ErrLockTimeout is returned by Txn.GetForUpdate if the lock on the key couldn't be acquired
+	// within Options.LockTimeout.
+	ErrLockTimeout = errors.New("Timed out waiting for a lock. Please retry")
+
 	// ErrReadOnlyTxn is returned if an update function is called on a read-only transaction.
 	ErrReadOnlyTxn = errors.New("No sets or deletes are allowed in a read-only transaction")
 
@@ -55,6 +83,22 @@ var (
 	// reserved for internal usage.
 	ErrInvalidKey = errors.New("Key is using a reserved !badger! prefix")
 
+	// ErrInvalidRange is returned if the end of a range passed to Txn.DeleteRange is not
+	// greater than its start.
+	ErrInvalidRange = errors.New("Range end must be greater than range start")
+
+	// ErrColumnFamilyExists is returned if a column family with the same name already exists.
+	ErrColumnFamilyExists = errors.New("Column family already exists")
+
+	// ErrColumnFamilyNotFound is returned if there is no column family with the given name.
+	ErrColumnFamilyNotFound = errors.New("Column family not found")
+
+	// ErrColumnFamilyDropped is returned if a column family is used after it has been dropped.
+	ErrColumnFamilyDropped = errors.New("Column family has been dropped")
+
+	// ErrBackupTruncated is returned by DB.Load if the backup ends before its trailer.
+	ErrBackupTruncated = errors.New("Backup is truncated")
+
 	// ErrThresholdZero is returned if threshold is set to zero, and value log GC is called.
 	// In such a case, GC can't be run.
 	ErrThresholdZero = errors.New(
@@ -108,6 +152,17 @@ var (
 	// ErrNilCallback is returned when subscriber's callback is nil.
 	ErrNilCallback = errors.New("Callback cannot be nil")
 
+	// ErrNoPrefixes is returned by DB.SubscribeFrom if no key prefix is passed to it.
+	ErrNoPrefixes = errors.New("At least one key prefix is required")
+
+	// ErrInvalidMatch is returned if a Match passed to DB.SubscribeMatch selects keys by more than
+	// one of Key, Prefix or Start and End.
+	ErrInvalidMatch = errors.New("Match can only select keys by one of Key, Prefix or range")
+
+	// ErrSlowSubscriber is returned by DB.Subscribe when the subscriber is disconnected because it
+	// couldn't keep up with the updates, see Options.SubscriberPolicy.
+	ErrSlowSubscriber = errors.New("Subscriber disconnected because it couldn't keep up with updates")
+
 	// ErrEncryptionKeyMismatch is returned when the storage key is not
 	// matched with the key previously given.
 	ErrEncryptionKeyMismatch = errors.New("Encryption key mismatch")
@@ -121,6 +176,11 @@ var (
 	// ErrGCInMemoryMode is returned when db.RunValueLogGC is called in in-memory mode.
 	ErrGCInMemoryMode = errors.New("Cannot run value log GC when DB is opened in InMemory mode")
 
+	// ErrCheckpointL0InMemory is returned when db.Checkpoint is called on a DB which keeps its
+	// L0 tables in memory.
+	ErrCheckpointL0InMemory = errors.New(
+		"Cannot checkpoint a DB which keeps L0 tables in memory")
+
 	// ErrDBClosed is returned when a get operation is performed after closing the DB.
 	ErrDBClosed = errors.New("DB Closed")
 )
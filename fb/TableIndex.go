@@ -128,8 +128,20 @@ func (rcv *TableIndex) MutateKeyCount(n uint32) bool {
 	return rcv._tab.MutateUint32Slot(14, n)
 }
 
+func (rcv *TableIndex) MaxExpiry() uint64 {
+	o := flatbuffers.UOffsetT(rcv._tab.Offset(16))
+	if o != 0 {
+		return rcv._tab.GetUint64(o + rcv._tab.Pos)
+	}
+	return 0
+}
+
+func (rcv *TableIndex) MutateMaxExpiry(n uint64) bool {
+	return rcv._tab.MutateUint64Slot(16, n)
+}
+
 func TableIndexStart(builder *flatbuffers.Builder) {
-	builder.StartObject(6)
+	builder.StartObject(7)
 }
 func TableIndexAddOffsets(builder *flatbuffers.Builder, offsets flatbuffers.UOffsetT) {
 	builder.PrependUOffsetTSlot(0, flatbuffers.UOffsetT(offsets), 0)
@@ -155,6 +167,9 @@ func TableIndexAddUncompressedSize(builder *flatbuffers.Builder, uncompressedSiz
 func TableIndexAddKeyCount(builder *flatbuffers.Builder, keyCount uint32) {
 	builder.PrependUint32Slot(5, keyCount, 0)
 }
+func TableIndexAddMaxExpiry(builder *flatbuffers.Builder, maxExpiry uint64) {
+	builder.PrependUint64Slot(6, maxExpiry, 0)
+}
 func TableIndexEnd(builder *flatbuffers.Builder) flatbuffers.UOffsetT {
 	return builder.EndObject()
 }
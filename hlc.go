@@ -0,0 +1,112 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+)
+
+// hlcLogicalBits is the number of low bits of an HLC timestamp used by the logical counter. The
+// remaining high bits hold the wall time in milliseconds since the Unix epoch.
+const hlcLogicalBits = 16
+
+// HLCTimestamp returns the smallest HLC timestamp at the given wall time. It can be used to
+// address the versions written with HLC timestamps by time, for example in DB.NewStreamAt,
+// DB.NewTransactionAt or DB.Backup.
+func HLCTimestamp(t time.Time) uint64 {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	if ms < 0 {
+		return 0
+	}
+	return uint64(ms) << hlcLogicalBits
+}
+
+// HLCTime returns the wall time of the given HLC timestamp, with a millisecond precision. It can
+// be used to get the time at which a version was written, see Item.Version.
+func HLCTime(ts uint64) time.Time {
+	ms := int64(ts >> hlcLogicalBits)
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// HLC is a hybrid logical clock, which issues timestamps for managed mode. A timestamp holds the
+// wall time in its high bits, and a logical counter in its low bits, which is incremented when
+// the wall time doesn't advance, so that the timestamps are strictly increasing even if the clock
+// of the machine goes backwards. When several nodes replicate their writes to each other, the
+// timestamps received from the other nodes should be passed to Update, so that the writes which
+// causally depend on them get greater timestamps.
+type HLC struct {
+	sync.Mutex
+	last uint64
+	now  func() time.Time
+}
+
+// NewHLC returns a new HLC using the wall clock of the machine.
+func NewHLC() *HLC {
+	return &HLC{now: time.Now}
+}
+
+// Now returns a timestamp greater than all the timestamps returned by the clock or passed to
+// Update before.
+func (c *HLC) Now() uint64 {
+	return c.Update(0)
+}
+
+// Update makes the clock observe a timestamp issued by another clock, and returns a timestamp
+// greater than it and than all the ones returned by this clock before.
+func (c *HLC) Update(ts uint64) uint64 {
+	c.Lock()
+	defer c.Unlock()
+	if ts < c.last {
+		ts = c.last
+	}
+	if wall := HLCTimestamp(c.now()); wall > ts {
+		c.last = wall
+	} else {
+		// The logical counter overflows into the wall time if more than 1<<hlcLogicalBits
+		// timestamps are issued within the same millisecond, which keeps them increasing.
+		c.last = ts + 1
+	}
+	return c.last
+}
+
+// observe makes the timestamps returned by the clock afterwards greater than ts.
+func (c *HLC) observe(ts uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if ts > c.last {
+		c.last = ts
+	}
+}
+
+// HLC returns the hybrid logical clock of the DB, which can be used to pick the timestamps of the
+// transactions in managed mode:
+//
+//	txn := db.NewTransactionAt(db.HLC().Now(), true)
+//	defer txn.Discard()
+//	// Call various APIs.
+//	err := txn.CommitAt(db.HLC().Now(), nil)
+//
+// The timestamps it returns are greater than the versions found in the DB when it was opened, and
+// than the commit timestamps passed to CommitAt since. This will panic if not used with managed
+// transactions.
+func (db *DB) HLC() *HLC {
+	if !db.opt.managedTxns {
+		panic("Cannot use HLC with managedDB=false.")
+	}
+	return db.orc.hlc
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLC(t *testing.T) {
+	wall := time.Unix(1600000000, 0)
+	c := NewHLC()
+	c.now = func() time.Time { return wall }
+
+	ts := c.Now()
+	require.Equal(t, HLCTimestamp(wall), ts)
+	require.Equal(t, wall, HLCTime(ts))
+
+	// The logical counter advances while the wall clock doesn't.
+	require.Equal(t, ts+1, c.Now())
+	wall = wall.Add(-time.Second)
+	require.Equal(t, ts+2, c.Now())
+
+	// A timestamp from another clock ahead of this one moves it forward.
+	remote := HLCTimestamp(wall.Add(time.Minute))
+	require.Equal(t, remote+1, c.Update(remote))
+	require.Equal(t, remote+2, c.Now())
+	require.Equal(t, remote+3, c.Update(ts))
+
+	wall = wall.Add(time.Hour)
+	require.Equal(t, HLCTimestamp(wall), c.Now())
+	require.Equal(t, wall.Add(time.Millisecond), HLCTime(HLCTimestamp(wall.Add(time.Millisecond))))
+}
+
+func TestManagedHLC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	start := time.Now()
+	txn := db.NewTransactionAt(db.HLC().Now(), true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("val")))
+	require.NoError(t, txn.CommitAt(db.HLC().Now(), nil))
+
+	var version uint64
+	require.NoError(t, db.View(func(txn *Txn) error {
+		item, err := txn.Get([]byte("key"))
+		require.NoError(t, err)
+		version = item.Version()
+		return nil
+	}))
+	written := HLCTime(version)
+	require.WithinDuration(t, start, written, time.Minute)
+
+	// The clock observes the commit timestamps picked by the user.
+	future := HLCTimestamp(start.Add(time.Hour))
+	txn = db.NewTransactionAt(future, true)
+	require.NoError(t, txn.Set([]byte("key"), []byte("future")))
+	require.NoError(t, txn.CommitAt(future, nil))
+	require.True(t, db.HLC().Now() > future)
+	require.NoError(t, db.Close())
+
+	// The clock starts after the versions found in the DB, even if the wall clock is behind them.
+	db, err = OpenManaged(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+	require.True(t, db.HLC().Now() > future)
+}
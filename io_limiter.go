@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// ioLimiterChunkSize is the size of the chunks in which ioLimiter.write writes, so that a large
+// table is written at a steady rate rather than in bursts.
+const ioLimiterChunkSize = 256 << 10
+
+// ioLimiter is a token bucket limiting the rate of the background I/O, see
+// Options.BackgroundIORate. A token is a byte, and the bucket holds up to a second worth of I/O.
+type ioLimiter struct {
+	sync.Mutex
+	rate    float64 // Bytes per second. Zero means no limit.
+	tokens  float64
+	last    time.Time
+	changed chan struct{} // Closed when the rate changes, to wake up the waiters.
+}
+
+func newIOLimiter(rate int64) *ioLimiter {
+	l := &ioLimiter{changed: make(chan struct{})}
+	l.setRate(rate)
+	return l
+}
+
+// refill adds the tokens accumulated since the last refill. It must be called with the lock held.
+func (l *ioLimiter) refill(now time.Time) {
+	l.tokens = math.Min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+}
+
+func (l *ioLimiter) setRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if l.rate == 0 {
+		// Start with a full bucket.
+		l.tokens = float64(rate)
+	} else {
+		l.refill(now)
+	}
+	l.rate = float64(rate)
+	l.tokens = math.Min(l.tokens, l.rate)
+	l.last = now
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *ioLimiter) getRate() int64 {
+	l.Lock()
+	defer l.Unlock()
+	return int64(l.rate)
+}
+
+// wait takes n tokens from the bucket, waiting for them if needed. The high priority I/O, like the
+// memtable flushes, never waits, so that it can't be starved by the rest. Its tokens are taken all
+// the same, which delays the low priority I/O until they are paid back.
+func (l *ioLimiter) wait(n int, high bool) {
+	for {
+		l.Lock()
+		if l.rate == 0 {
+			l.Unlock()
+			return
+		}
+		l.refill(time.Now())
+		// The requests larger than the bucket only wait for it to be full.
+		need := math.Min(float64(n), l.rate)
+		if high || l.tokens >= need {
+			l.tokens -= float64(n)
+			l.Unlock()
+			return
+		}
+		d := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.Unlock()
+
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
+// write writes data to w in chunks of ioLimiterChunkSize, taking the tokens for every chunk
+// before writing it.
+func (l *ioLimiter) write(w io.Writer, data []byte, high bool) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > ioLimiterChunkSize {
+			n = ioLimiterChunkSize
+		}
+		l.wait(n, high)
+		if _, err := w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// SetBackgroundIORate changes the rate limiting the background I/O of the DB, in bytes per second,
+// see Options.BackgroundIORate. Zero removes the limit. The compactions waiting for the previous
+// rate pick up the new one right away.
+func (db *DB) SetBackgroundIORate(rate int64) {
+	db.ioLimiter.setRate(rate)
+}
+
+// BackgroundIORate returns the rate limiting the background I/O of the DB, in bytes per second.
+func (db *DB) BackgroundIORate() int64 {
+	return db.ioLimiter.getRate()
+}
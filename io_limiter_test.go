@@ -0,0 +1,72 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOLimiter(t *testing.T) {
+	l := newIOLimiter(4 << 20)
+	// The bucket starts full.
+	start := time.Now()
+	l.wait(4<<20, false)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+
+	// The high priority I/O doesn't wait, but the low priority one pays for it.
+	l.wait(2<<20, true)
+	require.True(t, time.Since(start) < 100*time.Millisecond)
+	var buf bytes.Buffer
+	require.NoError(t, l.write(&buf, make([]byte, 1<<20), false))
+	require.Equal(t, 1<<20, buf.Len())
+	require.True(t, time.Since(start) >= 500*time.Millisecond)
+
+	// Changing the rate wakes up the waiters.
+	l.setRate(1)
+	done := make(chan struct{})
+	go func() {
+		l.wait(1<<20, false)
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.setRate(0)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The waiter wasn't woken up")
+	}
+}
+
+func TestBackgroundIORate(t *testing.T) {
+	opt := getTestOptions("").WithBackgroundIORate(64 << 20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.Equal(t, int64(64<<20), db.BackgroundIORate())
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(fmt.Sprintf("key%d", i)), make([]byte, 1<<10))
+			}))
+		}
+		require.NoError(t, db.Flatten(2))
+		db.SetBackgroundIORate(0)
+		require.Zero(t, db.BackgroundIORate())
+	})
+}
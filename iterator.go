@@ -55,6 +55,10 @@ type Item struct {
 	status   prefetchStatus
 	meta     byte // We need to store meta to know about bitValuePointer.
 	userMeta byte
+	// merge is set if the value is a merge operand to merge into the older versions of the key
+	// when it's read, see Txn.Merge. pending is set if the value of a merge operand or a blob is
+	// a pending write of txn.
+	merge, pending bool
 }
 
 // String returns a string representation of Item
@@ -148,11 +152,33 @@ func (item *Item) DiscardEarlierVersions() bool {
 	return item.meta&bitDiscardEarlierVersions > 0
 }
 
+// IsMergeOperand returns true if the value of the item is a merge operand written by Txn.Merge,
+// rather than the merged value. This is only the case when iterating over all the versions.
+func (item *Item) IsMergeOperand() bool {
+	return isMergeOperand(item.meta) && !item.merge
+}
+
 func (item *Item) yieldItemValue() ([]byte, func(), error) {
 	key := item.Key() // No need to copy.
 	if !item.hasValue() {
 		return nil, nil, nil
 	}
+	if item.merge {
+		var pending [][]byte
+		if item.pending {
+			pending = append(pending, item.vptr)
+		}
+		val, err := item.txn.db.mergeValue(key, item.version, pending)
+		return val, nil, err
+	}
+	if isBlob(item.meta) {
+		r, err := item.blobReader()
+		if err != nil {
+			return nil, nil, err
+		}
+		val, err := r.readAll()
+		return val, nil, err
+	}
 
 	if item.slice == nil {
 		item.slice = new(y.Slice)
@@ -230,6 +256,10 @@ func (item *Item) ValueSize() int64 {
 	if !item.hasValue() {
 		return 0
 	}
+	var m blobManifest
+	if isBlob(item.meta) && item.meta&bitValuePointer == 0 && m.decode(item.vptr) == nil {
+		return int64(m.size)
+	}
 	if (item.meta & bitValuePointer) == 0 {
 		return int64(len(item.vptr))
 	}
@@ -308,6 +338,13 @@ type IteratorOptions struct {
 	// prefix are picked based on their range of keys.
 	prefixIsKey bool   // If set, use the prefix for bloom filter lookup.
 	Prefix      []byte // Only iterate over this given prefix.
+
+	// AsOf, if set, makes the iterator read the DB as it was at this time, like a transaction
+	// created by DB.NewTransactionAsOf, but never past the read timestamp of the transaction. The
+	// pending writes of the transaction are not seen, and the keys read are not tracked for
+	// conflicts. If the DB can't be read at AsOf, the iterator is never valid, and its Err method
+	// returns ErrHistoryUnavailable.
+	AsOf time.Time
 }
 
 func (opt *IteratorOptions) compareToPrefix(key []byte) int {
@@ -394,6 +431,21 @@ type Iterator struct {
 
 	lastKey []byte // Used to skip over multiple versions of the same key.
 
+	cf *ColumnFamily // Set if iterating over a column family.
+
+	historical bool  // Set if IteratorOptions.AsOf is set.
+	err        error // Set if the iterator can't be used. See Err.
+	trackReads bool  // Whether the keys read are tracked for the conflict detection.
+
+	// The range of keys scanned since the last Seek is recorded for the conflict detection of
+	// update txns if Options.DetectRangeConflicts is set. The scan started at scanFrom, reached
+	// scanTo, and went past the last key of the iteration if scanDone is set.
+	trackRange bool
+	scanning   bool
+	scanDone   bool
+	scanFrom   []byte
+	scanTo     []byte
+
 	closed bool
 
 	// ThreadId is an optional value that can be set to identify which goroutine created
@@ -419,6 +471,14 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	if txn.db.IsClosed() {
 		panic(ErrDBClosed.Error())
 	}
+	readTs, historical := txn.readTs, !opt.AsOf.IsZero()
+	var err error
+	if historical {
+		var ts uint64
+		if ts, err = txn.db.orc.readTsAsOf(opt.AsOf); err == nil && ts < readTs {
+			readTs = ts
+		}
+	}
 
 	// Keep track of the number of active iterators.
 	atomic.AddInt32(&txn.numIterators, 1)
@@ -429,7 +489,7 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 	defer decr()
 	txn.db.vlog.incrIteratorCount()
 	var iters []y.Iterator
-	if itr := txn.newPendingWritesIterator(opt.Reverse); itr != nil {
+	if itr := txn.newPendingWritesIterator(opt.Reverse); itr != nil && !historical {
 		iters = append(iters, itr)
 	}
 	for i := 0; i < len(tables); i++ {
@@ -441,7 +501,13 @@ func (txn *Txn) NewIterator(opt IteratorOptions) *Iterator {
 		txn:    txn,
 		iitr:   table.NewMergeIterator(iters, opt.Reverse),
 		opt:    opt,
-		readTs: txn.readTs,
+		readTs: readTs,
+
+		historical: historical,
+		err:        err,
+		// Only the update txns are checked for conflicts.
+		trackReads: txn.update && !historical,
+		trackRange: txn.update && !historical && txn.db.orc.detectRangeConflicts,
 	}
 	return res
 }
@@ -470,20 +536,96 @@ func (it *Iterator) newItem() *Item {
 // Item returns pointer to the current key-value pair.
 // This item is only valid until it.Next() gets called.
 func (it *Iterator) Item() *Item {
-	tx := it.txn
-	tx.addReadKey(it.item.Key())
+	if it.trackReads {
+		it.txn.addReadKey(it.item.Key())
+	}
 	return it.item
 }
 
 // Valid returns false when iteration is done.
 func (it *Iterator) Valid() bool {
-	if it.item == nil {
-		return false
+	var valid bool
+	switch {
+	case it.item == nil, it.err != nil:
+	case it.opt.prefixIsKey:
+		valid = bytes.Equal(it.item.key, it.opt.Prefix)
+	default:
+		valid = bytes.HasPrefix(it.item.key, it.opt.Prefix)
+	}
+	if it.trackRange && it.scanning {
+		if valid {
+			it.scanTo = append(it.scanTo[:0], it.internalKey(it.item.key)...)
+		} else {
+			it.scanDone = true
+		}
 	}
-	if it.opt.prefixIsKey {
-		return bytes.Equal(it.item.key, it.opt.Prefix)
+	return valid
+}
+
+// internalKey returns the key stored in the LSM tree for the given key of the iteration, without
+// the timestamp.
+func (it *Iterator) internalKey(key []byte) []byte {
+	if it.cf == nil {
+		return key
 	}
-	return bytes.HasPrefix(it.item.key, it.opt.Prefix)
+	return it.cf.key(key)
+}
+
+// recordScan adds the range scanned since the last Seek to the ranges read by the txn.
+func (it *Iterator) recordScan() {
+	if !it.scanning {
+		return
+	}
+	it.scanning = false
+	// The iteration is over the keys with the prefix.
+	prefix := it.internalKey(it.opt.Prefix)
+	var r userKeyRange
+	if !it.opt.Reverse {
+		r.start = y.SafeCopy(nil, it.scanFrom)
+		switch {
+		case it.scanDone:
+			r.end = prefixEnd(prefix)
+		case len(it.scanTo) > 0:
+			r.end = append(y.SafeCopy(nil, it.scanTo), 0)
+		default:
+			return // No key has been read.
+		}
+	} else {
+		if len(it.scanFrom) > 0 {
+			r.end = append(y.SafeCopy(nil, it.scanFrom), 0)
+		}
+		switch {
+		case it.scanDone:
+			r.start = prefix
+		case len(it.scanTo) > 0:
+			r.start = y.SafeCopy(nil, it.scanTo)
+		default:
+			return
+		}
+	}
+	if r.end != nil && bytes.Compare(r.start, r.end) >= 0 {
+		return
+	}
+	it.txn.addReadRange(r)
+}
+
+// prefixEnd returns the smallest key greater than all the keys with the given prefix, or nil if
+// there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	end := y.SafeCopy(nil, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Err returns ErrHistoryUnavailable if IteratorOptions.AsOf is set and the DB can't be read at that
+// time, in which case the iterator is never valid.
+func (it *Iterator) Err() error {
+	return it.err
 }
 
 // ValidForPrefix returns false when iteration is done
@@ -498,6 +640,9 @@ func (it *Iterator) Close() {
 		return
 	}
 	it.closed = true
+	if it.trackRange {
+		it.recordScan()
+	}
 
 	it.iitr.Close()
 	// It is important to wait for the fill goroutines to finish. Otherwise, we might leave zombie
@@ -546,6 +691,14 @@ func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
 	return expiresAt <= uint64(time.Now().Unix())
 }
 
+// isRangeDeleted returns true if the given version of the key has been deleted by a range
+// tombstone, either committed or pending in this transaction.
+func (it *Iterator) isRangeDeleted(key []byte, version uint64) bool {
+	k := y.ParseKey(key)
+	return it.txn.coveredByPendingRangeDelete(k) ||
+		it.txn.db.rangeDels.covers(k, version, it.readTs)
+}
+
 // parseItem is a complex function because it needs to handle both forward and reverse iteration
 // implementation. We store keys such that their versions are sorted in descending order. This makes
 // forward iteration efficient, but revese iteration complicated. This tradeoff is better because
@@ -578,6 +731,11 @@ func (it *Iterator) parseItem() bool {
 	}
 
 	if it.opt.AllVersions {
+		// Versions deleted by a range tombstone are gone for good, skip them.
+		if it.isRangeDeleted(key, version) {
+			mi.Next()
+			return false
+		}
 		// Return deleted or expired values also, otherwise user can't figure out
 		// whether the key was deleted.
 		item := it.newItem()
@@ -605,7 +763,8 @@ func (it *Iterator) parseItem() bool {
 FILL:
 	// If deleted, advance and return.
 	vs := mi.Value()
-	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+	if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) ||
+		it.isRangeDeleted(mi.Key(), y.ParseTs(mi.Key())) {
 		mi.Next()
 		return false
 	}
@@ -623,7 +782,7 @@ FILL:
 
 	// Reverse direction.
 	nextTs := y.ParseTs(mi.Key())
-	mik := y.ParseKey(mi.Key())
+	mik := it.userKey(y.ParseKey(mi.Key()))
 	if nextTs <= it.readTs && bytes.Equal(mik, item.key) {
 		// This is a valid potential candidate.
 		goto FILL
@@ -640,11 +799,19 @@ func (it *Iterator) fill(item *Item) {
 	item.expiresAt = vs.ExpiresAt
 
 	item.version = y.ParseTs(it.iitr.Key())
-	item.key = y.SafeCopy(item.key, y.ParseKey(it.iitr.Key()))
+	item.key = y.SafeCopy(item.key, it.userKey(y.ParseKey(it.iitr.Key())))
 
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.val = nil
-	if it.opt.PrefetchValues {
+	item.merge, item.pending = false, false
+	if vs.Meta&bitMergeOperand > 0 && it.cf == nil {
+		// The pending writes take the place of the versions at the read timestamp.
+		_, pending := it.txn.pendingWrites[string(item.key)]
+		item.merge = isMergeOperand(vs.Meta) && !it.opt.AllVersions
+		item.pending = pending && item.version == it.readTs && !it.historical
+	}
+	// The blobs are only read on demand.
+	if it.opt.PrefetchValues && !isBlob(vs.Meta) {
 		item.wg.Add(1)
 		go func() {
 			// FIXME we are not handling errors here.
@@ -678,7 +845,13 @@ func (it *Iterator) prefetch() {
 // smallest key greater than the provided key if iterating in the forward direction.
 // Behavior would be reversed if iterating backwards.
 func (it *Iterator) Seek(key []byte) {
-	if len(key) > 0 {
+	if it.err != nil {
+		return
+	}
+	if it.cf != nil {
+		key = it.cfSeekKey(key)
+	}
+	if len(key) > 0 && it.trackReads {
 		it.txn.addReadKey(key)
 	}
 	for i := it.data.pop(); i != nil; i = it.data.pop() {
@@ -690,6 +863,12 @@ func (it *Iterator) Seek(key []byte) {
 	if len(key) == 0 {
 		key = it.opt.Prefix
 	}
+	if it.trackRange {
+		it.recordScan()
+		it.scanning, it.scanDone = true, false
+		it.scanFrom = append(it.scanFrom[:0], key...)
+		it.scanTo = it.scanTo[:0]
+	}
 	if len(key) == 0 {
 		it.iitr.Rewind()
 		it.prefetch()
@@ -697,7 +876,7 @@ func (it *Iterator) Seek(key []byte) {
 	}
 
 	if !it.opt.Reverse {
-		key = y.KeyWithTs(key, it.txn.readTs)
+		key = y.KeyWithTs(key, it.readTs)
 	} else {
 		key = y.KeyWithTs(key, 0)
 	}
@@ -21,6 +21,7 @@ import (
 	"sort"
 	"sync"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/table"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/pkg/errors"
@@ -100,6 +101,37 @@ func (s *levelHandler) deleteTables(toDel []*table.Table) error {
 	return decrRefs(toDel)
 }
 
+// swapTables removes toDel, putting the table of toAdd with the ID of a removed table in its place.
+// The tables of toAdd must hold keys in the range of the table they replace.
+func (s *levelHandler) swapTables(toDel []*table.Table, toAdd map[uint64]*table.Table) error {
+	s.Lock() // s.Unlock() below
+
+	toDelMap := make(map[uint64]struct{})
+	for _, t := range toDel {
+		toDelMap[t.ID()] = struct{}{}
+	}
+
+	// Make a copy as iterators might be keeping a slice of tables.
+	var newTables []*table.Table
+	for _, t := range s.tables {
+		if _, found := toDelMap[t.ID()]; !found {
+			newTables = append(newTables, t)
+			continue
+		}
+		s.totalSize -= t.Size()
+		if nt, ok := toAdd[t.ID()]; ok {
+			s.totalSize += nt.Size()
+			nt.IncrRef()
+			newTables = append(newTables, nt)
+		}
+	}
+	s.tables = newTables
+
+	s.Unlock() // Unlock s _before_ we DecrRef our tables, which can be slow.
+
+	return decrRefs(toDel)
+}
+
 // replaceTables will replace tables[left:right] with newTables. Note this EXCLUDES tables[right].
 // You must call decr() to delete the old tables _after_ writing the update to the manifest.
 func (s *levelHandler) replaceTables(toDel, toAdd []*table.Table) error {
@@ -186,8 +218,10 @@ func (s *levelHandler) tryAddLevel0Table(t *table.Table) bool {
 	// Need lock as we may be deleting the first table during a level 0 compaction.
 	s.Lock()
 	defer s.Unlock()
-	// Stall (by returning false) if we are above the specified stall setting for L0.
-	if len(s.tables) >= s.db.opt.NumLevelZeroTablesStall {
+	// Stall (by returning false) if we are above the specified stall setting for L0. The FIFO
+	// compactions never merge L0, so the writes would stall until its tables expire.
+	if len(s.tables) >= s.db.opt.NumLevelZeroTablesStall &&
+		s.db.opt.CompactionStyle != options.FIFOCompaction {
 		return false
 	}
 
@@ -44,7 +44,8 @@ type levelsController struct {
 	levels []*levelHandler
 	kv     *DB
 
-	cstatus compactStatus
+	cstatus  compactStatus
+	strategy compactionStrategy // See Options.CompactionStyle.
 	// This is for getting timings between stalls.
 	lastUnstalled time.Time
 }
@@ -81,6 +82,7 @@ func newLevelsController(db *DB, mf *Manifest) (*levelsController, error) {
 		levels: make([]*levelHandler, db.opt.MaxLevels),
 	}
 	s.cstatus.levels = make([]*levelCompactStatus, db.opt.MaxLevels)
+	s.strategy = newCompactionStrategy(s)
 
 	for i := 0; i < db.opt.MaxLevels; i++ {
 		s.levels[i] = newLevelHandler(db, i)
@@ -384,17 +386,9 @@ func (s *levelsController) runCompactor(id int, lc *z.Closer) {
 		select {
 		// Can add a done channel or other stuff.
 		case <-ticker.C:
-			prios := s.pickCompactLevels()
+			prios := s.strategy.pick(id)
 		loop:
 			for _, p := range prios {
-				if id == 0 && p.level > 1 {
-					// If I'm ID zero, I only compact L0 and L1.
-					continue
-				}
-				if id != 0 && p.level <= 1 {
-					// If I'm ID non-zero, I do NOT compact L0 and L1.
-					continue
-				}
 				err := s.doCompact(id, p)
 				switch err {
 				case nil:
@@ -426,8 +420,10 @@ func (l *levelHandler) isCompactable(delSize int64) bool {
 
 type compactionPriority struct {
 	level        int
+	nextLevel    int // Set by the universal compactions, which can skip levels.
 	score        float64
 	dropPrefixes [][]byte
+	drop         []*table.Table // Set by the FIFO compactions, which delete tables unmerged.
 }
 
 // pickCompactLevel determines which level to compact.
@@ -516,9 +512,14 @@ func (s *levelsController) compactBuildTables(
 	switch {
 	case lev == 0:
 		iters = appendIteratorsReversed(iters, topTables, table.NOCACHE)
-	case len(topTables) > 0:
-		y.AssertTrue(len(topTables) == 1)
+	case len(topTables) == 1:
 		iters = []y.Iterator{topTables[0].NewIterator(table.NOCACHE)}
+	case len(topTables) > 1:
+		// The universal compactions merge whole levels.
+		iters = []y.Iterator{table.NewConcatIterator(topTables, table.NOCACHE)}
+	}
+	for _, m := range cd.mid {
+		iters = append(iters, table.NewConcatIterator(m.tables, table.NOCACHE))
 	}
 
 	// Next level has level>=1 and we can use ConcatIterator as key ranges do not overlap.
@@ -526,6 +527,12 @@ func (s *levelsController) compactBuildTables(
 
 nextTable:
 	for _, table := range botTables {
+		if id, ok := cfID(table.Smallest()); ok && s.kv.cfs.isDropped(table.Smallest()) {
+			if bid, ok := cfID(table.Biggest()); ok && bid == id {
+				// All the keys in this table belong to a dropped column family.
+				continue nextTable
+			}
+		}
 		if len(cd.dropPrefixes) > 0 {
 			for _, prefix := range cd.dropPrefixes {
 				if bytes.HasPrefix(table.Smallest(), prefix) &&
@@ -549,10 +556,16 @@ nextTable:
 	// never discard any versions starting from above this timestamp, because
 	// that would affect the snapshot view guarantee provided by transactions.
 	discardTs := s.kv.orc.discardAtOrBelow()
+	// The retention rules may keep more versions of some keys, or expire them.
+	retention := s.kv.newKeyRetention(discardTs)
 
-	var numBuilds, numVersions int
+	var numBuilds, numVersions, numVersionsToKeep, rule int
+	var keyDiscardTs uint64
 	var lastKey, skipKey []byte
 	var vp valuePointer
+	var run operandRun // The merge operands of lastKey being folded.
+	var blobs blobLiveness
+	mergeFunc := s.kv.opt.MergeFunc
 	var newTables []*table.Table
 	mu := new(sync.Mutex) // Guards newTables
 
@@ -569,8 +582,20 @@ nextTable:
 		// Builder does not need cache but the same options are used for opening table.
 		bopts.BlockCache = s.kv.blockCache
 		bopts.IndexCache = s.kv.indexCache
+		// Keys of a column family are kept in tables of their own, so that the tables can use
+		// the compression of the column family.
+		builderCF, _ := cfID(it.Key())
+		if cf := s.kv.cfs.get(it.Key()); cf != nil {
+			bopts.Compression = cf.opt.Compression
+		}
 		builder := table.NewTableBuilder(bopts)
 		var numKeys, numSkips uint64
+		// addRun adds the operands of the run to the table, folded into base if hasBase is set.
+		addRun := func(base []byte, hasBase, complete bool) {
+			key, vs := run.fold(mergeFunc, base, hasBase, complete)
+			numKeys++
+			builder.Add(key, vs, 0)
+		}
 		for ; it.Valid(); it.Next() {
 			// See if we need to skip the prefix.
 			if len(cd.dropPrefixes) > 0 && hasAnyPrefixes(it.Key(), cd.dropPrefixes) {
@@ -578,6 +603,12 @@ nextTable:
 				updateStats(it.Value())
 				continue
 			}
+			// Skip the keys of the dropped column families.
+			if s.kv.cfs.isDropped(it.Key()) {
+				numSkips++
+				updateStats(it.Value())
+				continue
+			}
 
 			// See if we need to skip this key.
 			if len(skipKey) > 0 {
@@ -591,21 +622,94 @@ nextTable:
 			}
 
 			if !y.SameKey(it.Key(), lastKey) {
+				if run.active() {
+					// The older versions of the key in the lower levels need the operands to be
+					// merged into them.
+					addRun(nil, false, !hasOverlap)
+				}
 				if builder.ReachedCapacity(uint64(float64(s.kv.opt.MaxTableSize) * 0.9)) {
 					// Only break if we are on a different key, and have reached capacity. We want
 					// to ensure that all versions of the key are stored in the same sstable, and
 					// not divided across multiple tables at the same level.
 					break
 				}
+				if id, _ := cfID(it.Key()); id != builderCF && !builder.Empty() {
+					break
+				}
 				lastKey = y.SafeCopy(lastKey, it.Key())
 				numVersions = 0
+				rule, numVersionsToKeep, keyDiscardTs = retention.forKey(y.ParseKey(it.Key()))
 			}
 
 			vs := it.Value()
 			version := y.ParseTs(it.Key())
+			if run.active() {
+				// This version is older than the merge operands being folded, so it's at or below
+				// the discard timestamp too.
+				deleted := isDeletedOrExpired(vs.Meta, vs.ExpiresAt) ||
+					retention.expired(rule, version, vs.ExpiresAt) ||
+					s.kv.rangeDels.covers(y.ParseKey(it.Key()), version, keyDiscardTs)
+				switch {
+				case deleted:
+					addRun(nil, false, true)
+					skipKey = y.SafeCopy(skipKey, it.Key())
+					numSkips++
+					updateStats(vs)
+					continue
+				case vs.Meta&(bitValuePointer|bitMergeEntry) > 0 || vs.ExpiresAt > 0:
+					// Leave this version for the reads to merge into, as compactions don't read
+					// the value log, and the merged value must not expire.
+					addRun(nil, false, false)
+				case isMergeOperand(vs.Meta):
+					run.add(it.Key(), vs.Value)
+					numSkips++
+					continue
+				default:
+					// The merged value takes the place of this version.
+					addRun(vs.Value, true, true)
+					numSkips++
+					numVersions++
+					if numVersions == numVersionsToKeep || vs.Meta&bitDiscardEarlierVersions > 0 {
+						skipKey = y.SafeCopy(skipKey, it.Key())
+					}
+					continue
+				}
+			}
+			if version <= keyDiscardTs {
+				// Drop the versions deleted by a range tombstone visible to all the readers.
+				if s.kv.rangeDels.covers(y.ParseKey(it.Key()), version, keyDiscardTs) {
+					numSkips++
+					updateStats(vs)
+					continue
+				}
+				// Drop the range tombstone itself once there is nothing left for it to delete.
+				if vs.Meta&bitRangeDelete > 0 && s.dropRangeTombstone(it.Key()) {
+					numSkips++
+					updateStats(vs)
+					continue
+				}
+			}
+			// The chunks of a blob are discarded along with its manifest.
+			blobChunk := bytes.HasPrefix(it.Key(), blobPrefix)
+			if blobChunk && version <= keyDiscardTs && !s.kv.blobChunkLive(it.Key(), &blobs) {
+				numSkips++
+				updateStats(vs)
+				continue
+			}
+			// Fold the merge operands visible to all the readers, unless their values are in the
+			// value log.
+			if mergeFunc != nil && version <= keyDiscardTs && isMergeOperand(vs.Meta) &&
+				vs.Meta&bitValuePointer == 0 {
+				run.add(it.Key(), vs.Value)
+				numSkips++
+				continue
+			}
 			// Do not discard entries inserted by merge operator. These entries will be
-			// discarded once they're merged
-			if version <= discardTs && vs.Meta&bitMergeEntry == 0 {
+			// discarded once they're merged. Neither are the merge operands, which are only
+			// discarded once folded above. Range tombstones and blob chunks are not versioned
+			// like regular keys, every one of them is kept until dropped above.
+			if version <= keyDiscardTs && !blobChunk && (isBlob(vs.Meta) ||
+				vs.Meta&(bitMergeEntry|bitMergeOperand|bitRangeDelete) == 0) {
 				// Keep track of the number of versions encountered for this key. Only consider the
 				// versions which are below the minReadTs, otherwise, we might end up discarding the
 				// only valid version for a running transaction.
@@ -616,9 +720,19 @@ nextTable:
 				// - We've already processed `NumVersionsToKeep` number of versions
 				// (including the current item being processed)
 				lastValidVersion := vs.Meta&bitDiscardEarlierVersions > 0 ||
-					numVersions == s.kv.opt.NumVersionsToKeep
-
-				isExpired := isDeletedOrExpired(vs.Meta, vs.ExpiresAt)
+					numVersions == numVersionsToKeep
+
+				isExpired := isDeletedOrExpired(vs.Meta, vs.ExpiresAt) ||
+					retention.expired(rule, version, vs.ExpiresAt)
+				if !isExpired {
+					decision, filtered := s.kv.filterVersion(it.Key(), version, vs)
+					if decision != CompactionKeep {
+						// The value is replaced, by a deletion marker if the version is dropped.
+						updateStats(vs)
+						vs = filtered
+						isExpired = decision == CompactionDrop
+					}
+				}
 
 				if isExpired || lastValidVersion {
 					// If this version of the key is deleted or expired, skip all the rest of the
@@ -649,6 +763,9 @@ nextTable:
 			}
 			builder.Add(it.Key(), vs, vp.Len)
 		}
+		if run.active() {
+			addRun(nil, false, !hasOverlap)
+		}
 		// It was true that it.Valid() at least once in the loop above, which means we
 		// called Add() at least once, and builder is not Empty().
 		s.kv.opt.Debugf("LOG Compact. Added %d keys. Skipped %d keys. Iteration took: %v",
@@ -675,7 +792,7 @@ nextTable:
 					return nil, errors.Wrapf(err, "While opening new table: %d", fileID)
 				}
 
-				if _, err := fd.Write(builder.Finish(false)); err != nil {
+				if err := s.kv.ioLimiter.write(fd, builder.Finish(false), false); err != nil {
 					return nil, errors.Wrapf(err, "Unable to write to file: %d", fileID)
 				}
 				tbl, err := table.OpenTable(fd, bopts)
@@ -742,6 +859,11 @@ func buildChangeSet(cd *compactDef, newTables []*table.Table) pb.ManifestChangeS
 			changes = append(changes, newDeleteChange(table.ID()))
 		}
 	}
+	for _, m := range cd.mid {
+		for _, table := range m.tables {
+			changes = append(changes, newDeleteChange(table.ID()))
+		}
+	}
 	for _, table := range cd.bot {
 		changes = append(changes, newDeleteChange(table.ID()))
 	}
@@ -790,6 +912,9 @@ type compactDef struct {
 	nextLevel *levelHandler
 
 	top []*table.Table
+	// mid holds the tables of the levels between thisLevel and nextLevel, which are merged too by
+	// the universal compactions.
+	mid []levelTables
 	bot []*table.Table
 
 	thisRange keyRange
@@ -800,6 +925,12 @@ type compactDef struct {
 	dropPrefixes [][]byte
 }
 
+// levelTables are some tables of a level.
+type levelTables struct {
+	level  *levelHandler
+	tables []*table.Table
+}
+
 func (cd *compactDef) lockLevels() {
 	cd.thisLevel.RLock()
 	cd.nextLevel.RLock()
@@ -813,6 +944,9 @@ func (cd *compactDef) unlockLevels() {
 func (cd *compactDef) allTables() []*table.Table {
 	ret := make([]*table.Table, 0, len(cd.top)+len(cd.bot))
 	ret = append(ret, cd.top...)
+	for _, m := range cd.mid {
+		ret = append(ret, m.tables...)
+	}
 	ret = append(ret, cd.bot...)
 	return ret
 }
@@ -949,6 +1083,13 @@ func (s *levelsController) runCompactDef(l int, cd compactDef) (err error) {
 	if err := nextLevel.replaceTables(cd.bot, newTables); err != nil {
 		return err
 	}
+	numDeleted := len(cd.top) + len(cd.bot)
+	for _, m := range cd.mid {
+		if err := m.level.deleteTables(m.tables); err != nil {
+			return err
+		}
+		numDeleted += len(m.tables)
+	}
 	if err := thisLevel.deleteTables(cd.top); err != nil {
 		return err
 	}
@@ -956,9 +1097,9 @@ func (s *levelsController) runCompactDef(l int, cd compactDef) (err error) {
 	// Note: For level 0, while doCompact is running, it is possible that new tables are added.
 	// However, the tables are added only to the end, so it is ok to just delete the first table.
 
+	s.kv.metrics.addCompaction(thisLevel.level, time.Since(timeStart))
 	s.kv.opt.Infof("LOG Compact %d->%d, del %d tables, add %d tables, took %v\n",
-		thisLevel.level, nextLevel.level, len(cd.top)+len(cd.bot),
-		len(newTables), time.Since(timeStart))
+		thisLevel.level, nextLevel.level, numDeleted, len(newTables), time.Since(timeStart))
 
 	if cd.thisLevel.level != 0 && len(newTables) > 2*s.kv.opt.LevelSizeMultiplier {
 		s.kv.opt.Infof("This Range (numTables: %d)\nLeft:\n%s\nRight:\n%s\n",
@@ -973,6 +1114,9 @@ var errFillTables = errors.New("Unable to fill tables")
 
 // doCompact picks some table on level l and compacts it away to the next level.
 func (s *levelsController) doCompact(id int, p compactionPriority) error {
+	if len(p.drop) > 0 {
+		return s.dropTables(id, p)
+	}
 	l := p.level
 	y.AssertTrue(l+1 < s.kv.opt.MaxLevels) // Sanity check.
 
@@ -989,15 +1133,8 @@ func (s *levelsController) doCompact(id int, p compactionPriority) error {
 
 	// While picking tables to be compacted, both levels' tables are expected to
 	// remain unchanged.
-	if l == 0 {
-		if !s.fillTablesL0(&cd) {
-			return errFillTables
-		}
-
-	} else {
-		if !s.fillTables(&cd) {
-			return errFillTables
-		}
+	if !s.strategy.fill(p, &cd) {
+		return errFillTables
 	}
 	defer s.cstatus.delete(cd) // Remove the ranges from compaction status.
 
@@ -1105,6 +1242,12 @@ func (s *levelsController) get(key []byte, maxVs y.ValueStruct, startLevel int)
 			maxVs = vs
 		}
 	}
+	if maxVs.Meta != 0 || maxVs.Value != nil {
+		// The latest version found might have been deleted by a range tombstone.
+		if s.kv.rangeDels.covers(y.ParseKey(key), maxVs.Version, version) {
+			return y.ValueStruct{Meta: bitDelete, Version: maxVs.Version}, nil
+		}
+	}
 	return maxVs, nil
 }
 
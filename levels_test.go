@@ -1008,3 +1008,48 @@ func TestKeyVersions(t *testing.T) {
 		})
 	})
 }
+
+func TestCompactionRangeTombstone(t *testing.T) {
+	// Disable compactions and keep single version of each key.
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		tombstone := string(rangeDelPrefix) + "a"
+		l0 := []keyValVersion{{tombstone, "c", 5, bitRangeDelete}}
+		l01 := []keyValVersion{{"a", "foo", 2, 0}, {"b", "bar", 3, 0}, {"c", "baz", 1, 0}}
+		l1 := []keyValVersion{{"a", "foo", 1, 0}}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l01, 0)
+		createAndOpen(db, l1, 1)
+		require.NoError(t, db.loadRangeTombstones())
+
+		db.SetDiscardTs(10)
+		getAllAndCheck(t, db, []keyValVersion{
+			{tombstone, "c", 5, bitRangeDelete}, {"c", "baz", 1, 0},
+		})
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		// The deleted keys are gone, but the tombstone is still around since the input tables
+		// were live while it was compacted.
+		require.False(t, db.lc.rangeHasVersionsBelow([]byte("a"), []byte("c"), 5))
+		_, ok := db.rangeDels.get([]byte("a"), 5)
+		require.True(t, ok)
+
+		cdef = compactDef{
+			thisLevel: db.lc.levels[1],
+			nextLevel: db.lc.levels[2],
+			top:       db.lc.levels[1].tables,
+			bot:       db.lc.levels[2].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(1, cdef))
+		getAllAndCheck(t, db, []keyValVersion{{"c", "baz", 1, 0}})
+		_, ok = db.rangeDels.get([]byte("a"), 5)
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sync"
+	"time"
+)
+
+// rowLock is an exclusive lock on a key, held by a txn until it is committed or discarded.
+type rowLock struct {
+	owner uint64
+	// released is closed when the lock is released.
+	released chan struct{}
+}
+
+// lockManager holds the row locks taken by Txn.GetForUpdate. The txns waiting for a lock are
+// tracked in a wait-for graph, so that a txn which would close a cycle in the graph gets
+// ErrDeadlock instead of waiting forever.
+type lockManager struct {
+	sync.Mutex
+	nextID  uint64
+	locks   map[string]*rowLock
+	waitFor map[uint64]uint64 // Maps a txn to the owner of the lock it is waiting for.
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		nextID:  1,
+		locks:   make(map[string]*rowLock),
+		waitFor: make(map[uint64]uint64),
+	}
+}
+
+// newOwnerID returns a new ID to identify a txn taking locks.
+func (lm *lockManager) newOwnerID() uint64 {
+	lm.Lock()
+	defer lm.Unlock()
+	id := lm.nextID
+	lm.nextID++
+	return id
+}
+
+// acquire takes the lock on the key for the txn with the given ID, waiting for at most the given
+// timeout if it is held by another txn. A zero timeout means waiting until the lock is released.
+func (lm *lockManager) acquire(id uint64, key string, timeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	lm.Lock()
+	defer lm.Unlock()
+	for {
+		l, ok := lm.locks[key]
+		if !ok {
+			lm.locks[key] = &rowLock{owner: id, released: make(chan struct{})}
+			return nil
+		}
+		if l.owner == id {
+			return nil
+		}
+		if lm.waitsFor(l.owner, id) {
+			return ErrDeadlock
+		}
+		lm.waitFor[id] = l.owner
+
+		lm.Unlock()
+		var timedOut bool
+		select {
+		case <-l.released:
+		case <-timeoutCh:
+			timedOut = true
+		}
+		lm.Lock()
+
+		delete(lm.waitFor, id)
+		if timedOut {
+			return ErrLockTimeout
+		}
+	}
+}
+
+// waitsFor returns true if the txn a waits for the txn b, either directly or through other txns.
+// It must be called with lm.Lock held.
+func (lm *lockManager) waitsFor(a, b uint64) bool {
+	// Every txn waits for one lock at most, so the path from a is followed until it ends. It can't
+	// be longer than the number of waiting txns, unless it runs into a cycle, which isn't expected
+	// as no lock is granted to a txn closing one.
+	for i := 0; i <= len(lm.waitFor); i++ {
+		if a == b {
+			return true
+		}
+		next, ok := lm.waitFor[a]
+		if !ok {
+			return false
+		}
+		a = next
+	}
+	return false
+}
+
+// release releases the locks held by the txn with the given ID on the keys.
+func (lm *lockManager) release(id uint64, keys []string) {
+	lm.Lock()
+	defer lm.Unlock()
+	for _, key := range keys {
+		if l, ok := lm.locks[key]; ok && l.owner == id {
+			delete(lm.locks, key)
+			close(l.released)
+		}
+	}
+	// The woken up txns don't wait for this one anymore, even before they get to run.
+	for waiter, owner := range lm.waitFor {
+		if owner == id {
+			delete(lm.waitFor, waiter)
+		}
+	}
+}
@@ -46,6 +46,10 @@ type Manifest struct {
 	Levels []levelManifest
 	Tables map[uint64]TableManifest
 
+	// DroppedColumnFamilies contains the IDs of the column families which have been dropped.
+	// Their keys are removed lazily by compactions.
+	DroppedColumnFamilies map[uint32]struct{}
+
 	// Contains total number of creation and deletion changes in the manifest -- used to compute
 	// whether it'd be useful to rewrite the manifest.
 	Creations int
@@ -55,13 +59,15 @@ type Manifest struct {
 func createManifest() Manifest {
 	levels := make([]levelManifest, 0)
 	return Manifest{
-		Levels: levels,
-		Tables: make(map[uint64]TableManifest),
+		Levels:                levels,
+		Tables:                make(map[uint64]TableManifest),
+		DroppedColumnFamilies: make(map[uint32]struct{}),
 	}
 }
 
 // levelManifest contains information about LSM tree levels
-// in the MANIFEST file.
+// in the MANIFEST file. With options.UniversalCompaction, every level but L0 holds a single sorted
+// run and every table of L0 is a run of its own, so the levels represent the sorted runs too.
 type levelManifest struct {
 	Tables map[uint64]struct{} // Set of table id's
 }
@@ -103,10 +109,13 @@ const (
 // asChanges returns a sequence of changes that could be used to recreate the Manifest in its
 // present state.
 func (m *Manifest) asChanges() []*pb.ManifestChange {
-	changes := make([]*pb.ManifestChange, 0, len(m.Tables))
+	changes := make([]*pb.ManifestChange, 0, len(m.Tables)+len(m.DroppedColumnFamilies))
 	for id, tm := range m.Tables {
 		changes = append(changes, newCreateChange(id, int(tm.Level), tm.KeyID, tm.Compression))
 	}
+	for id := range m.DroppedColumnFamilies {
+		changes = append(changes, newDropColumnFamilyChange(id))
+	}
 	return changes
 }
 
@@ -437,6 +446,8 @@ func applyManifestChange(build *Manifest, tc *pb.ManifestChange) error {
 		delete(build.Levels[tm.Level].Tables, tc.Id)
 		delete(build.Tables, tc.Id)
 		build.Deletions++
+	case pb.ManifestChange_DROP_COLUMN_FAMILY:
+		build.DroppedColumnFamilies[uint32(tc.Id)] = struct{}{}
 	default:
 		return fmt.Errorf("MANIFEST file has invalid manifestChange op")
 	}
@@ -473,3 +484,10 @@ func newDeleteChange(id uint64) *pb.ManifestChange {
 		Op: pb.ManifestChange_DELETE,
 	}
 }
+
+func newDropColumnFamilyChange(id uint32) *pb.ManifestChange {
+	return &pb.ManifestChange{
+		Id: uint64(id),
+		Op: pb.ManifestChange_DROP_COLUMN_FAMILY,
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// Match selects the updates a subscriber receives, see DB.SubscribeMatch. The keys are selected by
+// at most one of Key, Prefix or the range [Start, End), and the remaining fields filter out some
+// of the updates to the selected keys. An empty Match selects all the updates.
+type Match struct {
+	// Key selects the updates to this key only.
+	Key []byte
+	// Start and End select the updates to the keys in [Start, End). A nil End means that the range
+	// has no upper bound.
+	Start, End []byte
+	// Prefix selects the updates to the keys with this prefix.
+	Prefix []byte
+
+	// IgnorePrefixes filters out the updates to the keys with any of these prefixes.
+	IgnorePrefixes [][]byte
+	// UserMetaMask filters out the updates whose user meta has none of the bits of the mask set,
+	// unless it is zero.
+	UserMetaMask byte
+	// IgnoreDeletes filters out the deletes and the writes which have already expired. Note that
+	// the range deletes of Txn.DeleteRange aren't published at all, so the subscribers don't see
+	// the keys they delete either way.
+	IgnoreDeletes bool
+	// Filter, if set, is called with the updates which pass the other filters, and filters out the
+	// ones it returns false for. It is called by the goroutine publishing the updates to all the
+	// subscribers, so it should be fast and must not modify the update.
+	Filter func(kv *pb.KV) bool
+}
+
+func (m *Match) isExact() bool {
+	return len(m.Key) > 0
+}
+
+func (m *Match) isRange() bool {
+	return len(m.Start) > 0 || m.End != nil
+}
+
+func (m *Match) validate() error {
+	var selectors int
+	if m.isExact() {
+		selectors++
+	}
+	if m.isRange() {
+		selectors++
+	}
+	if len(m.Prefix) > 0 {
+		selectors++
+	}
+	if selectors > 1 {
+		return ErrInvalidMatch
+	}
+	if m.End != nil && bytes.Compare(m.Start, m.End) >= 0 {
+		return ErrInvalidRange
+	}
+	return nil
+}
+
+// matches returns true if the update passes the filters of the match. The key is expected to be
+// selected by the match already.
+func (m *Match) matches(e *Entry, kv *pb.KV) bool {
+	for _, prefix := range m.IgnorePrefixes {
+		if bytes.HasPrefix(kv.Key, prefix) {
+			return false
+		}
+	}
+	if m.UserMetaMask != 0 && e.UserMeta&m.UserMetaMask == 0 {
+		return false
+	}
+	if m.IgnoreDeletes && isDeletedOrExpired(e.meta, e.ExpiresAt) {
+		return false
+	}
+	return m.Filter == nil || m.Filter(kv)
+}
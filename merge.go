@@ -17,15 +17,19 @@
 package badger
 
 import (
+	"bytes"
+	"encoding/binary"
 	"sync"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/table"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
 	"github.com/pkg/errors"
 )
 
-// MergeOperator represents a Badger merge operator.
+// MergeOperator represents a Badger merge operator. It merges the values of a single key in the
+// background. See Txn.Merge for the merge operands merged by the reads and the compactions.
 type MergeOperator struct {
 	sync.RWMutex
 	f      MergeFunc
@@ -41,6 +45,144 @@ type MergeOperator struct {
 // Note that the ordering of the operands is maintained.
 type MergeFunc func(existingVal, newVal []byte) []byte
 
+// CounterMerge is a MergeFunc for counters stored as 8-byte big-endian integers. It adds the
+// operand to the existing value, treating the values of another size as zero. See CounterOperand.
+func CounterMerge(existingVal, newVal []byte) []byte {
+	return CounterOperand(counterValue(existingVal) + counterValue(newVal))
+}
+
+// CounterOperand returns the operand adding delta to a counter merged by CounterMerge. The value
+// of the counter can be read back with int64(binary.BigEndian.Uint64(val)).
+func CounterOperand(delta int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(delta))
+	return buf[:]
+}
+
+func counterValue(val []byte) int64 {
+	if len(val) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(val))
+}
+
+// AppendMerge is a MergeFunc appending the operand to the existing value.
+func AppendMerge(existingVal, newVal []byte) []byte {
+	val := make([]byte, 0, len(existingVal)+len(newVal))
+	return append(append(val, existingVal...), newVal...)
+}
+
+// foldOperands merges the operands, given newest first, into base, or into the oldest of them if
+// there is no base.
+func foldOperands(f MergeFunc, base []byte, hasBase bool, operands [][]byte) []byte {
+	i := len(operands) - 1
+	if !hasBase && i >= 0 {
+		base, i = operands[i], i-1
+	}
+	for ; i >= 0; i-- {
+		base = f(base, operands[i])
+	}
+	return base
+}
+
+// mergeValue returns the value of the key at readTs, which is a merge operand, merged into the
+// older versions of the key. The pending operands, given newest first, are merged on top of it.
+// The versions are read from a snapshot of the LSM tree, so that they can't be folded by a
+// compaction in the meantime.
+func (db *DB) mergeValue(key []byte, readTs uint64, pending [][]byte) ([]byte, error) {
+	if db.opt.MergeFunc == nil {
+		return nil, ErrNoMergeFunc
+	}
+	tables, decr := db.getMemTables()
+	defer decr()
+	db.vlog.incrIteratorCount()
+	defer func() { _ = db.vlog.decrIteratorCount() }()
+	var iters []y.Iterator
+	for _, mt := range tables {
+		iters = append(iters, mt.NewUniIterator(false))
+	}
+	iters = db.lc.appendIterators(iters, &IteratorOptions{Prefix: key, prefixIsKey: true})
+	it := table.NewMergeIterator(iters, false)
+	defer it.Close()
+
+	operands := append([][]byte{}, pending...)
+	var base []byte
+	var hasBase bool
+	for it.Seek(y.KeyWithTs(key, readTs)); it.Valid(); it.Next() {
+		if !bytes.Equal(y.ParseKey(it.Key()), key) {
+			break
+		}
+		vs := it.Value()
+		if isDeletedOrExpired(vs.Meta, vs.ExpiresAt) ||
+			db.rangeDels.covers(key, y.ParseTs(it.Key()), readTs) {
+			break
+		}
+		val, err := db.readValue(vs)
+		if err == nil && isBlob(vs.Meta) {
+			var r *blobReader
+			if r, err = newBlobReader(db, nil, key, y.ParseTs(it.Key()), val); err == nil {
+				val, err = r.readAll()
+			}
+		}
+		if err != nil {
+			return nil, y.Wrapf(err, "while merging the value of key: %q", key)
+		}
+		if !isMergeOperand(vs.Meta) {
+			base, hasBase = val, true
+			break
+		}
+		operands = append(operands, val)
+	}
+	return foldOperands(db.opt.MergeFunc, base, hasBase, operands), nil
+}
+
+// readValue returns a copy of the value of vs, reading it from the value log if needed.
+func (db *DB) readValue(vs y.ValueStruct) ([]byte, error) {
+	if vs.Meta&bitValuePointer == 0 {
+		return y.SafeCopy(nil, vs.Value), nil
+	}
+	var vp valuePointer
+	vp.Decode(vs.Value)
+	val, cb, err := db.vlog.Read(vp, new(y.Slice))
+	defer runCallback(cb)
+	if err != nil {
+		return nil, err
+	}
+	return y.SafeCopy(nil, val), nil
+}
+
+// operandRun holds the merge operands of a key which a compaction folds together, along with the
+// value they apply to if the compaction finds it.
+type operandRun struct {
+	key      []byte   // The key of the newest operand, with its version.
+	operands [][]byte // The operands, newest first.
+}
+
+func (r *operandRun) active() bool {
+	return len(r.key) > 0
+}
+
+func (r *operandRun) add(key, operand []byte) {
+	if len(r.key) == 0 {
+		r.key = y.SafeCopy(r.key, key)
+	}
+	r.operands = append(r.operands, y.SafeCopy(nil, operand))
+}
+
+// fold returns the key and the value struct replacing the operands of the run, and resets it.
+// The operands are merged into base if hasBase is set. The result is a value if complete is set,
+// that is if the older versions of the key don't matter, or an operand otherwise.
+func (r *operandRun) fold(f MergeFunc, base []byte, hasBase, complete bool) (
+	[]byte, y.ValueStruct) {
+	vs := y.ValueStruct{Value: foldOperands(f, base, hasBase, r.operands)}
+	if !complete {
+		vs.Meta = bitMergeOperand
+	}
+	key := r.key
+	r.key, r.operands = nil, nil
+	return key, vs
+}
+
 // GetMergeOperator creates a new MergeOperator for a given key and returns a
 // pointer to it. It also fires off a goroutine that performs a compaction using
 // the merge function that runs periodically, as specified by dur.
@@ -18,10 +18,12 @@ package badger
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v2/y"
 	"github.com/stretchr/testify/require"
 )
 
@@ -167,3 +169,175 @@ func bytesToUint64(b []byte) uint64 {
 func add(existing, new []byte) []byte {
 	return uint64ToBytes(bytesToUint64(existing) + bytesToUint64(new))
 }
+
+func TestTxnMerge(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.Equal(t, ErrNoMergeFunc, txn.Merge([]byte("key"), CounterOperand(1)))
+	})
+
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithMergeFunc(CounterMerge)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	key := []byte("counter")
+	merge := func(delta int64) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Merge(key, CounterOperand(delta))
+		}))
+	}
+	get := func(txn *Txn) int64 {
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.False(t, item.IsMergeOperand())
+		return int64(binary.BigEndian.Uint64(val))
+	}
+	check := func(want int64) {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			require.Equal(t, want, get(txn))
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			it.Rewind()
+			require.True(t, it.Valid())
+			val, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, want, counterValue(val))
+			return nil
+		}))
+	}
+
+	// A key without value takes the value of the operand.
+	merge(3)
+	check(3)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set(key, CounterOperand(10))
+	}))
+	merge(5)
+	merge(-2)
+	check(13)
+
+	// The txns merging into the same key don't conflict.
+	txn1, txn2 := db.NewTransaction(true), db.NewTransaction(true)
+	require.NoError(t, txn1.Merge(key, CounterOperand(1)))
+	require.NoError(t, txn2.Merge(key, CounterOperand(1)))
+	require.NoError(t, txn1.Commit())
+	require.NoError(t, txn2.Commit())
+	check(15)
+
+	// The pending operands are merged together, and into the committed value.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Merge(key, CounterOperand(1)))
+		require.Equal(t, int64(16), get(txn))
+		require.NoError(t, txn.Merge(key, CounterOperand(1)))
+		require.Equal(t, int64(17), get(txn))
+		it := txn.NewIterator(DefaultIteratorOptions)
+		defer it.Close()
+		it.Rewind()
+		require.True(t, it.Valid())
+		val, err := it.Item().ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, int64(17), counterValue(val))
+		return nil
+	}))
+	check(17)
+
+	// The operands can be seen when iterating over all the versions.
+	require.NoError(t, db.View(func(txn *Txn) error {
+		iopt := DefaultIteratorOptions
+		iopt.AllVersions = true
+		it := txn.NewIterator(iopt)
+		defer it.Close()
+		var operands []int64
+		for it.Rewind(); it.Valid(); it.Next() {
+			if it.Item().IsMergeOperand() {
+				val, err := it.Item().ValueCopy(nil)
+				require.NoError(t, err)
+				operands = append(operands, counterValue(val))
+			}
+		}
+		require.Equal(t, []int64{2, 1, 1, -2, 5, 3}, operands)
+		return nil
+	}))
+
+	// Merging into a deleted key starts over.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.NoError(t, txn.Delete(key))
+		return txn.Merge(key, CounterOperand(4))
+	}))
+	check(4)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Delete(key)
+	}))
+	merge(1)
+	check(1)
+
+	// The operands are merged the same once flushed to the tables.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check(1)
+}
+
+func TestCompactionMergeOperands(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1).
+		WithMergeFunc(AppendMerge)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		l0 := []keyValVersion{
+			{"a", "3", 3, bitMergeOperand}, {"a", "2", 2, bitMergeOperand},
+			{"b", "x", 12, bitMergeOperand}, {"b", "2", 2, bitMergeOperand},
+			{"c", "3", 3, bitMergeOperand}, {"c", "2", 2, bitMergeOperand},
+			{"d", "3", 3, bitMergeOperand},
+		}
+		l1 := []keyValVersion{
+			{"a", "1", 1, 0}, {"b", "1", 1, 0}, {"d", "", 2, bitDelete}, {"d", "1", 1, 0},
+		}
+		// The lower levels hold an older version of c, which the operands must be merged into.
+		l2 := []keyValVersion{{"c", "1", 1, 0}}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l1, 1)
+		createAndOpen(db, l2, 2)
+
+		db.SetDiscardTs(10)
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		var keys []string
+		for _, tbl := range db.lc.levels[1].tables {
+			it := tbl.NewIterator(0)
+			for it.Rewind(); it.Valid(); it.Next() {
+				vs := it.Value()
+				key := fmt.Sprintf("%s@%d=%s", y.ParseKey(it.Key()), y.ParseTs(it.Key()), vs.Value)
+				if vs.Meta&bitMergeOperand > 0 {
+					key += " (operand)"
+				}
+				keys = append(keys, key)
+			}
+			require.NoError(t, it.Close())
+		}
+		require.Equal(t, []string{
+			"a@3=123", "b@12=x (operand)", "b@2=12", "c@3=23 (operand)", "d@3=3",
+		}, keys)
+
+		txn := db.NewTransactionAt(20, false)
+		defer txn.Discard()
+		for key, want := range map[string]string{"a": "123", "b": "12x", "c": "123", "d": "3"} {
+			item, err := txn.Get([]byte(key))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, want, string(val), "key %s", key)
+		}
+	})
+}
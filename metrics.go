@@ -0,0 +1,392 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto"
+)
+
+// Metrics is a point in time snapshot of the metrics of a single DB. Unlike the expvar metrics
+// in package y, which are shared by all the DBs in the process, these are tracked per DB.
+type Metrics struct {
+	// LSMSize and VlogSize are the sizes of the LSM tree and the value log on disk, in bytes.
+	// They're refreshed once a minute.
+	LSMSize  int64
+	VlogSize int64
+
+	Levels []LevelMetrics
+
+	// WriteStalls is the number of times writes had to wait for a memtable to be flushed, and
+	// WriteStallDuration the total time spent waiting.
+	WriteStalls        uint64
+	WriteStallDuration time.Duration
+
+	ValueLogGC ValueLogGCMetrics
+	Retries    RetryMetrics
+	BlockCache CacheMetrics
+	IndexCache CacheMetrics
+
+	Subscribers []SubscriberMetrics
+	// SubscriberDisconnects is the number of subscribers disconnected for being too slow, see
+	// Options.SubscriberPolicy.
+	SubscriberDisconnects uint64
+}
+
+// LevelMetrics holds the metrics of a single level of the LSM tree.
+type LevelMetrics struct {
+	Level     int
+	NumTables int
+	Size      int64
+	// Compactions is the number of compactions run from this level into the next one, and
+	// CompactionDuration the total time taken by them.
+	Compactions        uint64
+	CompactionDuration time.Duration
+}
+
+// ValueLogGCMetrics holds the outcomes of the calls to DB.RunValueLogGC, and of the cycles of the
+// background value log GC, see Options.ValueLogGCPolicy.
+type ValueLogGCMetrics struct {
+	Runs       uint64
+	Rewrites   uint64 // Runs which rewrote a value log file.
+	NoRewrites uint64 // Runs which returned ErrNoRewrite.
+	Rejected   uint64 // Runs which returned ErrRejected.
+	Errors     uint64 // Runs which failed with any other error.
+
+	Cycles         uint64
+	BackOffs       uint64 // Cycles skipped because of heavy writes.
+	FilesRewritten uint64 // Files rewritten by the cycles.
+	BytesRewritten uint64 // Total size of the files rewritten by the cycles.
+}
+
+// RetryMetrics holds the outcomes of the calls to DB.UpdateWithRetry.
+type RetryMetrics struct {
+	Calls     uint64
+	Attempts  uint64 // Transactions run by the calls, including their first attempts.
+	Exhausted uint64 // Calls which gave up after RetryPolicy.MaxAttempts attempts.
+	Canceled  uint64 // Calls which gave up because their context was done.
+}
+
+// CacheMetrics holds the metrics of the block or the index cache.
+type CacheMetrics struct {
+	Hits        uint64
+	Misses      uint64
+	KeysAdded   uint64
+	KeysEvicted uint64
+	CostAdded   uint64
+	CostEvicted uint64
+}
+
+// SubscriberMetrics holds the metrics of a single subscriber, see DB.Subscribe.
+type SubscriberMetrics struct {
+	ID      uint64
+	Matches []Match
+	// Pending is the number of updates queued for the subscriber.
+	Pending int64
+	// Lag is the difference between the highest version queued for the subscriber and the highest
+	// version passed to its callback.
+	Lag       uint64
+	Delivered uint64
+	Dropped   uint64
+}
+
+func newCacheMetrics(m *ristretto.Metrics) CacheMetrics {
+	// ristretto.Metrics methods are safe to call on a nil receiver.
+	return CacheMetrics{
+		Hits:        m.Hits(),
+		Misses:      m.Misses(),
+		KeysAdded:   m.KeysAdded(),
+		KeysEvicted: m.KeysEvicted(),
+		CostAdded:   m.CostAdded(),
+		CostEvicted: m.CostEvicted(),
+	}
+}
+
+// metrics holds the counters behind Metrics. All the fields are accessed atomically.
+type metrics struct {
+	writeStalls        uint64
+	writeStallDuration int64
+	vlogBytesWritten   uint64
+
+	compactions        []uint64
+	compactionDuration []int64
+
+	gcRuns       uint64
+	gcRewrites   uint64
+	gcNoRewrites uint64
+	gcRejected   uint64
+	gcErrors     uint64
+
+	gcCycles         uint64
+	gcBackOffs       uint64
+	gcFilesRewritten uint64
+	gcBytesRewritten uint64
+
+	retryCalls     uint64
+	retryAttempts  uint64
+	retryExhausted uint64
+	retryCanceled  uint64
+}
+
+func newMetrics(opt Options) *metrics {
+	return &metrics{
+		compactions:        make([]uint64, opt.MaxLevels),
+		compactionDuration: make([]int64, opt.MaxLevels),
+	}
+}
+
+func (m *metrics) addWriteStall(d time.Duration) {
+	atomic.AddUint64(&m.writeStalls, 1)
+	atomic.AddInt64(&m.writeStallDuration, int64(d))
+}
+
+func (m *metrics) addCompaction(level int, d time.Duration) {
+	atomic.AddUint64(&m.compactions[level], 1)
+	atomic.AddInt64(&m.compactionDuration[level], int64(d))
+}
+
+func (m *metrics) addValueLogGC(err error) {
+	atomic.AddUint64(&m.gcRuns, 1)
+	switch err {
+	case nil:
+		atomic.AddUint64(&m.gcRewrites, 1)
+	case ErrNoRewrite:
+		atomic.AddUint64(&m.gcNoRewrites, 1)
+	case ErrRejected:
+		atomic.AddUint64(&m.gcRejected, 1)
+	default:
+		atomic.AddUint64(&m.gcErrors, 1)
+	}
+}
+
+func (m *metrics) addValueLogGCCycle(cycle ValueLogGCCycle) {
+	atomic.AddUint64(&m.gcCycles, 1)
+	if cycle.BackedOff {
+		atomic.AddUint64(&m.gcBackOffs, 1)
+	}
+	atomic.AddUint64(&m.gcFilesRewritten, uint64(cycle.FilesRewritten))
+	atomic.AddUint64(&m.gcBytesRewritten, uint64(cycle.BytesRewritten))
+}
+
+// Metrics returns a snapshot of the metrics of this DB.
+func (db *DB) Metrics() *Metrics {
+	m := &Metrics{
+		WriteStalls:        atomic.LoadUint64(&db.metrics.writeStalls),
+		WriteStallDuration: time.Duration(atomic.LoadInt64(&db.metrics.writeStallDuration)),
+		ValueLogGC: ValueLogGCMetrics{
+			Runs:       atomic.LoadUint64(&db.metrics.gcRuns),
+			Rewrites:   atomic.LoadUint64(&db.metrics.gcRewrites),
+			NoRewrites: atomic.LoadUint64(&db.metrics.gcNoRewrites),
+			Rejected:   atomic.LoadUint64(&db.metrics.gcRejected),
+			Errors:     atomic.LoadUint64(&db.metrics.gcErrors),
+
+			Cycles:         atomic.LoadUint64(&db.metrics.gcCycles),
+			BackOffs:       atomic.LoadUint64(&db.metrics.gcBackOffs),
+			FilesRewritten: atomic.LoadUint64(&db.metrics.gcFilesRewritten),
+			BytesRewritten: atomic.LoadUint64(&db.metrics.gcBytesRewritten),
+		},
+		Retries: RetryMetrics{
+			Calls:     atomic.LoadUint64(&db.metrics.retryCalls),
+			Attempts:  atomic.LoadUint64(&db.metrics.retryAttempts),
+			Exhausted: atomic.LoadUint64(&db.metrics.retryExhausted),
+			Canceled:  atomic.LoadUint64(&db.metrics.retryCanceled),
+		},
+		BlockCache:            newCacheMetrics(db.BlockCacheMetrics()),
+		IndexCache:            newCacheMetrics(db.IndexCacheMetrics()),
+		Subscribers:           db.pub.metrics(),
+		SubscriberDisconnects: atomic.LoadUint64(&db.pub.disconnects),
+	}
+	m.LSMSize, m.VlogSize = db.Size()
+
+	for _, h := range db.lc.levels {
+		h.RLock()
+		lm := LevelMetrics{
+			Level:     h.level,
+			NumTables: len(h.tables),
+			Size:      h.totalSize,
+		}
+		h.RUnlock()
+		lm.Compactions = atomic.LoadUint64(&db.metrics.compactions[lm.Level])
+		lm.CompactionDuration =
+			time.Duration(atomic.LoadInt64(&db.metrics.compactionDuration[lm.Level]))
+		m.Levels = append(m.Levels, lm)
+	}
+	return m
+}
+
+// NewMetricsHandler returns an http.Handler which renders the metrics of the given DBs in the
+// Prometheus text exposition format. Every sample is labeled with the directory of its DB, so a
+// single handler can serve all the DBs in the process.
+func NewMetricsHandler(dbs ...*DB) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, dbs)
+		_ = bw.Flush()
+	})
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []metricSample
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricLabels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], labelEscaper.Replace(kv[i+1]))
+	}
+	return b.String()
+}
+
+func writeMetrics(w io.Writer, dbs []*DB) {
+	families := []*metricFamily{
+		{name: "badger_lsm_size_bytes", help: "Size of the LSM tree on disk.", typ: "gauge"},
+		{name: "badger_vlog_size_bytes", help: "Size of the value log on disk.", typ: "gauge"},
+		{name: "badger_level_tables", help: "Number of tables in a level.", typ: "gauge"},
+		{name: "badger_level_size_bytes", help: "Size of the tables in a level.", typ: "gauge"},
+		{name: "badger_compactions_total", help: "Number of compactions out of a level.",
+			typ: "counter"},
+		{name: "badger_compaction_seconds_total", help: "Time spent compacting out of a level.",
+			typ: "counter"},
+		{name: "badger_write_stalls_total", help: "Number of times writes waited for a flush.",
+			typ: "counter"},
+		{name: "badger_write_stall_seconds_total", help: "Time writes spent waiting for a flush.",
+			typ: "counter"},
+		{name: "badger_vlog_gc_runs_total", help: "Number of value log GC runs by result.",
+			typ: "counter"},
+		{name: "badger_cache_hits_total", help: "Number of cache hits.", typ: "counter"},
+		{name: "badger_cache_misses_total", help: "Number of cache misses.", typ: "counter"},
+		{name: "badger_cache_keys_added_total", help: "Number of keys added to a cache.",
+			typ: "counter"},
+		{name: "badger_cache_keys_evicted_total", help: "Number of keys evicted from a cache.",
+			typ: "counter"},
+		{name: "badger_cache_cost_added_total", help: "Cost of the keys added to a cache.",
+			typ: "counter"},
+		{name: "badger_cache_cost_evicted_total", help: "Cost of the keys evicted from a cache.",
+			typ: "counter"},
+		{name: "badger_subscriber_pending_updates", help: "Number of updates queued for a " +
+			"subscriber.", typ: "gauge"},
+		{name: "badger_subscriber_lag_versions", help: "Versions between the latest update queued " +
+			"for a subscriber and the latest one delivered.", typ: "gauge"},
+		{name: "badger_subscriber_delivered_total", help: "Number of updates delivered to a " +
+			"subscriber.", typ: "counter"},
+		{name: "badger_subscriber_dropped_total", help: "Number of updates dropped for a " +
+			"subscriber.", typ: "counter"},
+		{name: "badger_subscriber_disconnects_total", help: "Number of subscribers disconnected " +
+			"for being too slow.", typ: "counter"},
+		{name: "badger_update_retry_calls_total", help: "Number of calls to UpdateWithRetry.",
+			typ: "counter"},
+		{name: "badger_update_retry_attempts_total", help: "Number of transactions run by " +
+			"UpdateWithRetry.", typ: "counter"},
+		{name: "badger_update_retry_failures_total", help: "Number of calls to UpdateWithRetry " +
+			"which gave up, by reason.", typ: "counter"},
+		{name: "badger_vlog_gc_cycles_total", help: "Number of background value log GC cycles by " +
+			"result.", typ: "counter"},
+		{name: "badger_vlog_gc_files_rewritten_total", help: "Number of value log files " +
+			"rewritten by the background GC.", typ: "counter"},
+		{name: "badger_vlog_gc_rewritten_bytes_total", help: "Size of the value log files " +
+			"rewritten by the background GC.", typ: "counter"},
+	}
+	add := func(i int, value float64, labels string) {
+		families[i].samples = append(families[i].samples, metricSample{labels, value})
+	}
+
+	for _, db := range dbs {
+		m := db.Metrics()
+		dir := db.opt.Dir
+		l := metricLabels("dir", dir)
+		add(0, float64(m.LSMSize), l)
+		add(1, float64(m.VlogSize), l)
+		for _, lm := range m.Levels {
+			ll := metricLabels("dir", dir, "level", strconv.Itoa(lm.Level))
+			add(2, float64(lm.NumTables), ll)
+			add(3, float64(lm.Size), ll)
+			add(4, float64(lm.Compactions), ll)
+			add(5, lm.CompactionDuration.Seconds(), ll)
+		}
+		add(6, float64(m.WriteStalls), l)
+		add(7, m.WriteStallDuration.Seconds(), l)
+
+		gc := m.ValueLogGC
+		add(8, float64(gc.Rewrites), metricLabels("dir", dir, "result", "rewrite"))
+		add(8, float64(gc.NoRewrites), metricLabels("dir", dir, "result", "no_rewrite"))
+		add(8, float64(gc.Rejected), metricLabels("dir", dir, "result", "rejected"))
+		add(8, float64(gc.Errors), metricLabels("dir", dir, "result", "error"))
+
+		for _, c := range []struct {
+			name string
+			cm   CacheMetrics
+		}{{"block", m.BlockCache}, {"index", m.IndexCache}} {
+			cl := metricLabels("dir", dir, "cache", c.name)
+			add(9, float64(c.cm.Hits), cl)
+			add(10, float64(c.cm.Misses), cl)
+			add(11, float64(c.cm.KeysAdded), cl)
+			add(12, float64(c.cm.KeysEvicted), cl)
+			add(13, float64(c.cm.CostAdded), cl)
+			add(14, float64(c.cm.CostEvicted), cl)
+		}
+
+		for _, sm := range m.Subscribers {
+			sl := metricLabels("dir", dir, "subscriber", strconv.FormatUint(sm.ID, 10))
+			add(15, float64(sm.Pending), sl)
+			add(16, float64(sm.Lag), sl)
+			add(17, float64(sm.Delivered), sl)
+			add(18, float64(sm.Dropped), sl)
+		}
+		add(19, float64(m.SubscriberDisconnects), l)
+
+		rm := m.Retries
+		add(20, float64(rm.Calls), l)
+		add(21, float64(rm.Attempts), l)
+		add(22, float64(rm.Exhausted), metricLabels("dir", dir, "reason", "exhausted"))
+		add(22, float64(rm.Canceled), metricLabels("dir", dir, "reason", "canceled"))
+
+		add(23, float64(gc.Cycles-gc.BackOffs), metricLabels("dir", dir, "result", "run"))
+		add(23, float64(gc.BackOffs), metricLabels("dir", dir, "result", "backoff"))
+		add(24, float64(gc.FilesRewritten), l)
+		add(25, float64(gc.BytesRewritten), l)
+	}
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(w, "%s{%s} %s\n", f.name, s.labels,
+				strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 2, 0}}, 0)
+		createAndOpen(db, []keyValVersion{{"foo", "bar", 1, 0}}, 1)
+
+		m := db.Metrics()
+		require.Len(t, m.Levels, db.opt.MaxLevels)
+		require.Equal(t, 1, m.Levels[0].NumTables)
+		require.Equal(t, uint64(0), m.Levels[0].Compactions)
+
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		require.Equal(t, ErrNoRewrite, db.RunValueLogGC(0.5))
+
+		m = db.Metrics()
+		require.Equal(t, 0, m.Levels[0].NumTables)
+		require.Equal(t, 1, m.Levels[1].NumTables)
+		require.Equal(t, uint64(1), m.Levels[0].Compactions)
+		require.True(t, m.Levels[0].CompactionDuration > 0)
+		require.Equal(t, ValueLogGCMetrics{Runs: 1, NoRewrites: 1}, m.ValueLogGC)
+	})
+}
+
+func TestMetricsHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("foo"), []byte("bar"))
+	}))
+
+	rec := httptest.NewRecorder()
+	NewMetricsHandler(db).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	require.Contains(t, body, "# TYPE badger_level_tables gauge\n")
+	require.Contains(t, body, fmt.Sprintf("badger_level_tables{dir=%q,level=\"0\"} 0\n", dir))
+	require.Contains(t, body,
+		fmt.Sprintf("badger_vlog_gc_runs_total{dir=%q,result=\"rewrite\"} 0\n", dir))
+	require.Contains(t, body,
+		fmt.Sprintf("badger_cache_hits_total{dir=%q,cache=\"block\"} 0\n", dir))
+}
@@ -73,10 +73,12 @@ type Options struct {
 	ValueLogFileSize   int64
 	ValueLogMaxEntries uint32
 
-	NumCompactors        int
-	CompactL0OnClose     bool
-	LogRotatesToFlush    int32
-	ZSTDCompressionLevel int
+	NumCompactors         int
+	CompactL0OnClose      bool
+	CompactionStyle       options.CompactionStyle
+	FIFOCompactionMaxSize int64
+	LogRotatesToFlush     int32
+	ZSTDCompressionLevel  int
 
 	// When set, checksum will be validated for each entry read from the value log file.
 	VerifyValueChecksum bool
@@ -97,6 +99,27 @@ type Options struct {
 	// conflicts. The transactions can be processed at a higher rate when
 	// conflict detection is disabled.
 	DetectConflicts bool
+	// DetectRangeConflicts determines whether the key ranges read by iterators are checked for
+	// conflicts too.
+	DetectRangeConflicts bool
+	// LockTimeout is how long Txn.GetForUpdate waits for the lock on a key.
+	LockTimeout time.Duration
+	// HistoryRetention is how long the versions are kept for DB.NewTransactionAsOf.
+	HistoryRetention time.Duration
+	// RetentionRules override the retention of the versions of the keys with some prefixes.
+	RetentionRules []RetentionRule
+	// CompactionFilter decides which versions of the keys are kept by compactions.
+	CompactionFilter CompactionFilter
+	// MergeFunc merges the operands written by Txn.Merge into the values of the keys.
+	MergeFunc MergeFunc
+
+	// BackgroundIORate limits the rate of the background I/O, in bytes per second.
+	BackgroundIORate int64
+	// ValueLogGCPolicy configures the value log GC run in the background.
+	ValueLogGCPolicy ValueLogGCPolicy
+
+	// SubscriberPolicy decides what happens to a subscriber which can't keep up with the updates.
+	SubscriberPolicy options.SubscriberPolicy
 
 	// Transaction start and commit timestamps are managed by end-user.
 	// This is only useful for databases built on top of Badger (like Dgraph).
@@ -164,6 +187,7 @@ func DefaultOptions(path string) Options {
 		EncryptionKey:                 []byte{},
 		EncryptionKeyRotationDuration: 10 * 24 * time.Hour, // Default 10 days.
 		DetectConflicts:               true,
+		LockTimeout:                   time.Second,
 	}
 }
 
@@ -177,6 +201,7 @@ func buildTableOptions(opt Options) table.Options {
 		ChkMode:              opt.ChecksumVerificationMode,
 		Compression:          opt.Compression,
 		ZSTDCompressionLevel: opt.ZSTDCompressionLevel,
+		DisposableKeys:       [][]byte{head, txnKey, lfDiscardStatsKey},
 	}
 }
 
@@ -470,6 +495,38 @@ func (opt Options) WithCompactL0OnClose(val bool) Options {
 	return opt
 }
 
+// WithCompactionStyle returns a new Options value with CompactionStyle set to the given value.
+//
+// CompactionStyle decides how the compactions merge the tables of the LSM tree.
+// options.LeveledCompaction suits most workloads. options.UniversalCompaction merges the sorted
+// runs of similar sizes together, rewriting every key fewer times, which suits the write-heavy
+// ones like the ingestion of time series. options.FIFOCompaction never merges tables, and deletes
+// the oldest ones once their keys have expired, which suits the caches where every key is set with
+// a TTL, see FIFOCompactionMaxSize. It turns CompactL0OnClose off, and can't be used along with
+// KeepL0InMemory unless the DB is in memory. The levels of the tables are kept in the manifest
+// either way, so a DB can be reopened with another CompactionStyle.
+//
+// The default value of CompactionStyle is options.LeveledCompaction.
+func (opt Options) WithCompactionStyle(style options.CompactionStyle) Options {
+	opt.CompactionStyle = style
+	return opt
+}
+
+// WithFIFOCompactionMaxSize returns a new Options value with FIFOCompactionMaxSize set to the given
+// value.
+//
+// FIFOCompactionMaxSize is the total size of the tables above which options.FIFOCompaction
+// deletes the oldest ones, whether their keys have expired or not. It doesn't account for the
+// value log, whose files are reclaimed by the value log GC once the tables pointing to them are
+// deleted. Zero means no limit, the tables being deleted only once their keys have expired. The
+// definitions of the column families and the range tombstones of the deleted tables are kept.
+//
+// The default value of FIFOCompactionMaxSize is 0.
+func (opt Options) WithFIFOCompactionMaxSize(val int64) Options {
+	opt.FIFOCompactionMaxSize = val
+	return opt
+}
+
 // WithLogRotatesToFlush returns a new Options value with LogRotatesToFlush set to the given value.
 //
 // LogRotatesToFlush sets the number of value log file rotates after which the Memtables are
@@ -656,3 +713,131 @@ func (opt Options) WithDetectConflicts(b bool) Options {
 	opt.DetectConflicts = b
 	return opt
 }
+
+// WithDetectRangeConflicts returns a new Options value with DetectRangeConflicts set to the given
+// value.
+//
+// By default, only the keys returned by Txn.Get and Iterator.Item are checked for conflicts, so a
+// key written by another transaction into a range scanned by an update transaction doesn't make it
+// conflict. When DetectRangeConflicts is set, the ranges of keys scanned by the iterators of update
+// transactions are recorded, and the transaction fails with ErrConflict if another transaction
+// committed a write or a range delete in any of them after it started. The keys read by Txn.Get
+// are also checked against the ranges deleted by Txn.DeleteRange, which the default detection
+// misses. This makes the update transactions serializable, at the cost of keeping the keys read
+// and written by recent transactions in memory. It has no effect unless DetectConflicts is set.
+//
+// The default value of DetectRangeConflicts is false.
+func (opt Options) WithDetectRangeConflicts(b bool) Options {
+	opt.DetectRangeConflicts = b
+	return opt
+}
+
+// WithLockTimeout returns a new Options value with LockTimeout set to the given value.
+//
+// LockTimeout is how long Txn.GetForUpdate waits for the lock on a key held by another
+// transaction, before returning ErrLockTimeout. A zero LockTimeout means waiting until the lock
+// is released.
+//
+// The default value of LockTimeout is 1 second.
+func (opt Options) WithLockTimeout(d time.Duration) Options {
+	opt.LockTimeout = d
+	return opt
+}
+
+// WithHistoryRetention returns a new Options value with HistoryRetention set to the given value.
+//
+// HistoryRetention is how far back in time the DB can be read by DB.NewTransactionAsOf and
+// IteratorOptions.AsOf. The compactions keep the versions needed to read the DB as it was at any
+// time within the retention period, at the cost of the disk space taken by the older versions.
+// Keeping more versions with NumVersionsToKeep isn't enough to read the DB at a past time, as the
+// versions of the keys are not discarded at the same times.
+//
+// The default value of HistoryRetention is 0, which means that only the latest versions can be
+// read.
+func (opt Options) WithHistoryRetention(d time.Duration) Options {
+	opt.HistoryRetention = d
+	return opt
+}
+
+// WithRetentionRules returns a new Options value with RetentionRules set to the given value.
+//
+// RetentionRules declare how the versions of the keys with some prefixes are retained, instead of
+// NumVersionsToKeep and the expiry set on every entry. For example, a rule can keep the history of
+// the keys with an audit prefix for a week, while another one makes the keys with a cache prefix
+// expire after an hour. The rules can be changed at runtime with DB.SetRetentionRules.
+//
+// The default value of RetentionRules is nil.
+func (opt Options) WithRetentionRules(rules []RetentionRule) Options {
+	opt.RetentionRules = rules
+	return opt
+}
+
+// WithCompactionFilter returns a new Options value with CompactionFilter set to the given value.
+//
+// CompactionFilter is called by the compactions with the versions of the keys they keep, and can
+// drop them or rewrite their values. This allows the application to garbage collect the records
+// whose liveness only it can tell, without scanning the DB to delete them. See CompactionFilter
+// for the versions it is called with.
+//
+// The default value of CompactionFilter is nil.
+func (opt Options) WithCompactionFilter(filter CompactionFilter) Options {
+	opt.CompactionFilter = filter
+	return opt
+}
+
+// WithMergeFunc returns a new Options value with MergeFunc set to the given value.
+//
+// MergeFunc merges the operands written by Txn.Merge into the values of the keys when they are
+// read, and compactions use it to fold the operands together. It must be associative, as the
+// compactions merge consecutive operands before merging them into the value, and it must not
+// modify its arguments. CounterMerge and AppendMerge are provided for the common cases. A DB
+// holding merge operands must always be opened with the same MergeFunc.
+//
+// The default value of MergeFunc is nil, in which case Txn.Merge returns ErrNoMergeFunc.
+func (opt Options) WithMergeFunc(f MergeFunc) Options {
+	opt.MergeFunc = f
+	return opt
+}
+
+// WithBackgroundIORate returns a new Options value with BackgroundIORate set to the given value.
+//
+// BackgroundIORate limits the rate at which the compactions, including the ones run by DB.Flatten,
+// the memtable flushes, the value log GC and the StreamWriter write to disk, in bytes per second,
+// so that they don't starve the reads of the application. The limit is shared by all of them.
+// The memtable flushes never wait for it, as the writes would stall otherwise, but they count
+// towards it, slowing down the rest. The rate can be changed at runtime with
+// DB.SetBackgroundIORate.
+//
+// The default value of BackgroundIORate is 0, which means no limit.
+func (opt Options) WithBackgroundIORate(rate int64) Options {
+	opt.BackgroundIORate = rate
+	return opt
+}
+
+// WithValueLogGCPolicy returns a new Options value with ValueLogGCPolicy set to the given value.
+//
+// ValueLogGCPolicy makes the DB run the value log GC in the background, instead of the application
+// calling DB.RunValueLogGC. Every cycle ranks the value log files by the discard stats collected
+// by the compactions, and rewrites the ones above the discard ratio, up to a number of bytes per
+// cycle. The cycles are skipped while the writes are heavy. DefaultValueLogGCPolicy is a good
+// starting point. The background GC is not run in InMemory or ReadOnly mode.
+//
+// The default value of ValueLogGCPolicy is the zero value, which disables the background GC.
+func (opt Options) WithValueLogGCPolicy(policy ValueLogGCPolicy) Options {
+	opt.ValueLogGCPolicy = policy
+	return opt
+}
+
+// WithSubscriberPolicy returns a new Options value with SubscriberPolicy set to the given value.
+//
+// SubscriberPolicy decides what happens when the updates queued for a subscriber (see
+// DB.Subscribe) pile up because its callback is too slow. options.SubscriberBlock waits for the
+// subscriber, which stalls the writes once the publisher falls behind. options.SubscriberDropOldest
+// drops the oldest queued updates and reports the gap to the subscriber, and
+// options.SubscriberDisconnect disconnects the subscriber.
+//
+// The default value of SubscriberPolicy is options.SubscriberBlock.
+func (opt Options) WithSubscriberPolicy(policy options.SubscriberPolicy) Options {
+	opt.SubscriberPolicy = policy
+	return opt
+}
@@ -55,3 +55,36 @@ const (
 	// ZSTD mode indicates that a block is compressed using ZSTD algorithm.
 	ZSTD CompressionType = 2
 )
+
+// SubscriberPolicy specifies what happens when a subscriber can't keep up with the updates.
+type SubscriberPolicy int
+
+const (
+	// SubscriberBlock makes the publisher wait for the subscriber, which eventually stalls the
+	// writes to the DB.
+	SubscriberBlock SubscriberPolicy = iota
+	// SubscriberDropOldest drops the oldest updates queued for the subscriber to make room for
+	// the new ones. The subscriber is told about the gap by KVList.Dropped.
+	SubscriberDropOldest
+	// SubscriberDisconnect disconnects the subscriber, and its Subscribe call returns
+	// ErrSlowSubscriber.
+	SubscriberDisconnect
+)
+
+// CompactionStyle specifies how the compactions merge the tables of the LSM tree.
+type CompactionStyle int
+
+const (
+	// LeveledCompaction keeps every level below L0 under a size limit, growing by
+	// LevelSizeMultiplier from one level to the next, and merges the tables of a level into the
+	// overlapping tables of the next one. It keeps the space and the read amplification low.
+	LeveledCompaction CompactionStyle = iota
+	// UniversalCompaction, also known as tiered compaction, sees every level below L0 as a sorted
+	// run, and merges whole runs of similar sizes together. It keeps the write amplification low,
+	// at the cost of more space and read amplification.
+	UniversalCompaction
+	// FIFOCompaction never merges tables. It deletes the oldest tables as a whole once all their
+	// keys have expired, or once the tables take more than Options.FIFOCompactionMaxSize. It
+	// suits caches where every key is set with an expiry.
+	FIFOCompaction
+)
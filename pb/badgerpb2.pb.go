@@ -47,18 +47,21 @@ func (EncryptionAlgo) EnumDescriptor() ([]byte, []int) {
 type ManifestChange_Operation int32
 
 const (
-	ManifestChange_CREATE ManifestChange_Operation = 0
-	ManifestChange_DELETE ManifestChange_Operation = 1
+	ManifestChange_CREATE             ManifestChange_Operation = 0
+	ManifestChange_DELETE             ManifestChange_Operation = 1
+	ManifestChange_DROP_COLUMN_FAMILY ManifestChange_Operation = 2
 )
 
 var ManifestChange_Operation_name = map[int32]string{
 	0: "CREATE",
 	1: "DELETE",
+	2: "DROP_COLUMN_FAMILY",
 }
 
 var ManifestChange_Operation_value = map[string]int32{
-	"CREATE": 0,
-	"DELETE": 1,
+	"CREATE":             0,
+	"DELETE":             1,
+	"DROP_COLUMN_FAMILY": 2,
 }
 
 func (x ManifestChange_Operation) String() string {
@@ -200,7 +203,11 @@ func (m *KV) GetStreamDone() bool {
 }
 
 type KVList struct {
-	Kv                   []*KV    `protobuf:"bytes,1,rep,name=kv,proto3" json:"kv,omitempty"`
+	Kv []*KV `protobuf:"bytes,1,rep,name=kv,proto3" json:"kv,omitempty"`
+	// Version to resume a subscription from, set by DB.Subscribe and DB.SubscribeFrom.
+	Cursor uint64 `protobuf:"varint,2,opt,name=cursor,proto3" json:"cursor,omitempty"`
+	// Number of updates dropped before this list because the subscriber couldn't keep up.
+	Dropped              uint64   `protobuf:"varint,3,opt,name=dropped,proto3" json:"dropped,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -246,6 +253,20 @@ func (m *KVList) GetKv() []*KV {
 	return nil
 }
 
+func (m *KVList) GetCursor() uint64 {
+	if m != nil {
+		return m.Cursor
+	}
+	return 0
+}
+
+func (m *KVList) GetDropped() uint64 {
+	if m != nil {
+		return m.Dropped
+	}
+	return 0
+}
+
 type ManifestChangeSet struct {
 	// A set of changes that are applied atomically.
 	Changes              []*ManifestChange `protobuf:"bytes,1,rep,name=changes,proto3" json:"changes,omitempty"`
@@ -522,44 +543,47 @@ func init() {
 func init() { proto.RegisterFile("badgerpb2.proto", fileDescriptor_e63e84f9f0d3998c) }
 
 var fileDescriptor_e63e84f9f0d3998c = []byte{
-	// 589 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x93, 0xcf, 0x6e, 0xda, 0x4e,
-	0x10, 0xc7, 0x59, 0xe3, 0xf0, 0x67, 0x48, 0x08, 0xbf, 0xd5, 0xaf, 0x92, 0xa3, 0x2a, 0x94, 0x3a,
-	0xaa, 0x8a, 0x2a, 0x15, 0x54, 0xa8, 0x7a, 0x27, 0x04, 0x29, 0x88, 0x44, 0x91, 0xb6, 0x51, 0x14,
-	0xf5, 0x82, 0x16, 0x7b, 0x0a, 0x16, 0xf8, 0x8f, 0x76, 0x17, 0xab, 0x3c, 0x44, 0xef, 0x7d, 0xa4,
-	0x1e, 0x7b, 0xe8, 0x03, 0x54, 0xe9, 0x8b, 0x54, 0xbb, 0x36, 0x14, 0x0e, 0xbd, 0xcd, 0x7c, 0xe7,
-	0xbb, 0x3b, 0xe3, 0xcf, 0x8e, 0xe1, 0x74, 0xc6, 0xfd, 0x39, 0x8a, 0x64, 0xd6, 0xeb, 0x24, 0x22,
-	0x56, 0x31, 0xad, 0xee, 0x04, 0xf7, 0x27, 0x01, 0x6b, 0xf2, 0x40, 0x1b, 0x50, 0x5c, 0xe2, 0xc6,
-	0x21, 0x2d, 0xd2, 0x3e, 0x66, 0x3a, 0xa4, 0xff, 0xc3, 0x51, 0xca, 0x57, 0x6b, 0x74, 0x2c, 0xa3,
-	0x65, 0x09, 0x7d, 0x0e, 0xd5, 0xb5, 0x44, 0x31, 0x0d, 0x51, 0x71, 0xa7, 0x68, 0x2a, 0x15, 0x2d,
-	0xdc, 0xa2, 0xe2, 0xd4, 0x81, 0x72, 0x8a, 0x42, 0x06, 0x71, 0xe4, 0xd8, 0x2d, 0xd2, 0xb6, 0xd9,
-	0x36, 0xa5, 0xe7, 0x00, 0xf8, 0x25, 0x09, 0x04, 0xca, 0x29, 0x57, 0xce, 0x91, 0x29, 0x56, 0x73,
-	0x65, 0xa0, 0x28, 0x05, 0xdb, 0x5c, 0x58, 0x32, 0x17, 0x9a, 0x58, 0x77, 0x92, 0x4a, 0x20, 0x0f,
-	0xa7, 0x81, 0xef, 0x40, 0x8b, 0xb4, 0x4f, 0x58, 0x25, 0x13, 0xc6, 0x3e, 0x7d, 0x01, 0xb5, 0xbc,
-	0xe8, 0xc7, 0x11, 0x3a, 0xb5, 0x16, 0x69, 0x57, 0x18, 0x64, 0xd2, 0x55, 0x1c, 0xa1, 0xfb, 0x1a,
-	0x4a, 0x93, 0x87, 0x9b, 0x40, 0x2a, 0x7a, 0x0e, 0xd6, 0x32, 0x75, 0x48, 0xab, 0xd8, 0xae, 0xf5,
-	0x4e, 0x3a, 0x7f, 0x49, 0x4c, 0x1e, 0x98, 0xb5, 0x4c, 0xdd, 0x6b, 0xf8, 0xef, 0x96, 0x47, 0xc1,
-	0x67, 0x94, 0x6a, 0xb8, 0xe0, 0xd1, 0x1c, 0x3f, 0xa2, 0xa2, 0x7d, 0x28, 0x7b, 0x26, 0x91, 0xf9,
-	0xc1, 0xb3, 0xbd, 0x83, 0x87, 0x76, 0xb6, 0x75, 0xba, 0x5f, 0x2d, 0xa8, 0x1f, 0xd6, 0x68, 0x1d,
-	0xac, 0xb1, 0x6f, 0xa0, 0xda, 0xcc, 0x1a, 0xfb, 0xb4, 0x0f, 0xd6, 0x5d, 0x62, 0x80, 0xd6, 0x7b,
-	0x17, 0xff, 0xbc, 0xb2, 0x73, 0x97, 0xa0, 0xe0, 0x2a, 0x88, 0x23, 0x66, 0xdd, 0x25, 0xfa, 0x21,
-	0x6e, 0x30, 0xc5, 0x95, 0xc1, 0x7d, 0xc2, 0xb2, 0x84, 0x3e, 0x83, 0xd2, 0x12, 0x37, 0x9a, 0x4d,
-	0x86, 0xfa, 0x68, 0x89, 0x9b, 0xb1, 0x4f, 0x2f, 0xe1, 0x14, 0x23, 0x4f, 0x6c, 0x12, 0x7d, 0x7c,
-	0xca, 0x57, 0xf3, 0xd8, 0xd0, 0xae, 0x1f, 0x7c, 0xc1, 0x68, 0xe7, 0x18, 0xac, 0xe6, 0x31, 0xab,
-	0xe3, 0x41, 0x4e, 0x5b, 0x50, 0xf3, 0xe2, 0x30, 0x11, 0x28, 0xcd, 0x53, 0x96, 0x4c, 0xdb, 0x7d,
-	0xc9, 0xbd, 0x80, 0xea, 0x6e, 0x46, 0x0a, 0x50, 0x1a, 0xb2, 0xd1, 0xe0, 0x7e, 0xd4, 0x28, 0xe8,
-	0xf8, 0x6a, 0x74, 0x33, 0xba, 0x1f, 0x35, 0x88, 0x9b, 0x42, 0x65, 0xb8, 0x40, 0x6f, 0x29, 0xd7,
-	0x21, 0x7d, 0x07, 0xb6, 0x99, 0x85, 0x98, 0x59, 0xce, 0xf7, 0x66, 0xd9, 0x5a, 0x3a, 0xba, 0xb5,
-	0x08, 0xd4, 0x22, 0x64, 0xc6, 0xaa, 0x37, 0x52, 0xae, 0x43, 0x03, 0xcb, 0x66, 0x3a, 0x74, 0x5f,
-	0x41, 0x75, 0x67, 0xca, 0xba, 0x0e, 0xfb, 0xbd, 0x61, 0xa3, 0x40, 0x8f, 0xa1, 0xf2, 0xf8, 0x78,
-	0xcd, 0xe5, 0xe2, 0xc3, 0xfb, 0x06, 0x71, 0x3d, 0x28, 0x5f, 0x71, 0xc5, 0x27, 0xb8, 0xd9, 0x83,
-	0x44, 0xf6, 0x21, 0x51, 0xb0, 0x7d, 0xae, 0x78, 0xbe, 0xd9, 0x26, 0xd6, 0x4f, 0x15, 0xa4, 0xf9,
-	0x46, 0x5b, 0x41, 0xaa, 0x37, 0xd6, 0x13, 0xc8, 0x15, 0xfa, 0x7a, 0x63, 0x35, 0xe3, 0x22, 0xab,
-	0xe6, 0xca, 0x40, 0xbd, 0x39, 0x83, 0xfa, 0x21, 0x45, 0x5a, 0x86, 0x22, 0x47, 0xd9, 0x28, 0x5c,
-	0xf6, 0xbf, 0x3f, 0x35, 0xc9, 0x8f, 0xa7, 0x26, 0xf9, 0xf5, 0xd4, 0x24, 0xdf, 0x7e, 0x37, 0x0b,
-	0x9f, 0x5e, 0xce, 0x03, 0xb5, 0x58, 0xcf, 0x3a, 0x5e, 0x1c, 0x76, 0xfd, 0xb9, 0xe0, 0xc9, 0xe2,
-	0x6d, 0x10, 0x77, 0x33, 0x06, 0xdd, 0xb4, 0xd7, 0x4d, 0x66, 0xb3, 0x92, 0xf9, 0x31, 0xfb, 0x7f,
-	0x02, 0x00, 0x00, 0xff, 0xff, 0x1d, 0xc3, 0x11, 0xa3, 0xab, 0x03, 0x00, 0x00,
+	// 631 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x53, 0xcd, 0x8e, 0x12, 0x41,
+	0x10, 0xa6, 0x87, 0x59, 0x7e, 0x8a, 0x5d, 0x16, 0x3b, 0xba, 0x99, 0x8d, 0x59, 0xc4, 0x31, 0x26,
+	0xc4, 0x44, 0x88, 0x60, 0xbc, 0x78, 0x62, 0x01, 0xb3, 0x04, 0x10, 0xd3, 0xae, 0x9b, 0x5d, 0x2f,
+	0xa4, 0x99, 0x29, 0x61, 0xc2, 0xcf, 0x4c, 0x7a, 0x9a, 0x89, 0xbc, 0x89, 0x2f, 0xe0, 0xbb, 0x78,
+	0xf4, 0xe0, 0x03, 0x98, 0xf5, 0x45, 0x4c, 0xf7, 0x0c, 0x08, 0x07, 0x6f, 0x55, 0x5f, 0x55, 0x77,
+	0x7d, 0xf5, 0x7d, 0xdd, 0x70, 0x3a, 0xe1, 0xee, 0x14, 0x45, 0x30, 0x69, 0xd4, 0x02, 0xe1, 0x4b,
+	0x9f, 0xe6, 0x77, 0x80, 0xfd, 0x8b, 0x80, 0xd1, 0xbf, 0xa1, 0x25, 0x48, 0xcf, 0x71, 0x63, 0x91,
+	0x0a, 0xa9, 0x1e, 0x33, 0x15, 0xd2, 0x87, 0x70, 0x14, 0xf1, 0xc5, 0x1a, 0x2d, 0x43, 0x63, 0x71,
+	0x42, 0x1f, 0x43, 0x7e, 0x1d, 0xa2, 0x18, 0x2f, 0x51, 0x72, 0x2b, 0xad, 0x2b, 0x39, 0x05, 0x0c,
+	0x51, 0x72, 0x6a, 0x41, 0x36, 0x42, 0x11, 0x7a, 0xfe, 0xca, 0x32, 0x2b, 0xa4, 0x6a, 0xb2, 0x6d,
+	0x4a, 0x2f, 0x00, 0xf0, 0x6b, 0xe0, 0x09, 0x0c, 0xc7, 0x5c, 0x5a, 0x47, 0xba, 0x98, 0x4f, 0x90,
+	0x96, 0xa4, 0x14, 0x4c, 0x7d, 0x61, 0x46, 0x5f, 0xa8, 0x63, 0x35, 0x29, 0x94, 0x02, 0xf9, 0x72,
+	0xec, 0xb9, 0x16, 0x54, 0x48, 0xf5, 0x84, 0xe5, 0x62, 0xa0, 0xe7, 0xd2, 0x27, 0x50, 0x48, 0x8a,
+	0xae, 0xbf, 0x42, 0xab, 0x50, 0x21, 0xd5, 0x1c, 0x83, 0x18, 0xea, 0xf8, 0x2b, 0xb4, 0xef, 0x20,
+	0xd3, 0xbf, 0x19, 0x78, 0xa1, 0xa4, 0x17, 0x60, 0xcc, 0x23, 0x8b, 0x54, 0xd2, 0xd5, 0x42, 0xe3,
+	0xa4, 0xf6, 0x4f, 0x89, 0xfe, 0x0d, 0x33, 0xe6, 0x11, 0x3d, 0x83, 0x8c, 0xb3, 0x16, 0xa1, 0x2f,
+	0xf4, 0x9e, 0x26, 0x4b, 0x32, 0xb5, 0x8b, 0x2b, 0xfc, 0x20, 0x40, 0x57, 0xaf, 0x69, 0xb2, 0x6d,
+	0x6a, 0x5f, 0xc1, 0x83, 0x21, 0x5f, 0x79, 0x5f, 0x30, 0x94, 0xed, 0x19, 0x5f, 0x4d, 0xf1, 0x23,
+	0x4a, 0xda, 0x84, 0xac, 0xa3, 0x93, 0x30, 0x19, 0x75, 0xbe, 0x37, 0xea, 0xb0, 0x9d, 0x6d, 0x3b,
+	0xed, 0xef, 0x06, 0x14, 0x0f, 0x6b, 0xb4, 0x08, 0x46, 0xcf, 0xd5, 0x36, 0x98, 0xcc, 0xe8, 0xb9,
+	0xb4, 0x09, 0xc6, 0x28, 0xd0, 0xd4, 0x8a, 0x8d, 0x67, 0xff, 0xbd, 0xb2, 0x36, 0x0a, 0x50, 0x70,
+	0xe9, 0xf9, 0x2b, 0x66, 0x8c, 0x02, 0x65, 0xdd, 0x00, 0x23, 0x5c, 0x68, 0xe6, 0x27, 0x2c, 0x4e,
+	0xe8, 0x23, 0xc8, 0xcc, 0x71, 0xa3, 0xd4, 0x8c, 0xcd, 0x39, 0x9a, 0xe3, 0xa6, 0xe7, 0xd2, 0x4b,
+	0x38, 0xc5, 0x95, 0x23, 0x36, 0x81, 0x3a, 0x3e, 0xe6, 0x8b, 0xa9, 0xaf, 0xfd, 0x29, 0x1e, 0x6c,
+	0xd0, 0xdd, 0x75, 0xb4, 0x16, 0x53, 0x9f, 0x15, 0xf1, 0x20, 0xa7, 0x15, 0x28, 0x38, 0xfe, 0x32,
+	0x10, 0x18, 0x6a, 0xf3, 0x33, 0x7a, 0xec, 0x3e, 0x64, 0xbf, 0x85, 0xfc, 0x8e, 0x23, 0x05, 0xc8,
+	0xb4, 0x59, 0xb7, 0x75, 0xdd, 0x2d, 0xa5, 0x54, 0xdc, 0xe9, 0x0e, 0xba, 0xd7, 0xdd, 0x12, 0xa1,
+	0x67, 0x40, 0x3b, 0x6c, 0xf4, 0x61, 0xdc, 0x1e, 0x0d, 0x3e, 0x0d, 0xdf, 0x8f, 0xdf, 0xb5, 0x86,
+	0xbd, 0xc1, 0x5d, 0xc9, 0xb0, 0x23, 0xc8, 0xb5, 0x67, 0xe8, 0xcc, 0xc3, 0xf5, 0x92, 0xbe, 0x02,
+	0x53, 0x73, 0x24, 0x9a, 0xe3, 0xc5, 0x1e, 0xc7, 0x6d, 0x4b, 0x4d, 0x51, 0x12, 0x9e, 0x9c, 0x2d,
+	0x99, 0x6e, 0x55, 0x6f, 0x3b, 0x5c, 0x2f, 0x13, 0x7f, 0x55, 0x68, 0x3f, 0x87, 0xfc, 0xae, 0x29,
+	0x66, 0xd3, 0x6e, 0x36, 0xda, 0xa5, 0x14, 0x3d, 0x86, 0xdc, 0xed, 0xed, 0x15, 0x0f, 0x67, 0x6f,
+	0x5e, 0x97, 0x88, 0xed, 0x40, 0xb6, 0xc3, 0x25, 0xef, 0xe3, 0x66, 0x4f, 0x3c, 0xb2, 0x2f, 0x1e,
+	0x05, 0xd3, 0xe5, 0x92, 0x27, 0x7f, 0x44, 0xc7, 0xca, 0x42, 0x2f, 0x4a, 0xfe, 0x86, 0xe1, 0x45,
+	0xea, 0xed, 0x3b, 0x02, 0xb9, 0x44, 0x57, 0xbd, 0x7d, 0xa5, 0x7d, 0x9a, 0xe5, 0x13, 0xa4, 0x25,
+	0x5f, 0x9c, 0x43, 0xf1, 0x50, 0x5d, 0x9a, 0x85, 0x34, 0xc7, 0xb0, 0x94, 0xba, 0x6c, 0xfe, 0xb8,
+	0x2f, 0x93, 0x9f, 0xf7, 0x65, 0xf2, 0xfb, 0xbe, 0x4c, 0xbe, 0xfd, 0x29, 0xa7, 0x3e, 0x3f, 0x9d,
+	0x7a, 0x72, 0xb6, 0x9e, 0xd4, 0x1c, 0x7f, 0x59, 0x77, 0xa7, 0x82, 0x07, 0xb3, 0x97, 0x9e, 0x5f,
+	0x8f, 0x35, 0xa8, 0x47, 0x8d, 0x7a, 0x30, 0x99, 0x64, 0xf4, 0x17, 0x6f, 0xfe, 0x1d, 0x00, 0xe1,
+	0x84, 0x69, 0x49, 0xf5, 0x03, 0x00, 0x00,
 }
 
 func (m *KV) Marshal() (dAtA []byte, err error) {
@@ -666,6 +690,16 @@ func (m *KVList) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i -= len(m.XXX_unrecognized)
 		copy(dAtA[i:], m.XXX_unrecognized)
 	}
+	if m.Dropped != 0 {
+		i = encodeVarintBadgerpb2(dAtA, i, uint64(m.Dropped))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.Cursor != 0 {
+		i = encodeVarintBadgerpb2(dAtA, i, uint64(m.Cursor))
+		i--
+		dAtA[i] = 0x10
+	}
 	if len(m.Kv) > 0 {
 		for iNdEx := len(m.Kv) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -932,6 +966,12 @@ func (m *KVList) Size() (n int) {
 			n += 1 + l + sovBadgerpb2(uint64(l))
 		}
 	}
+	if m.Cursor != 0 {
+		n += 1 + sovBadgerpb2(uint64(m.Cursor))
+	}
+	if m.Dropped != 0 {
+		n += 1 + sovBadgerpb2(uint64(m.Dropped))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1366,6 +1406,44 @@ func (m *KVList) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cursor", wireType)
+			}
+			m.Cursor = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBadgerpb2
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Cursor |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Dropped", wireType)
+			}
+			m.Dropped = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowBadgerpb2
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Dropped |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipBadgerpb2(dAtA[iNdEx:])
@@ -17,34 +17,83 @@
 package badger
 
 import (
+	"bytes"
+	"sort"
 	"sync"
+	"sync/atomic"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/trie"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
 )
 
+// KVMergeOperand is set in the second byte of the Meta of a KV passed to the subscribers if its
+// value is a merge operand written by Txn.Merge, rather than the value of the key. The first byte
+// of the Meta is the user meta of the update.
+const KVMergeOperand byte = 1 << 0
+
+// updateMeta returns the Meta of a KV passed to the subscribers.
+func updateMeta(userMeta, meta byte) []byte {
+	if isMergeOperand(meta) {
+		return []byte{userMeta, KVMergeOperand}
+	}
+	return []byte{userMeta}
+}
+
 type subscriber struct {
-	prefixes  [][]byte
-	sendCh    chan<- *pb.KVList
+	id        uint64
+	matches   []Match
+	matchIDs  []uint64 // IDs of the matches in the publisher indexes.
+	sendCh    chan *pb.KVList
 	subCloser *z.Closer
+	// disconnected is closed when the subscriber is disconnected by the SubscriberDisconnect
+	// policy.
+	disconnected chan struct{}
+
+	// The fields below are accessed atomically.
+	pending          int64  // Number of updates queued in sendCh.
+	delivered        uint64 // Number of updates passed to the callback.
+	dropped          uint64 // Number of updates dropped by the SubscriberDropOldest policy.
+	gap              uint64 // Number of dropped updates not reported to the callback yet.
+	firstDropped     uint64 // Version of the first dropped update, or zero.
+	sentVersion      uint64 // Highest version queued in sendCh.
+	deliveredVersion uint64 // Highest version passed to the callback.
+}
+
+// subscriberMatch is a match of a subscriber, indexed by the publisher.
+type subscriberMatch struct {
+	sub   *subscriber
+	match *Match
 }
 
 type publisher struct {
 	sync.Mutex
+	db          *DB
 	pubCh       chan requests
-	subscribers map[uint64]subscriber
+	subscribers map[uint64]*subscriber
 	nextID      uint64
+	// The matches of all the subscribers are indexed by their IDs. The indexer holds the IDs of the
+	// exact key and prefix matches, and ranges holds the IDs of the range matches.
+	matches     map[uint64]*subscriberMatch
+	nextMatchID uint64
 	indexer     *trie.Trie
+	ranges      *trie.Intervals
+	policy      options.SubscriberPolicy
+	disconnects uint64 // Accessed atomically.
 }
 
-func newPublisher() *publisher {
+func newPublisher(db *DB) *publisher {
 	return &publisher{
+		db:          db,
 		pubCh:       make(chan requests, 1000),
-		subscribers: make(map[uint64]subscriber),
+		subscribers: make(map[uint64]*subscriber),
 		nextID:      0,
+		matches:     make(map[uint64]*subscriberMatch),
 		indexer:     trie.NewTrie(),
+		ranges:      trie.NewIntervals(),
+		policy:      db.opt.SubscriberPolicy,
 	}
 }
 
@@ -82,60 +131,168 @@ func (p *publisher) publishUpdates(reqs requests) {
 		reqs.DecrRef()
 	}()
 	batchedUpdates := make(map[uint64]*pb.KVList)
+	var chunks map[string][]byte // The chunks of the blobs written by reqs, by key with version.
 	for _, req := range reqs {
 		for _, e := range req.Entries {
-			ids := p.indexer.Get(e.Key)
-			if len(ids) > 0 {
-				k := y.SafeCopy(nil, e.Key)
-				kv := &pb.KV{
-					Key:       y.ParseKey(k),
-					Value:     y.SafeCopy(nil, e.Value),
-					Meta:      []byte{e.UserMeta},
-					ExpiresAt: e.ExpiresAt,
-					Version:   y.ParseTs(k),
+			key := y.ParseKey(e.Key)
+			if isInternalKey(key) {
+				// Like the range tombstones, the internal keys aren't published.
+				continue
+			}
+			ids := p.indexer.Get(key)
+			for id := range p.ranges.Get(key) {
+				ids[id] = struct{}{}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			k := y.SafeCopy(nil, e.Key)
+			kv := &pb.KV{
+				Key:       y.ParseKey(k),
+				Value:     y.SafeCopy(nil, e.Value),
+				Meta:      updateMeta(e.UserMeta, e.meta),
+				ExpiresAt: e.ExpiresAt,
+				Version:   y.ParseTs(k),
+			}
+			if isBlob(e.meta) {
+				// The blobs are passed whole, as by Item.ValueCopy.
+				if chunks == nil {
+					chunks = reqs.blobChunks()
+				}
+				var err error
+				if kv.Value, err = p.db.blobValue(kv.Key, kv.Version, e.Value, chunks); err != nil {
+					p.db.opt.Errorf("Unable to publish the update of key %q: %v", kv.Key, err)
+					continue
 				}
-				for id := range ids {
-					if _, ok := batchedUpdates[id]; !ok {
-						batchedUpdates[id] = &pb.KVList{}
-					}
-					batchedUpdates[id].Kv = append(batchedUpdates[id].Kv, kv)
+			}
+			// A subscriber gets the update once, even if several of its matches select it.
+			sent := make(map[uint64]struct{})
+			for id := range ids {
+				sm := p.matches[id]
+				if _, ok := sent[sm.sub.id]; ok || !sm.match.matches(e, kv) {
+					continue
+				}
+				sent[sm.sub.id] = struct{}{}
+				if _, ok := batchedUpdates[sm.sub.id]; !ok {
+					batchedUpdates[sm.sub.id] = &pb.KVList{}
 				}
+				batchedUpdates[sm.sub.id].Kv = append(batchedUpdates[sm.sub.id].Kv, kv)
 			}
 		}
 	}
 
 	for id, kvs := range batchedUpdates {
-		p.subscribers[id].sendCh <- kvs
+		p.send(p.subscribers[id], kvs)
+	}
+}
+
+// send queues the updates for the subscriber. If its queue is full, the updates are handled
+// according to the subscriber policy. It should be called with p.Lock held.
+func (p *publisher) send(s *subscriber, kvs *pb.KVList) {
+	var maxVersion uint64
+	for _, kv := range kvs.Kv {
+		if kv.Version > maxVersion {
+			maxVersion = kv.Version
+		}
+	}
+	n := int64(len(kvs.Kv))
+	atomic.AddInt64(&s.pending, n)
+	if maxVersion > atomic.LoadUint64(&s.sentVersion) {
+		atomic.StoreUint64(&s.sentVersion, maxVersion)
+	}
+
+	switch p.policy {
+	case options.SubscriberDropOldest:
+		for {
+			select {
+			case s.sendCh <- kvs:
+				return
+			default:
+			}
+			// The subscriber might have taken the oldest updates in the meantime.
+			select {
+			case old := <-s.sendCh:
+				s.drop(old)
+			default:
+			}
+		}
+	case options.SubscriberDisconnect:
+		select {
+		case s.sendCh <- kvs:
+		default:
+			atomic.AddInt64(&s.pending, -n)
+			atomic.AddUint64(&p.disconnects, 1)
+			p.removeSubscriber(s)
+			close(s.disconnected)
+		}
+	default:
+		s.sendCh <- kvs
+	}
+}
+
+// drop records that the given updates have been dropped instead of being passed to the callback.
+func (s *subscriber) drop(kvs *pb.KVList) {
+	n := int64(len(kvs.Kv))
+	atomic.AddInt64(&s.pending, -n)
+	atomic.AddUint64(&s.dropped, uint64(n))
+	atomic.AddUint64(&s.gap, uint64(n))
+	for _, kv := range kvs.Kv {
+		atomic.CompareAndSwapUint64(&s.firstDropped, 0, kv.Version)
+	}
+}
+
+// received records that the given updates have been taken out of the queue.
+func (s *subscriber) received(kvs *pb.KVList) {
+	atomic.AddInt64(&s.pending, -int64(len(kvs.Kv)))
+}
+
+// markDelivered records that the given updates have been passed to the callback.
+func (s *subscriber) markDelivered(kvs *pb.KVList) {
+	atomic.AddUint64(&s.delivered, uint64(len(kvs.Kv)))
+	for _, kv := range kvs.Kv {
+		if kv.Version > atomic.LoadUint64(&s.deliveredVersion) {
+			atomic.StoreUint64(&s.deliveredVersion, kv.Version)
+		}
 	}
 }
 
-func (p *publisher) newSubscriber(c *z.Closer, prefixes ...[]byte) (<-chan *pb.KVList, uint64) {
+func (p *publisher) newSubscriber(c *z.Closer, matches []Match) *subscriber {
 	p.Lock()
 	defer p.Unlock()
-	ch := make(chan *pb.KVList, 1000)
-	id := p.nextID
+	s := &subscriber{
+		id:           p.nextID,
+		matches:      matches,
+		sendCh:       make(chan *pb.KVList, 1000),
+		subCloser:    c,
+		disconnected: make(chan struct{}),
+	}
 	// Increment next ID.
 	p.nextID++
-	p.subscribers[id] = subscriber{
-		prefixes:  prefixes,
-		sendCh:    ch,
-		subCloser: c,
-	}
-	for _, prefix := range prefixes {
-		p.indexer.Add(prefix, id)
+	p.subscribers[s.id] = s
+	for i := range matches {
+		m := &matches[i]
+		id := p.nextMatchID
+		p.nextMatchID++
+		p.matches[id] = &subscriberMatch{sub: s, match: m}
+		s.matchIDs = append(s.matchIDs, id)
+		switch {
+		case m.isExact():
+			p.indexer.AddExact(m.Key, id)
+		case m.isRange():
+			p.ranges.Add(m.Start, m.End, id)
+		default:
+			p.indexer.Add(m.Prefix, id)
+		}
 	}
-	return ch, id
+	return s
 }
 
 // cleanSubscribers stops all the subscribers. Ideally, It should be called while closing DB.
 func (p *publisher) cleanSubscribers() {
 	p.Lock()
 	defer p.Unlock()
-	for id, s := range p.subscribers {
-		for _, prefix := range s.prefixes {
-			p.indexer.Delete(prefix, id)
-		}
-		delete(p.subscribers, id)
+	for _, s := range p.subscribers {
+		p.removeSubscriber(s)
 		s.subCloser.SignalAndWait()
 	}
 }
@@ -144,11 +301,38 @@ func (p *publisher) deleteSubscriber(id uint64) {
 	p.Lock()
 	defer p.Unlock()
 	if s, ok := p.subscribers[id]; ok {
-		for _, prefix := range s.prefixes {
-			p.indexer.Delete(prefix, id)
+		p.removeSubscriber(s)
+	}
+}
+
+// removeSubscriber should be called with p.Lock held.
+func (p *publisher) removeSubscriber(s *subscriber) {
+	for i, id := range s.matchIDs {
+		m := &s.matches[i]
+		switch {
+		case m.isExact():
+			p.indexer.DeleteExact(m.Key, id)
+		case m.isRange():
+			p.ranges.Delete(m.Start, m.End, id)
+		default:
+			p.indexer.Delete(m.Prefix, id)
+		}
+		delete(p.matches, id)
+	}
+	delete(p.subscribers, s.id)
+}
+
+// blobChunks returns the values of the blob chunks written by the requests, by key with version.
+func (reqs requests) blobChunks() map[string][]byte {
+	chunks := make(map[string][]byte)
+	for _, req := range reqs {
+		for _, e := range req.Entries {
+			if bytes.HasPrefix(e.Key, blobPrefix) {
+				chunks[string(e.Key)] = e.Value
+			}
 		}
 	}
-	delete(p.subscribers, id)
+	return chunks
 }
 
 func (p *publisher) sendUpdates(reqs requests) {
@@ -158,6 +342,29 @@ func (p *publisher) sendUpdates(reqs requests) {
 	}
 }
 
+// metrics returns the metrics of the subscribers, ordered by ID.
+func (p *publisher) metrics() []SubscriberMetrics {
+	p.Lock()
+	defer p.Unlock()
+	ms := make([]SubscriberMetrics, 0, len(p.subscribers))
+	for _, s := range p.subscribers {
+		m := SubscriberMetrics{
+			ID:        s.id,
+			Matches:   s.matches,
+			Pending:   atomic.LoadInt64(&s.pending),
+			Delivered: atomic.LoadUint64(&s.delivered),
+			Dropped:   atomic.LoadUint64(&s.dropped),
+		}
+		sent, delivered := atomic.LoadUint64(&s.sentVersion), atomic.LoadUint64(&s.deliveredVersion)
+		if sent > delivered {
+			m.Lag = sent - delivered
+		}
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].ID < ms[j].ID })
+	return ms
+}
+
 func (p *publisher) noOfSubscribers() int {
 	p.Lock()
 	defer p.Unlock()
@@ -17,13 +17,17 @@ package badger
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
+	"github.com/dgraph-io/badger/v2/y"
 )
 
 func TestPublisherOrdering(t *testing.T) {
@@ -101,3 +105,298 @@ func TestMultiplePrefix(t *testing.T) {
 		wg.Wait()
 	})
 }
+
+func TestSubscribeFrom(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, ErrNoPrefixes, db.SubscribeFrom(context.Background(), 0,
+			func(kvs *KVList) error { return nil }))
+
+		set := func(key, val string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte(key), []byte(val))
+			}))
+		}
+		for i := 0; i < 10; i++ {
+			set(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i))
+			set(fmt.Sprintf("other%02d", i), "other")
+		}
+		var since uint64
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get([]byte("key05"))
+			if err != nil {
+				return err
+			}
+			since = item.Version()
+			return nil
+		}))
+
+		// subscribe returns the keys received from SubscribeFrom once it has received the
+		// given number of distinct keys, along with the last cursor.
+		subscribe := func(since uint64, n int, write func()) (map[string]string, uint64) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			got := make(map[string]string)
+			var cursor uint64
+			done := make(chan error, 1)
+			go func() {
+				done <- db.SubscribeFrom(ctx, since, func(kvs *KVList) error {
+					for _, kv := range kvs.GetKv() {
+						require.True(t, kv.Version >= since)
+						got[string(kv.Key)] = string(kv.Value)
+					}
+					require.True(t, kvs.Cursor >= cursor)
+					cursor = kvs.Cursor
+					if len(got) == n {
+						cancel()
+					}
+					return nil
+				}, []byte("key"))
+			}()
+			write()
+			require.Equal(t, context.Canceled, <-done)
+			return got, cursor
+		}
+
+		// The replay starts at key05 and is followed by the live updates.
+		got, cursor := subscribe(since, 10, func() {
+			for i := 10; i < 15; i++ {
+				set(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i))
+			}
+		})
+		for i := 5; i < 15; i++ {
+			require.Equal(t, fmt.Sprintf("value%d", i), got[fmt.Sprintf("key%02d", i)])
+		}
+
+		// Resuming from the cursor only delivers the later changes.
+		got, _ = subscribe(cursor, 1, func() {
+			set("key00", "updated")
+		})
+		require.Equal(t, map[string]string{"key00": "updated"}, got)
+	})
+}
+
+func TestSubscribeMergeOperands(t *testing.T) {
+	opt := getTestOptions("").WithMergeFunc(AppendMerge)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), []byte("a"))
+		}))
+		merge := func(operand string) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Merge([]byte("key"), []byte(operand))
+			}))
+		}
+		merge("b")
+
+		// The operands are flagged, both in the replay and in the live updates.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		metas := make(map[string][]byte)
+		done := make(chan error, 1)
+		go func() {
+			done <- db.SubscribeFrom(ctx, 1, func(kvs *KVList) error {
+				for _, kv := range kvs.GetKv() {
+					metas[string(kv.Value)] = kv.Meta
+				}
+				if len(metas) == 3 {
+					cancel()
+				}
+				return nil
+			}, []byte("key"))
+		}()
+		merge("c")
+		require.Equal(t, context.Canceled, <-done)
+		require.Equal(t, map[string][]byte{
+			"a": {0},
+			"b": {0, KVMergeOperand},
+			"c": {0, KVMergeOperand},
+		}, metas)
+	})
+}
+
+func TestSubscriberPolicy(t *testing.T) {
+	// publish sends an update for the given version straight to the subscribers.
+	publish := func(db *DB, version uint64) {
+		req := requestPool.Get().(*request)
+		req.reset()
+		req.Entries = []*Entry{{Key: y.KeyWithTs([]byte("key"), version), Value: []byte("value")}}
+		req.IncrRef()
+		db.pub.publishUpdates(requests{req})
+	}
+	// subscribe starts a subscriber whose callback blocks until release is closed, and publishes
+	// n updates while the callback is blocked.
+	subscribe := func(t *testing.T, db *DB, n int, release chan struct{}) (<-chan error,
+		*[]*KVList) {
+		var lists []*KVList
+		blocked := make(chan struct{})
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- db.Subscribe(context.Background(), func(kvs *KVList) error {
+				lists = append(lists, kvs)
+				if len(lists) == 1 {
+					close(blocked)
+					<-release
+				}
+				if len(lists) == 2 {
+					return errors.New("done")
+				}
+				return nil
+			}, []byte("key"))
+		}()
+		for db.pub.noOfSubscribers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		publish(db, 1)
+		<-blocked
+		for i := 2; i <= n; i++ {
+			publish(db, uint64(i))
+		}
+		return errCh, &lists
+	}
+
+	t.Run("drop oldest", func(t *testing.T) {
+		opt := getTestOptions("").WithSubscriberPolicy(options.SubscriberDropOldest)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			release := make(chan struct{})
+			errCh, lists := subscribe(t, db, 1500, release)
+
+			m := db.Metrics().Subscribers
+			require.Len(t, m, 1)
+			require.Equal(t, int64(1000), m[0].Pending)
+			require.Equal(t, uint64(499), m[0].Dropped)
+			require.Equal(t, uint64(1500), m[0].Lag)
+
+			close(release)
+			require.EqualError(t, <-errCh, "done")
+			require.Len(t, *lists, 2)
+			last := (*lists)[1]
+			require.Equal(t, uint64(499), last.Dropped)
+			require.Len(t, last.Kv, 1000)
+			require.Equal(t, uint64(501), last.Kv[0].Version)
+			// The cursor points to the first dropped update.
+			require.Equal(t, uint64(2), last.Cursor)
+		})
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		opt := getTestOptions("").WithSubscriberPolicy(options.SubscriberDisconnect)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			release := make(chan struct{})
+			errCh, _ := subscribe(t, db, 1002, release)
+			require.Equal(t, 0, db.pub.noOfSubscribers())
+			require.Equal(t, uint64(1), db.Metrics().SubscriberDisconnects)
+
+			close(release)
+			require.Equal(t, ErrSlowSubscriber, <-errCh)
+		})
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		defer func(size int) { maxReplayPendingSize = size }(maxReplayPendingSize)
+		maxReplayPendingSize = 1
+		opt := getTestOptions("").WithSubscriberPolicy(options.SubscriberDropOldest)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte("key"), []byte("value"))
+			}))
+			// The live updates pile up while the callback holds up the replay.
+			release := make(chan struct{})
+			blocked := make(chan struct{})
+			errCh := make(chan error, 1)
+			var calls int
+			go func() {
+				errCh <- db.SubscribeFrom(context.Background(), 0, func(kvs *KVList) error {
+					if calls++; calls == 1 {
+						close(blocked)
+						<-release
+						return nil
+					}
+					return errors.New("done")
+				}, []byte("key"))
+			}()
+			<-blocked
+			publish(db, 10)
+			for db.Metrics().Subscribers[0].Pending > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			// The first update is buffered by SubscribeFrom, which leaves the next ones in the
+			// queue, where they are dropped once it holds 1000 of them.
+			for i := 1; i < 1500; i++ {
+				publish(db, uint64(10+i))
+			}
+			m := db.Metrics().Subscribers
+			require.Len(t, m, 1)
+			require.Equal(t, int64(1000), m[0].Pending)
+			require.Equal(t, uint64(499), m[0].Dropped)
+
+			close(release)
+			require.EqualError(t, <-errCh, "done")
+		})
+	})
+}
+
+func TestSubscribeMatch(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		cb := func(kvs *KVList) error { return nil }
+		ctx := context.Background()
+		require.Equal(t, ErrInvalidMatch,
+			db.SubscribeMatch(ctx, cb, Match{Key: []byte("a"), Prefix: []byte("a")}))
+		require.Equal(t, ErrInvalidRange,
+			db.SubscribeMatch(ctx, cb, Match{Start: []byte("b"), End: []byte("a")}))
+
+		matches := []Match{
+			{Key: []byte("exact")},
+			{Start: []byte("b"), End: []byte("d"), IgnorePrefixes: [][]byte{[]byte("bx")}},
+			{Prefix: []byte("c")}, // Overlaps with the range.
+			{Prefix: []byte("m"), UserMetaMask: 0x2},
+			{Prefix: []byte("del"), IgnoreDeletes: true},
+			{Prefix: []byte("f"), Filter: func(kv *pb.KV) bool { return string(kv.Value) == "yes" }},
+			{Key: []byte("zz-end")},
+			{Prefix: badgerPrefix}, // The internal keys aren't published.
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		var keys []string
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- db.SubscribeMatch(ctx, func(kvs *KVList) error {
+				for _, kv := range kvs.Kv {
+					keys = append(keys, string(kv.Key))
+					if string(kv.Key) == "zz-end" {
+						cancel()
+					}
+				}
+				return nil
+			}, matches...)
+		}()
+		for db.pub.noOfSubscribers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		require.Len(t, db.Metrics().Subscribers[0].Matches, len(matches))
+
+		update := func(e *Entry) {
+			require.NoError(t, db.Update(func(txn *Txn) error { return txn.SetEntry(e) }))
+		}
+		set := func(key, val string) { update(NewEntry([]byte(key), []byte(val))) }
+		for _, key := range []string{"exact", "exactly", "exac", "a", "b", "bx1", "c1", "d"} {
+			set(key, "val")
+		}
+		update(NewEntry([]byte("m1"), nil).WithMeta(0x1))
+		update(NewEntry([]byte("m2"), nil).WithMeta(0x3))
+		set("del1", "val")
+		require.NoError(t, db.Update(func(txn *Txn) error { return txn.Delete([]byte("del1")) }))
+		expired := NewEntry([]byte("del2"), []byte("val"))
+		expired.ExpiresAt = 1
+		update(expired)
+		set("f1", "no")
+		set("f2", "yes")
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.DeleteRange([]byte("a"), []byte("c"))
+		}))
+		set("zz-end", "val")
+
+		require.Equal(t, context.Canceled, <-errCh)
+		require.Equal(t, []string{"exact", "b", "c1", "m2", "del1", "f2", "zz-end"}, keys)
+		require.Equal(t, 0, db.pub.noOfSubscribers())
+		require.Empty(t, db.pub.matches)
+	})
+}
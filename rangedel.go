@@ -0,0 +1,374 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dgraph-io/badger/v2/table"
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// rangeTombstone deletes all the versions of the keys in [start, end) which are older than
+// version. A range tombstone is stored in the LSM tree as a single entry with key
+// rangeDelPrefix + start, value end and the bitRangeDelete meta bit set.
+type rangeTombstone struct {
+	start   []byte
+	end     []byte
+	version uint64
+}
+
+func (rt *rangeTombstone) contains(key []byte) bool {
+	return bytes.Compare(key, rt.start) >= 0 && bytes.Compare(key, rt.end) < 0
+}
+
+// rangeTombstones is an in-memory index over all the range tombstones present in the LSM tree.
+// It is loaded on DB open, updated on every write of a range tombstone and trimmed by the
+// compaction which drops the tombstone.
+//
+// The tombstones are sorted by start, and seen as an implicit binary search tree where the root of
+// the tombstones in [lo, hi) is at (lo+hi)/2. maxEnd holds the largest end in the subtree rooted at
+// every tombstone, so that covers skips the subtrees ending before the key, and only visits the
+// tombstones which contain it along with O(log n) others.
+type rangeTombstones struct {
+	sync.RWMutex
+	num    int32 // Accessed atomically so that lookups are cheap when there are no tombstones.
+	list   []rangeTombstone
+	maxEnd [][]byte
+}
+
+// find returns the position of the tombstone with the given start and version, or the position
+// where it would be inserted.
+func (r *rangeTombstones) find(start []byte, version uint64) (int, bool) {
+	i := sort.Search(len(r.list), func(i int) bool {
+		t := &r.list[i]
+		if c := bytes.Compare(t.start, start); c != 0 {
+			return c > 0
+		}
+		return t.version >= version
+	})
+	return i, i < len(r.list) && r.list[i].version == version && bytes.Equal(r.list[i].start, start)
+}
+
+// update rebuilds maxEnd after a change of the list. It must be called with the lock held.
+func (r *rangeTombstones) update() {
+	r.maxEnd = make([][]byte, len(r.list))
+	r.buildMaxEnd(0, len(r.list))
+	atomic.StoreInt32(&r.num, int32(len(r.list)))
+}
+
+func (r *rangeTombstones) buildMaxEnd(lo, hi int) []byte {
+	if lo >= hi {
+		return nil
+	}
+	mid := (lo + hi) / 2
+	maxEnd := r.list[mid].end
+	for _, end := range [][]byte{r.buildMaxEnd(lo, mid), r.buildMaxEnd(mid+1, hi)} {
+		if bytes.Compare(end, maxEnd) > 0 {
+			maxEnd = end
+		}
+	}
+	r.maxEnd[mid] = maxEnd
+	return maxEnd
+}
+
+func (r *rangeTombstones) add(rt rangeTombstone) {
+	r.Lock()
+	defer r.Unlock()
+	i, found := r.find(rt.start, rt.version)
+	if found {
+		// The same tombstone can be written again by the value log GC.
+		return
+	}
+	r.list = append(r.list, rangeTombstone{})
+	copy(r.list[i+1:], r.list[i:])
+	r.list[i] = rt
+	r.update()
+}
+
+func (r *rangeTombstones) get(start []byte, version uint64) (rangeTombstone, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if i, found := r.find(start, version); found {
+		return r.list[i], true
+	}
+	return rangeTombstone{}, false
+}
+
+func (r *rangeTombstones) remove(start []byte, version uint64) {
+	r.Lock()
+	defer r.Unlock()
+	if i, found := r.find(start, version); found {
+		r.list = append(r.list[:i], r.list[i+1:]...)
+		r.update()
+	}
+}
+
+func (r *rangeTombstones) clear() {
+	r.Lock()
+	defer r.Unlock()
+	r.list = nil
+	r.update()
+}
+
+// covers returns true if the given version of the key has been deleted by a range tombstone
+// which is visible at readTs. The internal keys are never covered.
+func (r *rangeTombstones) covers(key []byte, version, readTs uint64) bool {
+	if atomic.LoadInt32(&r.num) == 0 || isInternalKey(key) {
+		return false
+	}
+	r.RLock()
+	defer r.RUnlock()
+	return r.coversIn(0, len(r.list), key, version, readTs)
+}
+
+// coversIn is covers for the tombstones in [lo, hi). It must be called with the lock held.
+func (r *rangeTombstones) coversIn(lo, hi int, key []byte, version, readTs uint64) bool {
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if bytes.Compare(key, r.maxEnd[mid]) >= 0 {
+			// All the tombstones of the subtree end before the key.
+			return false
+		}
+		if r.coversIn(lo, mid, key, version, readTs) {
+			return true
+		}
+		t := &r.list[mid]
+		if bytes.Compare(key, t.start) < 0 {
+			// The tombstones of the right subtree start after the key.
+			return false
+		}
+		if t.version > version && t.version <= readTs && t.contains(key) {
+			return true
+		}
+		lo = mid + 1
+	}
+	return false
+}
+
+// DeleteRange deletes all the keys in the range [start, end). The deletion is recorded as a
+// single range tombstone, which is written along with the rest of the transaction at commit time.
+// Keys set in this transaction before the call to DeleteRange are deleted as well, while keys set
+// after it are retained. The deleted keys are physically removed by compactions, once no running
+// transaction can read them anymore.
+//
+// Note that the range tombstone takes part in conflict detection like a single key. Transactions
+// which read keys within the range are not considered to be in conflict with it.
+func (txn *Txn) DeleteRange(start, end []byte) error {
+	switch {
+	case len(start) == 0:
+		return ErrEmptyKey
+	case bytes.Compare(start, end) >= 0:
+		return ErrInvalidRange
+	case bytes.HasPrefix(start, badgerPrefix):
+		return ErrInvalidKey
+	}
+	return txn.deleteRange(start, end)
+}
+
+// DeleteRangeCF deletes all the keys in the range [start, end) of the column family. See
+// Txn.DeleteRange.
+func (txn *Txn) DeleteRangeCF(cf *ColumnFamily, start, end []byte) error {
+	switch {
+	case cf.isDropped():
+		return ErrColumnFamilyDropped
+	case len(start) == 0:
+		return ErrEmptyKey
+	case bytes.Compare(start, end) >= 0:
+		return ErrInvalidRange
+	}
+	return txn.deleteRange(cf.key(start), cf.key(end))
+}
+
+func (txn *Txn) deleteRange(start, end []byte) error {
+	key := make([]byte, 0, len(rangeDelPrefix)+len(start))
+	key = append(append(key, rangeDelPrefix...), start...)
+	var merged bool
+	if txn.update {
+		// Two range deletes with the same start in a transaction are merged into one.
+		var e *Entry
+		if e, merged = txn.pendingWrites[string(key)]; merged && bytes.Compare(e.Value, end) > 0 {
+			end = e.Value
+		}
+	}
+	e := &Entry{
+		Key:   key,
+		Value: y.SafeCopy(nil, end),
+		meta:  bitRangeDelete,
+	}
+	if err := txn.modifyEntry(e, true); err != nil {
+		return err
+	}
+	if !merged {
+		txn.numRangeDeletes++
+	}
+	covered := func(pe *Entry) bool {
+		return pe.meta&bitRangeDelete == 0 &&
+			bytes.Compare(pe.Key, start) >= 0 && bytes.Compare(pe.Key, end) < 0
+	}
+	for k, pe := range txn.pendingWrites {
+		if covered(pe) {
+			txn.deletePendingWrite(k)
+			txn.uncount(pe)
+		}
+	}
+	var duplicates []*Entry
+	for _, pe := range txn.duplicateWrites {
+		if covered(pe) {
+			txn.uncount(pe)
+			continue
+		}
+		duplicates = append(duplicates, pe)
+	}
+	if len(duplicates) < len(txn.duplicateWrites) {
+		// A new slice is built, as the savepoints keep the previous one.
+		txn.duplicateWrites = duplicates
+	}
+	return nil
+}
+
+// uncount takes the entry out of the count and size of the transaction, once it is dropped.
+func (txn *Txn) uncount(e *Entry) {
+	txn.count--
+	txn.size -= int64(e.estimateSize(txn.db.opt.ValueThreshold)) + 10
+}
+
+// coveredByPendingRangeDelete returns true if the key has been deleted by a DeleteRange call in
+// this transaction and hasn't been set again afterwards.
+func (txn *Txn) coveredByPendingRangeDelete(key []byte) bool {
+	if txn.numRangeDeletes == 0 || isInternalKey(key) {
+		return false
+	}
+	if _, ok := txn.pendingWrites[string(key)]; ok {
+		return false
+	}
+	for _, e := range txn.pendingWrites {
+		if e.meta&bitRangeDelete == 0 {
+			continue
+		}
+		rt := rangeTombstone{start: e.Key[len(rangeDelPrefix):], end: e.Value}
+		if rt.contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// addRangeTombstone adds the range tombstone written as entry e to the in-memory index. The key of
+// the entry must contain the version.
+func (db *DB) addRangeTombstone(e *Entry) {
+	key := y.ParseKey(e.Key)
+	db.rangeDels.add(rangeTombstone{
+		start:   y.SafeCopy(nil, key[len(rangeDelPrefix):]),
+		end:     y.SafeCopy(nil, e.Value),
+		version: y.ParseTs(e.Key),
+	})
+}
+
+// loadRangeTombstones reads all the range tombstones present in the LSM tree into the in-memory
+// index. It must be called after the value log has been replayed.
+func (db *DB) loadRangeTombstones() error {
+	// Same as in getHead, txnMark isn't ready to hand out read timestamps yet.
+	txn := Txn{
+		db:     db,
+		readTs: math.MaxUint64, // Show all versions.
+	}
+	iopt := DefaultIteratorOptions
+	iopt.AllVersions = true
+	iopt.InternalAccess = true
+	iopt.PrefetchValues = false
+	iopt.Prefix = rangeDelPrefix
+
+	it := txn.NewIterator(iopt)
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		if item.meta&bitRangeDelete == 0 {
+			continue
+		}
+		end, err := item.ValueCopy(nil)
+		if err != nil {
+			return errors.Wrapf(err, "while reading range tombstone for key: %q", item.Key())
+		}
+		db.rangeDels.add(rangeTombstone{
+			start:   item.KeyCopy(nil)[len(rangeDelPrefix):],
+			end:     end,
+			version: item.Version(),
+		})
+	}
+	return nil
+}
+
+// rangeHasVersionsBelow returns true if any of the memtables or the levels contain a version of a
+// key in [start, end) which is older than the given version. It is used to figure out whether a
+// range tombstone is still needed.
+func (s *levelsController) rangeHasVersionsBelow(start, end []byte, version uint64) bool {
+	tables, decr := s.kv.getMemTables()
+	defer decr()
+
+	var iters []y.Iterator
+	for _, tbl := range tables {
+		iters = append(iters, tbl.NewUniIterator(false))
+	}
+	iters = s.appendIterators(iters, &IteratorOptions{})
+	it := table.NewMergeIterator(iters, false)
+	defer it.Close()
+
+	it.Seek(y.KeyWithTs(start, math.MaxUint64))
+	for it.Valid() {
+		key := y.ParseKey(it.Key())
+		switch {
+		case bytes.Compare(key, end) >= 0:
+			return false
+		case isInternalKey(key):
+			// The internal keys are never covered by the tombstone. Skip over them, up to the keys
+			// of the column families if they come next.
+			next := badgerPrefixEnd
+			if bytes.Compare(key, cfPrefix) < 0 {
+				next = cfPrefix
+			}
+			it.Seek(y.KeyWithTs(next, math.MaxUint64))
+		case y.ParseTs(it.Key()) < version:
+			return true
+		default:
+			it.Next()
+		}
+	}
+	return false
+}
+
+// dropRangeTombstone returns true if the range tombstone stored under the given key (with version)
+// is no longer needed, after removing it from the in-memory index.
+func (s *levelsController) dropRangeTombstone(key []byte) bool {
+	start := y.ParseKey(key)[len(rangeDelPrefix):]
+	version := y.ParseTs(key)
+	rt, ok := s.kv.rangeDels.get(start, version)
+	if !ok {
+		// We haven't loaded this tombstone yet. Keep it around.
+		return false
+	}
+	if s.rangeHasVersionsBelow(rt.start, rt.end, rt.version) {
+		return false
+	}
+	s.kv.rangeDels.remove(rt.start, rt.version)
+	return true
+}
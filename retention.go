@@ -0,0 +1,182 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+// RetentionRule declares how the versions of the keys with a prefix are retained, see
+// Options.RetentionRules. When several rules match a key, the one with the longest prefix applies.
+// The rules don't apply to the keys of the column families.
+type RetentionRule struct {
+	// Prefix selects the keys the rule applies to.
+	Prefix []byte
+	// NumVersionsToKeep overrides Options.NumVersionsToKeep for the keys, unless it is zero.
+	NumVersionsToKeep int
+	// KeepNewerThan makes compactions keep all the versions committed within this duration, on
+	// top of the ones kept as per NumVersionsToKeep. The versions committed before the DB recorded
+	// their commit times are kept until it has recorded commits older than KeepNewerThan.
+	KeepNewerThan time.Duration
+	// DefaultTTL is the time to live of the entries written without an expiry, see Entry.WithTTL.
+	// The entries written without an expiry before the rule was set are discarded by compactions
+	// and by the value log GC once they are older than DefaultTTL, but they can still be read
+	// until then.
+	DefaultTTL time.Duration
+}
+
+// retentionRules holds the RetentionRules of a DB.
+type retentionRules struct {
+	rules atomic.Value // []RetentionRule, sorted by decreasing length of the prefixes.
+}
+
+func (r *retentionRules) load() []RetentionRule {
+	rules, _ := r.rules.Load().([]RetentionRule)
+	return rules
+}
+
+func (r *retentionRules) store(rules []RetentionRule) error {
+	sorted := make([]RetentionRule, 0, len(rules))
+	for _, rule := range rules {
+		switch {
+		case bytes.HasPrefix(rule.Prefix, badgerPrefix):
+			return errors.Errorf("Retention rule prefix %q is reserved for internal use",
+				rule.Prefix)
+		case rule.NumVersionsToKeep < 0:
+			return errors.Errorf("Retention rule for prefix %q keeps a negative number of versions",
+				rule.Prefix)
+		case rule.KeepNewerThan < 0 || rule.DefaultTTL < 0:
+			return errors.Errorf("Retention rule for prefix %q has a negative duration",
+				rule.Prefix)
+		}
+		rule.Prefix = append([]byte{}, rule.Prefix...)
+		sorted = append(sorted, rule)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	r.rules.Store(sorted)
+	return nil
+}
+
+// matchRetentionRule returns the index of the rule applying to the key without version, or -1 if
+// there is none.
+func matchRetentionRule(rules []RetentionRule, key []byte) int {
+	// The prefixes of the rules are matched against the keys of the DB only. The column families
+	// have their own NumVersionsToKeep, see CFOptions.
+	if isInternalKey(key) || isCFKey(key) {
+		return -1
+	}
+	for i, rule := range rules {
+		if bytes.HasPrefix(key, rule.Prefix) {
+			return i
+		}
+	}
+	return -1
+}
+
+// defaultTTL returns the time to live of the key if it's written without an expiry.
+func (r *retentionRules) defaultTTL(key []byte) time.Duration {
+	rules := r.load()
+	if i := matchRetentionRule(rules, key); i >= 0 {
+		return rules[i].DefaultTTL
+	}
+	return 0
+}
+
+// SetRetentionRules replaces the retention rules of the DB, see Options.RetentionRules. The
+// compactions apply the new rules from their next run, and the DefaultTTL of the new rules applies
+// to the entries written afterwards.
+func (db *DB) SetRetentionRules(rules []RetentionRule) error {
+	return db.retention.store(rules)
+}
+
+// RetentionRules returns the current retention rules of the DB.
+func (db *DB) RetentionRules() []RetentionRule {
+	rules := db.retention.load()
+	return append(make([]RetentionRule, 0, len(rules)), rules...)
+}
+
+// keyRetention decides which versions of the keys are retained, as per the retention rules and
+// the discard timestamp at the time it was created.
+type keyRetention struct {
+	db        *DB
+	rules     []RetentionRule
+	discardTs uint64
+	// keepAbove and expireAtOrBelow hold for every rule the versions to keep as per KeepNewerThan
+	// and the versions expired as per DefaultTTL.
+	keepAbove       []uint64
+	expireAtOrBelow []uint64
+}
+
+func (db *DB) newKeyRetention(discardTs uint64) *keyRetention {
+	kr := &keyRetention{db: db, rules: db.retention.load(), discardTs: discardTs}
+	kr.keepAbove = make([]uint64, len(kr.rules))
+	kr.expireAtOrBelow = make([]uint64, len(kr.rules))
+	now := time.Now()
+	for i, rule := range kr.rules {
+		kr.keepAbove[i] = discardTs
+		if rule.KeepNewerThan > 0 {
+			// Nothing is discarded until the time log goes back far enough.
+			kr.keepAbove[i], _ = db.orc.timeLog.versionAt(now.Add(-rule.KeepNewerThan))
+		}
+		if rule.DefaultTTL > 0 {
+			kr.expireAtOrBelow[i], _ = db.orc.timeLog.versionAt(now.Add(-rule.DefaultTTL))
+		}
+	}
+	return kr
+}
+
+// forKey returns the rule applying to the key without version, or -1, along with the number of
+// versions of the key to keep and the timestamp at or below which they can be discarded.
+func (kr *keyRetention) forKey(key []byte) (int, int, uint64) {
+	i := matchRetentionRule(kr.rules, key)
+	if i < 0 {
+		return i, kr.db.numVersionsToKeep(key), kr.discardTs
+	}
+	numVersions := kr.db.opt.NumVersionsToKeep
+	if kr.rules[i].NumVersionsToKeep > 0 {
+		numVersions = kr.rules[i].NumVersionsToKeep
+	}
+	discardTs := kr.discardTs
+	if kr.keepAbove[i] < discardTs {
+		discardTs = kr.keepAbove[i]
+	}
+	return i, numVersions, discardTs
+}
+
+// expired returns true if the version written without an expiry has outlived the DefaultTTL of
+// the rule.
+func (kr *keyRetention) expired(rule int, version, expiresAt uint64) bool {
+	return rule >= 0 && expiresAt == 0 && version <= kr.expireAtOrBelow[rule]
+}
+
+// expiredVersion returns true if the version of the key with timestamp, as read from the LSM tree,
+// has outlived the DefaultTTL of its rule and can be discarded like the compactions do.
+func (kr *keyRetention) expiredVersion(key []byte, vs y.ValueStruct) bool {
+	if vs.Version != y.ParseTs(key) || isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+		return false
+	}
+	rule, _, discardTs := kr.forKey(y.ParseKey(key))
+	return vs.Version <= discardTs && kr.expired(rule, vs.Version, vs.ExpiresAt)
+}
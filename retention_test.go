@@ -0,0 +1,162 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/trace"
+)
+
+func TestRetentionRulesTTL(t *testing.T) {
+	opt := getTestOptions("").WithRetentionRules([]RetentionRule{
+		{Prefix: []byte("cache/"), DefaultTTL: time.Hour},
+	})
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("cache/a"), []byte("a")))
+			e := NewEntry([]byte("cache/b"), []byte("b")).WithTTL(time.Minute)
+			require.NoError(t, txn.SetEntry(e))
+			return txn.Set([]byte("other"), []byte("c"))
+		}))
+		expiresAt := func(key string) uint64 {
+			var expiresAt uint64
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get([]byte(key))
+				require.NoError(t, err)
+				expiresAt = item.ExpiresAt()
+				return nil
+			}))
+			return expiresAt
+		}
+		now := uint64(time.Now().Unix())
+		require.InDelta(t, now+3600, expiresAt("cache/a"), 5)
+		require.InDelta(t, now+60, expiresAt("cache/b"), 5)
+		require.Zero(t, expiresAt("other"))
+
+		// The rules can be replaced at runtime.
+		require.Error(t, db.SetRetentionRules([]RetentionRule{{Prefix: badgerPrefix}}))
+		require.Error(t, db.SetRetentionRules([]RetentionRule{{NumVersionsToKeep: -1}}))
+		require.NoError(t, db.SetRetentionRules(nil))
+		require.Empty(t, db.RetentionRules())
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("cache/a"), []byte("a"))
+		}))
+		require.Zero(t, expiresAt("cache/a"))
+	})
+}
+
+func TestCompactionRetentionRules(t *testing.T) {
+	opt := DefaultOptions("").WithNumCompactors(0).WithNumVersionsToKeep(1)
+	opt.managedTxns = true
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.SetRetentionRules([]RetentionRule{
+			{Prefix: []byte("a"), NumVersionsToKeep: 2},
+			{Prefix: []byte("audit/"), KeepNewerThan: 150 * time.Minute},
+			{Prefix: []byte("cache/"), DefaultTTL: 90 * time.Minute},
+		}))
+		now := time.Now()
+		db.orc.timeLog.record(1, now.Add(-3*time.Hour))
+		db.orc.timeLog.record(2, now.Add(-2*time.Hour))
+		db.orc.timeLog.record(3, now.Add(-time.Minute))
+
+		l0 := []keyValVersion{
+			{"abc", "3", 3, 0}, {"audit/a", "3", 3, 0}, {"cache/a", "3", 3, 0}, {"foo", "3", 3, 0},
+		}
+		l1 := []keyValVersion{
+			{"abc", "2", 2, 0}, {"abc", "1", 1, 0},
+			{"audit/a", "2", 2, 0}, {"audit/a", "1", 1, 0},
+			{"cache/a", "2", 2, 0}, {"cache/b", "2", 2, 0}, {"cache/b", "1", 1, 0},
+			{"foo", "2", 2, 0}, {"foo", "1", 1, 0},
+		}
+		createAndOpen(db, l0, 0)
+		createAndOpen(db, l1, 1)
+
+		db.SetDiscardTs(10)
+		cdef := compactDef{
+			thisLevel: db.lc.levels[0],
+			nextLevel: db.lc.levels[1],
+			top:       db.lc.levels[0].tables,
+			bot:       db.lc.levels[1].tables,
+		}
+		require.NoError(t, db.lc.runCompactDef(0, cdef))
+		var keys []string
+		for _, tbl := range db.lc.levels[1].tables {
+			it := tbl.NewIterator(0)
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, fmt.Sprintf("%s@%d", y.ParseKey(it.Key()), y.ParseTs(it.Key())))
+			}
+			require.NoError(t, it.Close())
+		}
+		// The audit keys are kept since the start of the retention period, and the cache keys
+		// written before it expire.
+		require.Equal(t, []string{
+			"abc@3", "abc@2", "audit/a@3", "audit/a@2", "audit/a@1", "cache/a@3", "foo@3",
+		}, keys)
+	})
+}
+
+func TestValueGCRetentionRules(t *testing.T) {
+	opt := getTestOptions("").WithValueLogFileSize(1 << 20)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		// The commits are recorded as older than the DefaultTTL below.
+		db.orc.timeLog.record(1000, time.Now().Add(-2*time.Hour))
+		val := make([]byte, 32<<10)
+		for i := 0; i < 40; i++ {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				require.NoError(t, txn.Set([]byte(fmt.Sprintf("cache/%02d", i)), val))
+				return txn.Set([]byte(fmt.Sprintf("keep/%02d", i)), val)
+			}))
+		}
+		// The rule applies to the entries written without an expiry before it was set.
+		require.NoError(t, db.SetRetentionRules([]RetentionRule{
+			{Prefix: []byte("cache/"), DefaultTTL: time.Hour},
+		}))
+
+		db.vlog.filesLock.RLock()
+		lf := db.vlog.filesMap[db.vlog.sortedFids()[0]]
+		db.vlog.filesLock.RUnlock()
+		tr := trace.New("Test", "Test")
+		defer tr.Finish()
+		require.NoError(t, db.vlog.rewrite(lf, tr))
+
+		// The expired values of the file are discarded, and don't show up in the reads anymore.
+		discarded := make(map[int]bool)
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 40; i++ {
+				item, err := txn.Get([]byte(fmt.Sprintf("keep/%02d", i)))
+				require.NoError(t, err)
+				require.Equal(t, val, getItemValue(t, item))
+
+				item, err = txn.Get([]byte(fmt.Sprintf("cache/%02d", i)))
+				if err == ErrKeyNotFound {
+					discarded[i] = true
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, val, getItemValue(t, item))
+			}
+			return nil
+		}))
+		require.True(t, discarded[0])
+		require.False(t, discarded[39])
+	})
+}
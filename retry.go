@@ -0,0 +1,114 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy decides how DB.UpdateWithRetry retries the transactions which fail with a conflict.
+// The fields left at zero take the values of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times the transaction is run. A negative value means no
+	// limit.
+	MaxAttempts int
+	// MinBackoff is the time to wait before the first retry. It doubles on every retry, up to
+	// MaxBackoff, which is raised to MinBackoff if it's lower. The actual wait is picked at random
+	// between half of it and all of it, so that the conflicting transactions don't retry in
+	// lockstep.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is a RetryPolicy suitable for transactions which conflict occasionally.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	MinBackoff:  time.Millisecond,
+	MaxBackoff:  100 * time.Millisecond,
+}
+
+// withDefaults returns the policy with its zero fields set to the values of DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.MinBackoff <= 0 {
+		p.MinBackoff = DefaultRetryPolicy.MinBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if p.MaxBackoff < p.MinBackoff {
+		p.MaxBackoff = p.MinBackoff
+	}
+	return p
+}
+
+// nextBackoff returns the backoff doubled, without going over MaxBackoff.
+func (p RetryPolicy) nextBackoff(backoff time.Duration) time.Duration {
+	if backoff > p.MaxBackoff/2 {
+		return p.MaxBackoff
+	}
+	return backoff * 2
+}
+
+// UpdateWithRetry is like Update, but if the transaction fails with ErrConflict or ErrDeadlock, it
+// runs fn again in a new transaction after a backoff, as decided by the policy. The error of the
+// last attempt is returned once the policy runs out of attempts, and the error of the context is
+// returned if it is done before the transaction succeeds. fn must be safe to run several times.
+// UpdateWithRetry cannot be used with managed transactions.
+func (db *DB) UpdateWithRetry(ctx context.Context, fn func(txn *Txn) error,
+	policy RetryPolicy) error {
+	m := db.metrics
+	atomic.AddUint64(&m.retryCalls, 1)
+	policy = policy.withDefaults()
+	backoff := policy.MinBackoff
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			atomic.AddUint64(&m.retryCanceled, 1)
+			return err
+		}
+		atomic.AddUint64(&m.retryAttempts, 1)
+		err := db.Update(fn)
+		if cause := errors.Cause(err); cause != ErrConflict && cause != ErrDeadlock {
+			return err
+		}
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			atomic.AddUint64(&m.retryExhausted, 1)
+			return err
+		}
+
+		wait := backoff
+		if half := int64(backoff / 2); half > 0 {
+			wait = time.Duration(half + rand.Int63n(half+1))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&m.retryCanceled, 1)
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = policy.nextBackoff(backoff)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateWithRetry(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		// conflictingUpdate returns a function which conflicts with a concurrent write until it
+		// has been run the given number of times.
+		conflictingUpdate := func(conflicts int, attempts *int) func(txn *Txn) error {
+			return func(txn *Txn) error {
+				*attempts++
+				if _, err := txn.Get(key); err != nil && err != ErrKeyNotFound {
+					return err
+				}
+				if *attempts <= conflicts {
+					require.NoError(t, db.Update(func(txn *Txn) error {
+						return txn.Set(key, []byte("concurrent"))
+					}))
+				}
+				return txn.Set(key, []byte("retried"))
+			}
+		}
+		ctx := context.Background()
+
+		var attempts int
+		require.NoError(t, db.UpdateWithRetry(ctx, conflictingUpdate(2, &attempts),
+			DefaultRetryPolicy))
+		require.Equal(t, 3, attempts)
+		require.Equal(t, RetryMetrics{Calls: 1, Attempts: 3}, db.Metrics().Retries)
+
+		attempts = 0
+		policy := RetryPolicy{MaxAttempts: 2}
+		require.Equal(t, ErrConflict, db.UpdateWithRetry(ctx, conflictingUpdate(5, &attempts), policy))
+		require.Equal(t, 2, attempts)
+
+		// Other errors aren't retried.
+		errTest := errors.New("test")
+		attempts = 0
+		require.Equal(t, errTest, db.UpdateWithRetry(ctx, func(txn *Txn) error {
+			attempts++
+			return errTest
+		}, DefaultRetryPolicy))
+		require.Equal(t, 1, attempts)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Equal(t, context.Canceled, db.UpdateWithRetry(cctx, func(txn *Txn) error {
+			return txn.Set(key, nil)
+		}, DefaultRetryPolicy))
+
+		require.Equal(t, RetryMetrics{Calls: 4, Attempts: 6, Exhausted: 1, Canceled: 1},
+			db.Metrics().Retries)
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	require.Equal(t, DefaultRetryPolicy, RetryPolicy{}.withDefaults())
+	p := RetryPolicy{MaxAttempts: -1, MinBackoff: time.Second}.withDefaults()
+	require.Equal(t, RetryPolicy{MaxAttempts: -1, MinBackoff: time.Second, MaxBackoff: time.Second},
+		p)
+
+	p = RetryPolicy{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+	var backoffs []time.Duration
+	for b := p.MinBackoff; len(backoffs) < 5; b = p.nextBackoff(b) {
+		backoffs = append(backoffs, b)
+	}
+	require.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond,
+		4 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond}, backoffs)
+
+	// The doubling doesn't overflow.
+	p.MaxBackoff = time.Duration(1<<63 - 1)
+	require.Equal(t, p.MaxBackoff, p.nextBackoff(p.MaxBackoff/2+1))
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+// SavepointID identifies a savepoint of a transaction, see Txn.Savepoint.
+type SavepointID int
+
+// savepoint holds the state of a txn at the time of a Savepoint call. The pending writes and the
+// conflict keys are restored from undo logs, which are only kept while the txn has savepoints.
+type savepoint struct {
+	undoWrites      int
+	undoConflicts   int
+	duplicateWrites []*Entry // DeleteRange replaces the slice rather than changing it.
+	reads           int
+	readRanges      int
+	readKeys        int
+	preconditions   int
+	size            int64
+	count           int64
+	numRangeDeletes int
+}
+
+// undoWrite holds the entry of a key in the pending writes before it got overwritten or deleted.
+type undoWrite struct {
+	key string
+	old *Entry // nil if the key wasn't in the pending writes.
+}
+
+// Savepoint marks the current state of the transaction, so that the changes done afterwards can be
+// undone by passing the returned ID to RollbackTo, without discarding the whole transaction.
+func (txn *Txn) Savepoint() SavepointID {
+	txn.readsLock.Lock()
+	reads, readRanges, readKeys := len(txn.reads), len(txn.readRanges), len(txn.readKeys)
+	txn.readsLock.Unlock()
+	txn.savepoints = append(txn.savepoints, savepoint{
+		undoWrites:      len(txn.undoWrites),
+		undoConflicts:   len(txn.undoConflicts),
+		duplicateWrites: txn.duplicateWrites,
+		reads:           reads,
+		readRanges:      readRanges,
+		readKeys:        readKeys,
+		preconditions:   len(txn.preconditions),
+		size:            txn.size,
+		count:           txn.count,
+		numRangeDeletes: txn.numRangeDeletes,
+	})
+	return SavepointID(len(txn.savepoints))
+}
+
+// RollbackTo undoes the writes and forgets the reads done by the transaction since the given
+// savepoint was created. The savepoint can be rolled back to again, while the ones created after
+// it are released. The iterators created afterwards reflect the rollback, but the ones already
+// open are not affected. The locks taken by GetForUpdate are kept until the transaction is
+// committed or discarded.
+func (txn *Txn) RollbackTo(id SavepointID) error {
+	switch {
+	case txn.discarded:
+		return ErrDiscardedTxn
+	case id <= 0 || int(id) > len(txn.savepoints):
+		return ErrInvalidSavepoint
+	}
+	sp := txn.savepoints[id-1]
+	txn.savepoints = txn.savepoints[:id]
+
+	for i := len(txn.undoWrites) - 1; i >= sp.undoWrites; i-- {
+		u := txn.undoWrites[i]
+		if u.old == nil {
+			delete(txn.pendingWrites, u.key)
+		} else {
+			txn.pendingWrites[u.key] = u.old
+		}
+		txn.undoWrites[i] = undoWrite{} // garbage collecting
+	}
+	txn.undoWrites = txn.undoWrites[:sp.undoWrites]
+	for _, fp := range txn.undoConflicts[sp.undoConflicts:] {
+		delete(txn.conflictKeys, fp)
+	}
+	txn.undoConflicts = txn.undoConflicts[:sp.undoConflicts]
+	txn.duplicateWrites = sp.duplicateWrites
+
+	txn.readsLock.Lock()
+	txn.reads = txn.reads[:sp.reads]
+	txn.readRanges = txn.readRanges[:sp.readRanges]
+	txn.readKeys = txn.readKeys[:sp.readKeys]
+	txn.readsLock.Unlock()
+	txn.preconditions = txn.preconditions[:sp.preconditions]
+	txn.size, txn.count = sp.size, sp.count
+	txn.numRangeDeletes = sp.numRangeDeletes
+	return nil
+}
+
+// releaseSavepoint drops the latest savepoint, keeping the changes done since it was created.
+func (txn *Txn) releaseSavepoint(id SavepointID) {
+	txn.savepoints = txn.savepoints[:id-1]
+	if len(txn.savepoints) == 0 {
+		// The undo logs are only kept while the txn has savepoints.
+		txn.undoWrites, txn.undoConflicts = nil, nil
+	}
+}
+
+// setPendingWrite adds the entry to the pending writes, keeping track of the change if the txn
+// has savepoints.
+func (txn *Txn) setPendingWrite(e *Entry) {
+	key := string(e.Key)
+	if len(txn.savepoints) > 0 {
+		txn.undoWrites = append(txn.undoWrites, undoWrite{key: key, old: txn.pendingWrites[key]})
+	}
+	txn.pendingWrites[key] = e
+}
+
+// deletePendingWrite removes the key from the pending writes, keeping track of the change if the
+// txn has savepoints.
+func (txn *Txn) deletePendingWrite(key string) {
+	if len(txn.savepoints) > 0 {
+		txn.undoWrites = append(txn.undoWrites, undoWrite{key: key, old: txn.pendingWrites[key]})
+	}
+	delete(txn.pendingWrites, key)
+}
+
+// addConflictKey adds the fingerprint to the conflict keys, keeping track of the change if the txn
+// has savepoints.
+func (txn *Txn) addConflictKey(fp uint64) {
+	if _, ok := txn.conflictKeys[fp]; ok {
+		return
+	}
+	if len(txn.savepoints) > 0 {
+		txn.undoConflicts = append(txn.undoConflicts, fp)
+	}
+	txn.conflictKeys[fp] = struct{}{}
+}
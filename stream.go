@@ -42,6 +42,9 @@ var maxStreamSize = uint64(100 << 20) // 100MB
 // key-values, batch them up and call Send. Stream does concurrent iteration over many smaller key
 // ranges. It does NOT send keys in lexicographical sorted order. To get keys in sorted
 // order, use Iterator.
+//
+// The keys of the column families are sent as well, with the prefix they have within the DB.
+// Stream.Backup records the column families along with the keys, so that DB.Load restores them.
 type Stream struct {
 	// Prefix to only iterate over certain range of keys. If set to nil (default), Stream would
 	// iterate over the entire DB.
@@ -97,6 +100,10 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 		}
 
 		valCopy, err := item.ValueCopy(nil)
+		if item.IsMergeOperand() {
+			// Send the merged value, which replaces the older versions.
+			valCopy, err = st.db.mergeValue(key, item.Version(), nil)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -108,7 +115,7 @@ func (st *Stream) ToList(key []byte, itr *Iterator) (*pb.KVList, error) {
 			ExpiresAt: item.ExpiresAt(),
 		}
 		list.Kv = append(list.Kv, kv)
-		if st.db.opt.NumVersionsToKeep == 1 {
+		if st.db.opt.NumVersionsToKeep == 1 || item.IsMergeOperand() {
 			break
 		}
 
@@ -167,6 +174,8 @@ func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 		iterOpts.AllVersions = true
 		iterOpts.Prefix = st.Prefix
 		iterOpts.PrefetchValues = false
+		// The keys of the column families are streamed too.
+		iterOpts.InternalAccess = true
 		itr := txn.NewIterator(iterOpts)
 		itr.ThreadId = threadId
 		defer itr.Close()
@@ -200,6 +209,9 @@ func (st *Stream) produceKVs(ctx context.Context, threadId int) error {
 			if len(kr.right) > 0 && bytes.Compare(item.Key(), kr.right) >= 0 {
 				break
 			}
+			if isInternalKey(item.Key()) || st.db.cfs.isDropped(item.Key()) {
+				continue
+			}
 			// Check if we should pick this key.
 			if st.ChooseKey != nil && !st.ChooseKey(item) {
 				continue
@@ -21,7 +21,9 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"time"
 
+	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/pb"
 	"github.com/dgraph-io/badger/v2/table"
 	"github.com/dgraph-io/badger/v2/y"
@@ -233,10 +235,18 @@ func (sw *StreamWriter) Flush() error {
 	}
 
 	if !sw.db.opt.managedTxns {
+		var tl *timeLog
 		if sw.db.orc != nil {
+			tl = sw.db.orc.timeLog
 			sw.db.orc.Stop()
 		}
 		sw.db.orc = newOracle(sw.db.opt)
+		// The time log is kept, and all the versions written are recorded as committed now.
+		sw.db.orc.timeLog = tl
+		tl.record(sw.maxVersion, time.Now())
+		if err := tl.persist(); err != nil {
+			return err
+		}
 		sw.db.orc.nextTxnTs = sw.maxVersion
 		sw.db.orc.txnMark.Done(sw.maxVersion)
 		sw.db.orc.readMark.Done(sw.maxVersion)
@@ -432,7 +442,7 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 		if err != nil {
 			return err
 		}
-		if _, err := fd.Write(data); err != nil {
+		if err := w.db.ioLimiter.write(fd, data, false); err != nil {
 			return err
 		}
 		if tbl, err = table.OpenTable(fd, opts); err != nil {
@@ -446,11 +456,15 @@ func (w *sortedWriter) createTable(builder *table.Builder) error {
 	// cannot mix up this key with other keys from the DB, otherwise we would introduce a range
 	// overlap violation.
 	y.AssertTrue(len(lc.levels) > 1)
-	for _, l := range lc.levels[1:] {
-		ratio := float64(l.getTotalSize()) / float64(l.maxTotalSize)
-		if ratio < 1.0 {
-			lhandler = l
-			break
+	// The universal compaction sees every level as a sorted run, so all the tables go to the
+	// lowest level, as a single run.
+	if w.db.opt.CompactionStyle == options.LeveledCompaction {
+		for _, l := range lc.levels[1:] {
+			ratio := float64(l.getTotalSize()) / float64(l.maxTotalSize)
+			if ratio < 1.0 {
+				lhandler = l
+				break
+			}
 		}
 	}
 	if lhandler == nil {
@@ -17,6 +17,7 @@
 package table
 
 import (
+	"bytes"
 	"crypto/aes"
 	"math"
 	"runtime"
@@ -91,6 +92,7 @@ type Builder struct {
 	keyHashes     []uint32 // Used for building the bloomfilter.
 	opt           *Options
 	maxVersion    uint64
+	maxExpiry     uint64 // math.MaxUint64 if some key never expires.
 
 	// Used to concurrently compress/encrypt blocks.
 	wg        sync.WaitGroup
@@ -190,12 +192,31 @@ func (b *Builder) keyDiff(newKey []byte) []byte {
 	return newKey[i:]
 }
 
+// isDisposable returns true if the key is one of the Options.DisposableKeys.
+func (b *Builder) isDisposable(key []byte) bool {
+	parsed := y.ParseKey(key)
+	for _, k := range b.opt.DisposableKeys {
+		if bytes.Equal(parsed, k) {
+			return true
+		}
+	}
+	return false
+}
+
 func (b *Builder) addHelper(key []byte, v y.ValueStruct, vpLen uint32) {
 	b.keyHashes = append(b.keyHashes, y.Hash(y.ParseKey(key)))
 
 	if version := y.ParseTs(key); version > b.maxVersion {
 		b.maxVersion = version
 	}
+	if !b.isDisposable(key) {
+		switch {
+		case v.ExpiresAt == 0:
+			b.maxExpiry = math.MaxUint64
+		case v.ExpiresAt > b.maxExpiry:
+			b.maxExpiry = v.ExpiresAt
+		}
+	}
 
 	// diffKey stores the difference of key with baseKey.
 	var diffKey []byte
@@ -565,6 +586,13 @@ func (b *Builder) buildIndex(bloom []byte, tableSz uint32) []byte {
 	fb.TableIndexAddMaxVersion(builder, b.maxVersion)
 	fb.TableIndexAddUncompressedSize(builder, tableSz)
 	fb.TableIndexAddKeyCount(builder, uint32(len(b.keyHashes)))
+	maxExpiry := b.maxExpiry
+	if maxExpiry == 0 {
+		// The table only holds disposable keys, so nothing in it needs to be kept. Zero is left for
+		// the tables built before the max expiry was recorded.
+		maxExpiry = 1
+	}
+	fb.TableIndexAddMaxExpiry(builder, maxExpiry)
 	builder.Finish(fb.TableIndexEnd(builder))
 
 	return builder.FinishedBytes()
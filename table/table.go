@@ -84,6 +84,10 @@ type Options struct {
 	// When LoadBloomsOnOpen is set, bloom filters will be loaded while opening
 	// the table. Otherwise, they will be loaded lazily when they're accessed.
 	LoadBloomsOnOpen bool
+
+	// DisposableKeys are the bookkeeping keys, without their version, which are left out of the
+	// max expiry of the table, as nothing is lost when a table holding them is dropped.
+	DisposableKeys [][]byte
 }
 
 // TableInterface is useful for testing.
@@ -125,6 +129,13 @@ func (t *Table) MaxVersion() uint64 {
 	return t.fetchIndex().MaxVersion()
 }
 
+// MaxExpiry returns the latest expiry time across all keys stored in this table, math.MaxUint64
+// if some of them never expire, or zero if the table was built before it was recorded. The
+// Options.DisposableKeys are left out, and a table holding only such keys has a max expiry of one.
+func (t *Table) MaxExpiry() uint64 {
+	return t.fetchIndex().MaxExpiry()
+}
+
 // CompressionType returns the compression algorithm used for block compression.
 func (t *Table) CompressionType() options.CompressionType {
 	return t.opt.Compression
@@ -159,9 +170,12 @@ func (t *Table) DecrRef() error {
 		if t.fd == nil {
 			return nil
 		}
-		if err := t.fd.Truncate(0); err != nil {
-			// This is very important to let the FS know that the file is deleted.
-			return err
+		// The file can be hard linked into a checkpoint, which truncating would corrupt.
+		if !y.HasOtherLinks(t.fd) {
+			if err := t.fd.Truncate(0); err != nil {
+				// This is very important to let the FS know that the file is deleted.
+				return err
+			}
 		}
 		filename := t.fd.Name()
 		if err := t.fd.Close(); err != nil {
@@ -21,6 +21,7 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash/crc32"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
@@ -992,3 +993,47 @@ func TestMaxVersion(t *testing.T) {
 	table, err := OpenTable(f, opt)
 	require.Equal(t, N, int(table.MaxVersion()))
 }
+
+func TestTableMaxExpiry(t *testing.T) {
+	opts := getTestTableOptions()
+	opts.DisposableKeys = [][]byte{[]byte("!internal!head")}
+	build := func(expiries map[string]uint64) *Table {
+		keys := make([]string, 0, len(expiries))
+		for k := range expiries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := NewTableBuilder(opts)
+		defer b.Close()
+		for _, k := range keys {
+			b.Add(y.KeyWithTs([]byte(k), 1), y.ValueStruct{ExpiresAt: expiries[k]}, 0)
+		}
+		filename := fmt.Sprintf("%s%s%d.sst", os.TempDir(), string(os.PathSeparator), rand.Uint32())
+		f, err := y.CreateSyncedFile(filename, true)
+		require.NoError(t, err)
+		_, err = f.Write(b.Finish(false))
+		require.NoError(t, err)
+		tbl, err := OpenTable(f, opts)
+		require.NoError(t, err)
+		return tbl
+	}
+
+	tbl := build(map[string]uint64{"a": 10, "b": 30, "c": 20, "!internal!head": 0})
+	require.Equal(t, uint64(30), tbl.MaxExpiry())
+	require.NoError(t, tbl.DecrRef())
+
+	// A key which never expires.
+	tbl = build(map[string]uint64{"a": 10, "b": 0})
+	require.Equal(t, uint64(math.MaxUint64), tbl.MaxExpiry())
+	require.NoError(t, tbl.DecrRef())
+
+	// Only disposable keys.
+	tbl = build(map[string]uint64{"!internal!head": 0})
+	require.Equal(t, uint64(1), tbl.MaxExpiry())
+	require.NoError(t, tbl.DecrRef())
+
+	// The other keys with the same prefix count like the user keys.
+	tbl = build(map[string]uint64{"!internal!head": 0, "!internal!other": 0})
+	require.Equal(t, uint64(math.MaxUint64), tbl.MaxExpiry())
+	require.NoError(t, tbl.DecrRef())
+}
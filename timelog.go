@@ -0,0 +1,245 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TimeLogFilename is the filename for the time log, which maps the versions to the times at
+	// which they were committed, see DB.NewTransactionAsOf.
+	TimeLogFilename = "TIMELOG"
+
+	timeLogRewriteFilename = "TIMELOG-REWRITE"
+	// timeLogInterval is the minimum time between two points of the time log. It is the precision
+	// with which the versions are looked up by time.
+	timeLogInterval = time.Second
+	// timeLogRewriteThreshold is the minimum number of points dropped from the time log on Open
+	// for the file to be rewritten.
+	timeLogRewriteThreshold = 1000
+	timePointSize           = 16
+)
+
+// timePoint records that version was the latest commit at the given time.
+type timePoint struct {
+	version uint64
+	nanos   int64 // Unix time in nanoseconds.
+}
+
+// timeLog maps the versions to the times at which they were committed. It holds a point for the
+// first commit of every timeLogInterval, which is persisted by appending it to the time log file.
+// The points are recorded in memory while the oracle is locked, and persisted later on, so that
+// the commits don't wait on the file under the lock.
+type timeLog struct {
+	sync.RWMutex
+	points []timePoint
+	// latest is the latest commit, which is only persisted if it's a point.
+	latest timePoint
+
+	// fileLock guards the file and the number of points persisted to it.
+	fileLock   sync.Mutex
+	fp         *os.File // nil if the DB is in memory or read-only.
+	syncWrites bool
+	persisted  int
+}
+
+// openTimeLog loads the time log of the DB, and drops the points which are older than needed to
+// look up the times within opt.HistoryRetention.
+func openTimeLog(opt Options) (*timeLog, error) {
+	tl := &timeLog{syncWrites: opt.SyncWrites}
+	if opt.InMemory {
+		return tl, nil
+	}
+	path := filepath.Join(opt.Dir, TimeLogFilename)
+	buf, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, y.Wrapf(err, "While reading the time log")
+	default:
+		tl.decode(buf)
+	}
+	if opt.ReadOnly {
+		return tl, nil
+	}
+
+	// The point at or before the retention boundary is kept, as it's needed to look it up.
+	cutoff := time.Now().Add(-opt.HistoryRetention).UnixNano()
+	drop := sort.Search(len(tl.points), func(i int) bool { return tl.points[i].nanos > cutoff })
+	if drop--; drop >= timeLogRewriteThreshold && drop >= len(tl.points)/2 {
+		tl.points = append(tl.points[:0], tl.points[drop:]...)
+		if tl.fp, err = tl.rewrite(opt.Dir); err != nil {
+			return nil, err
+		}
+		tl.persisted = len(tl.points)
+		return tl, nil
+	}
+
+	if tl.fp, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666); err != nil {
+		return nil, y.Wrapf(err, "While opening the time log")
+	}
+	// Drop a half-written point at the end, if any.
+	size := int64(len(tl.points) * timePointSize)
+	if err := tl.fp.Truncate(size); err != nil {
+		_ = tl.fp.Close()
+		return nil, y.Wrapf(err, "While truncating the time log")
+	}
+	tl.persisted = len(tl.points)
+	return tl, nil
+}
+
+// decode loads the points from buf, ignoring a half-written point at the end.
+func (tl *timeLog) decode(buf []byte) {
+	for ; len(buf) >= timePointSize; buf = buf[timePointSize:] {
+		p := timePoint{
+			version: binary.BigEndian.Uint64(buf[0:8]),
+			nanos:   int64(binary.BigEndian.Uint64(buf[8:16])),
+		}
+		if p.version <= tl.latest.version || p.nanos < tl.latest.nanos {
+			// The points are written in order, so this can only be a corrupted one.
+			break
+		}
+		tl.points = append(tl.points, p)
+		tl.latest = p
+	}
+}
+
+// rewrite writes the points to a new time log file, which replaces the current one.
+func (tl *timeLog) rewrite(dir string) (*os.File, error) {
+	rewritePath := filepath.Join(dir, timeLogRewriteFilename)
+	fp, err := y.OpenTruncFile(rewritePath, false)
+	if err != nil {
+		return nil, y.Wrapf(err, "While creating the time log")
+	}
+	buf := make([]byte, 0, len(tl.points)*timePointSize)
+	for _, p := range tl.points {
+		buf = p.append(buf)
+	}
+	if _, err := fp.Write(buf); err != nil {
+		_ = fp.Close()
+		return nil, y.Wrapf(err, "While writing the time log")
+	}
+	if err := fp.Sync(); err != nil {
+		_ = fp.Close()
+		return nil, y.Wrapf(err, "While syncing the time log")
+	}
+	if err := os.Rename(rewritePath, filepath.Join(dir, TimeLogFilename)); err != nil {
+		_ = fp.Close()
+		return nil, y.Wrapf(err, "While replacing the time log")
+	}
+	if err := syncDir(dir); err != nil {
+		_ = fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (p timePoint) append(buf []byte) []byte {
+	var b [timePointSize]byte
+	binary.BigEndian.PutUint64(b[0:8], p.version)
+	binary.BigEndian.PutUint64(b[8:16], uint64(p.nanos))
+	return append(buf, b[:]...)
+}
+
+// record notes that the version was committed at the given time. The versions committed out of
+// order, which happens in managed mode, and the commits seen while the clock goes backwards are
+// ignored, as the versions committed before a time are always looked up as a range. The point is
+// only kept in memory, see persist.
+func (tl *timeLog) record(version uint64, t time.Time) {
+	p := timePoint{version: version, nanos: t.UnixNano()}
+	tl.Lock()
+	defer tl.Unlock()
+	if p.version <= tl.latest.version || p.nanos < tl.latest.nanos {
+		return
+	}
+	tl.latest = p
+	if n := len(tl.points); n > 0 && p.nanos-tl.points[n-1].nanos < int64(timeLogInterval) {
+		return
+	}
+	tl.points = append(tl.points, p)
+}
+
+// persist writes the points which haven't been persisted yet to the time log file. If it fails,
+// they are written again by the next call.
+func (tl *timeLog) persist() error {
+	tl.fileLock.Lock()
+	defer tl.fileLock.Unlock()
+	if tl.fp == nil {
+		return nil
+	}
+	tl.RLock()
+	pending := tl.points[tl.persisted:]
+	tl.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, len(pending)*timePointSize)
+	for _, p := range pending {
+		buf = p.append(buf)
+	}
+	if _, err := tl.fp.WriteAt(buf, int64(tl.persisted*timePointSize)); err != nil {
+		return y.Wrapf(err, "While writing to the time log")
+	}
+	if tl.syncWrites {
+		if err := tl.fp.Sync(); err != nil {
+			return y.Wrapf(err, "While syncing the time log")
+		}
+	}
+	tl.persisted += len(pending)
+	return nil
+}
+
+// versionAt returns the latest version known to have been committed at or before the given time.
+// It returns false if the time is before all the recorded points.
+func (tl *timeLog) versionAt(t time.Time) (uint64, bool) {
+	nanos := t.UnixNano()
+	tl.RLock()
+	defer tl.RUnlock()
+	if tl.latest.version > 0 && nanos >= tl.latest.nanos {
+		return tl.latest.version, true
+	}
+	i := sort.Search(len(tl.points), func(i int) bool { return tl.points[i].nanos > nanos })
+	if i == 0 {
+		return 0, false
+	}
+	return tl.points[i-1].version, true
+}
+
+func (tl *timeLog) close() error {
+	if tl.fp == nil {
+		return nil
+	}
+	if err := tl.persist(); err != nil {
+		_ = tl.fp.Close()
+		return err
+	}
+	if err := tl.fp.Sync(); err != nil {
+		_ = tl.fp.Close()
+		return errors.Wrap(err, "While syncing the time log")
+	}
+	return tl.fp.Close()
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir)
+
+	tl, err := openTimeLog(opt)
+	require.NoError(t, err)
+	start := time.Now().Add(-time.Hour)
+	_, ok := tl.versionAt(start)
+	require.False(t, ok)
+
+	// Only the first commit of every second is persisted as a point.
+	for v := uint64(1); v <= 30; v++ {
+		tl.record(v, start.Add(time.Duration(v)*100*time.Millisecond))
+	}
+	// The commits out of order are ignored.
+	tl.record(10, start.Add(time.Minute))
+	// The points are only written by persist.
+	path := filepath.Join(dir, TimeLogFilename)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+	require.NoError(t, tl.persist())
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(3*timePointSize), fi.Size())
+	require.NoError(t, tl.close())
+
+	check := func(tl *timeLog, latest uint64) {
+		_, ok := tl.versionAt(start)
+		require.False(t, ok)
+		for _, tc := range []struct {
+			at      time.Duration
+			version uint64
+		}{
+			{100 * time.Millisecond, 1},
+			{1050 * time.Millisecond, 1},
+			{1100 * time.Millisecond, 11},
+			{2900 * time.Millisecond, 21},
+			{time.Hour, latest},
+		} {
+			version, ok := tl.versionAt(start.Add(tc.at))
+			require.True(t, ok)
+			require.Equal(t, tc.version, version, "at %s", tc.at)
+		}
+	}
+	check(tl, 30)
+
+	// The latest commit is lost on restart, unless it's a point.
+	tl, err = openTimeLog(opt)
+	require.NoError(t, err)
+	check(tl, 21)
+	require.NoError(t, tl.close())
+
+	// A half-written point is dropped.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	tl, err = openTimeLog(opt)
+	require.NoError(t, err)
+	check(tl, 21)
+	tl.record(40, time.Now())
+	require.NoError(t, tl.close())
+	fi, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, int64(4*timePointSize), fi.Size())
+}
+
+func TestTimeLogRewrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithHistoryRetention(time.Hour)
+
+	tl, err := openTimeLog(opt)
+	require.NoError(t, err)
+	start := time.Now().Add(-2 * time.Hour)
+	n := 2 * timeLogRewriteThreshold
+	for i := 0; i < n; i++ {
+		tl.record(uint64(i+1), start.Add(time.Duration(i)*time.Second))
+	}
+	require.NoError(t, tl.close())
+
+	// The points older than the retention period are dropped, except the one at its start.
+	tl, err = openTimeLog(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tl.close()) }()
+	require.Equal(t, 1, len(tl.points))
+	version, ok := tl.versionAt(time.Now().Add(-time.Hour))
+	require.True(t, ok)
+	require.Equal(t, uint64(n), version)
+	_, ok = tl.versionAt(start)
+	require.False(t, ok)
+}
+
+func TestNewTransactionAsOf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithHistoryRetention(time.Hour)
+
+	db, err := Open(opt)
+	require.NoError(t, err)
+	key := []byte("key")
+	set := func(val string) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set(key, []byte(val))
+		}))
+	}
+	before := time.Now().Add(-time.Second)
+	set("old")
+	// The commit times are recorded with a precision of a second.
+	time.Sleep(timeLogInterval + 100*time.Millisecond)
+	asOf := time.Now()
+	time.Sleep(timeLogInterval + 100*time.Millisecond)
+	set("new")
+
+	check := func(db *DB) {
+		_, err := db.NewTransactionAsOf(before)
+		require.Equal(t, ErrHistoryUnavailable, err)
+
+		txn, err := db.NewTransactionAsOf(asOf)
+		require.NoError(t, err)
+		item, err := txn.Get(key)
+		require.NoError(t, err)
+		require.NoError(t, item.Value(func(val []byte) error {
+			require.Equal(t, "old", string(val))
+			return nil
+		}))
+		txn.Discard()
+
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.Set([]byte("pending"), nil))
+		iopt := DefaultIteratorOptions
+		iopt.AsOf = asOf
+		it := txn.NewIterator(iopt)
+		require.NoError(t, it.Err())
+		var vals []string
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			require.NoError(t, err)
+			vals = append(vals, string(val))
+		}
+		it.Close()
+		require.Equal(t, []string{"old"}, vals)
+
+		iopt.AsOf = before
+		it = txn.NewIterator(iopt)
+		require.Equal(t, ErrHistoryUnavailable, it.Err())
+		it.Rewind()
+		require.False(t, it.Valid())
+		it.Close()
+		require.NoError(t, txn.Commit())
+	}
+	check(db)
+
+	// The history survives a restart, and is kept by the compactions.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Flatten(1))
+	check(db)
+	require.NoError(t, db.Close())
+
+	// Without a retention period, only the latest versions are kept.
+	db, err = Open(opt.WithHistoryRetention(0))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.orc.readMark.WaitForMark(context.Background(), db.orc.nextTs()-1))
+	_, err = db.NewTransactionAsOf(asOf)
+	require.Equal(t, ErrHistoryUnavailable, err)
+	txn, err := db.NewTransactionAsOf(time.Now())
+	require.NoError(t, err)
+	txn.Discard()
+}
+
+func TestReadTsAsOfUnwritten(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), nil)
+		}))
+		// A commit which got its timestamp, but isn't written yet, isn't read.
+		done := db.orc.txnMark.DoneUntil()
+		db.orc.timeLog.record(done+1, time.Now())
+		readTs, err := db.orc.readTsAsOf(time.Now())
+		require.NoError(t, err)
+		require.Equal(t, done, readTs)
+	})
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"bytes"
+	"sort"
+)
+
+type interval struct {
+	start, end []byte // A nil end means the interval has no upper bound.
+	id         uint64
+}
+
+// endsAfter returns true if the interval ends after the key.
+func (iv interval) endsAfter(key []byte) bool {
+	return iv.end == nil || bytes.Compare(key, iv.end) < 0
+}
+
+// intervalNode is a node of a centered interval tree. It holds the intervals containing its
+// center, while the intervals which end before the center are in the left subtree and the ones
+// which start after it are in the right subtree.
+type intervalNode struct {
+	center      []byte
+	byStart     []interval // Sorted by start in ascending order.
+	byEnd       []interval // Sorted by end in descending order.
+	left, right *intervalNode
+}
+
+// Intervals is an index of key ranges, which finds the ranges containing a key in logarithmic time
+// in the number of ranges. The index is rebuilt on the first Get after a change, as it is meant
+// for ranges which change far less often than they're looked up.
+type Intervals struct {
+	intervals []interval
+	root      *intervalNode
+	dirty     bool
+}
+
+// NewIntervals returns an empty Intervals.
+func NewIntervals() *Intervals {
+	return &Intervals{}
+}
+
+// Add adds the id in the index for the keys in [start, end). A nil end means the range has no
+// upper bound. Empty ranges are ignored.
+func (t *Intervals) Add(start, end []byte, id uint64) {
+	if end != nil && bytes.Compare(start, end) >= 0 {
+		return
+	}
+	t.intervals = append(t.intervals, interval{start: start, end: end, id: id})
+	t.dirty = true
+}
+
+// Delete deletes the id from the index for the given range, if it exists.
+func (t *Intervals) Delete(start, end []byte, id uint64) {
+	out := t.intervals[:0]
+	for _, iv := range t.intervals {
+		if iv.id == id && bytes.Equal(iv.start, start) && bytes.Equal(iv.end, end) {
+			continue
+		}
+		out = append(out, iv)
+	}
+	for i := len(out); i < len(t.intervals); i++ {
+		t.intervals[i] = interval{} // garbage collecting
+	}
+	t.intervals = out
+	t.dirty = true
+}
+
+// Get returns the ids of the ranges containing the key.
+func (t *Intervals) Get(key []byte) map[uint64]struct{} {
+	if t.dirty {
+		t.root = buildIntervalNode(append([]interval{}, t.intervals...))
+		t.dirty = false
+	}
+	out := make(map[uint64]struct{})
+	for n := t.root; n != nil; {
+		if bytes.Compare(key, n.center) < 0 {
+			// All the intervals of the node end after the key, as they contain the center.
+			for _, iv := range n.byStart {
+				if bytes.Compare(iv.start, key) > 0 {
+					break
+				}
+				out[iv.id] = struct{}{}
+			}
+			n = n.left
+		} else {
+			// All the intervals of the node start before the key.
+			for _, iv := range n.byEnd {
+				if !iv.endsAfter(key) {
+					break
+				}
+				out[iv.id] = struct{}{}
+			}
+			n = n.right
+		}
+	}
+	return out
+}
+
+func buildIntervalNode(intervals []interval) *intervalNode {
+	if len(intervals) == 0 {
+		return nil
+	}
+	sort.Slice(intervals, func(i, j int) bool {
+		return bytes.Compare(intervals[i].start, intervals[j].start) < 0
+	})
+	// The interval the center is picked from contains it, so every node holds at least one
+	// interval.
+	n := &intervalNode{center: intervals[len(intervals)/2].start}
+	var left, right []interval
+	for _, iv := range intervals {
+		switch {
+		case !iv.endsAfter(n.center):
+			left = append(left, iv)
+		case bytes.Compare(iv.start, n.center) > 0:
+			right = append(right, iv)
+		default:
+			n.byStart = append(n.byStart, iv)
+		}
+	}
+	n.byEnd = append([]interval{}, n.byStart...)
+	sort.Slice(n.byEnd, func(i, j int) bool {
+		a, b := n.byEnd[i], n.byEnd[j]
+		if a.end == nil || b.end == nil {
+			return a.end == nil && b.end != nil
+		}
+		return bytes.Compare(a.end, b.end) > 0
+	})
+	n.left = buildIntervalNode(left)
+	n.right = buildIntervalNode(right)
+	return n
+}
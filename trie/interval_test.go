@@ -0,0 +1,73 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package trie
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntervalsGet(t *testing.T) {
+	iv := NewIntervals()
+	iv.Add([]byte("b"), []byte("d"), 1)
+	iv.Add([]byte("c"), nil, 2)
+	iv.Add([]byte("a"), []byte("c"), 3)
+	iv.Add([]byte("c"), []byte("c"), 4) // Empty.
+
+	require.Equal(t, map[uint64]struct{}{}, iv.Get([]byte("0")))
+	require.Equal(t, map[uint64]struct{}{3: {}}, iv.Get([]byte("a")))
+	require.Equal(t, map[uint64]struct{}{1: {}, 3: {}}, iv.Get([]byte("bz")))
+	require.Equal(t, map[uint64]struct{}{1: {}, 2: {}}, iv.Get([]byte("c")))
+	require.Equal(t, map[uint64]struct{}{2: {}}, iv.Get([]byte("d")))
+	require.Equal(t, map[uint64]struct{}{2: {}}, iv.Get([]byte("zzz")))
+
+	iv.Delete([]byte("c"), nil, 2)
+	iv.Delete([]byte("b"), []byte("d"), 3) // Doesn't exist.
+	require.Equal(t, map[uint64]struct{}{1: {}}, iv.Get([]byte("c")))
+	require.Equal(t, map[uint64]struct{}{}, iv.Get([]byte("d")))
+}
+
+func TestIntervalsRandom(t *testing.T) {
+	key := func() []byte { return []byte(fmt.Sprintf("%03d", rand.Intn(1000))) }
+	iv := NewIntervals()
+	var all []interval
+	for i := 0; i < 500; i++ {
+		start, end := key(), key()
+		if bytes.Compare(start, end) >= 0 {
+			start, end = end, start
+		}
+		if i%10 == 0 {
+			end = nil
+		}
+		iv.Add(start, end, uint64(i))
+		all = append(all, interval{start: start, end: end, id: uint64(i)})
+	}
+	for i := 0; i < 1000; i++ {
+		k := key()
+		exp := make(map[uint64]struct{})
+		for _, in := range all {
+			if bytes.Compare(in.start, k) <= 0 && in.endsAfter(k) && !bytes.Equal(in.start, in.end) {
+				exp[in.id] = struct{}{}
+			}
+		}
+		require.Equal(t, exp, iv.Get(k), "key: %s", k)
+	}
+}
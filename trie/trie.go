@@ -19,6 +19,7 @@ package trie
 type node struct {
 	children map[byte]*node
 	ids      []uint64
+	exact    []uint64 // ids added for the key ending at this node only.
 }
 
 func newNode() *node {
@@ -42,8 +43,21 @@ func NewTrie() *Trie {
 
 // Add adds the id in the trie for the given prefix path.
 func (t *Trie) Add(prefix []byte, id uint64) {
+	node := t.path(prefix)
+	// We only need to add the id to the last node of the given prefix.
+	node.ids = append(node.ids, id)
+}
+
+// AddExact adds the id in the trie for the given key only, and not for the keys it prefixes.
+func (t *Trie) AddExact(key []byte, id uint64) {
+	node := t.path(key)
+	node.exact = append(node.exact, id)
+}
+
+// path returns the node for the given path, creating the missing nodes.
+func (t *Trie) path(path []byte) *node {
 	node := t.root
-	for _, val := range prefix {
+	for _, val := range path {
 		child, ok := node.children[val]
 		if !ok {
 			child = newNode()
@@ -51,8 +65,7 @@ func (t *Trie) Add(prefix []byte, id uint64) {
 		}
 		node = child
 	}
-	// We only need to add the id to the last node of the given prefix.
-	node.ids = append(node.ids, id)
+	return node
 }
 
 // Get returns prefix matched ids for the given key.
@@ -69,7 +82,7 @@ func (t *Trie) Get(key []byte) map[uint64]struct{} {
 	for _, val := range key {
 		child, ok := node.children[val]
 		if !ok {
-			break
+			return out
 		}
 		// We need ids of the all the node in the matching key path.
 		for _, id := range child.ids {
@@ -77,28 +90,50 @@ func (t *Trie) Get(key []byte) map[uint64]struct{} {
 		}
 		node = child
 	}
+	// The whole key is in the trie, so add the ids of the exact matches too.
+	for _, id := range node.exact {
+		out[id] = struct{}{}
+	}
 	return out
 }
 
 // Delete will delete the id if the id exist in the given index path.
 func (t *Trie) Delete(index []byte, id uint64) {
+	if node := t.find(index); node != nil {
+		// We're just removing the id not the hanging path.
+		node.ids = deleteID(node.ids, id)
+	}
+}
+
+// DeleteExact will delete the id if it was added for the given key by AddExact.
+func (t *Trie) DeleteExact(key []byte, id uint64) {
+	if node := t.find(key); node != nil {
+		node.exact = deleteID(node.exact, id)
+	}
+}
+
+// find returns the node for the given path, or nil if it doesn't exist.
+func (t *Trie) find(path []byte) *node {
 	node := t.root
-	for _, val := range index {
+	for _, val := range path {
 		child, ok := node.children[val]
 		if !ok {
-			return
+			return nil
 		}
 		node = child
 	}
-	// We're just removing the id not the hanging path.
-	out := node.ids[:0]
-	for _, val := range node.ids {
+	return node
+}
+
+func deleteID(ids []uint64, id uint64) []uint64 {
+	out := ids[:0]
+	for _, val := range ids {
 		if val != id {
 			out = append(out, val)
 		}
 	}
-	for i := len(out); i < len(node.ids); i++ {
-		node.ids[i] = 0 // garbage collecting
+	for i := len(out); i < len(ids); i++ {
+		ids[i] = 0 // garbage collecting
 	}
-	node.ids = out
+	return out
 }
@@ -65,3 +65,23 @@ func TestTrieDelete(t *testing.T) {
 	trie.Delete(nil, 5)
 	require.Equal(t, map[uint64]struct{}{1: {}, 3: {}}, trie.Get([]byte("hello")))
 }
+
+func TestTrieExact(t *testing.T) {
+	trie := NewTrie()
+	trie.AddExact([]byte("hello"), 1)
+	trie.AddExact([]byte("hel"), 2)
+	trie.Add([]byte("hel"), 3)
+	trie.AddExact(nil, 4)
+
+	require.Equal(t, map[uint64]struct{}{1: {}, 3: {}}, trie.Get([]byte("hello")))
+	require.Equal(t, map[uint64]struct{}{2: {}, 3: {}}, trie.Get([]byte("hel")))
+	require.Equal(t, map[uint64]struct{}{3: {}}, trie.Get([]byte("hell")))
+	require.Equal(t, map[uint64]struct{}{3: {}}, trie.Get([]byte("hello!")))
+	require.Equal(t, map[uint64]struct{}{}, trie.Get([]byte("he")))
+	require.Equal(t, map[uint64]struct{}{4: {}}, trie.Get(nil))
+
+	trie.DeleteExact([]byte("hello"), 1)
+	trie.Delete([]byte("hel"), 2) // Doesn't delete exact matches.
+	require.Equal(t, map[uint64]struct{}{3: {}}, trie.Get([]byte("hello")))
+	require.Equal(t, map[uint64]struct{}{2: {}, 3: {}}, trie.Get([]byte("hel")))
+}
@@ -20,11 +20,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"fmt"
 	"math"
 	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
@@ -34,12 +36,18 @@ import (
 type oracle struct {
 	isManaged       bool // Does not change value, so no locking required.
 	detectConflicts bool // Determines if the txns should be checked for conflicts.
+	// Determines if the key ranges read by the txns should be checked for conflicts too.
+	detectRangeConflicts bool
 
 	sync.Mutex // For nextTxnTs and commits.
 	// writeChLock lock is for ensuring that transactions go to the write
 	// channel in the same order as their commit timestamps.
 	writeChLock sync.Mutex
 	nextTxnTs   uint64
+	// commits counts the txns which got a commit timestamp, see checkPreconditions.
+	commits uint64
+	// cleanedCommits is the highest commits of the committedTxns removed by the cleanup.
+	cleanedCommits uint64
 
 	// Used to block NewTransaction, so all previous commits are visible to a new read.
 	txnMark *y.WaterMark
@@ -56,18 +64,68 @@ type oracle struct {
 
 	// closer is used to stop watermarks.
 	closer *z.Closer
+
+	// hlc issues the timestamps of the txns in managed mode, see DB.HLC.
+	hlc *HLC
+
+	// timeLog maps the commit timestamps to the times of the commits, see DB.NewTransactionAsOf.
+	// It is set by Open.
+	timeLog          *timeLog
+	historyRetention time.Duration
 }
 
 type committedTxn struct {
 	ts uint64
+	// The value of oracle.commits once the txn got its commit timestamp.
+	commits uint64
 	// ConflictKeys Keeps track of the entries written at timestamp ts.
 	conflictKeys map[uint64]struct{}
+	// The sorted keys written at timestamp ts, only kept when range conflicts are detected, and
+	// the ranges deleted at timestamp ts.
+	keys   []string
+	ranges []userKeyRange
+}
+
+// userKeyRange is the range of keys [start, end), without timestamps. A nil end means that the
+// range has no upper bound.
+type userKeyRange struct {
+	start, end []byte
+}
+
+func (r userKeyRange) overlaps(o userKeyRange) bool {
+	return (r.end == nil || bytes.Compare(o.start, r.end) < 0) &&
+		(o.end == nil || bytes.Compare(r.start, o.end) < 0)
+}
+
+// hasWriteIn returns true if the committed txn wrote or deleted a key in the given range.
+func (ct *committedTxn) hasWriteIn(r userKeyRange) bool {
+	i := sort.SearchStrings(ct.keys, string(r.start))
+	if i < len(ct.keys) && (r.end == nil || ct.keys[i] < string(r.end)) {
+		return true
+	}
+	for _, w := range ct.ranges {
+		if w.overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRangeDeleteOf returns true if the committed txn deleted a range containing the key.
+func (ct *committedTxn) hasRangeDeleteOf(key []byte) bool {
+	for _, w := range ct.ranges {
+		if bytes.Compare(key, w.start) >= 0 && (w.end == nil || bytes.Compare(key, w.end) < 0) {
+			return true
+		}
+	}
+	return false
 }
 
 func newOracle(opt Options) *oracle {
 	orc := &oracle{
-		isManaged:       opt.managedTxns,
-		detectConflicts: opt.DetectConflicts,
+		isManaged:            opt.managedTxns,
+		detectConflicts:      opt.DetectConflicts,
+		detectRangeConflicts: opt.DetectConflicts && opt.DetectRangeConflicts,
 		// We're not initializing nextTxnTs and readOnlyTs. It would be done after replay in Open.
 		//
 		// WaterMarks must be 64-bit aligned for atomic package, hence we must use pointers here.
@@ -75,6 +133,9 @@ func newOracle(opt Options) *oracle {
 		readMark: &y.WaterMark{Name: "badger.PendingReads"},
 		txnMark:  &y.WaterMark{Name: "badger.TxnTimestamp"},
 		closer:   z.NewCloser(2),
+		hlc:      NewHLC(),
+
+		historyRetention: opt.HistoryRetention,
 	}
 	orc.readMark.Init(orc.closer)
 	orc.txnMark.Init(orc.closer)
@@ -104,6 +165,15 @@ func (o *oracle) readTs() uint64 {
 	return readTs
 }
 
+// latestTs returns the commit timestamp of the latest txn, once its writes are visible.
+func (o *oracle) latestTs() uint64 {
+	o.Lock()
+	ts := o.nextTxnTs - 1
+	o.Unlock()
+	y.Check(o.txnMark.WaitForMark(context.Background(), ts))
+	return ts
+}
+
 func (o *oracle) nextTs() uint64 {
 	o.Lock()
 	defer o.Unlock()
@@ -126,17 +196,46 @@ func (o *oracle) setDiscardTs(ts uint64) {
 }
 
 func (o *oracle) discardAtOrBelow() uint64 {
+	var ts uint64
 	if o.isManaged {
 		o.Lock()
-		defer o.Unlock()
-		return o.discardTs
+		ts = o.discardTs
+		o.Unlock()
+	} else {
+		ts = o.readMark.DoneUntil()
+	}
+	if o.historyRetention > 0 {
+		// Keep the versions needed to read at the times within the retention period. Nothing is
+		// discarded until the time log goes back far enough.
+		retained, _ := o.timeLog.versionAt(time.Now().Add(-o.historyRetention))
+		if retained < ts {
+			ts = retained
+		}
+	}
+	return ts
+}
+
+// readTsAsOf returns the read timestamp to read the DB as it was at the given time.
+func (o *oracle) readTsAsOf(t time.Time) (uint64, error) {
+	readTs, ok := o.timeLog.versionAt(t)
+	if !o.isManaged {
+		// The commits are recorded as soon as they get a timestamp, but they're only readable once
+		// written.
+		if done := o.txnMark.DoneUntil(); readTs > done {
+			readTs = done
+		}
 	}
-	return o.readMark.DoneUntil()
+	// The compactions keep the latest version at or below the discard timestamp of every key, so
+	// the DB can still be read at that timestamp, but not below it.
+	if !ok || readTs < o.discardAtOrBelow() {
+		return 0, ErrHistoryUnavailable
+	}
+	return readTs, nil
 }
 
 // hasConflict must be called while having a lock.
 func (o *oracle) hasConflict(txn *Txn) bool {
-	if len(txn.reads) == 0 {
+	if len(txn.reads) == 0 && len(txn.readRanges) == 0 && len(txn.readKeys) == 0 {
 		return false
 	}
 	for _, committedTxn := range o.committedTxns {
@@ -152,6 +251,23 @@ func (o *oracle) hasConflict(txn *Txn) bool {
 
 		for _, ro := range txn.reads {
 			if _, has := committedTxn.conflictKeys[ro]; has {
+				// The locked keys couldn't have been modified by the txns taking locks, so they
+				// are not checked for conflicts. In managed mode, they are read at the read
+				// timestamp, which can be older than the txns which held the locks before.
+				if _, locked := txn.locked[ro]; !locked || o.isManaged {
+					return true
+				}
+			}
+		}
+		for _, r := range txn.readRanges {
+			if committedTxn.hasWriteIn(r) {
+				return true
+			}
+		}
+		// The fingerprints of the keys read don't catch the range deletes, and the locks don't
+		// keep the keys from being deleted by them.
+		for _, key := range txn.readKeys {
+			if committedTxn.hasRangeDeleteOf(key) {
 				return true
 			}
 		}
@@ -160,12 +276,22 @@ func (o *oracle) hasConflict(txn *Txn) bool {
 	return false
 }
 
-func (o *oracle) newCommitTs(txn *Txn) uint64 {
+// errPreconditionsChanged is returned by newCommitTs if the keys of the preconditions of the txn
+// may have been written since checkPreconditions, so that they have to be checked again.
+var errPreconditionsChanged = errors.New("Preconditions changed")
+
+// newCommitTs returns the commit timestamp of the txn, or ErrConflict if it has a conflict. checked
+// is the value returned by checkPreconditions.
+func (o *oracle) newCommitTs(txn *Txn, checked uint64) (uint64, error) {
 	o.Lock()
 	defer o.Unlock()
 
 	if o.hasConflict(txn) {
-		return 0
+		// The commit timestamp can be zero in managed mode, so it can't tell the conflicts.
+		return 0, ErrConflict
+	}
+	if !o.preconditionsHold(txn, checked) {
+		return 0, errPreconditionsChanged
 	}
 
 	var ts uint64
@@ -175,12 +301,22 @@ func (o *oracle) newCommitTs(txn *Txn) uint64 {
 
 		// This is the general case, when user doesn't specify the read and commit ts.
 		ts = o.nextTxnTs
+		o.timeLog.record(ts, time.Now())
 		o.nextTxnTs++
+		o.commits++
 		o.txnMark.Begin(ts)
 
 	} else {
 		// If commitTs is set, use it instead.
 		ts = txn.commitTs
+		o.timeLog.record(ts, time.Now())
+		// Keep track of the latest commit, so that the DB knows the versions it holds on restart
+		// and the HLC stays ahead of them.
+		if ts >= o.nextTxnTs {
+			o.nextTxnTs = ts + 1
+		}
+		o.commits++
+		o.hlc.observe(ts)
 	}
 
 	y.AssertTrue(ts >= o.lastCleanupTs)
@@ -188,13 +324,79 @@ func (o *oracle) newCommitTs(txn *Txn) uint64 {
 	if o.detectConflicts {
 		// We should ensure that txns are not added to o.committedTxns slice when
 		// conflict detection is disabled otherwise this slice would keep growing.
-		o.committedTxns = append(o.committedTxns, committedTxn{
+		ct := committedTxn{
 			ts:           ts,
+			commits:      o.commits,
 			conflictKeys: txn.conflictKeys,
-		})
+			ranges:       txn.deletedRanges(),
+		}
+		if o.detectRangeConflicts {
+			ct.keys = txn.writtenKeys()
+		}
+		o.committedTxns = append(o.committedTxns, ct)
 	}
 
-	return ts
+	return ts, nil
+}
+
+// checkPreconditions returns a *PreconditionError if the latest committed version of a key
+// doesn't match the one expected by the txn. It reads the versions without holding o.Lock, so it
+// returns the number of commits it has seen, for newCommitTs to check that no txn committed since
+// then has written the keys.
+func (o *oracle) checkPreconditions(txn *Txn) (uint64, error) {
+	if len(txn.preconditions) == 0 {
+		return 0, nil
+	}
+	o.Lock()
+	commits := o.commits
+	readTs := uint64(math.MaxUint64)
+	if !o.isManaged {
+		readTs = o.nextTxnTs - 1
+	}
+	o.Unlock()
+	if !o.isManaged {
+		// Wait for the txns which got a commit timestamp already to be written.
+		if err := o.txnMark.WaitForMark(context.Background(), readTs); err != nil {
+			return 0, errors.Wrap(err, "While waiting for the commits to check the preconditions")
+		}
+	}
+	for _, pc := range txn.preconditions {
+		vs, err := txn.db.get(y.KeyWithTs(pc.key, readTs))
+		if err != nil {
+			return 0, errors.Wrapf(err, "While checking the version of key: %q", pc.key)
+		}
+		var version uint64
+		if (vs.Value != nil || vs.Meta != 0) && !isDeletedOrExpired(vs.Meta, vs.ExpiresAt) {
+			version = vs.Version
+		}
+		if version != pc.version {
+			return 0, &PreconditionError{Key: pc.key, Version: version}
+		}
+	}
+	return commits, nil
+}
+
+// preconditionsHold returns true if none of the txns committed since checkPreconditions returned
+// checked has written or deleted the keys of the preconditions of the txn. It returns false if that
+// can't be told from o.committedTxns. It must be called with o.Lock held.
+func (o *oracle) preconditionsHold(txn *Txn, checked uint64) bool {
+	if len(txn.preconditions) == 0 || o.commits == checked {
+		return true
+	}
+	if !o.detectConflicts || o.cleanedCommits > checked {
+		return false
+	}
+	for _, ct := range o.committedTxns {
+		if ct.commits <= checked {
+			continue
+		}
+		for _, pc := range txn.preconditions {
+			if _, has := ct.conflictKeys[z.MemHash(pc.key)]; has || ct.hasRangeDeleteOf(pc.key) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
 func (o *oracle) doneRead(txn *Txn) {
@@ -230,6 +432,9 @@ func (o *oracle) cleanupCommittedTransactions() { // Must be called under o.Lock
 	tmp := o.committedTxns[:0]
 	for _, txn := range o.committedTxns {
 		if txn.ts <= maxReadTs {
+			if txn.commits > o.cleanedCommits {
+				o.cleanedCommits = txn.commits
+			}
 			continue
 		}
 		tmp = append(tmp, txn)
@@ -256,10 +461,22 @@ type Txn struct {
 	reads []uint64 // contains fingerprints of keys read.
 	// contains fingerprints of keys written. This is used for conflict detection.
 	conflictKeys map[uint64]struct{}
-	readsLock    sync.Mutex // guards the reads slice. See addReadKey.
+	readsLock    sync.Mutex     // guards the reads slice. See addReadKey.
+	readRanges   []userKeyRange // contains the key ranges scanned by iterators. See addReadRange.
+	readKeys     [][]byte       // contains the keys read by Get. See addGetKey.
+
+	lockID     uint64              // Identifies the txn in the lock manager, see GetForUpdate.
+	locked     map[uint64]struct{} // contains fingerprints of keys locked by GetForUpdate.
+	lockedKeys map[string]struct{} // contains keys locked by GetForUpdate.
 
 	pendingWrites   map[string]*Entry // cache stores any writes done by txn.
 	duplicateWrites []*Entry          // Used in managed mode to store duplicate entries.
+	numRangeDeletes int               // Number of range tombstones in pendingWrites.
+	preconditions   []precondition    // Versions of keys checked on commit.
+
+	savepoints    []savepoint
+	undoWrites    []undoWrite // Changes to pendingWrites since the first savepoint.
+	undoConflicts []uint64    // Fingerprints added to conflictKeys since the first savepoint.
 
 	numIterators int32
 	discarded    bool
@@ -359,6 +576,12 @@ func exceedsSize(prefix string, max int64, key []byte) error {
 }
 
 func (txn *Txn) modify(e *Entry) error {
+	return txn.modifyEntry(e, false)
+}
+
+// modifyEntry is like modify, but allows keys with the !badger! prefix if internal is set. This
+// is used to write range tombstones and the keys of column families.
+func (txn *Txn) modifyEntry(e *Entry, internal bool) error {
 	const maxKeySize = 65000
 
 	switch {
@@ -368,7 +591,7 @@ func (txn *Txn) modify(e *Entry) error {
 		return ErrDiscardedTxn
 	case len(e.Key) == 0:
 		return ErrEmptyKey
-	case bytes.HasPrefix(e.Key, badgerPrefix):
+	case !internal && bytes.HasPrefix(e.Key, badgerPrefix):
 		return ErrInvalidKey
 	case len(e.Key) > maxKeySize:
 		// Key length can't be more than uint16, as determined by table::header.  To
@@ -384,12 +607,17 @@ func (txn *Txn) modify(e *Entry) error {
 	if err := txn.checkSize(e); err != nil {
 		return err
 	}
+	if !internal && e.ExpiresAt == 0 && e.meta&bitDelete == 0 && !isMergeOperand(e.meta) {
+		if ttl := txn.db.retention.defaultTTL(e.Key); ttl > 0 {
+			e.ExpiresAt = uint64(time.Now().Add(ttl).Unix())
+		}
+	}
 
 	// The txn.conflictKeys is used for conflict detection. If conflict detection
 	// is disabled, we don't need to store key hashes in this map.
 	if txn.db.opt.DetectConflicts {
 		fp := z.MemHash(e.Key) // Avoid dealing with byte arrays.
-		txn.conflictKeys[fp] = struct{}{}
+		txn.addConflictKey(fp)
 	}
 	// If a duplicate entry was inserted in managed mode, move it to the duplicate writes slice.
 	// Add the entry to duplicateWrites only if both the entries have different versions. For
@@ -397,7 +625,7 @@ func (txn *Txn) modify(e *Entry) error {
 	if oldEntry, ok := txn.pendingWrites[string(e.Key)]; ok && oldEntry.version != e.version {
 		txn.duplicateWrites = append(txn.duplicateWrites, oldEntry)
 	}
-	txn.pendingWrites[string(e.Key)] = e
+	txn.setPendingWrite(e)
 	return nil
 }
 
@@ -435,6 +663,106 @@ func (txn *Txn) Delete(key []byte) error {
 	return txn.modify(e)
 }
 
+// Merge adds a merge operand to the key, which Options.MergeFunc merges into the value of the key
+// when it's read. Merging doesn't read the key, so the transactions merging into the same key
+// don't conflict with each other, unlike the ones updating it with Get and Set. The value of a
+// key without value is the operand. Merging into a key set by this transaction updates the value
+// to be set.
+//
+// It returns ErrNoMergeFunc if Options.MergeFunc isn't set. The current transaction keeps a
+// reference to the key and operand, as in Set.
+func (txn *Txn) Merge(key, operand []byte) error {
+	f := txn.db.opt.MergeFunc
+	if f == nil {
+		return ErrNoMergeFunc
+	}
+	e := &Entry{Key: key, Value: operand, meta: bitMergeOperand}
+	switch old, ok := txn.pendingWrites[string(key)]; {
+	case ok && isDeletedOrExpired(old.meta, old.ExpiresAt):
+		e.meta = 0
+	case ok && isMergeOperand(old.meta):
+		e.Value = f(old.Value, operand)
+	case ok:
+		val := old.Value
+		if isBlob(old.meta) {
+			r, err := newBlobReader(txn.db, txn, key, 0, old.Value)
+			if err != nil {
+				return err
+			}
+			if val, err = r.readAll(); err != nil {
+				return err
+			}
+		}
+		e = &Entry{
+			Key:       key,
+			Value:     f(val, operand),
+			UserMeta:  old.UserMeta,
+			ExpiresAt: old.ExpiresAt,
+			meta:      old.meta &^ bitBlob,
+		}
+	case txn.coveredByPendingRangeDelete(key):
+		e.meta = 0
+	}
+	return txn.modify(e)
+}
+
+// precondition requires the latest committed version of key to be version, or the key to be
+// absent if version is zero.
+type precondition struct {
+	key     []byte
+	version uint64
+}
+
+// PreconditionError is returned by Commit if the version of a key doesn't match the one expected
+// by SetIfVersion, SetIfAbsent or DeleteIfVersion. Its cause is ErrPreconditionFailed.
+type PreconditionError struct {
+	Key []byte
+	// Version is the latest committed version of the key, or zero if the key is absent.
+	Version uint64
+}
+
+func (e *PreconditionError) Error() string {
+	return fmt.Sprintf("%s: key %q is at version %d", ErrPreconditionFailed, e.Key, e.Version)
+}
+
+// Cause returns ErrPreconditionFailed.
+func (e *PreconditionError) Cause() error {
+	return ErrPreconditionFailed
+}
+
+// Unwrap returns ErrPreconditionFailed.
+func (e *PreconditionError) Unwrap() error {
+	return ErrPreconditionFailed
+}
+
+// SetIfVersion is like Set, but Commit fails with a *PreconditionError unless the latest committed
+// version of the key is expectedVersion. An expectedVersion of zero requires the key to be absent,
+// that is never written, deleted or expired. The version is checked atomically with the commit,
+// and the key isn't tracked as read, so the transaction doesn't conflict with other writes to it.
+func (txn *Txn) SetIfVersion(key, val []byte, expectedVersion uint64) error {
+	return txn.modifyIf(NewEntry(key, val), expectedVersion)
+}
+
+// SetIfAbsent is like Set, but Commit fails with a *PreconditionError if the key exists. See
+// SetIfVersion.
+func (txn *Txn) SetIfAbsent(key, val []byte) error {
+	return txn.SetIfVersion(key, val, 0)
+}
+
+// DeleteIfVersion is like Delete, but Commit fails with a *PreconditionError unless the latest
+// committed version of the key is expectedVersion. See SetIfVersion.
+func (txn *Txn) DeleteIfVersion(key []byte, expectedVersion uint64) error {
+	return txn.modifyIf(&Entry{Key: key, meta: bitDelete}, expectedVersion)
+}
+
+func (txn *Txn) modifyIf(e *Entry, expectedVersion uint64) error {
+	if err := txn.modify(e); err != nil {
+		return err
+	}
+	txn.preconditions = append(txn.preconditions, precondition{key: e.Key, version: expectedVersion})
+	return nil
+}
+
 // Get looks for key and returns corresponding Item.
 // If key is not found, ErrKeyNotFound is returned.
 func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
@@ -444,29 +772,72 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 		return nil, ErrDiscardedTxn
 	}
 
-	item = new(Item)
 	if txn.update {
-		if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key) {
-			if isDeletedOrExpired(e.meta, e.ExpiresAt) {
+		if item, has := txn.getPending(key); has {
+			if item == nil {
 				return nil, ErrKeyNotFound
 			}
-			// Fulfill from cache.
-			item.meta = e.meta
-			item.val = e.Value
-			item.userMeta = e.UserMeta
-			item.key = key
-			item.status = prefetched
-			item.version = txn.readTs
-			item.expiresAt = e.ExpiresAt
-			// We probably don't need to set db on item here.
-			return item, nil
+			if !isMergeOperand(item.meta) {
+				return item, nil
+			}
+			// The value of a pending merge operand depends on the committed versions.
+			txn.addGetKey(key)
+			return txn.mergePending(item, txn.readTs)
 		}
 		// Only track reads if this is update txn. No need to track read if txn serviced it
 		// internally.
-		txn.addReadKey(key)
+		txn.addGetKey(key)
 	}
+	return txn.getAt(key, txn.readTs)
+}
 
-	seek := y.KeyWithTs(key, txn.readTs)
+// getPending returns the item for the key from the writes of the txn, or nil if the txn deleted
+// it. It returns false if the key hasn't been written or deleted by the txn.
+func (txn *Txn) getPending(key []byte) (*Item, bool) {
+	if e, has := txn.pendingWrites[string(key)]; has && bytes.Equal(key, e.Key) {
+		if isDeletedOrExpired(e.meta, e.ExpiresAt) {
+			return nil, true
+		}
+		// Fulfill from cache.
+		item := new(Item)
+		item.meta = e.meta
+		item.userMeta = e.UserMeta
+		item.key = key
+		item.version = txn.readTs
+		item.expiresAt = e.ExpiresAt
+		if isBlob(e.meta) {
+			// The value is read from the pending chunks when needed.
+			item.vptr = e.Value
+			item.pending = true
+			item.txn = txn
+		} else {
+			item.val = e.Value
+			item.status = prefetched
+		}
+		// We probably don't need to set db on item here.
+		return item, true
+	}
+	if txn.coveredByPendingRangeDelete(key) {
+		return nil, true
+	}
+	return nil, false
+}
+
+// mergePending merges the pending merge operand of the item into the value of the key at readTs.
+func (txn *Txn) mergePending(item *Item, readTs uint64) (*Item, error) {
+	val, err := txn.db.mergeValue(item.key, readTs, [][]byte{item.val})
+	if err != nil {
+		return nil, err
+	}
+	item.val = val
+	item.meta &^= bitMergeOperand
+	return item, nil
+}
+
+// getAt returns the version of the key visible at readTs.
+func (txn *Txn) getAt(key []byte, readTs uint64) (item *Item, rerr error) {
+	item = new(Item)
+	seek := y.KeyWithTs(key, readTs)
 	vs, err := txn.db.get(seek)
 	if err != nil {
 		return nil, errors.Wrapf(err, "DB::Get key: %q", key)
@@ -485,9 +856,72 @@ func (txn *Txn) Get(key []byte) (item *Item, rerr error) {
 	item.vptr = y.SafeCopy(item.vptr, vs.Value)
 	item.txn = txn
 	item.expiresAt = vs.ExpiresAt
+	if isMergeOperand(vs.Meta) {
+		// Return the merged value in place of the operand.
+		if item.vptr, err = txn.db.mergeValue(key, readTs, nil); err != nil {
+			return nil, err
+		}
+		item.meta &^= bitMergeOperand | bitValuePointer
+	}
 	return item, nil
 }
 
+// GetForUpdate is like Get, but it first locks the key, so that the other transactions calling
+// GetForUpdate on it wait until this one is committed or discarded. The returned item is the latest
+// committed version of the key, which can be newer than the read timestamp of the transaction.
+// The locked keys aren't checked for conflicts on Commit, so transactions updating the same keys
+// through GetForUpdate take turns instead of failing with ErrConflict. The writes done by
+// transactions which don't lock the keys are not ordered by the locks though.
+//
+// In managed mode, the key is read at the read timestamp of the transaction, so the locked keys
+// are still checked for conflicts, and Commit returns ErrConflict if they have been written after
+// that timestamp.
+//
+// If the lock is held by another transaction, GetForUpdate waits for at most Options.LockTimeout
+// before returning ErrLockTimeout. If that transaction is waiting for a lock held by this one,
+// directly or through other transactions, it returns ErrDeadlock instead. In both cases, the
+// transaction should be discarded and retried.
+func (txn *Txn) GetForUpdate(key []byte) (*Item, error) {
+	switch {
+	case len(key) == 0:
+		return nil, ErrEmptyKey
+	case txn.discarded:
+		return nil, ErrDiscardedTxn
+	case !txn.update:
+		return nil, ErrReadOnlyTxn
+	}
+
+	db := txn.db
+	if txn.lockID == 0 {
+		txn.lockID = db.locks.newOwnerID()
+		txn.locked = make(map[uint64]struct{})
+		txn.lockedKeys = make(map[string]struct{})
+	}
+	if err := db.locks.acquire(txn.lockID, string(key), db.opt.LockTimeout); err != nil {
+		return nil, err
+	}
+	txn.locked[z.MemHash(key)] = struct{}{}
+	txn.lockedKeys[string(key)] = struct{}{}
+
+	// The lock might have been released by a txn which committed after this one started.
+	readTs := txn.readTs
+	if !db.orc.isManaged {
+		readTs = db.orc.latestTs()
+	} else {
+		txn.addGetKey(key)
+	}
+	if item, has := txn.getPending(key); has {
+		if item == nil {
+			return nil, ErrKeyNotFound
+		}
+		if isMergeOperand(item.meta) {
+			return txn.mergePending(item, readTs)
+		}
+		return item, nil
+	}
+	return txn.getAt(key, readTs)
+}
+
 func (txn *Txn) addReadKey(key []byte) {
 	if txn.update {
 		fp := z.MemHash(key)
@@ -502,6 +936,50 @@ func (txn *Txn) addReadKey(key []byte) {
 	}
 }
 
+// addGetKey records a key read by Get. Unlike the keys returned by the iterators, which fall into
+// the ranges they scanned, it is also kept for checking against the range deletes when range
+// conflicts are detected.
+func (txn *Txn) addGetKey(key []byte) {
+	txn.addReadKey(key)
+	if txn.db.orc.detectRangeConflicts {
+		txn.readsLock.Lock()
+		txn.readKeys = append(txn.readKeys, y.SafeCopy(nil, key))
+		txn.readsLock.Unlock()
+	}
+}
+
+func (txn *Txn) addReadRange(r userKeyRange) {
+	txn.readsLock.Lock()
+	txn.readRanges = append(txn.readRanges, r)
+	txn.readsLock.Unlock()
+}
+
+// writtenKeys returns the sorted keys written by the txn, leaving out its range tombstones.
+func (txn *Txn) writtenKeys() []string {
+	keys := make([]string, 0, len(txn.pendingWrites)-txn.numRangeDeletes)
+	for k, e := range txn.pendingWrites {
+		if e.meta&bitRangeDelete == 0 {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// deletedRanges returns the ranges deleted by the txn.
+func (txn *Txn) deletedRanges() []userKeyRange {
+	if txn.numRangeDeletes == 0 {
+		return nil
+	}
+	var ranges []userKeyRange
+	for _, e := range txn.pendingWrites {
+		if e.meta&bitRangeDelete > 0 {
+			ranges = append(ranges, userKeyRange{start: e.Key[len(rangeDelPrefix):], end: e.Value})
+		}
+	}
+	return ranges
+}
+
 // Discard discards a created transaction. This method is very important and must be called. Commit
 // method calls this internally, however, calling this multiple times doesn't cause any issues. So,
 // this can safely be called via a defer right when transaction is created.
@@ -518,23 +996,42 @@ func (txn *Txn) Discard() {
 	if !txn.db.orc.isManaged {
 		txn.db.orc.doneRead(txn)
 	}
+	if len(txn.lockedKeys) > 0 {
+		keys := make([]string, 0, len(txn.lockedKeys))
+		for key := range txn.lockedKeys {
+			keys = append(keys, key)
+		}
+		txn.db.locks.release(txn.lockID, keys)
+	}
 }
 
 func (txn *Txn) commitAndSend() (func() error, error) {
 	orc := txn.db.orc
+	// The preconditions are checked before taking the locks, as it takes reads.
+	checked, err := orc.checkPreconditions(txn)
+	if err != nil {
+		return nil, err
+	}
 	// Ensure that the order in which we get the commit timestamp is the same as
 	// the order in which we push these updates to the write channel. So, we
 	// acquire a writeChLock before getting a commit timestamp, and only release
 	// it after pushing the entries to it.
 	orc.writeChLock.Lock()
 	defer orc.writeChLock.Unlock()
-
-	commitTs := orc.newCommitTs(txn)
+	commitTs, err := orc.newCommitTs(txn, checked)
+	if err == errPreconditionsChanged {
+		// Check them again under writeChLock, so that no txn commits in the meantime, rather than
+		// retrying for as long as other txns commit.
+		if checked, err = orc.checkPreconditions(txn); err != nil {
+			return nil, err
+		}
+		commitTs, err = orc.newCommitTs(txn, checked)
+	}
+	if err != nil {
+		return nil, err
+	}
 	// The commitTs can be zero if the transaction is running in managed mode.
 	// Individual entries might have their own timestamps.
-	if commitTs == 0 && !txn.db.opt.managedTxns {
-		return nil, ErrConflict
-	}
 
 	keepTogether := true
 	setVersion := func(e *Entry) {
@@ -601,6 +1098,11 @@ func (txn *Txn) commitAndSend() (func() error, error) {
 	}
 	ret := func() error {
 		err := req.Wait()
+		// The time log is written here rather than in newCommitTs, to keep the file out of the
+		// lock of the oracle. The points it fails to write are written with the next commits.
+		if tlErr := orc.timeLog.persist(); tlErr != nil {
+			txn.db.opt.Warningf("%v", tlErr)
+		}
 		// Wait before marking commitTs as done.
 		// We can't defer doneCommit above, because it is being called from a
 		// callback here.
@@ -737,7 +1239,8 @@ func (txn *Txn) ReadTs() uint64 {
 // NewTransaction creates a new transaction. Badger supports concurrent execution of transactions,
 // providing serializable snapshot isolation, avoiding write skews. Badger achieves this by tracking
 // the keys read and at Commit time, ensuring that these read keys weren't concurrently modified by
-// another transaction.
+// another transaction. The keys written into the ranges scanned by the iterators, and the range
+// deletes of Txn.DeleteRange, are only checked when Options.DetectRangeConflicts is set.
 //
 // For read-only transactions, set update to false. In this mode, we don't track the rows read for
 // any changes. Thus, any long running iterations done in this mode wouldn't pay this overhead.
@@ -758,6 +1261,34 @@ func (db *DB) NewTransaction(update bool) *Txn {
 	return db.newTransaction(update, false)
 }
 
+// NewTransactionAsOf creates a read-only transaction, which reads the DB as it was at the given
+// wall-clock time. The commit times are recorded with a precision of a second, so the
+// transaction may not see some of the commits done within the second before t.
+//
+// ErrHistoryUnavailable is returned if the versions needed to read the DB at t may have been
+// discarded by the compactions, which keep them for Options.HistoryRetention, or if t is before
+// the earliest commit recorded by the DB. The transaction should be discarded before t falls out
+// of the retention period, as its versions can be discarded afterwards.
+//
+//	txn, err := db.NewTransactionAsOf(time.Now().Add(-time.Minute))
+//	if err != nil {
+//		return err
+//	}
+//	defer txn.Discard()
+//	// Call various APIs.
+func (db *DB) NewTransactionAsOf(t time.Time) (*Txn, error) {
+	readTs, err := db.orc.readTsAsOf(t)
+	if err != nil {
+		return nil, err
+	}
+	txn := db.newTransaction(false, true)
+	txn.readTs = readTs
+	// The txn doesn't hold back the read watermark, the versions it reads are kept by the
+	// retention period instead.
+	txn.doneRead = true
+	return txn, nil
+}
+
 func (db *DB) newTransaction(update, isManaged bool) *Txn {
 	if db.opt.ReadOnly && update {
 		// DB is read-only, force read-only transaction.
@@ -19,6 +19,7 @@ package badger
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"strconv"
 	"sync"
@@ -29,6 +30,7 @@ import (
 	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/y"
 	"github.com/dgraph-io/ristretto/z"
+	"github.com/pkg/errors"
 
 	"github.com/stretchr/testify/require"
 )
@@ -945,3 +947,651 @@ func TestConflict(t *testing.T) {
 		runTest(t, testAndSetItr)
 	})
 }
+
+func TestTxnRangeConflict(t *testing.T) {
+	// scan reads the keys from seek on in the given direction, stopping after limit keys if limit
+	// is positive.
+	scan := func(txn *Txn, prefix, seek string, reverse bool, limit int) {
+		opt := DefaultIteratorOptions
+		opt.Prefix = []byte(prefix)
+		opt.Reverse = reverse
+		it := txn.NewIterator(opt)
+		defer it.Close()
+		var n int
+		for it.Seek([]byte(seek)); (limit <= 0 || n < limit) && it.Valid(); it.Next() {
+			n++
+		}
+	}
+	tests := []struct {
+		name     string
+		scan     func(txn *Txn)
+		write    func(txn *Txn) error
+		conflict bool
+	}{
+		{
+			name:     "insert into scanned prefix",
+			scan:     func(txn *Txn) { scan(txn, "b", "", false, 0) },
+			write:    func(txn *Txn) error { return txn.Set([]byte("b3"), nil) },
+			conflict: true,
+		},
+		{
+			name:  "insert out of scanned prefix",
+			scan:  func(txn *Txn) { scan(txn, "b", "", false, 0) },
+			write: func(txn *Txn) error { return txn.Set([]byte("c0"), nil) },
+		},
+		{
+			name:     "insert before last key read",
+			scan:     func(txn *Txn) { scan(txn, "", "b", false, 1) },
+			write:    func(txn *Txn) error { return txn.Set([]byte("b0"), nil) },
+			conflict: true,
+		},
+		{
+			name:  "insert after last key read",
+			scan:  func(txn *Txn) { scan(txn, "", "b", false, 1) },
+			write: func(txn *Txn) error { return txn.Set([]byte("b15"), nil) },
+		},
+		{
+			name:     "insert into reverse scan",
+			scan:     func(txn *Txn) { scan(txn, "", "b2", true, 0) },
+			write:    func(txn *Txn) error { return txn.Set([]byte("0"), nil) },
+			conflict: true,
+		},
+		{
+			name:  "insert after reverse scan",
+			scan:  func(txn *Txn) { scan(txn, "", "b2", true, 0) },
+			write: func(txn *Txn) error { return txn.Set([]byte("b3"), nil) },
+		},
+		{
+			name:     "delete range overlapping scan",
+			scan:     func(txn *Txn) { scan(txn, "b", "", false, 0) },
+			write:    func(txn *Txn) error { return txn.DeleteRange([]byte("a"), []byte("b0")) },
+			conflict: true,
+		},
+		{
+			name:  "delete range out of scan",
+			scan:  func(txn *Txn) { scan(txn, "b", "", false, 0) },
+			write: func(txn *Txn) error { return txn.DeleteRange([]byte("c"), []byte("d")) },
+		},
+		{
+			name: "delete range of key read",
+			scan: func(txn *Txn) {
+				_, err := txn.Get([]byte("b1"))
+				require.NoError(t, err)
+			},
+			write:    func(txn *Txn) error { return txn.DeleteRange([]byte("b"), []byte("c")) },
+			conflict: true,
+		},
+		{
+			name: "delete range next to key read",
+			scan: func(txn *Txn) {
+				_, err := txn.Get([]byte("b1"))
+				require.NoError(t, err)
+			},
+			write: func(txn *Txn) error { return txn.DeleteRange([]byte("b2"), []byte("c")) },
+		},
+		{
+			name: "delete range of key read and rolled back",
+			scan: func(txn *Txn) {
+				sp := txn.Savepoint()
+				_, err := txn.Get([]byte("b1"))
+				require.NoError(t, err)
+				require.NoError(t, txn.RollbackTo(sp))
+			},
+			write: func(txn *Txn) error { return txn.DeleteRange([]byte("b"), []byte("c")) },
+		},
+	}
+	for _, detect := range []bool{false, true} {
+		for _, tc := range tests {
+			t.Run(fmt.Sprintf("%s/detect=%v", tc.name, detect), func(t *testing.T) {
+				opt := getTestOptions("")
+				opt.DetectRangeConflicts = detect
+				runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+					require.NoError(t, db.Update(func(txn *Txn) error {
+						for _, k := range []string{"a1", "b1", "b2", "c1"} {
+							require.NoError(t, txn.Set([]byte(k), nil))
+						}
+						return nil
+					}))
+					txn := db.NewTransaction(true)
+					defer txn.Discard()
+					tc.scan(txn)
+					require.NoError(t, db.Update(tc.write))
+					require.NoError(t, txn.Set([]byte("result"), nil))
+					if tc.conflict && detect {
+						require.Equal(t, ErrConflict, txn.Commit())
+					} else {
+						require.NoError(t, txn.Commit())
+					}
+				})
+			})
+		}
+	}
+}
+
+func TestTxnGetForUpdate(t *testing.T) {
+	t.Run("counter", func(t *testing.T) {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			key := []byte("counter")
+			incr := func() error {
+				return db.Update(func(txn *Txn) error {
+					var n int
+					item, err := txn.GetForUpdate(key)
+					switch {
+					case err == ErrKeyNotFound:
+					case err != nil:
+						return err
+					default:
+						require.NoError(t, item.Value(func(val []byte) error {
+							n, err = strconv.Atoi(string(val))
+							return err
+						}))
+					}
+					return txn.Set(key, []byte(strconv.Itoa(n+1)))
+				})
+			}
+			const numGo, numIncr = 16, 20
+			var wg sync.WaitGroup
+			wg.Add(numGo)
+			for i := 0; i < numGo; i++ {
+				go func() {
+					defer wg.Done()
+					for j := 0; j < numIncr; j++ {
+						require.NoError(t, incr())
+					}
+				}()
+			}
+			wg.Wait()
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				require.Equal(t, strconv.Itoa(numGo*numIncr), string(val))
+				return nil
+			}))
+		})
+	})
+	t.Run("deadlock", func(t *testing.T) {
+		runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+			txn1 := db.NewTransaction(true)
+			defer txn1.Discard()
+			txn2 := db.NewTransaction(true)
+			defer txn2.Discard()
+
+			_, err := txn1.GetForUpdate([]byte("a"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn2.GetForUpdate([]byte("b"))
+			require.Equal(t, ErrKeyNotFound, err)
+
+			errCh := make(chan error, 1)
+			go func() {
+				_, err := txn1.GetForUpdate([]byte("b"))
+				errCh <- err
+			}()
+			for {
+				db.locks.Lock()
+				_, waiting := db.locks.waitFor[txn1.lockID]
+				db.locks.Unlock()
+				if waiting {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			_, err = txn2.GetForUpdate([]byte("a"))
+			require.Equal(t, ErrDeadlock, err)
+			txn2.Discard()
+			require.Equal(t, ErrKeyNotFound, <-errCh)
+		})
+	})
+	t.Run("timeout", func(t *testing.T) {
+		opt := getTestOptions("").WithLockTimeout(10 * time.Millisecond)
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			require.NoError(t, db.Update(func(txn *Txn) error {
+				return txn.Set([]byte("a"), []byte("1"))
+			}))
+			txn1 := db.NewTransaction(true)
+			defer txn1.Discard()
+			txn2 := db.NewTransaction(true)
+			defer txn2.Discard()
+
+			_, err := txn1.GetForUpdate([]byte("a"))
+			require.NoError(t, err)
+			_, err = txn2.GetForUpdate([]byte("a"))
+			require.Equal(t, ErrLockTimeout, err)
+
+			// The lock is reentrant and gets released on commit.
+			_, err = txn1.GetForUpdate([]byte("a"))
+			require.NoError(t, err)
+			require.NoError(t, txn1.Set([]byte("a"), []byte("2")))
+			require.NoError(t, txn1.Commit())
+			item, err := txn2.GetForUpdate([]byte("a"))
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, "2", string(val))
+		})
+	})
+	t.Run("managed", func(t *testing.T) {
+		opt := getTestOptions("")
+		opt.managedTxns = true
+		runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+			key := []byte("k")
+			txn := db.NewTransactionAt(1, true)
+			require.NoError(t, txn.Set(key, []byte("0")))
+			require.NoError(t, txn.CommitAt(2, nil))
+
+			incr := func(txn *Txn, commitTs uint64) error {
+				item, err := txn.GetForUpdate(key)
+				require.NoError(t, err)
+				val, err := item.ValueCopy(nil)
+				require.NoError(t, err)
+				n, err := strconv.Atoi(string(val))
+				require.NoError(t, err)
+				require.NoError(t, txn.Set(key, []byte(strconv.Itoa(n+1))))
+				return txn.CommitAt(commitTs, nil)
+			}
+			txn1 := db.NewTransactionAt(5, true)
+			defer txn1.Discard()
+			txn2 := db.NewTransactionAt(5, true)
+			defer txn2.Discard()
+			require.NoError(t, incr(txn1, 10))
+			// The key is read at the read timestamp, so the lock doesn't keep the update of txn1
+			// from being lost.
+			require.Equal(t, ErrConflict, incr(txn2, 11))
+
+			txn = db.NewTransactionAt(20, false)
+			defer txn.Discard()
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, "1", string(val))
+		})
+	})
+}
+
+func TestTxnSavepoint(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			require.NoError(t, txn.Set([]byte("c"), []byte("db")))
+			return txn.Set([]byte("r"), []byte("db"))
+		}))
+
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		keys := func() []string {
+			it := txn.NewIterator(DefaultIteratorOptions)
+			defer it.Close()
+			var keys []string
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, string(it.Item().Key()))
+			}
+			return keys
+		}
+		require.Equal(t, ErrInvalidSavepoint, txn.RollbackTo(0))
+
+		require.NoError(t, txn.Set([]byte("a"), []byte("1")))
+		count, size, conflicts := txn.count, txn.size, len(txn.conflictKeys)
+		sp1 := txn.Savepoint()
+		require.NoError(t, txn.Set([]byte("a"), []byte("2")))
+		require.NoError(t, txn.Set([]byte("b"), []byte("1")))
+		sp2 := txn.Savepoint()
+		require.NoError(t, txn.Delete([]byte("c")))
+		require.NoError(t, txn.Set([]byte("d1"), []byte("1")))
+		require.NoError(t, txn.DeleteRange([]byte("a"), []byte("b0")))
+		_, err := txn.Get([]byte("r"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"d1", "r"}, keys())
+
+		require.NoError(t, txn.RollbackTo(sp2))
+		require.Empty(t, txn.reads)
+		require.Equal(t, 0, txn.numRangeDeletes)
+		require.Equal(t, []string{"a", "b", "c", "r"}, keys())
+		// A savepoint can be rolled back to several times.
+		require.NoError(t, txn.Set([]byte("e"), []byte("1")))
+		require.NoError(t, txn.RollbackTo(sp2))
+		require.Equal(t, []string{"a", "b", "c", "r"}, keys())
+
+		require.NoError(t, txn.RollbackTo(sp1))
+		require.Equal(t, ErrInvalidSavepoint, txn.RollbackTo(sp2))
+		item, err := txn.Get([]byte("a"))
+		require.NoError(t, err)
+		val, err := item.ValueCopy(nil)
+		require.NoError(t, err)
+		require.Equal(t, "1", string(val))
+		sp3 := txn.Savepoint()
+		require.Equal(t, []string{"a", "c", "r"}, keys())
+		require.NoError(t, txn.RollbackTo(sp3))
+		require.Equal(t, count, txn.count)
+		require.Equal(t, size, txn.size)
+		require.Equal(t, conflicts, len(txn.conflictKeys))
+
+		// The read of r has been rolled back, so writing it concurrently isn't a conflict.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("r"), []byte("concurrent"))
+		}))
+		require.NoError(t, txn.Commit())
+		require.NoError(t, db.View(func(txn *Txn) error {
+			_, err := txn.Get([]byte("b"))
+			require.Equal(t, ErrKeyNotFound, err)
+			_, err = txn.Get([]byte("c"))
+			require.NoError(t, err)
+			return nil
+		}))
+	})
+}
+
+func TestTxnConditionalWrites(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		version := func() uint64 {
+			var v uint64
+			require.NoError(t, db.View(func(txn *Txn) error {
+				item, err := txn.Get(key)
+				require.NoError(t, err)
+				v = item.Version()
+				return nil
+			}))
+			return v
+		}
+		update := func(fn func(txn *Txn) error) error {
+			txn := db.NewTransaction(true)
+			defer txn.Discard()
+			require.NoError(t, fn(txn))
+			return txn.Commit()
+		}
+		requireFailed := func(err error, version uint64) {
+			require.Equal(t, ErrPreconditionFailed, errors.Cause(err))
+			pe, ok := err.(*PreconditionError)
+			require.True(t, ok)
+			require.Equal(t, key, pe.Key)
+			require.Equal(t, version, pe.Version)
+		}
+
+		// Only one of the concurrent SetIfAbsent calls succeeds.
+		var wg sync.WaitGroup
+		var succeeded uint32
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := update(func(txn *Txn) error { return txn.SetIfAbsent(key, []byte("v1")) })
+				if err == nil {
+					atomic.AddUint32(&succeeded, 1)
+				} else {
+					require.Equal(t, ErrPreconditionFailed, errors.Cause(err))
+				}
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, uint32(1), succeeded)
+		v1 := version()
+		requireFailed(update(func(txn *Txn) error { return txn.SetIfAbsent(key, nil) }), v1)
+
+		// A stale version fails even if the txn started before the latest write.
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.SetIfVersion(key, []byte("stale"), v1))
+		require.NoError(t, update(func(txn *Txn) error {
+			return txn.SetIfVersion(key, []byte("v2"), v1)
+		}))
+		v2 := version()
+		requireFailed(txn.Commit(), v2)
+
+		requireFailed(update(func(txn *Txn) error { return txn.DeleteIfVersion(key, v1) }), v2)
+		require.NoError(t, update(func(txn *Txn) error { return txn.DeleteIfVersion(key, v2) }))
+		requireFailed(update(func(txn *Txn) error { return txn.SetIfVersion(key, nil, v2) }), 0)
+		require.NoError(t, update(func(txn *Txn) error { return txn.SetIfAbsent(key, []byte("v3")) }))
+
+		// The preconditions are checked without holding the lock of the oracle, so the writes
+		// committed in the meantime are caught under it.
+		v3 := version()
+		txn = db.NewTransaction(true)
+		defer txn.Discard()
+		require.NoError(t, txn.SetIfVersion(key, []byte("v4"), v3))
+		checked, err := db.orc.checkPreconditions(txn)
+		require.NoError(t, err)
+		require.NoError(t, update(func(txn *Txn) error { return txn.Set([]byte("other"), nil) }))
+		db.orc.Lock()
+		require.True(t, db.orc.preconditionsHold(txn, checked))
+		db.orc.Unlock()
+		require.NoError(t, update(func(txn *Txn) error {
+			return txn.DeleteRange([]byte("a"), []byte("z"))
+		}))
+		db.orc.Lock()
+		require.False(t, db.orc.preconditionsHold(txn, checked))
+		db.orc.Unlock()
+		requireFailed(txn.Commit(), 0)
+	})
+}
+
+func TestTxnConditionalWritesConcurrent(t *testing.T) {
+	opt := getTestOptions("").WithDetectConflicts(false)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		key := []byte("counter")
+		// incr adds one to the counter, retrying until its version hasn't changed in between.
+		incr := func() {
+			for {
+				txn := db.NewTransaction(true)
+				var n int
+				var version uint64
+				item, err := txn.Get(key)
+				if err == nil {
+					version = item.Version()
+					val, err := item.ValueCopy(nil)
+					require.NoError(t, err)
+					n, err = strconv.Atoi(string(val))
+					require.NoError(t, err)
+				} else {
+					require.Equal(t, ErrKeyNotFound, err)
+				}
+				require.NoError(t, txn.SetIfVersion(key, []byte(strconv.Itoa(n+1)), version))
+				err = txn.Commit()
+				txn.Discard()
+				if err == nil {
+					return
+				}
+				require.Equal(t, ErrPreconditionFailed, errors.Cause(err))
+			}
+		}
+
+		// The other keys are written all along, which doesn't keep the counter from being updated.
+		stop := make(chan struct{})
+		var writers sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			writers.Add(1)
+			go func(i int) {
+				defer writers.Done()
+				for j := 0; ; j++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					require.NoError(t, db.Update(func(txn *Txn) error {
+						return txn.Set([]byte(fmt.Sprintf("other/%d/%d", i, j)), nil)
+					}))
+				}
+			}(i)
+		}
+		const numGo, numIncr = 4, 100
+		var wg sync.WaitGroup
+		for i := 0; i < numGo; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < numIncr; j++ {
+					incr()
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("The conditional writes didn't get through")
+		}
+		close(stop)
+		writers.Wait()
+
+		require.NoError(t, db.View(func(txn *Txn) error {
+			item, err := txn.Get(key)
+			require.NoError(t, err)
+			val, err := item.ValueCopy(nil)
+			require.NoError(t, err)
+			require.Equal(t, strconv.Itoa(numGo*numIncr), string(val))
+			return nil
+		}))
+	})
+}
+
+func TestTxnDeleteRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key=%d", i)) }
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, txn.Set(key(i), []byte("val")))
+		}
+		return nil
+	}))
+
+	snapshot := db.NewTransaction(false)
+	defer snapshot.Discard()
+
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		require.Equal(t, ErrInvalidRange, txn.DeleteRange(key(5), key(2)))
+		require.Equal(t, ErrInvalidKey, txn.DeleteRange(badgerPrefix, []byte("~")))
+
+		require.NoError(t, txn.Set(key(3), []byte("before")))
+		require.NoError(t, txn.DeleteRange(key(2), key(6)))
+		require.NoError(t, txn.Set(key(4), []byte("after")))
+
+		// The range delete should be visible within the transaction.
+		_, err := txn.Get(key(3))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = txn.Get(key(4))
+		require.NoError(t, err)
+		return nil
+	}))
+
+	getKeys := func(txn *Txn, reverse bool) []string {
+		opt := DefaultIteratorOptions
+		opt.Reverse = reverse
+		itr := txn.NewIterator(opt)
+		defer itr.Close()
+
+		var keys []string
+		for itr.Rewind(); itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Item().Key()))
+		}
+		return keys
+	}
+	check := func() {
+		require.NoError(t, db.View(func(txn *Txn) error {
+			for i := 0; i < 10; i++ {
+				_, err := txn.Get(key(i))
+				if i >= 2 && i < 6 && i != 4 {
+					require.Equal(t, ErrKeyNotFound, err, "key=%d", i)
+				} else {
+					require.NoError(t, err, "key=%d", i)
+				}
+			}
+			expected := []string{"key=0", "key=1", "key=4", "key=6", "key=7", "key=8", "key=9"}
+			require.Equal(t, expected, getKeys(txn, false))
+			reversed := getKeys(txn, true)
+			for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+				reversed[i], reversed[j] = reversed[j], reversed[i]
+			}
+			require.Equal(t, expected, reversed)
+			return nil
+		}))
+	}
+	check()
+	// Transactions started before the range delete should still see all the keys.
+	require.Len(t, getKeys(snapshot, false), 10)
+	snapshot.Discard()
+
+	// The range tombstone should survive a restart.
+	require.NoError(t, db.Close())
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	check()
+}
+
+func TestTxnDeleteRangeSize(t *testing.T) {
+	runBadgerTest(t, nil, func(t *testing.T, db *DB) {
+		txn := db.NewTransaction(true)
+		defer txn.Discard()
+		key := func(i int) []byte { return []byte(fmt.Sprintf("key=%05d", i)) }
+		n := int(db.opt.maxBatchCount) * 3 / 4
+		for i := 0; i < n; i++ {
+			require.NoError(t, txn.Set(key(i), []byte("val")))
+		}
+		require.NoError(t, txn.DeleteRange(key(0), key(n)))
+		// The keys deleted by the range delete no longer count towards the size of the txn, which
+		// only holds the range tombstone along with the entry marking the end of the txn.
+		require.Equal(t, int64(2), txn.count)
+		for i := 0; i < n; i++ {
+			require.NoError(t, txn.Set(key(i), []byte("val")))
+		}
+		require.NoError(t, txn.Commit())
+
+		// The internal keys within the range don't keep the tombstone around.
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.DeleteRange([]byte("!"), []byte("~"))
+		}))
+		require.True(t, db.lc.rangeHasVersionsBelow([]byte("!"), []byte("~"), math.MaxUint64))
+		require.NoError(t, db.DropPrefix([]byte("key")))
+		require.False(t, db.lc.rangeHasVersionsBelow([]byte("!"), []byte("~"), math.MaxUint64))
+	})
+}
+
+func TestRangeTombstonesCovers(t *testing.T) {
+	var r rangeTombstones
+	var list []rangeTombstone
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%04d", i)) }
+	for i := 0; i < 500; i++ {
+		start := rand.Intn(1000)
+		// Mostly small ranges, along with a few large ones.
+		length := 1 + rand.Intn(10)
+		if i%50 == 0 {
+			length = rand.Intn(500)
+		}
+		rt := rangeTombstone{start: key(start), end: key(start + length), version: uint64(i + 1)}
+		r.add(rt)
+		r.add(rt)
+		list = append(list, rt)
+	}
+	for i := 0; i < 100; i++ {
+		rt := list[rand.Intn(len(list))]
+		r.remove(rt.start, rt.version)
+	}
+	r.RLock()
+	list = append([]rangeTombstone{}, r.list...)
+	r.RUnlock()
+
+	for i := 0; i < 1100; i++ {
+		k := key(i)
+		version, readTs := uint64(rand.Intn(500)), uint64(rand.Intn(500))
+		var expected bool
+		for _, rt := range list {
+			if rt.version > version && rt.version <= readTs && rt.contains(k) {
+				expected = true
+			}
+		}
+		require.Equal(t, expected, r.covers(k, version, readTs), "key: %s", k)
+	}
+	r.clear()
+	require.False(t, r.covers(key(1), 0, math.MaxUint64))
+}
@@ -58,6 +58,14 @@ const (
 	bitDiscardEarlierVersions byte = 1 << 2 // Set if earlier versions can be discarded.
 	// Set if item shouldn't be discarded via compactions (used by merge operator)
 	bitMergeEntry byte = 1 << 3
+	// Set if the entry is a range tombstone. The key holds the start of the range and the
+	// value holds the (exclusive) end.
+	bitRangeDelete byte = 1 << 4
+	// Set if the value is a merge operand, to merge into the older versions of the key.
+	bitMergeOperand byte = 1 << 5
+	// Set if the value is the manifest of a blob, whose chunks are stored under blobPrefix. All
+	// the bits are taken, so this uses two which are never set together otherwise.
+	bitBlob = bitMergeEntry | bitMergeOperand
 	// The MSB 2 bits are for transactions.
 	bitTxn    byte = 1 << 6 // Set if the entry is part of a txn.
 	bitFinTxn byte = 1 << 7 // Set if the entry is to indicate end of txn in value log.
@@ -501,6 +509,7 @@ func (vlog *valueLog) rewrite(f *logFile, tr trace.Trace) error {
 	var size int64
 
 	y.AssertTrue(vlog.db != nil)
+	retention := vlog.db.newKeyRetention(vlog.db.orc.discardAtOrBelow())
 	var count, moved int
 	fe := func(e Entry) error {
 		count++
@@ -512,7 +521,10 @@ func (vlog *valueLog) rewrite(f *logFile, tr trace.Trace) error {
 		if err != nil {
 			return err
 		}
-		if discardEntry(e, vs, vlog.db) {
+		// The versions expired by a retention rule can still be read until the compactions drop
+		// them, so they're replaced by deletion markers rather than left pointing to this file.
+		expired := retention.expiredVersion(e.Key, vs)
+		if !expired && discardEntry(e, vs, retention) {
 			return nil
 		}
 
@@ -540,11 +552,19 @@ func (vlog *valueLog) rewrite(f *logFile, tr trace.Trace) error {
 			moved++
 			// This new entry only contains the key, and a pointer to the value.
 			ne := new(Entry)
-			ne.meta = 0 // Remove all bits. Different keyspace doesn't need these bits.
+			// Remove all bits. Different keyspace doesn't need these bits. Except the ones telling
+			// the range tombstones, the merge operands and the blobs apart.
+			ne.meta = e.meta & bitRangeDelete
+			if e.meta&bitMergeOperand > 0 {
+				ne.meta |= e.meta & bitBlob
+			}
 			ne.UserMeta = e.UserMeta
 			ne.ExpiresAt = e.ExpiresAt
 			ne.Key = append([]byte{}, e.Key...)
 			ne.Value = append([]byte{}, e.Value...)
+			if expired {
+				ne = &Entry{Key: ne.Key, meta: bitDelete}
+			}
 			es := int64(ne.estimateSize(vlog.opt.ValueThreshold))
 			// Consider size of value as well while considering the total size
 			// of the batch. There have been reports of high memory usage in
@@ -561,6 +581,7 @@ func (vlog *valueLog) rewrite(f *logFile, tr trace.Trace) error {
 				size = 0
 				wb = wb[:0]
 			}
+			vlog.db.ioLimiter.wait(int(es), false)
 			wb = append(wb, ne)
 			size += es
 		} else {
@@ -1387,6 +1408,7 @@ func (vlog *valueLog) write(reqs []*request) error {
 		buf.Reset()
 		y.NumWrites.Add(1)
 		y.NumBytesWritten.Add(int64(n))
+		atomic.AddUint64(&vlog.db.metrics.vlogBytesWritten, uint64(n))
 		vlog.opt.Debugf("Done")
 		atomic.AddUint32(&vlog.writableLogOffset, uint32(n))
 		atomic.StoreUint32(&curlf.size, vlog.writableLogOffset)
@@ -1611,7 +1633,16 @@ func (vlog *valueLog) pickLog(head valuePointer, tr trace.Trace) (files []*logFi
 	return files
 }
 
-func discardEntry(e Entry, vs y.ValueStruct, db *DB) bool {
+// isMergeOperand returns true if meta is the meta of a merge operand, rather than of a blob.
+func isMergeOperand(meta byte) bool {
+	return meta&bitBlob == bitMergeOperand
+}
+
+func isBlob(meta byte) bool {
+	return meta&bitBlob == bitBlob
+}
+
+func discardEntry(e Entry, vs y.ValueStruct, retention *keyRetention) bool {
 	if vs.Version != y.ParseTs(e.Key) {
 		// Version not found. Discard.
 		return true
@@ -1627,7 +1658,8 @@ func discardEntry(e Entry, vs y.ValueStruct, db *DB) bool {
 		// Just a txn finish entry. Discard.
 		return true
 	}
-	return false
+	// The version has outlived the DefaultTTL of its retention rule.
+	return retention.expiredVersion(e.Key, vs)
 }
 
 type reason struct {
@@ -1705,6 +1737,7 @@ func (vlog *valueLog) sample(samp *sampler, discardRatio float64) (*reason, erro
 	var r reason
 	start := time.Now()
 	y.AssertTrue(vlog.db != nil)
+	retention := vlog.db.newKeyRetention(vlog.db.orc.discardAtOrBelow())
 	s := new(y.Slice)
 	var numIterations int
 	_, err = vlog.iterate(lf, 0, func(e Entry, vp valuePointer) error {
@@ -1735,7 +1768,7 @@ func (vlog *valueLog) sample(samp *sampler, discardRatio float64) (*reason, erro
 		if err != nil {
 			return err
 		}
-		if discardEntry(e, vs, vlog.db) {
+		if discardEntry(e, vs, retention) {
 			r.discard += esz
 			return nil
 		}
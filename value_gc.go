@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package badger
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2/y"
+	"github.com/dgraph-io/ristretto/z"
+	"golang.org/x/net/trace"
+)
+
+// ValueLogGCPolicy configures the value log GC run in the background by the DB, see
+// Options.ValueLogGCPolicy.
+type ValueLogGCPolicy struct {
+	// Interval is the time between two GC cycles. Zero disables the background GC.
+	Interval time.Duration
+	// DiscardRatio is the fraction of a value log file which must be discardable, according to
+	// the discard stats collected by the compactions, for the file to be rewritten. It must be in
+	// the range (0.0, 1.0), both endpoints excluded.
+	DiscardRatio float64
+	// MaxBytesPerCycle bounds the total size of the files rewritten by a cycle. The first file is
+	// always rewritten, whatever its size. Zero means no limit.
+	MaxBytesPerCycle int64
+	// MaxWriteRate is the rate of writes to the value log, in bytes per second, above which the
+	// cycles are skipped, so that the GC doesn't compete with heavy writes. The rate is measured
+	// since the end of the previous cycle. Zero means that the cycles are never skipped.
+	MaxWriteRate int64
+	// OnCycle, if set, is called with the outcome of every cycle.
+	OnCycle func(ValueLogGCCycle)
+}
+
+// DefaultValueLogGCPolicy is a ValueLogGCPolicy suitable for most workloads.
+var DefaultValueLogGCPolicy = ValueLogGCPolicy{
+	Interval:         5 * time.Minute,
+	DiscardRatio:     0.5,
+	MaxBytesPerCycle: 4 << 30,
+	MaxWriteRate:     64 << 20,
+}
+
+// ValueLogGCCycle is the outcome of a cycle of the background value log GC.
+type ValueLogGCCycle struct {
+	Start    time.Time
+	Duration time.Duration
+	// BackedOff is set if the cycle was skipped because of heavy writes.
+	BackedOff bool
+	// Candidates is the number of files whose discard stats were above the discard ratio.
+	Candidates int
+	// FilesRewritten is the number of candidates rewritten, within MaxBytesPerCycle.
+	FilesRewritten int
+	// BytesRewritten is the total size of the files rewritten, and BytesDiscarded the part of it
+	// which was discardable according to the discard stats.
+	BytesRewritten int64
+	BytesDiscarded int64
+	// Err is the error which stopped the cycle, if any. It is ErrRejected if another value log GC
+	// was running.
+	Err error
+}
+
+// gcCandidate is a value log file which can be rewritten by the value log GC.
+type gcCandidate struct {
+	lf      *logFile
+	size    int64
+	discard int64
+}
+
+// gcCandidates returns the files before head whose discard stats are above discardRatio, the
+// files with the highest ratio first.
+func (vlog *valueLog) gcCandidates(head valuePointer, discardRatio float64) []gcCandidate {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	vlog.lfDiscardStats.RLock()
+	defer vlog.lfDiscardStats.RUnlock()
+
+	var candidates []gcCandidate
+	for _, fid := range vlog.sortedFids() {
+		// The file being written is never rewritten, even if it is before head.
+		if fid >= head.Fid || fid >= vlog.maxFid {
+			break
+		}
+		lf := vlog.filesMap[fid]
+		c := gcCandidate{
+			lf:      lf,
+			size:    int64(atomic.LoadUint32(&lf.size)),
+			discard: vlog.lfDiscardStats.m[fid],
+		}
+		if c.size > 0 && float64(c.discard) >= discardRatio*float64(c.size) {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		return float64(ci.discard)/float64(ci.size) > float64(cj.discard)/float64(cj.size)
+	})
+	return candidates
+}
+
+// runValueLogGCCycle rewrites the candidates of the value log GC, until MaxBytesPerCycle is
+// reached or lc is closed.
+func (db *DB) runValueLogGCCycle(policy ValueLogGCPolicy, lc *z.Closer) (cycle ValueLogGCCycle) {
+	cycle.Start = time.Now()
+	defer func() {
+		cycle.Duration = time.Since(cycle.Start)
+	}()
+	head, err := db.valueLogGCHead()
+	if err != nil {
+		cycle.Err = err
+		return cycle
+	}
+
+	vlog := &db.vlog
+	select {
+	case vlog.garbageCh <- struct{}{}:
+	default:
+		cycle.Err = ErrRejected
+		return cycle
+	}
+	tr := trace.New("Badger.ValueLog", "GC cycle")
+	tr.SetMaxEvents(100)
+	defer func() {
+		tr.Finish()
+		<-vlog.garbageCh
+	}()
+
+	candidates := vlog.gcCandidates(head, policy.DiscardRatio)
+	cycle.Candidates = len(candidates)
+	tr.LazyPrintf("Found %d candidates via discard stats", len(candidates))
+	for _, c := range candidates {
+		if policy.MaxBytesPerCycle > 0 && cycle.FilesRewritten > 0 &&
+			cycle.BytesRewritten+c.size > policy.MaxBytesPerCycle {
+			tr.LazyPrintf("Reached the limit of %d bytes per cycle", policy.MaxBytesPerCycle)
+			break
+		}
+		select {
+		case <-lc.HasBeenClosed():
+			return cycle
+		default:
+		}
+		if err := vlog.rewrite(c.lf, tr); err != nil {
+			cycle.Err = y.Wrapf(err, "while rewriting value log file %d", c.lf.fid)
+			return cycle
+		}
+		vlog.lfDiscardStats.Lock()
+		delete(vlog.lfDiscardStats.m, c.lf.fid)
+		vlog.lfDiscardStats.Unlock()
+		cycle.FilesRewritten++
+		cycle.BytesRewritten += c.size
+		cycle.BytesDiscarded += c.discard
+	}
+	return cycle
+}
+
+// runValueLogGCScheduler runs the cycles of the background value log GC every
+// ValueLogGCPolicy.Interval, until lc is closed.
+func (db *DB) runValueLogGCScheduler(lc *z.Closer) {
+	defer lc.Done()
+
+	policy := db.opt.ValueLogGCPolicy
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	// The counter of the bytes written starts at zero when the DB is opened.
+	last := time.Now()
+	var written uint64
+	for {
+		select {
+		case <-lc.HasBeenClosed():
+			return
+		case <-ticker.C:
+		}
+
+		var cycle ValueLogGCCycle
+		now := time.Now()
+		rate := float64(atomic.LoadUint64(&db.metrics.vlogBytesWritten)-written) /
+			now.Sub(last).Seconds()
+		if policy.MaxWriteRate > 0 && rate > float64(policy.MaxWriteRate) {
+			cycle = ValueLogGCCycle{Start: now, BackedOff: true}
+		} else {
+			cycle = db.runValueLogGCCycle(policy, lc)
+		}
+		db.metrics.addValueLogGCCycle(cycle)
+		if cycle.Err != nil && cycle.Err != ErrRejected {
+			db.opt.Warningf("Value log GC cycle failed: %v", cycle.Err)
+		}
+		if policy.OnCycle != nil {
+			policy.OnCycle(cycle)
+		}
+		// The writes of the cycle itself don't count towards the rate.
+		last = time.Now()
+		written = atomic.LoadUint64(&db.metrics.vlogBytesWritten)
+	}
+}
@@ -32,6 +32,7 @@ import (
 
 	"github.com/dgraph-io/badger/v2/options"
 	"github.com/dgraph-io/badger/v2/y"
+	"github.com/dgraph-io/ristretto/z"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/trace"
@@ -436,6 +437,50 @@ func TestValueGC4(t *testing.T) {
 	require.NoError(t, kv.Close())
 }
 
+func TestValueGCRangeTombstone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	// Without compactions, only the range tombstone hides the deleted key.
+	opt := getTestOptions(dir).WithValueLogFileSize(1 << 20).WithNumCompactors(0).
+		WithCompactL0OnClose(false)
+	db, err := Open(opt)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("b"), []byte("value"))
+	}))
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+
+	// The end of the range is long enough for the tombstone to be stored in the value log.
+	end := append([]byte("c"), bytes.Repeat([]byte("z"), opt.ValueThreshold)...)
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.DeleteRange([]byte("a"), end)
+	}))
+	// Fill the value log file, so that the one holding the tombstone is no longer written to.
+	require.NoError(t, db.Update(func(txn *Txn) error {
+		return txn.Set([]byte("z"), make([]byte, opt.ValueLogFileSize))
+	}))
+	db.vlog.filesLock.RLock()
+	lf := db.vlog.filesMap[db.vlog.sortedFids()[0]]
+	db.vlog.filesLock.RUnlock()
+	tr := trace.New("Test", "Test")
+	defer tr.Finish()
+	require.NoError(t, db.vlog.rewrite(lf, tr))
+	require.NoError(t, db.Close())
+
+	// The moved tombstone still deletes the range once loaded again.
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+	require.NoError(t, db.View(func(txn *Txn) error {
+		_, err := txn.Get([]byte("b"))
+		require.Equal(t, ErrKeyNotFound, err)
+		return nil
+	}))
+}
+
 func TestPersistLFDiscardStats(t *testing.T) {
 	dir, err := ioutil.TempDir("", "badger-test")
 	require.NoError(t, err)
@@ -1301,3 +1346,110 @@ func TestValidateWrite(t *testing.T) {
 	err = log.validateWrites([]*request{req1, req})
 	require.Error(t, err)
 }
+
+func TestValueLogGCCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "badger-test")
+	require.NoError(t, err)
+	defer removeDir(dir)
+	opt := getTestOptions(dir).WithValueLogFileSize(1 << 20).WithNumCompactors(0)
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	sz := 128 << 10
+	vals := make(map[string][]byte)
+	for i := 0; i < 40; i++ {
+		key, val := fmt.Sprintf("key%d", i), make([]byte, sz)
+		rand.Read(val)
+		vals[key] = val
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte(key), val)
+		}))
+	}
+	// Persist the head of the value log.
+	require.NoError(t, db.Close())
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, db.Close()) }()
+
+	head, err := db.valueLogGCHead()
+	require.NoError(t, err)
+	db.vlog.filesLock.RLock()
+	fids := db.vlog.sortedFids()
+	require.True(t, len(fids) > 3 && head.Fid > fids[2])
+	size := func(i int) int64 {
+		return int64(db.vlog.filesMap[fids[i]].size)
+	}
+	sizes := []int64{size(0), size(1), size(2)}
+	db.vlog.filesLock.RUnlock()
+	db.vlog.lfDiscardStats.Lock()
+	db.vlog.lfDiscardStats.m[fids[0]] = sizes[0] / 2
+	db.vlog.lfDiscardStats.m[fids[1]] = sizes[1]
+	db.vlog.lfDiscardStats.m[fids[2]] = sizes[2] / 10
+	db.vlog.lfDiscardStats.Unlock()
+
+	// The file with the highest discard ratio is rewritten first, and the limit of bytes per
+	// cycle stops the cycle after it.
+	policy := ValueLogGCPolicy{DiscardRatio: 0.5, MaxBytesPerCycle: 1}
+	cycle := db.runValueLogGCCycle(policy, z.NewCloser(0))
+	require.NoError(t, cycle.Err)
+	require.Equal(t, 2, cycle.Candidates)
+	require.Equal(t, 1, cycle.FilesRewritten)
+	require.Equal(t, sizes[1], cycle.BytesRewritten)
+	require.Equal(t, sizes[1], cycle.BytesDiscarded)
+	db.vlog.lfDiscardStats.RLock()
+	_, ok := db.vlog.lfDiscardStats.m[fids[1]]
+	db.vlog.lfDiscardStats.RUnlock()
+	require.False(t, ok)
+
+	policy.MaxBytesPerCycle = 0
+	cycle = db.runValueLogGCCycle(policy, z.NewCloser(0))
+	require.NoError(t, cycle.Err)
+	require.Equal(t, 1, cycle.Candidates)
+	require.Equal(t, 1, cycle.FilesRewritten)
+	require.Equal(t, sizes[0], cycle.BytesRewritten)
+
+	require.NoError(t, db.View(func(txn *Txn) error {
+		for key, val := range vals {
+			item, err := txn.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, val, getItemValue(t, item))
+		}
+		return nil
+	}))
+}
+
+func TestValueLogGCScheduler(t *testing.T) {
+	cycles := make(chan ValueLogGCCycle, 10)
+	policy := ValueLogGCPolicy{
+		Interval:     500 * time.Millisecond,
+		DiscardRatio: 0.5,
+		MaxWriteRate: 1,
+		OnCycle: func(cycle ValueLogGCCycle) {
+			select {
+			case cycles <- cycle:
+			default:
+			}
+		},
+	}
+	opt := getTestOptions("").WithValueLogGCPolicy(policy)
+	runBadgerTest(t, &opt, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Update(func(txn *Txn) error {
+			return txn.Set([]byte("key"), []byte("value"))
+		}))
+		// The cycle following the write backs off, and the next one runs.
+		cycle := <-cycles
+		require.True(t, cycle.BackedOff)
+		cycle = <-cycles
+		require.False(t, cycle.BackedOff)
+		require.NoError(t, cycle.Err)
+		require.Zero(t, cycle.Candidates)
+
+		m := db.Metrics().ValueLogGC
+		require.True(t, m.Cycles >= 2)
+		require.True(t, m.BackOffs >= 1)
+	})
+
+	opt.ValueLogGCPolicy.DiscardRatio = 0
+	_, err := Open(opt)
+	require.Error(t, err)
+}